@@ -5,6 +5,7 @@ import (
 	"github.com/bugfixes/go-bugfixes/logs"
 	"github.com/caarlos0/env/v8"
 	ConfigBuilder "github.com/keloran/go-config"
+	"time"
 )
 
 var (
@@ -29,8 +30,39 @@ func (pc ProjectConfig) Build(cfg *ConfigBuilder.Config) error {
 		RailwayPort string `env:"PORT" envDefault:"3000"`
 		OnRailway   bool   `env:"ON_RAILWAY" envDefault:"false"`
 
+		// CORS
+		AllowedOrigins []string `env:"CORS_ALLOWED_ORIGINS" envDefault:"*" envSeparator:","`
+
 		// Policy
-		EngineAddress string `env:"ENGINE_ADDRESS" envDefault:"localhost:9009"`
+		EngineAddress          string        `env:"ENGINE_ADDRESS" envDefault:"localhost:9009"`
+		EngineTimeout          time.Duration `env:"ENGINE_TIMEOUT" envDefault:"3s"`
+		EngineRetryAttempts    int           `env:"ENGINE_RETRY_ATTEMPTS" envDefault:"3"`
+		EngineRetryBaseDelay   time.Duration `env:"ENGINE_RETRY_BASE_DELAY" envDefault:"100ms"`
+		EngineRetryMaxDelay    time.Duration `env:"ENGINE_RETRY_MAX_DELAY" envDefault:"2s"`
+		EngineBreakerThreshold int           `env:"ENGINE_BREAKER_THRESHOLD" envDefault:"5"`
+		EngineBreakerCooldown  time.Duration `env:"ENGINE_BREAKER_COOLDOWN" envDefault:"30s"`
+		EngineBalancer         string        `env:"ENGINE_BALANCER" envDefault:"round-robin"`
+		EngineHealthInterval   time.Duration `env:"ENGINE_HEALTH_INTERVAL" envDefault:"10s"`
+		EngineHealthTimeout    time.Duration `env:"ENGINE_HEALTH_TIMEOUT" envDefault:"2s"`
+		EngineUnhealthyAfter   int           `env:"ENGINE_HEALTH_UNHEALTHY_THRESHOLD" envDefault:"2"`
+		EngineHealthyAfter     int           `env:"ENGINE_HEALTH_HEALTHY_THRESHOLD" envDefault:"2"`
+		EngineBatchMaxItems    int           `env:"ENGINE_BATCH_MAX_ITEMS" envDefault:"10000"`
+		EngineBatchConcurrency int           `env:"ENGINE_BATCH_CONCURRENCY" envDefault:"8"`
+		EngineBatchTimeout     time.Duration `env:"ENGINE_BATCH_TIMEOUT" envDefault:"2m"`
+		PolicyRetention        time.Duration `env:"POLICY_RETENTION" envDefault:"720h"`
+		PolicyPurgeInterval    time.Duration `env:"POLICY_PURGE_INTERVAL" envDefault:"1h"`
+		PolicyRequireTests     bool          `env:"POLICY_REQUIRE_PASSING_TESTS" envDefault:"false"`
+
+		// Review
+		RequireReviews bool `env:"REQUIRE_REVIEWS" envDefault:"true"`
+
+		// Replay
+		ReplayTimeout time.Duration `env:"REPLAY_TIMEOUT" envDefault:"5m"`
+
+		// Shadow
+		ShadowConcurrency int           `env:"SHADOW_CONCURRENCY" envDefault:"4"`
+		ShadowTimeout     time.Duration `env:"SHADOW_TIMEOUT" envDefault:"10s"`
+		ShadowSettingsTTL time.Duration `env:"SHADOW_SETTINGS_TTL" envDefault:"30s"`
 	}
 	p := PC{}
 
@@ -42,12 +74,38 @@ func (pc ProjectConfig) Build(cfg *ConfigBuilder.Config) error {
 	}
 	cfg.ProjectProperties["railway_port"] = p.RailwayPort
 	cfg.ProjectProperties["on_railway"] = p.OnRailway
+	cfg.ProjectProperties["cors_allowed_origins"] = p.AllowedOrigins
 
 	cfg.ProjectProperties["flags_agent"] = p.Flags.AgentID
 	cfg.ProjectProperties["flags_environment"] = p.Flags.EnvironmentID
 	cfg.ProjectProperties["flags_project"] = p.Flags.ProjectID
 
 	cfg.ProjectProperties["engine_address"] = p.EngineAddress
+	cfg.ProjectProperties["engine_timeout"] = p.EngineTimeout
+	cfg.ProjectProperties["engine_retry_attempts"] = p.EngineRetryAttempts
+	cfg.ProjectProperties["engine_retry_base_delay"] = p.EngineRetryBaseDelay
+	cfg.ProjectProperties["engine_retry_max_delay"] = p.EngineRetryMaxDelay
+	cfg.ProjectProperties["engine_breaker_threshold"] = p.EngineBreakerThreshold
+	cfg.ProjectProperties["engine_breaker_cooldown"] = p.EngineBreakerCooldown
+	cfg.ProjectProperties["engine_balancer"] = p.EngineBalancer
+	cfg.ProjectProperties["engine_health_interval"] = p.EngineHealthInterval
+	cfg.ProjectProperties["engine_health_timeout"] = p.EngineHealthTimeout
+	cfg.ProjectProperties["engine_health_unhealthy_threshold"] = p.EngineUnhealthyAfter
+	cfg.ProjectProperties["engine_health_healthy_threshold"] = p.EngineHealthyAfter
+	cfg.ProjectProperties["engine_batch_max_items"] = p.EngineBatchMaxItems
+	cfg.ProjectProperties["engine_batch_concurrency"] = p.EngineBatchConcurrency
+	cfg.ProjectProperties["engine_batch_timeout"] = p.EngineBatchTimeout
+	cfg.ProjectProperties["policy_retention"] = p.PolicyRetention
+	cfg.ProjectProperties["policy_purge_interval"] = p.PolicyPurgeInterval
+	cfg.ProjectProperties["policy_require_passing_tests"] = p.PolicyRequireTests
+
+	cfg.ProjectProperties["require_reviews"] = p.RequireReviews
+
+	cfg.ProjectProperties["replay_timeout"] = p.ReplayTimeout
+
+	cfg.ProjectProperties["shadow_concurrency"] = p.ShadowConcurrency
+	cfg.ProjectProperties["shadow_timeout"] = p.ShadowTimeout
+	cfg.ProjectProperties["shadow_settings_ttl"] = p.ShadowSettingsTTL
 
 	return nil
 }
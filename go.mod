@@ -7,7 +7,9 @@ toolchain go1.24.3
 require (
 	github.com/bugfixes/go-bugfixes v0.14.0
 	github.com/caarlos0/env/v8 v8.0.0
+	github.com/jackc/pgx/v5 v5.7.5
 	github.com/keloran/go-config v1.7.0
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
 	github.com/stretchr/testify v1.11.1
 	github.com/testcontainers/testcontainers-go v0.38.0
 	github.com/testcontainers/testcontainers-go/modules/postgres v0.38.0
@@ -54,7 +56,6 @@ require (
 	github.com/hashicorp/vault/api v1.16.0 // indirect
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgservicefile v0.0.0-20240606120523-5a60cdf6a761 // indirect
-	github.com/jackc/pgx/v5 v5.7.5 // indirect
 	github.com/jackc/puddle/v2 v2.2.2 // indirect
 	github.com/keloran/vault-helper v1.1.0 // indirect
 	github.com/klauspost/compress v1.18.0 // indirect
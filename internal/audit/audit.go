@@ -0,0 +1,682 @@
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/bugfixes/go-bugfixes/middleware"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	ConfigBuilder "github.com/keloran/go-config"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ActionCreate   = "create"
+	ActionUpdate   = "update"
+	ActionPublish  = "publish"
+	ActionDraft    = "draft"
+	ActionArchive  = "archive"
+	ActionRestore  = "restore"
+	ActionPurge    = "purge"
+	ActionRollback = "rollback"
+	ActionMetadata = "metadata"
+	ActionPromote  = "promote"
+	ActionMove     = "move"
+	ActionImport   = "import"
+	ActionSubmit   = "submit"
+	ActionApprove  = "approve"
+	ActionReject   = "reject"
+	ActionRule     = "rule"
+
+	// KindFolder is the kind of the entries of folder moves and folder approval rules, its id is
+	// the path
+	KindFolder = "folder"
+
+	// ActorSystem made the changes that don't come from a request, such as purging archived policies
+	ActorSystem = "system"
+	// ActorAnonymous made the changes of requests without an X-User header
+	ActorAnonymous = "anonymous"
+
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+var actions = []string{
+	ActionCreate, ActionUpdate, ActionPublish, ActionDraft, ActionArchive, ActionRestore, ActionPurge, ActionRollback,
+	ActionMetadata, ActionPromote, ActionMove, ActionImport, ActionSubmit, ActionApprove, ActionReject, ActionRule,
+}
+
+// edits are the actions that change the draft of a policy or flow
+var edits = []string{ActionCreate, ActionUpdate, ActionDraft, ActionRollback, ActionImport}
+
+// errBroken stops Verify at the first entry that breaks the chain
+var errBroken = stderrors.New("audit chain broken")
+
+// entities are the table, id column and base id column of each kind
+var entities = map[string][3]string{
+	decision.KindPolicy: {"policies", "policy_id", "base_policy_id"},
+	decision.KindFlow:   {"flows", "flow_id", "base_flow_id"},
+}
+
+// related are the rows kept about a base policy or flow outside its own table, by the table
+// they are in. {base} is its base id and $2 its kind
+var related = [][2]string{
+	{"metadata", `(SELECT row_to_json(m) FROM metadata m WHERE m.kind = $2 AND m.base_id = {base})`},
+	{"channels", `(SELECT json_agg(c ORDER BY c.channel) FROM channels c WHERE c.kind = $2 AND c.base_id = {base})`},
+	{"reviews", `(SELECT json_agg(r ORDER BY r.id) FROM reviews r WHERE r.kind = $2 AND r.base_id = {base})`},
+	{"review_comments", `(SELECT json_agg(r ORDER BY r.id) FROM review_comments r WHERE r.kind = $2 AND r.base_id = {base})`},
+	{"approval_rules", `(SELECT row_to_json(a) FROM approval_rules a WHERE a.scope = $2 AND a.target = {base})`},
+}
+
+// folderRelated are the rows kept about a folder, by the table they are in
+var folderRelated = [][2]string{
+	{"metadata", `(SELECT json_agg(m ORDER BY m.kind, m.base_id) FROM metadata m WHERE m.folder = $1 OR LEFT(m.folder, LENGTH($1) + 1) = $1 || '/')`},
+	{"approval_rules", `(SELECT row_to_json(a) FROM approval_rules a WHERE a.scope = 'folder' AND a.target = $1)`},
+}
+
+// DB is where changes are made, each change is a transaction of its own
+type DB interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// Recorder keeps the changes made to policies and flows
+type Recorder interface {
+	// Begin starts the audit of a change made on tx, what it records is committed or rolled
+	// back with the change
+	Begin(ctx context.Context, tx pgx.Tx) (Log, error)
+}
+
+// Log is the audit log of a change
+type Log interface {
+	// State resolves id, a base id or the id of a single draft or version, to its base id and a
+	// hash of every row of the base. Both are empty when there are no rows
+	State(ctx context.Context, kind, id string) (string, string, error)
+	Record(ctx context.Context, e structs.AuditEntry) error
+}
+
+// Reader is the part of a pool or transaction reading the audit log needs
+type Reader interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// Editors are the actors that changed the draft of a base policy or flow since its last
+// published version, oldest first
+func Editors(ctx context.Context, db Reader, kind, baseId string) ([]string, error) {
+	rows, err := db.Query(ctx, `
+		SELECT actor
+		FROM audit_log
+		WHERE kind = $1 AND entity_id = $2 AND action = ANY($3)
+		  AND id > COALESCE((SELECT MAX(id) FROM audit_log WHERE kind = $1 AND entity_id = $2 AND action = 'publish'), 0)
+		GROUP BY actor
+		ORDER BY MIN(id)`, kind, baseId, edits)
+	if err != nil {
+		return nil, logs.Errorf("failed to load editors: %v", err)
+	}
+	defer rows.Close()
+
+	editors := make([]string, 0)
+	for rows.Next() {
+		var actor string
+		if err := rows.Scan(&actor); err != nil {
+			return nil, logs.Errorf("failed to load editors: %v", err)
+		}
+		editors = append(editors, actor)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, logs.Errorf("failed to load editors: %v", err)
+	}
+	return editors, nil
+}
+
+type actorKey struct{}
+
+type actor struct {
+	name    string
+	claimed bool
+}
+
+// Actors puts who each request says it is from, its X-User header, in the request context.
+// Nothing authenticates the header, so the entries of its changes record the actor as claimed
+func Actors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSpace(r.Header.Get("X-User"))
+		ctx := WithClaimedActor(r.Context(), name)
+		if name == "" {
+			ctx = WithActor(r.Context(), ActorAnonymous)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// WithActor acts for an actor that is known to be who it is
+func WithActor(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor{name: name})
+}
+
+// WithClaimedActor acts for an actor that only says who it is
+func WithClaimedActor(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor{name: name, claimed: true})
+}
+
+// Actor is who ctx is acting for, the system when it isn't a request
+func Actor(ctx context.Context) string {
+	if ctx != nil {
+		if a, ok := ctx.Value(actorKey{}).(actor); ok && a.name != "" {
+			return a.name
+		}
+	}
+	return ActorSystem
+}
+
+// ActorClaimed is whether the actor of ctx only says who it is
+func ActorClaimed(ctx context.Context) bool {
+	if ctx != nil {
+		if a, ok := ctx.Value(actorKey{}).(actor); ok && a.name != "" {
+			return a.claimed
+		}
+	}
+	return false
+}
+
+// Change is a change on its way to the audit log. Begin starts its transaction and takes the
+// state before the change is made, the change is made with Exec, Query and QueryRow, and Done
+// takes the state after, records it and commits the change and its entry together
+type Change struct {
+	ctx     context.Context
+	action  string
+	tx      pgx.Tx
+	log     Log
+	entries []structs.AuditEntry
+}
+
+// Begin starts the change action makes to each policy or flow ids names on db, an id is empty
+// when it doesn't exist yet. Nothing is committed until Done and nothing is audited with a nil
+// recorder
+func Begin(ctx context.Context, r Recorder, db DB, kind, action string, ids ...string) (*Change, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if len(ids) == 0 {
+		ids = []string{""}
+	}
+
+	tx, err := db.Begin(context.WithoutCancel(ctx))
+	if err != nil {
+		return nil, logs.Errorf("failed to start %s: %v", action, err)
+	}
+	c := &Change{ctx: ctx, action: action, tx: tx}
+	if r == nil {
+		return c, nil
+	}
+
+	if c.log, err = r.Begin(context.WithoutCancel(ctx), tx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	for _, id := range ids {
+		e := structs.AuditEntry{
+			Kind:   kind,
+			Action: action,
+		}
+		if id != "" {
+			if e.EntityID, e.BeforeHash, err = c.log.State(context.WithoutCancel(ctx), kind, id); err != nil {
+				c.Close()
+				return nil, logs.Errorf("failed to load %s %s before %s: %v", kind, id, action, err)
+			}
+		}
+		c.entries = append(c.entries, e)
+	}
+	return c, nil
+}
+
+func (c *Change) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return c.tx.Exec(ctx, sql, args...)
+}
+
+func (c *Change) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return c.tx.Query(ctx, sql, args...)
+}
+
+func (c *Change) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return c.tx.QueryRow(ctx, sql, args...)
+}
+
+// Done records the change once it is made and commits it, id is the draft or version it named
+// or made and version the version it published. An empty id is each policy or flow Begin
+// named. Nothing is kept when the change can't be recorded
+func (c *Change) Done(id, version string) error {
+	if c.tx == nil {
+		return nil
+	}
+	defer c.Close()
+	ctx := context.WithoutCancel(c.ctx)
+
+	if c.log != nil {
+		for _, e := range c.entries {
+			ref := e.EntityID
+			if ref == "" {
+				ref = id
+			}
+			baseId, hash, err := c.log.State(ctx, e.Kind, ref)
+			if err != nil {
+				return logs.Errorf("failed to load %s %s after %s: %v", e.Kind, ref, e.Action, err)
+			}
+
+			if e.EntityID == "" {
+				e.EntityID = baseId
+			}
+			if e.EntityID == "" {
+				e.EntityID = id
+			}
+			if id != "" && id != e.EntityID {
+				e.TargetID = id
+			}
+			e.Version = version
+			e.AfterHash = hash
+			e.Actor = Actor(ctx)
+			e.ActorClaimed = ActorClaimed(ctx)
+			e.RequestID = middleware.GetReqID(ctx)
+
+			if err := c.log.Record(ctx, e); err != nil {
+				return logs.Errorf("failed to audit %s of %s %s: %v", e.Action, e.Kind, e.EntityID, err)
+			}
+		}
+	}
+
+	tx := c.tx
+	c.tx = nil
+	if err := tx.Commit(ctx); err != nil {
+		return logs.Errorf("failed to commit %s: %v", c.action, err)
+	}
+	return nil
+}
+
+// Close rolls the change back when it wasn't done, it does nothing once it is
+func (c *Change) Close() {
+	if c.tx == nil {
+		return
+	}
+	_ = c.tx.Rollback(context.WithoutCancel(c.ctx))
+	c.tx = nil
+}
+
+// Hash is the hash of e chained to the entry before it, it covers every field but the id and
+// the hash itself
+func Hash(e structs.AuditEntry) string {
+	b, _ := json.Marshal([]string{
+		e.PrevHash,
+		e.Actor,
+		strconv.FormatBool(e.ActorClaimed),
+		e.Action,
+		e.Kind,
+		e.EntityID,
+		e.TargetID,
+		e.Version,
+		e.BeforeHash,
+		e.AfterHash,
+		e.RequestID,
+		e.CreatedAt.UTC().Format(time.RFC3339Nano),
+	})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+type System struct {
+	Config  *ConfigBuilder.Config
+	Context context.Context
+}
+
+func NewSystem(cfg *ConfigBuilder.Config) *System {
+	return &System{
+		Config:  cfg,
+		Context: context.Background(),
+	}
+}
+
+func (s *System) SetContext(ctx context.Context) *System {
+	s.Context = ctx
+	return s
+}
+
+// Begin audits a change made on tx
+func (s *System) Begin(_ context.Context, tx pgx.Tx) (Log, error) {
+	return &heldLog{tx: tx}, nil
+}
+
+// chainLock is the advisory lock on the end of the chain, it is held from the first entry a
+// change records until the change commits so no two entries chain to the same one
+const chainLock = 0x61756469746c6f67
+
+// heldLog is the audit log of a change
+type heldLog struct {
+	tx     pgx.Tx
+	locked bool
+	tables map[string]bool
+}
+
+// State hashes the rows of a policy or flow along with its metadata, channels, reviews and
+// approval rule, and those of a folder the metadata of everything in it and its approval rule
+func (l *heldLog) State(ctx context.Context, kind, id string) (string, string, error) {
+	if kind == KindFolder {
+		parts, err := l.related(ctx, folderRelated, "")
+		if err != nil {
+			return "", "", err
+		}
+		if parts == "" {
+			return id, "", nil
+		}
+		var hash string
+		if err := l.tx.QueryRow(ctx, `
+			SELECT encode(sha256(convert_to(json_build_array(`+parts+`)::text, 'UTF8')), 'hex')`,
+			id).Scan(&hash); err != nil {
+			return "", "", logs.Errorf("failed to load folder %s: %v", id, err)
+		}
+		return id, hash, nil
+	}
+
+	e, ok := entities[kind]
+	if !ok {
+		return "", "", fmt.Errorf("unknown kind %q", kind)
+	}
+	parts, err := l.related(ctx, related, "t."+e[2]+"::text")
+	if err != nil {
+		return "", "", err
+	}
+	args := []interface{}{id}
+	if parts != "" {
+		parts = ", " + parts
+		args = append(args, kind)
+	}
+
+	var baseId, hash string
+	err = l.tx.QueryRow(ctx, fmt.Sprintf(`
+		SELECT
+		    t.%[3]s::text,
+		    encode(sha256(convert_to(json_build_array(json_agg(t ORDER BY t.%[2]s)%[4]s)::text, 'UTF8')), 'hex')
+		FROM %[1]s t
+		WHERE t.%[3]s = (SELECT %[3]s FROM %[1]s WHERE %[3]s::text = $1 OR %[2]s::text = $1 LIMIT 1)
+		GROUP BY t.%[3]s`, e[0], e[1], e[2], parts), args...).Scan(&baseId, &hash)
+	if stderrors.Is(err, pgx.ErrNoRows) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", logs.Errorf("failed to load %s %s: %v", kind, id, err)
+	}
+
+	return baseId, hash, nil
+}
+
+// related joins the subqueries of the tables of rr that exist, not every deployment keeps
+// channels or reviews
+func (l *heldLog) related(ctx context.Context, rr [][2]string, baseId string) (string, error) {
+	if l.tables == nil {
+		var names []string
+		for _, r := range related {
+			names = append(names, r[0])
+		}
+		for _, r := range folderRelated {
+			names = append(names, r[0])
+		}
+		rows, err := l.tx.Query(ctx, `SELECT n FROM unnest($1::text[]) n WHERE to_regclass(n) IS NOT NULL`, names)
+		if err != nil {
+			return "", logs.Errorf("failed to load audited tables: %v", err)
+		}
+		defer rows.Close()
+		l.tables = make(map[string]bool, len(names))
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return "", logs.Errorf("failed to load audited tables: %v", err)
+			}
+			l.tables[name] = true
+		}
+		if err := rows.Err(); err != nil {
+			return "", logs.Errorf("failed to load audited tables: %v", err)
+		}
+	}
+
+	parts := make([]string, 0, len(rr))
+	for _, r := range rr {
+		if l.tables[r[0]] {
+			parts = append(parts, strings.ReplaceAll(r[1], "{base}", baseId))
+		}
+	}
+	return strings.Join(parts, ", "), nil
+}
+
+// Record appends e to the audit log, chained to the last entry
+func (l *heldLog) Record(ctx context.Context, e structs.AuditEntry) error {
+	if !l.locked {
+		if _, err := l.tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, int64(chainLock)); err != nil {
+			return logs.Errorf("failed to lock audit log: %v", err)
+		}
+		l.locked = true
+	}
+
+	err := l.tx.QueryRow(ctx, `SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1`).Scan(&e.PrevHash)
+	if err != nil && !stderrors.Is(err, pgx.ErrNoRows) {
+		return logs.Errorf("failed to load last audit entry: %v", err)
+	}
+
+	// postgres keeps microseconds, the hash has to be of what is stored
+	e.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	e.Hash = Hash(e)
+
+	if _, err := l.tx.Exec(ctx, `
+		INSERT INTO audit_log (
+		    actor,
+		    actor_claimed,
+		    action,
+		    kind,
+		    entity_id,
+		    target_id,
+		    version,
+		    before_hash,
+		    after_hash,
+		    request_id,
+		    prev_hash,
+		    hash,
+		    created_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		e.Actor,
+		e.ActorClaimed,
+		e.Action,
+		e.Kind,
+		e.EntityID,
+		nullString(e.TargetID),
+		nullString(e.Version),
+		nullString(e.BeforeHash),
+		nullString(e.AfterHash),
+		nullString(e.RequestID),
+		e.PrevHash,
+		e.Hash,
+		e.CreatedAt,
+	); err != nil {
+		return logs.Errorf("failed to record audit entry: %v", err)
+	}
+	return nil
+}
+
+// Query returns the newest entries matching q, at most 100 unless q says otherwise
+func (s *System) Query(q structs.AuditQuery) ([]structs.AuditEntry, error) {
+	ee := make([]structs.AuditEntry, 0)
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+
+	err := s.each(q, "DESC", limit, func(e structs.AuditEntry) error {
+		ee = append(ee, e)
+		return nil
+	})
+	return ee, err
+}
+
+// Export passes every entry matching q to write, oldest first
+func (s *System) Export(q structs.AuditQuery, write func(structs.AuditEntry) error) error {
+	return s.each(q, "ASC", 0, write)
+}
+
+// Verify rechecks the hash of every entry and that it chains to the one before it, it stops at
+// the first that doesn't
+func (s *System) Verify() (structs.AuditVerification, error) {
+	v := structs.AuditVerification{Valid: true}
+
+	prev := ""
+	err := s.each(structs.AuditQuery{}, "ASC", 0, func(e structs.AuditEntry) error {
+		v.Entries++
+		switch {
+		case e.PrevHash != prev:
+			v.Reason = "does not chain to the entry before it"
+		case Hash(e) != e.Hash:
+			v.Reason = "hash does not match the entry"
+		default:
+			prev = e.Hash
+			return nil
+		}
+		v.Valid = false
+		v.BrokenAt = e.ID
+		return errBroken
+	})
+	if err != nil && !stderrors.Is(err, errBroken) {
+		return v, err
+	}
+
+	return v, nil
+}
+
+func (s *System) each(q structs.AuditQuery, order string, limit int, fn func(structs.AuditEntry) error) error {
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if q.Actor != "" {
+		where = append(where, "actor = "+arg(q.Actor))
+	}
+	if q.Action != "" {
+		where = append(where, "action = "+arg(q.Action))
+	}
+	if q.Kind != "" {
+		where = append(where, "kind = "+arg(q.Kind))
+	}
+	if q.EntityID != "" {
+		p := arg(q.EntityID)
+		where = append(where, fmt.Sprintf("(entity_id = %s OR target_id = %s)", p, p))
+	}
+	if q.RequestID != "" {
+		where = append(where, "request_id = "+arg(q.RequestID))
+	}
+	if !q.From.IsZero() {
+		where = append(where, "created_at >= "+arg(q.From))
+	}
+	if !q.To.IsZero() {
+		where = append(where, "created_at < "+arg(q.To))
+	}
+
+	query := auditSelect
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id " + order
+	if limit > 0 {
+		query += " LIMIT " + arg(limit)
+	}
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	rows, err := client.Query(s.Context, query, args...)
+	if err != nil {
+		return logs.Errorf("failed to load audit log: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return logs.Errorf("failed to load audit log: %v", err)
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return logs.Errorf("failed to load audit log: %v", err)
+	}
+
+	return nil
+}
+
+const auditSelect = `
+	SELECT
+	    id,
+	    actor,
+	    actor_claimed,
+	    action,
+	    kind,
+	    entity_id,
+	    target_id,
+	    version,
+	    before_hash,
+	    after_hash,
+	    request_id,
+	    prev_hash,
+	    hash,
+	    created_at
+	FROM audit_log`
+
+func scanEntry(row pgx.Row) (structs.AuditEntry, error) {
+	var e structs.AuditEntry
+	var targetId, version, beforeHash, afterHash, requestId sql.NullString
+	if err := row.Scan(
+		&e.ID,
+		&e.Actor,
+		&e.ActorClaimed,
+		&e.Action,
+		&e.Kind,
+		&e.EntityID,
+		&targetId,
+		&version,
+		&beforeHash,
+		&afterHash,
+		&requestId,
+		&e.PrevHash,
+		&e.Hash,
+		&e.CreatedAt,
+	); err != nil {
+		return e, err
+	}
+	e.TargetID = targetId.String
+	e.Version = version.String
+	e.BeforeHash = beforeHash.String
+	e.AfterHash = afterHash.String
+	e.RequestID = requestId.String
+	e.CreatedAt = e.CreatedAt.UTC()
+
+	return e, nil
+}
+
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,316 @@
+package audit
+
+import (
+	"context"
+	stderrors "errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/1rp-pw/orchestrator/internal/testutil"
+	"github.com/bugfixes/go-bugfixes/middleware"
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSystem_Audit(t *testing.T) {
+	cfg := testutil.Postgres(t, "policy.sql", "flow.sql", "audit.sql")
+
+	ctx := WithActor(context.WithValue(context.Background(), middleware.RequestIDKey, "req-1"), "alice")
+	client, err := cfg.Database.GetPGXPoolClient(ctx)
+	require.NoError(t, err)
+	defer client.Close()
+
+	s := NewSystem(cfg)
+	s.SetContext(ctx)
+
+	var baseId string
+	change, err := Begin(ctx, s, client, decision.KindPolicy, ActionCreate, "")
+	require.NoError(t, err)
+	require.NoError(t, change.QueryRow(ctx, `SELECT create_policy('Licence', '{}', '[]', 'rule one', FALSE)`).Scan(&baseId))
+	require.NoError(t, change.Done(baseId, ""))
+
+	change, err = Begin(ctx, s, client, decision.KindPolicy, ActionUpdate, baseId)
+	require.NoError(t, err)
+	_, err = change.Exec(ctx, `SELECT update_draft($1, NULL, NULL, 'rule two')`, baseId)
+	require.NoError(t, err)
+	require.NoError(t, change.Done(baseId, ""))
+
+	change, err = Begin(ctx, s, client, decision.KindPolicy, ActionPublish, baseId)
+	require.NoError(t, err)
+	_, err = change.Exec(ctx, `SELECT publish_draft_as_version($1, 'v1.0.0', 'first')`, baseId)
+	require.NoError(t, err)
+	require.NoError(t, change.Done(baseId, "v1.0.0"))
+
+	var flowId string
+	change, err = Begin(WithClaimedActor(context.Background(), "bob"), s, client, decision.KindFlow, ActionCreate, "")
+	require.NoError(t, err)
+	require.NoError(t, change.QueryRow(ctx, `SELECT create_flow('Flow', '[]', '[]', '[]', 'flow: {}')`).Scan(&flowId))
+	require.NoError(t, change.Done(flowId, ""))
+	ee, err := s.Query(structs.AuditQuery{EntityID: flowId})
+	require.NoError(t, err)
+	require.Len(t, ee, 1)
+	assert.Equal(t, "bob", ee[0].Actor)
+	assert.True(t, ee[0].ActorClaimed)
+
+	// a change that isn't done leaves neither the change nor an entry behind
+	change, err = Begin(ctx, s, client, decision.KindPolicy, ActionUpdate, baseId)
+	require.NoError(t, err)
+	_, err = change.Exec(ctx, `SELECT update_draft($1, NULL, NULL, 'rule three')`, baseId)
+	require.NoError(t, err)
+	change.Close()
+	var rule string
+	require.NoError(t, client.QueryRow(ctx, `SELECT rule FROM policies WHERE base_policy_id = $1 AND status = 'draft'`, baseId).Scan(&rule))
+	assert.Equal(t, "rule two", rule)
+
+	ee, err = s.Query(structs.AuditQuery{EntityID: baseId})
+	require.NoError(t, err)
+	require.Len(t, ee, 3)
+	assert.Equal(t, ActionPublish, ee[0].Action)
+	assert.Equal(t, "v1.0.0", ee[0].Version)
+	assert.Equal(t, ActionCreate, ee[2].Action)
+	assert.Empty(t, ee[2].BeforeHash, "nothing before it was created")
+	for i, e := range ee {
+		assert.Equal(t, "alice", e.Actor)
+		assert.False(t, e.ActorClaimed)
+		assert.Equal(t, "req-1", e.RequestID)
+		assert.NotEmpty(t, e.AfterHash)
+		if i > 0 {
+			assert.Equal(t, e.AfterHash, ee[i-1].BeforeHash, "each change starts where the last one left off")
+			assert.Equal(t, e.Hash, ee[i-1].PrevHash)
+		}
+	}
+
+	ee, err = s.Query(structs.AuditQuery{Kind: decision.KindFlow})
+	require.NoError(t, err)
+	require.Len(t, ee, 1)
+	assert.Equal(t, ActorSystem, ee[0].Actor)
+	assert.Equal(t, flowId, ee[0].TargetID)
+	assert.NotEqual(t, flowId, ee[0].EntityID, "flows are audited against their base flow")
+
+	var exported []structs.AuditEntry
+	require.NoError(t, s.Export(structs.AuditQuery{}, func(e structs.AuditEntry) error {
+		exported = append(exported, e)
+		return nil
+	}))
+	require.Len(t, exported, 4)
+	assert.Equal(t, ActionCreate, exported[0].Action)
+	assert.Empty(t, exported[0].PrevHash)
+
+	v, err := s.Verify()
+	require.NoError(t, err)
+	assert.True(t, v.Valid)
+	assert.Equal(t, int64(4), v.Entries)
+
+	// entries can't be changed, and changing one behind the triggers' back breaks the chain
+	_, err = client.Exec(ctx, `UPDATE audit_log SET actor = 'mallory' WHERE id = $1`, exported[1].ID)
+	assert.Error(t, err)
+	_, err = client.Exec(ctx, `DELETE FROM audit_log`)
+	assert.Error(t, err)
+
+	_, err = client.Exec(ctx, `ALTER TABLE audit_log DISABLE TRIGGER audit_log_no_update`)
+	require.NoError(t, err)
+	_, err = client.Exec(ctx, `UPDATE audit_log SET actor = 'mallory' WHERE id = $1`, exported[1].ID)
+	require.NoError(t, err)
+
+	v, err = s.Verify()
+	require.NoError(t, err)
+	assert.False(t, v.Valid)
+	assert.Equal(t, exported[1].ID, v.BrokenAt)
+}
+
+type fakeRecorder struct {
+	states  map[string][2]string
+	entries []structs.AuditEntry
+	fail    error
+}
+
+func (f *fakeRecorder) Begin(_ context.Context, _ pgx.Tx) (Log, error) {
+	return f, nil
+}
+
+func (f *fakeRecorder) State(_ context.Context, _, id string) (string, string, error) {
+	st := f.states[id]
+	return st[0], st[1], nil
+}
+
+func (f *fakeRecorder) Record(_ context.Context, e structs.AuditEntry) error {
+	if f.fail != nil {
+		return f.fail
+	}
+	f.entries = append(f.entries, e)
+	return nil
+}
+
+// fakeDB starts fakeTx transactions, only committing and rolling back are used by a change
+type fakeDB struct {
+	tx *fakeTx
+}
+
+func (f *fakeDB) Begin(_ context.Context) (pgx.Tx, error) {
+	f.tx = &fakeTx{open: true}
+	return f.tx, nil
+}
+
+type fakeTx struct {
+	pgx.Tx
+	open       bool
+	committed  bool
+	rolledBack bool
+}
+
+func (f *fakeTx) Commit(_ context.Context) error {
+	f.open = false
+	f.committed = true
+	return nil
+}
+
+func (f *fakeTx) Rollback(_ context.Context) error {
+	f.open = false
+	f.rolledBack = true
+	return nil
+}
+
+func TestChange(t *testing.T) {
+	r := &fakeRecorder{states: map[string][2]string{
+		"base": {"base", "before"},
+		"v1":   {"base", "before"},
+	}}
+	db := &fakeDB{}
+
+	change, err := Begin(WithActor(context.Background(), "alice"), r, db, decision.KindPolicy, ActionDraft, "v1")
+	require.NoError(t, err)
+	assert.True(t, db.tx.open, "the change is made in a transaction")
+	r.states["base"] = [2]string{"base", "after"}
+	require.NoError(t, change.Done("draft", ""))
+	assert.True(t, db.tx.committed)
+
+	require.Len(t, r.entries, 1)
+	e := r.entries[0]
+	assert.Equal(t, "alice", e.Actor)
+	assert.False(t, e.ActorClaimed)
+	assert.Equal(t, "base", e.EntityID)
+	assert.Equal(t, "draft", e.TargetID)
+	assert.Equal(t, "before", e.BeforeHash)
+	assert.Equal(t, "after", e.AfterHash)
+	change.Close()
+	assert.False(t, db.tx.rolledBack, "closing a done change keeps it")
+
+	t.Run("every id", func(t *testing.T) {
+		r := &fakeRecorder{states: map[string][2]string{
+			"one": {"one", "1"},
+			"two": {"two", "2"},
+		}}
+		db := &fakeDB{}
+		change, err := Begin(context.Background(), r, db, decision.KindPolicy, ActionPurge, "one", "two")
+		require.NoError(t, err)
+		require.NoError(t, change.Done("", ""))
+		require.Len(t, r.entries, 2)
+		assert.Equal(t, "one", r.entries[0].EntityID)
+		assert.Equal(t, "two", r.entries[1].EntityID)
+		assert.Empty(t, r.entries[0].TargetID)
+		assert.True(t, db.tx.committed, "one commit for the lot")
+	})
+
+	t.Run("record fails", func(t *testing.T) {
+		r := &fakeRecorder{states: map[string][2]string{}, fail: stderrors.New("disk full")}
+		db := &fakeDB{}
+		change, err := Begin(context.Background(), r, db, decision.KindPolicy, ActionCreate, "")
+		require.NoError(t, err)
+		assert.Error(t, change.Done("base", ""))
+		assert.True(t, db.tx.rolledBack, "the change is undone")
+		assert.False(t, db.tx.committed)
+	})
+
+	t.Run("not made", func(t *testing.T) {
+		r := &fakeRecorder{states: map[string][2]string{}}
+		db := &fakeDB{}
+		change, err := Begin(context.Background(), r, db, decision.KindPolicy, ActionCreate, "")
+		require.NoError(t, err)
+		change.Close()
+		assert.True(t, db.tx.rolledBack)
+		assert.False(t, db.tx.committed)
+	})
+
+	// without a recorder the change is made but nothing is audited
+	db = &fakeDB{}
+	change, err = Begin(context.Background(), nil, db, decision.KindPolicy, ActionCreate, "")
+	require.NoError(t, err)
+	assert.NoError(t, change.Done("base", ""))
+	assert.True(t, db.tx.committed)
+}
+
+func TestHash(t *testing.T) {
+	e := structs.AuditEntry{
+		Actor:     "alice",
+		Action:    ActionUpdate,
+		Kind:      decision.KindPolicy,
+		EntityID:  "base",
+		CreatedAt: time.Date(2025, 1, 7, 10, 0, 0, 1000, time.UTC),
+	}
+	h := Hash(e)
+	assert.Len(t, h, 64)
+
+	local := e
+	local.CreatedAt = e.CreatedAt.In(time.FixedZone("CET", 3600))
+	assert.Equal(t, h, Hash(local), "the time zone the time was read in doesn't matter")
+
+	for _, edit := range []func(*structs.AuditEntry){
+		func(e *structs.AuditEntry) { e.Actor = "mallory" },
+		func(e *structs.AuditEntry) { e.ActorClaimed = true },
+		func(e *structs.AuditEntry) { e.PrevHash = "abc" },
+		func(e *structs.AuditEntry) { e.AfterHash = "abc" },
+		func(e *structs.AuditEntry) { e.CreatedAt = e.CreatedAt.Add(time.Microsecond) },
+	} {
+		edited := e
+		edit(&edited)
+		assert.NotEqual(t, h, Hash(edited))
+	}
+}
+
+func TestActors(t *testing.T) {
+	var actor string
+	var claimed bool
+	h := Actors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor, claimed = Actor(r.Context()), ActorClaimed(r.Context())
+	}))
+
+	r := httptest.NewRequest("GET", "/audit", nil)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, ActorAnonymous, actor)
+	assert.False(t, claimed)
+
+	// nothing authenticates the header
+	r.Header.Set("X-User", " alice ")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, "alice", actor)
+	assert.True(t, claimed)
+
+	assert.Equal(t, ActorSystem, Actor(context.Background()))
+	assert.False(t, ActorClaimed(context.Background()))
+}
+
+func TestParseQuery(t *testing.T) {
+	q, err := parseQuery(url.Values{"actor": {"alice"}, "action": {"publish"}, "from": {"2025-01-07"}, "limit": {"5000"}})
+	require.NoError(t, err)
+	assert.Equal(t, "alice", q.Actor)
+	assert.Equal(t, ActionPublish, q.Action)
+	assert.Equal(t, time.Date(2025, 1, 7, 0, 0, 0, 0, time.UTC), q.From)
+	assert.Equal(t, maxLimit, q.Limit)
+
+	for _, v := range []url.Values{
+		{"action": {"edit"}},
+		{"kind": {"channel"}},
+		{"from": {"yesterday"}},
+		{"from": {"2025-01-08"}, "to": {"2025-01-07"}},
+		{"limit": {"0"}},
+	} {
+		_, err := parseQuery(v)
+		assert.Error(t, err, v.Encode())
+	}
+}
@@ -0,0 +1,146 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	stderrors "errors"
+	"fmt"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"gopkg.in/yaml.v3"
+	"io"
+	"path"
+	"time"
+)
+
+const (
+	FormatYAML    = "yaml"
+	FormatArchive = "tar.gz"
+)
+
+// WriteYAML writes the bundle as a YAML stream, one document per base policy or flow
+func WriteYAML(w io.Writer, entities []structs.BundleEntity) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	for _, e := range entities {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return enc.Close()
+}
+
+// WriteArchive writes the bundle as a tar.gz with a policies/{baseId}.yaml or flows/{baseId}.yaml
+// per base policy or flow, each dated by its newest draft or version
+func WriteArchive(w io.Writer, entities []structs.BundleEntity) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	for _, e := range entities {
+		var buf bytes.Buffer
+		if err := WriteYAML(&buf, []structs.BundleEntity{e}); err != nil {
+			return err
+		}
+
+		var modTime time.Time
+		for _, rev := range e.Revisions {
+			if rev.CreatedAt.After(modTime) {
+				modTime = rev.CreatedAt
+			}
+		}
+
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    entityPath(e),
+			Mode:    0644,
+			Size:    int64(buf.Len()),
+			ModTime: modTime,
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func entityPath(e structs.BundleEntity) string {
+	dir := "policies"
+	if e.Kind == decision.KindFlow {
+		dir = "flows"
+	}
+	return dir + "/" + e.BaseID + ".yaml"
+}
+
+// Read reads a bundle written by WriteYAML or WriteArchive, telling them apart by the gzip header
+func Read(r io.Reader) ([]structs.BundleEntity, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return readArchive(br)
+	}
+	return readYAML(br, "bundle")
+}
+
+func readArchive(r io.Reader) ([]structs.BundleEntity, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.NewValidationError("bundle", "invalid tar.gz archive")
+	}
+	defer func() {
+		_ = gz.Close()
+	}()
+
+	var entities []structs.BundleEntity
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if stderrors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, errors.NewValidationError("bundle", "invalid tar.gz archive")
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		if ext := path.Ext(h.Name); ext != ".yaml" && ext != ".yml" {
+			continue
+		}
+
+		es, err := readYAML(tr, h.Name)
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, es...)
+	}
+
+	return entities, nil
+}
+
+func readYAML(r io.Reader, name string) ([]structs.BundleEntity, error) {
+	var entities []structs.BundleEntity
+	dec := yaml.NewDecoder(r)
+	for {
+		var e structs.BundleEntity
+		err := dec.Decode(&e)
+		if stderrors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, errors.NewValidationError("bundle", fmt.Sprintf("invalid YAML in %s: %v", name, err))
+		}
+		if e.Kind == "" && e.BaseID == "" && len(e.Revisions) == 0 {
+			continue
+		}
+		entities = append(entities, e)
+	}
+	return entities, nil
+}
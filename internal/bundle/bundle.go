@@ -0,0 +1,411 @@
+package bundle
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/1rp-pw/orchestrator/internal/audit"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/policy"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/jackc/pgx/v5"
+	ConfigBuilder "github.com/keloran/go-config"
+	"gopkg.in/yaml.v3"
+	"sort"
+	"strings"
+	"time"
+)
+
+type System struct {
+	Config  *ConfigBuilder.Config
+	Context context.Context
+	Reviews policy.Reviews
+	Audit   audit.Recorder
+}
+
+func NewSystem(cfg *ConfigBuilder.Config) *System {
+	return &System{
+		Config:  cfg,
+		Context: context.Background(),
+		Audit:   audit.NewSystem(cfg),
+	}
+}
+
+func (s *System) SetContext(ctx context.Context) *System {
+	s.Context = ctx
+	return s
+}
+
+// SetReviews imports published versions as they are and leaves the bundle's draft a draft,
+// which r has to approve before it is published. A new version is never made from the draft
+func (s *System) SetReviews(r policy.Reviews) *System {
+	s.Reviews = r
+	return s
+}
+
+// SetAudit records each policy and flow an import stores with a, nil records nothing
+func (s *System) SetAudit(a audit.Recorder) *System {
+	s.Audit = a
+	return s
+}
+
+// table is where the drafts and versions of a kind are stored, Live is the condition for the
+// rows of t that haven't been deleted
+type table struct {
+	Name   string
+	ID     string
+	BaseID string
+	Live   string
+}
+
+var tables = map[string]table{
+	decision.KindPolicy: {"policies", "policy_id", "base_policy_id", "t.archived_at IS NULL"},
+	decision.KindFlow:   {"flows", "flow_id", "base_flow_id", "TRUE"},
+}
+
+// Selection is what to export, nothing selected exports every policy and flow. Dependencies
+// adds the policies the selected flows refer to
+type Selection struct {
+	Policies     []string
+	Flows        []string
+	Folder       string
+	Dependencies bool
+}
+
+func (sel Selection) empty() bool {
+	return len(sel.Policies) == 0 && len(sel.Flows) == 0 && sel.Folder == ""
+}
+
+// DB is the part of a pool or transaction the bundle queries need
+type DB interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// Export loads the selected base policies and flows with all their drafts and versions, the
+// policies first and each kind sorted by name
+func (s *System) Export(sel Selection) ([]structs.BundleEntity, error) {
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return nil, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	policyIds, flowIds, err := s.selected(client, sel)
+	if err != nil {
+		return nil, err
+	}
+
+	flows, err := s.loadFlows(client, flowIds)
+	if err != nil {
+		return nil, err
+	}
+
+	if sel.Dependencies {
+		var refs []string
+		for _, f := range flows {
+			for _, rev := range f.Revisions {
+				refs = append(refs, flowRefs(rev.FlowFlat)...)
+			}
+		}
+		deps, err := s.referencedPolicies(client, refs)
+		if err != nil {
+			return nil, err
+		}
+		policyIds = append(policyIds, deps...)
+	}
+
+	policies, err := s.loadPolicies(client, policyIds)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(policies, flows...), nil
+}
+
+// selected is the base ids of the policies and flows the selection picks
+func (s *System) selected(db DB, sel Selection) ([]string, []string, error) {
+	policyIds := append([]string{}, sel.Policies...)
+	flowIds := append([]string{}, sel.Flows...)
+
+	var where string
+	var args []interface{}
+	switch {
+	case sel.empty():
+		where = "TRUE"
+	case sel.Folder != "":
+		where = "m.folder = $1 OR LEFT(m.folder, LENGTH($1) + 1) = $1 || '/'"
+		args = append(args, sel.Folder)
+	default:
+		return policyIds, flowIds, nil
+	}
+
+	for kind, ids := range map[string]*[]string{decision.KindPolicy: &policyIds, decision.KindFlow: &flowIds} {
+		t := tables[kind]
+		rows, err := db.Query(s.Context, `
+			SELECT DISTINCT t.`+t.BaseID+`::text
+			FROM `+t.Name+` t
+			LEFT JOIN metadata m ON m.kind = '`+kind+`' AND m.base_id = t.`+t.BaseID+`::text
+			WHERE `+t.Live+` AND (`+where+`)`, args...)
+		if err != nil {
+			return nil, nil, logs.Errorf("failed to select %s: %v", t.Name, err)
+		}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, nil, logs.Errorf("failed to select %s: %v", t.Name, err)
+			}
+			*ids = append(*ids, id)
+		}
+		rows.Close()
+	}
+
+	return policyIds, flowIds, nil
+}
+
+// referencedPolicies is the base ids of the policies the flow references lead to, by policy id
+// or {basePolicyId}@{version}
+func (s *System) referencedPolicies(db DB, refs []string) ([]string, error) {
+	if len(refs) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		id, _, _ := strings.Cut(ref, "@")
+		ids = append(ids, id)
+	}
+
+	rows, err := db.Query(s.Context, `
+		SELECT DISTINCT base_policy_id::text
+		FROM policies
+		WHERE archived_at IS NULL AND (policy_id::text = ANY($1) OR base_policy_id::text = ANY($1))`, ids)
+	if err != nil {
+		return nil, logs.Errorf("failed to load referenced policies: %v", err)
+	}
+	defer rows.Close()
+
+	var baseIds []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, logs.Errorf("failed to load referenced policies: %v", err)
+		}
+		baseIds = append(baseIds, id)
+	}
+	return baseIds, nil
+}
+
+func (s *System) loadPolicies(db DB, baseIds []string) ([]structs.BundleEntity, error) {
+	rows, err := db.Query(s.Context, `
+		SELECT
+		    base_policy_id::text,
+		    name,
+		    policy_id::text,
+		    status,
+		    version,
+		    description,
+		    created_at,
+		    effective_from,
+		    effective_until,
+		    rule,
+		    data_model::text,
+		    tests::text,
+		    strict_validation
+		FROM policies
+		WHERE archived_at IS NULL AND base_policy_id::text = ANY($1)
+		ORDER BY created_at, policy_id`, unique(baseIds))
+	if err != nil {
+		return nil, logs.Errorf("failed to export policies: %v", err)
+	}
+	defer rows.Close()
+
+	entities := newEntities(decision.KindPolicy)
+	for rows.Next() {
+		var baseId, name, dataModel, tests string
+		var version, description sql.NullString
+		var createdAt, from, until sql.NullTime
+		rev := structs.BundleRevision{}
+		if err := rows.Scan(&baseId, &name, &rev.ID, &rev.Status, &version, &description, &createdAt, &from, &until, &rev.Rule, &dataModel, &tests, &rev.StrictValidation); err != nil {
+			return nil, logs.Errorf("failed to export policies: %v", err)
+		}
+		rev.Version = version.String
+		rev.Description = description.String
+		rev.CreatedAt = createdAt.Time
+		rev.EffectiveFrom = timeOf(from)
+		rev.EffectiveUntil = timeOf(until)
+		rev.DataModel = jsonValue(dataModel)
+		rev.Tests = jsonValue(tests)
+		entities.add(baseId, name, rev)
+	}
+
+	return s.withMetadata(db, entities)
+}
+
+func (s *System) loadFlows(db DB, baseIds []string) ([]structs.BundleEntity, error) {
+	rows, err := db.Query(s.Context, `
+		SELECT
+		    base_flow_id::text,
+		    name,
+		    flow_id::text,
+		    status,
+		    version,
+		    description,
+		    created_at,
+		    effective_from,
+		    effective_until,
+		    flow,
+		    nodes::text,
+		    edges::text,
+		    tests::text
+		FROM flows
+		WHERE base_flow_id::text = ANY($1)
+		ORDER BY created_at, flow_id`, unique(baseIds))
+	if err != nil {
+		return nil, logs.Errorf("failed to export flows: %v", err)
+	}
+	defer rows.Close()
+
+	entities := newEntities(decision.KindFlow)
+	for rows.Next() {
+		var baseId, name, nodes, edges, tests string
+		var version, description sql.NullString
+		var createdAt, from, until sql.NullTime
+		rev := structs.BundleRevision{}
+		if err := rows.Scan(&baseId, &name, &rev.ID, &rev.Status, &version, &description, &createdAt, &from, &until, &rev.FlowFlat, &nodes, &edges, &tests); err != nil {
+			return nil, logs.Errorf("failed to export flows: %v", err)
+		}
+		rev.Version = version.String
+		rev.Description = description.String
+		rev.CreatedAt = createdAt.Time
+		rev.EffectiveFrom = timeOf(from)
+		rev.EffectiveUntil = timeOf(until)
+		rev.Nodes = jsonValue(nodes)
+		rev.Edges = jsonValue(edges)
+		rev.Tests = jsonValue(tests)
+		entities.add(baseId, name, rev)
+	}
+
+	return s.withMetadata(db, entities)
+}
+
+// entities collects the revisions of each base in the order they are loaded
+type entities struct {
+	kind  string
+	byID  map[string]*structs.BundleEntity
+	order []string
+}
+
+func newEntities(kind string) *entities {
+	return &entities{kind: kind, byID: make(map[string]*structs.BundleEntity)}
+}
+
+func (es *entities) add(baseId, name string, rev structs.BundleRevision) {
+	e, ok := es.byID[baseId]
+	if !ok {
+		e = &structs.BundleEntity{Kind: es.kind, BaseID: baseId}
+		es.byID[baseId] = e
+		es.order = append(es.order, baseId)
+	}
+	e.Name = name
+	e.Revisions = append(e.Revisions, rev)
+}
+
+// withMetadata adds the owner, description, tags, folder and team and sorts by name
+func (s *System) withMetadata(db DB, es *entities) ([]structs.BundleEntity, error) {
+	rows, err := db.Query(s.Context, `
+		SELECT
+		    base_id,
+		    owner,
+		    description,
+		    tags,
+		    folder,
+		    team
+		FROM metadata
+		WHERE kind = $1 AND base_id = ANY($2)`, es.kind, es.order)
+	if err != nil {
+		return nil, logs.Errorf("failed to export metadata: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var baseId string
+		var owner, description, folder, team sql.NullString
+		var tags []string
+		if err := rows.Scan(&baseId, &owner, &description, &tags, &folder, &team); err != nil {
+			return nil, logs.Errorf("failed to export metadata: %v", err)
+		}
+		e := es.byID[baseId]
+		e.Owner = owner.String
+		e.Description = description.String
+		e.Tags = tags
+		e.Folder = folder.String
+		e.Team = team.String
+	}
+
+	list := make([]structs.BundleEntity, 0, len(es.order))
+	for _, id := range es.order {
+		list = append(list, *es.byID[id])
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].BaseID < list[j].BaseID
+	})
+	return list, nil
+}
+
+// flowRefs lists the policy references of the nodes of a flow yaml
+func flowRefs(flowYAML string) []string {
+	var fc structs.FlowConfig
+	if err := yaml.Unmarshal([]byte(flowYAML), &fc); err != nil {
+		return nil
+	}
+
+	var refs []string
+	var walk func(nodes []structs.FlowNode)
+	walk = func(nodes []structs.FlowNode) {
+		for _, n := range nodes {
+			if n.PolicyID != "" {
+				refs = append(refs, n.PolicyID)
+			}
+			walk(n.OnTrue)
+			walk(n.OnFalse)
+		}
+	}
+	walk(fc.Flow.Start)
+
+	return unique(refs)
+}
+
+// jsonValue decodes a stored JSON column so the bundle shows it as YAML
+func jsonValue(s string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return s
+	}
+	return v
+}
+
+func timeOf(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func unique(ss []string) []string {
+	seen := make(map[string]bool, len(ss))
+	out := make([]string, 0, len(ss))
+	for _, s := range ss {
+		if s == "" || seen[s] {
+			continue
+		}
+		seen[s] = true
+		out = append(out, s)
+	}
+	return out
+}
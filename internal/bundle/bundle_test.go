@@ -0,0 +1,328 @@
+package bundle
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1rp-pw/orchestrator/internal/audit"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/policy"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/1rp-pw/orchestrator/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSystem_ExportImport(t *testing.T) {
+	cfg := testutil.Postgres(t, "policy.sql", "flow.sql", "metadata.sql", "channel.sql", "audit.sql")
+
+	ctx := context.Background()
+	client, err := cfg.Database.GetPGXPoolClient(ctx)
+	require.NoError(t, err)
+	defer client.Close()
+
+	var policyBase, versionId, flowId, flowBase string
+	require.NoError(t, client.QueryRow(ctx, `SELECT create_policy('Licence', '{"age": 0}', '[]', 'rule', FALSE)`).Scan(&policyBase))
+	_, err = client.Exec(ctx, `SELECT publish_draft_as_version($1, 'v1.0.0', 'first')`, policyBase)
+	require.NoError(t, err)
+	require.NoError(t, client.QueryRow(ctx, `SELECT policy_id FROM policies WHERE base_policy_id = $1 AND version = 'v1.0.0'`, policyBase).Scan(&versionId))
+	_, err = client.Exec(ctx, `SELECT create_draft_from_version($1, 'v1.0.0')`, policyBase)
+	require.NoError(t, err)
+	_, err = client.Exec(ctx, `SELECT update_metadata('policy', $1, NULL, 'licensing', NULL, ARRAY['dvla'], NULL, 'credit/retail')`, policyBase)
+	require.NoError(t, err)
+
+	flowYAML := "flow:\n  start:\n    - id: check\n      type: start\n      policyId: " + versionId + "\n      onTrue:\n        - id: latest\n          type: policy\n          policyId: " + policyBase + "@latest\n"
+	nodes := `[{"id": "check", "data": {"policyId": "` + versionId + `"}}]`
+	require.NoError(t, client.QueryRow(ctx, `SELECT create_flow('Licence Flow', $1, '[]', '[]', $2)`, nodes, flowYAML).Scan(&flowId))
+	require.NoError(t, client.QueryRow(ctx, `SELECT base_flow_id FROM flows WHERE flow_id = $1`, flowId).Scan(&flowBase))
+
+	s := NewSystem(cfg)
+
+	entities, err := s.Export(Selection{Flows: []string{flowBase}, Dependencies: true})
+	require.NoError(t, err)
+	require.Len(t, entities, 2, "the flow brings the policy it runs")
+	assert.Equal(t, decision.KindPolicy, entities[0].Kind)
+	assert.Equal(t, "credit/retail", entities[0].Folder)
+	require.Len(t, entities[0].Revisions, 2)
+	assert.Equal(t, "v1.0.0", entities[0].Revisions[0].Version)
+	assert.Equal(t, map[string]interface{}{"age": float64(0)}, entities[0].Revisions[0].DataModel)
+	assert.Equal(t, decision.KindFlow, entities[1].Kind)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteArchive(&buf, entities))
+	entities, err = Read(&buf)
+	require.NoError(t, err)
+	require.Len(t, entities, 2)
+
+	imported := func(t *testing.T, baseId string) []structs.AuditEntry {
+		t.Helper()
+		entries, err := audit.NewSystem(cfg).Query(structs.AuditQuery{Action: audit.ActionImport, EntityID: baseId})
+		require.NoError(t, err)
+		return entries
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		report, err := s.Import(entities, Options{DryRun: true, Remap: true})
+		require.NoError(t, err)
+		assert.True(t, report.DryRun)
+		require.Len(t, report.Results, 2)
+
+		var count int
+		require.NoError(t, client.QueryRow(ctx, `SELECT COUNT(*) FROM policies WHERE name = 'Licence'`).Scan(&count))
+		assert.Equal(t, 2, count, "nothing was stored")
+		assert.Empty(t, imported(t, report.Results[0].BaseID))
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		report, err := s.Import(entities, Options{})
+		require.NoError(t, err)
+		assert.Equal(t, ActionSkipped, report.Results[0].Action)
+		assert.Equal(t, ActionSkipped, report.Results[1].Action)
+		assert.Empty(t, imported(t, policyBase), "nothing changed")
+	})
+
+	t.Run("remap", func(t *testing.T) {
+		report, err := s.Import(entities, Options{Remap: true})
+		require.NoError(t, err)
+		require.Len(t, report.Results, 2)
+		newBase := report.IDMap[policyBase]
+		newVersion := report.IDMap[versionId]
+		assert.NotEqual(t, policyBase, newBase)
+		assert.Equal(t, ActionCreated, report.Results[1].Action)
+		assert.Empty(t, report.Results[1].Unresolved)
+
+		var flow, nodes string
+		require.NoError(t, client.QueryRow(ctx, `SELECT flow, nodes::text FROM flows WHERE base_flow_id = $1`, report.Results[1].BaseID).Scan(&flow, &nodes))
+		assert.Contains(t, flow, "policyId: "+newVersion)
+		assert.Contains(t, flow, "policyId: "+newBase+"@latest")
+		assert.NotContains(t, flow, versionId)
+		assert.Contains(t, nodes, newVersion)
+
+		var folder string
+		require.NoError(t, client.QueryRow(ctx, `SELECT folder FROM metadata WHERE kind = 'policy' AND base_id = $1`, newBase).Scan(&folder))
+		assert.Equal(t, "credit/retail", folder)
+
+		for _, result := range report.Results {
+			entries := imported(t, result.BaseID)
+			require.Len(t, entries, 1)
+			assert.Equal(t, result.Kind, entries[0].Kind)
+			assert.Empty(t, entries[0].BeforeHash, "it didn't exist")
+			assert.NotEmpty(t, entries[0].AfterHash)
+		}
+	})
+
+	t.Run("reviewed", func(t *testing.T) {
+		rs := NewSystem(cfg).SetReviews(fakeReviews{})
+
+		// published versions come in as they are, the draft waits for its review
+		report, err := rs.Import(entities[:1], Options{Remap: true})
+		require.NoError(t, err)
+		assert.Equal(t, ActionCreated, report.Results[0].Action)
+		assert.Equal(t, 2, report.Results[0].Revisions)
+		var status string
+		require.NoError(t, client.QueryRow(ctx, `SELECT status FROM policies WHERE policy_id::text = $1`, report.IDMap[versionId]).Scan(&status))
+		assert.Equal(t, "version", status)
+		require.NoError(t, client.QueryRow(ctx, `SELECT status FROM policies WHERE policy_id::text = $1`, report.IDMap[entities[0].Revisions[1].ID]).Scan(&status))
+		assert.Equal(t, "draft", status)
+
+		// a new version made from the draft would publish it around the review
+		draftOnly := entities[0]
+		draftOnly.Revisions = entities[0].Revisions[1:]
+		_, err = rs.Import([]structs.BundleEntity{draftOnly}, Options{Conflict: ConflictNewVersion})
+		assert.ErrorIs(t, err, errors.ErrNotApproved)
+
+		var count int
+		require.NoError(t, client.QueryRow(ctx, `SELECT COUNT(*) FROM policies WHERE base_policy_id = $1`, policyBase).Scan(&count))
+		assert.Equal(t, 2, count, "nothing was published")
+	})
+
+	t.Run("new version", func(t *testing.T) {
+		report, err := s.Import(entities[:1], Options{Conflict: ConflictNewVersion})
+		require.NoError(t, err)
+		assert.Equal(t, ActionVersioned, report.Results[0].Action)
+		assert.Equal(t, "v1.1.0", report.Results[0].Version)
+
+		entries := imported(t, policyBase)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "v1.1.0", entries[0].Version)
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		// the bundle doesn't have v1.1.0, a flow running it would break
+		var usesNext string
+		nextYAML := "flow:\n  start:\n    - id: check\n      type: start\n      policyId: " + policyBase + "@v1.1.0\n"
+		require.NoError(t, client.QueryRow(ctx, `SELECT create_flow('Uses Next', '[]', '[]', '[]', $1)`, nextYAML).Scan(&usesNext))
+		_, err := s.Import(entities[:1], Options{Conflict: ConflictOverwrite})
+		var inUse *errors.InUseError
+		require.ErrorAs(t, err, &inUse)
+		require.Len(t, inUse.Dependents, 1)
+		assert.Equal(t, usesNext, inUse.Dependents[0].FlowID)
+		_, err = client.Exec(ctx, `DELETE FROM flows WHERE flow_id = $1`, usesNext)
+		require.NoError(t, err)
+
+		// the flow from the start only runs what the bundle has
+		report, err := s.Import(entities[:1], Options{Conflict: ConflictOverwrite})
+		require.NoError(t, err)
+		assert.Equal(t, ActionOverwritten, report.Results[0].Action)
+
+		var count int
+		require.NoError(t, client.QueryRow(ctx, `SELECT COUNT(*) FROM policies WHERE base_policy_id = $1`, policyBase).Scan(&count))
+		assert.Equal(t, 2, count, "the imported version is gone again")
+		assert.Len(t, imported(t, policyBase), 2)
+	})
+}
+
+func TestSystem_ExportImport_Effective(t *testing.T) {
+	cfg := testutil.Postgres(t, "policy.sql", "flow.sql", "metadata.sql", "channel.sql", "audit.sql")
+
+	ctx := context.Background()
+	client, err := cfg.Database.GetPGXPoolClient(ctx)
+	require.NoError(t, err)
+	defer client.Close()
+
+	from := time.Now().UTC().Add(30 * 24 * time.Hour).Truncate(time.Second)
+	until := from.Add(365 * 24 * time.Hour)
+	var baseId string
+	require.NoError(t, client.QueryRow(ctx, `SELECT create_policy('Licence', '{}', '[]', 'rule', FALSE)`).Scan(&baseId))
+	_, err = client.Exec(ctx, `SELECT publish_draft_as_version($1, 'v1.0.0', 'next year', $2, $3)`, baseId, from, until)
+	require.NoError(t, err)
+
+	s := NewSystem(cfg)
+	entities, err := s.Export(Selection{Policies: []string{baseId}})
+	require.NoError(t, err)
+	require.Len(t, entities, 1)
+	require.Len(t, entities[0].Revisions, 1)
+	require.NotNil(t, entities[0].Revisions[0].EffectiveFrom)
+	assert.True(t, from.Equal(*entities[0].Revisions[0].EffectiveFrom))
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteArchive(&buf, entities))
+	entities, err = Read(&buf)
+	require.NoError(t, err)
+
+	report, err := s.Import(entities, Options{Remap: true})
+	require.NoError(t, err)
+	var importedFrom, importedUntil time.Time
+	require.NoError(t, client.QueryRow(ctx, `SELECT effective_from, effective_until FROM policies WHERE base_policy_id = $1`, report.Results[0].BaseID).Scan(&importedFrom, &importedUntil))
+	assert.True(t, from.Equal(importedFrom), "still comes into force in the future")
+	assert.True(t, until.Equal(importedUntil))
+
+	_, err = policy.NewSystem(cfg).ResolvePolicy(report.Results[0].BaseID + "@latest")
+	assert.Error(t, err, "nothing is in force yet")
+}
+
+type fakeReviews struct{}
+
+func (fakeReviews) Approved(context.Context, *audit.Change, string, string) (int64, error) {
+	return 1, nil
+}
+
+func (fakeReviews) Published(context.Context, *audit.Change, int64, string) error {
+	return nil
+}
+
+func TestReadWrite(t *testing.T) {
+	entities := []structs.BundleEntity{
+		{
+			Kind:   decision.KindPolicy,
+			BaseID: "6f1c2f4e-1d0a-4c1e-9f4e-2b1d3c4a5b6c",
+			Name:   "Licence",
+			Tags:   []string{"dvla"},
+			Revisions: []structs.BundleRevision{
+				{ID: "0b7e3a52-5f8e-4d7a-8c1b-9a2d3e4f5a6b", Status: "version", Version: "v1.0.0", Description: "first", Rule: "rule", Tests: []interface{}{}},
+			},
+		},
+		{
+			Kind:   decision.KindFlow,
+			BaseID: "1a2b3c4d-5e6f-4a1b-8c2d-3e4f5a6b7c8d",
+			Name:   "Flow",
+			Revisions: []structs.BundleRevision{
+				{ID: "2b3c4d5e-6f7a-4b2c-9d3e-4f5a6b7c8d9e", Status: "draft", FlowFlat: "flow:\n  start: []\n"},
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteYAML(&buf, entities))
+	assert.Equal(t, 2, strings.Count(buf.String(), "kind: "), "one document per base")
+	read, err := Read(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, entities, read)
+
+	buf.Reset()
+	require.NoError(t, WriteArchive(&buf, entities))
+	read, err = Read(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, entities, read)
+
+	_, err = Read(strings.NewReader("kind: [policy"))
+	assert.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() structs.BundleEntity {
+		return structs.BundleEntity{
+			Kind:   decision.KindPolicy,
+			BaseID: newID(),
+			Name:   "Licence",
+			Revisions: []structs.BundleRevision{
+				{ID: newID(), Status: "version", Version: "v1.0.0", Description: "first"},
+				{ID: newID(), Status: "draft"},
+			},
+		}
+	}
+	require.NoError(t, validate([]structs.BundleEntity{valid()}))
+
+	twice := valid()
+	assert.Error(t, validate([]structs.BundleEntity{twice, twice}))
+
+	for name, breakIt := range map[string]func(e *structs.BundleEntity){
+		"kind":        func(e *structs.BundleEntity) { e.Kind = "rule" },
+		"base id":     func(e *structs.BundleEntity) { e.BaseID = "not-a-uuid" },
+		"name":        func(e *structs.BundleEntity) { e.Name = " " },
+		"revisions":   func(e *structs.BundleEntity) { e.Revisions = nil },
+		"status":      func(e *structs.BundleEntity) { e.Revisions[0].Status = "published" },
+		"description": func(e *structs.BundleEntity) { e.Revisions[0].Description = "" },
+		"two drafts":  func(e *structs.BundleEntity) { e.Revisions[0] = structs.BundleRevision{ID: newID(), Status: "draft"} },
+		"draft label": func(e *structs.BundleEntity) { e.Revisions[1].Version = "v2" },
+		"draft in force": func(e *structs.BundleEntity) {
+			now := time.Now()
+			e.Revisions[1].EffectiveFrom = &now
+		},
+		"in force backwards": func(e *structs.BundleEntity) {
+			from, until := time.Now(), time.Now().Add(-time.Hour)
+			e.Revisions[0].EffectiveFrom, e.Revisions[0].EffectiveUntil = &from, &until
+		},
+	} {
+		e := valid()
+		breakIt(&e)
+		assert.Error(t, validate([]structs.BundleEntity{e}), name)
+	}
+}
+
+func TestRemap(t *testing.T) {
+	ids := map[string]string{"old-version": "new-version", "old-base": "new-base"}
+
+	assert.Equal(t, "new-version", remapRef("old-version", ids))
+	assert.Equal(t, "new-base@v1.0", remapRef("old-base@v1.0", ids))
+	assert.Equal(t, "other@latest", remapRef("other@latest", ids))
+
+	flowYAML := "flow:\n  start:\n    - id: a\n      policyId: old-version\n      onTrue:\n        - id: b\n          policyId: old-base@latest\n"
+	remapped := remapYAML(flowYAML, ids)
+	assert.Contains(t, remapped, "policyId: new-version")
+	assert.Contains(t, remapped, "policyId: new-base@latest")
+	assert.Equal(t, []string{"new-version", "new-base@latest"}, flowRefs(remapped))
+
+	unchanged := "flow:\n  start: []  # kept as written\n"
+	assert.Equal(t, unchanged, remapYAML(unchanged, ids))
+
+	nodes := remapValue([]interface{}{map[string]interface{}{"data": map[string]interface{}{"policyId": "old-version"}}}, ids)
+	assert.Equal(t, "new-version", nodes.([]interface{})[0].(map[string]interface{})["data"].(map[string]interface{})["policyId"])
+
+	assert.True(t, isUUID(newID()))
+	assert.NotEqual(t, newID(), newID())
+}
@@ -0,0 +1,104 @@
+package bundle
+
+import (
+	"encoding/json"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/listing"
+	"net/http"
+	"strconv"
+)
+
+// maxBundleSize is the largest bundle an import reads
+const maxBundleSize = 32 << 20
+
+// ExportBundle exports the base policies and flows picked by the repeatable policy and flow
+// parameters and the folder parameter, or everything when none is given. The policies the flows
+// refer to come along unless dependencies=false. format=tar.gz sends an archive instead of YAML
+func (s *System) ExportBundle(w http.ResponseWriter, r *http.Request) {
+	s.SetContext(r.Context())
+
+	v := r.URL.Query()
+	sel := Selection{
+		Policies:     v["policy"],
+		Flows:        v["flow"],
+		Dependencies: true,
+	}
+	folder, err := listing.CleanFolder(v.Get("folder"))
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+	sel.Folder = folder
+	if d := v.Get("dependencies"); d != "" {
+		b, err := strconv.ParseBool(d)
+		if err != nil {
+			errors.WriteHTTPError(w, errors.NewValidationError("dependencies", "dependencies must be true or false"))
+			return
+		}
+		sel.Dependencies = b
+	}
+
+	format := v.Get("format")
+	if format == "" {
+		format = FormatYAML
+	}
+	if format != FormatYAML && format != FormatArchive {
+		errors.WriteHTTPError(w, errors.NewValidationError("format", "format must be yaml or tar.gz"))
+		return
+	}
+
+	entities, err := s.Export(sel)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	if format == FormatArchive {
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", `attachment; filename="bundle.tar.gz"`)
+		_ = WriteArchive(w, entities)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Header().Set("Content-Disposition", `attachment; filename="bundle.yaml"`)
+	_ = WriteYAML(w, entities)
+}
+
+// ImportBundle imports a YAML or tar.gz bundle. dryRun=true reports what would happen without
+// storing anything, conflict is skip, overwrite or new-version for the policies and flows that
+// are already stored and remap=true stores the bundle under new ids. While reviews are required
+// overwrite and new-version are refused, they would publish without one
+func (s *System) ImportBundle(w http.ResponseWriter, r *http.Request) {
+	s.SetContext(r.Context())
+
+	v := r.URL.Query()
+	opts := Options{Conflict: v.Get("conflict")}
+	for name, dst := range map[string]*bool{"dryRun": &opts.DryRun, "remap": &opts.Remap} {
+		if p := v.Get(name); p != "" {
+			b, err := strconv.ParseBool(p)
+			if err != nil {
+				errors.WriteHTTPError(w, errors.NewValidationError(name, name+" must be true or false"))
+				return
+			}
+			*dst = b
+		}
+	}
+
+	entities, err := Read(http.MaxBytesReader(w, r.Body, maxBundleSize))
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	report, err := s.Import(entities, opts)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
+	}
+}
@@ -0,0 +1,625 @@
+package bundle
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"github.com/1rp-pw/orchestrator/internal/audit"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/effective"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/policy"
+	"github.com/1rp-pw/orchestrator/internal/semver"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gopkg.in/yaml.v3"
+	"strings"
+)
+
+const (
+	// ConflictSkip leaves a base policy or flow that is already stored as it is
+	ConflictSkip = "skip"
+	// ConflictOverwrite replaces every draft and version of it with the bundle's, unless a flow
+	// refers to one the bundle doesn't have
+	ConflictOverwrite = "overwrite"
+	// ConflictNewVersion publishes the bundle's latest version, or its draft when reviews aren't
+	// required, as the next minor version
+	ConflictNewVersion = "new-version"
+
+	ActionCreated     = "created"
+	ActionSkipped     = "skipped"
+	ActionOverwritten = "overwritten"
+	ActionVersioned   = "versioned"
+
+	importedDescription = "Imported from a bundle"
+)
+
+// Options are how an import goes. A dry run does everything in a transaction that is rolled
+// back, Remap stores the bundle under new ids instead of its own
+type Options struct {
+	DryRun   bool
+	Conflict string
+	Remap    bool
+}
+
+// Tx is the part of a transaction an import needs
+type Tx interface {
+	DB
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// Import stores the policies of a bundle and then its flows, in one transaction. The policy
+// references of the flows are rewritten to the ids the policies were stored under
+func (s *System) Import(entities []structs.BundleEntity, opts Options) (structs.ImportReport, error) {
+	if opts.Conflict == "" {
+		opts.Conflict = ConflictSkip
+	}
+	report := structs.ImportReport{
+		DryRun:   opts.DryRun,
+		Conflict: opts.Conflict,
+		Remap:    opts.Remap,
+		Results:  make([]structs.ImportResult, 0, len(entities)),
+		IDMap:    make(map[string]string),
+	}
+
+	if opts.Conflict != ConflictSkip && opts.Conflict != ConflictOverwrite && opts.Conflict != ConflictNewVersion {
+		return report, errors.NewValidationError("conflict", "conflict must be skip, overwrite or new-version")
+	}
+	if err := validate(entities); err != nil {
+		return report, err
+	}
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return report, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	tx, err := client.Begin(s.Context)
+	if err != nil {
+		return report, logs.Errorf("failed to start import: %v", err)
+	}
+	defer func() {
+		_ = tx.Rollback(s.Context)
+	}()
+	// the flows it stores wait for a policy being archived, and overwriting policies waits for
+	// the flows being stored as it archives
+	lock := policy.ShareReferences
+	if opts.Conflict == ConflictOverwrite {
+		lock = policy.LockReferences
+	}
+	if err := lock(s.Context, tx); err != nil {
+		return report, err
+	}
+
+	// flows refer to policies, so the policies have to have their ids first
+	for _, kind := range []string{decision.KindPolicy, decision.KindFlow} {
+		for _, e := range entities {
+			if e.Kind != kind {
+				continue
+			}
+			if kind == decision.KindFlow {
+				e = remapFlow(e, report.IDMap)
+			}
+
+			result, err := s.importOne(tx, e, opts, report.IDMap)
+			if err != nil {
+				return report, err
+			}
+			report.Results = append(report.Results, result)
+		}
+	}
+
+	if opts.DryRun {
+		return report, nil
+	}
+	if err := tx.Commit(s.Context); err != nil {
+		return report, logs.Errorf("failed to commit import: %v", err)
+	}
+	return report, nil
+}
+
+// importOne imports one base policy or flow in a transaction nested in tx, audited unless it
+// was skipped
+func (s *System) importOne(tx pgx.Tx, e structs.BundleEntity, opts Options, ids map[string]string) (structs.ImportResult, error) {
+	// a remapped one is stored under a base id it doesn't have yet
+	baseId := e.BaseID
+	if opts.Remap {
+		baseId = ""
+	}
+	change, err := audit.Begin(s.Context, s.Audit, tx, e.Kind, audit.ActionImport, baseId)
+	if err != nil {
+		return structs.ImportResult{}, err
+	}
+	defer change.Close()
+
+	result, err := s.importEntity(change, e, opts, ids)
+	if err != nil || result.Action == ActionSkipped {
+		return result, err
+	}
+	if e.Kind == decision.KindFlow {
+		if result.Unresolved, err = s.unresolved(change, e); err != nil {
+			return result, err
+		}
+	}
+	if err := change.Done(result.BaseID, result.Version); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// importEntity stores one base policy or flow and adds the ids it was stored under to ids
+func (s *System) importEntity(tx Tx, e structs.BundleEntity, opts Options, ids map[string]string) (structs.ImportResult, error) {
+	t := tables[e.Kind]
+	result := structs.ImportResult{
+		Kind:     e.Kind,
+		Name:     e.Name,
+		SourceID: e.BaseID,
+		BaseID:   e.BaseID,
+	}
+
+	if opts.Remap {
+		result.BaseID = newID()
+		ids[e.BaseID] = result.BaseID
+		e.BaseID = result.BaseID
+		e = revisions(e, ids, func(string) string { return newID() })
+		return s.create(tx, e, result, ActionCreated)
+	}
+
+	ids[e.BaseID] = e.BaseID
+	var name string
+	err := tx.QueryRow(s.Context, `SELECT name FROM `+t.Name+` t WHERE `+t.Live+` AND `+t.BaseID+`::text = $1 ORDER BY created_at DESC LIMIT 1`, e.BaseID).Scan(&name)
+	if stderrors.Is(err, pgx.ErrNoRows) {
+		if err := s.checkIDs(tx, e); err != nil {
+			return result, err
+		}
+		e = revisions(e, ids, func(id string) string { return id })
+		return s.create(tx, e, result, ActionCreated)
+	}
+	if err != nil {
+		return result, logs.Errorf("failed to look up %s: %v", e.BaseID, err)
+	}
+
+	switch opts.Conflict {
+	case ConflictOverwrite:
+		if err := s.checkIDs(tx, e); err != nil {
+			return result, err
+		}
+		if e.Kind == decision.KindPolicy {
+			if err := s.checkDependents(tx, e); err != nil {
+				return result, err
+			}
+		}
+		if _, err := tx.Exec(s.Context, `DELETE FROM `+t.Name+` WHERE `+t.BaseID+`::text = $1`, e.BaseID); err != nil {
+			return result, logs.Errorf("failed to overwrite %s: %v", e.BaseID, err)
+		}
+		if _, err := tx.Exec(s.Context, `DELETE FROM metadata WHERE kind = $1 AND base_id = $2`, e.Kind, e.BaseID); err != nil {
+			return result, logs.Errorf("failed to overwrite %s: %v", e.BaseID, err)
+		}
+		for _, rev := range e.Revisions {
+			ids[rev.ID] = rev.ID
+		}
+		return s.create(tx, e, result, ActionOverwritten)
+
+	case ConflictNewVersion:
+		return s.newVersion(tx, e, name, result, ids)
+	}
+
+	// skipped, references to its drafts and versions lead to the stored ones with the same label
+	result.Action = ActionSkipped
+	rows, err := tx.Query(s.Context, `SELECT `+t.ID+`::text, COALESCE(version, '') FROM `+t.Name+` t WHERE `+t.Live+` AND `+t.BaseID+`::text = $1`, e.BaseID)
+	if err != nil {
+		return result, logs.Errorf("failed to look up %s: %v", e.BaseID, err)
+	}
+	defer rows.Close()
+	stored := make(map[string]string)
+	for rows.Next() {
+		var id, version string
+		if err := rows.Scan(&id, &version); err != nil {
+			return result, logs.Errorf("failed to look up %s: %v", e.BaseID, err)
+		}
+		stored[version] = id
+	}
+	for _, rev := range e.Revisions {
+		if id, ok := stored[rev.Version]; ok {
+			ids[rev.ID] = id
+		}
+	}
+	return result, nil
+}
+
+// checkDependents refuses to overwrite a base policy when flows refer to a draft or version
+// of it the bundle doesn't have
+func (s *System) checkDependents(tx Tx, e structs.BundleEntity) error {
+	var policyIds, versions []string
+	for _, rev := range e.Revisions {
+		policyIds = append(policyIds, rev.ID)
+		if rev.Version != "" {
+			versions = append(versions, rev.Version)
+		}
+	}
+
+	dependents, err := policy.NewSystem(s.Config).SetContext(s.Context).Overwritten(tx, e.BaseID, policyIds, versions)
+	if err != nil {
+		return err
+	}
+	if len(dependents) > 0 {
+		return errors.NewInUseError(e.BaseID, dependents)
+	}
+	return nil
+}
+
+// revisions gives each draft and version of a new base the id next makes of its own and adds
+// them to ids
+func revisions(e structs.BundleEntity, ids map[string]string, next func(string) string) structs.BundleEntity {
+	revisions := make([]structs.BundleRevision, len(e.Revisions))
+	for i, rev := range e.Revisions {
+		rev.ID = next(rev.ID)
+		ids[e.Revisions[i].ID] = rev.ID
+		revisions[i] = rev
+	}
+	e.Revisions = revisions
+	return e
+}
+
+// latestVersion is the highest version of revisions, or the last of them when none is a version
+func latestVersion(revisions []structs.BundleRevision) (structs.BundleRevision, bool) {
+	latest := revisions[len(revisions)-1]
+	found := false
+	for _, rev := range revisions {
+		if rev.Status == "version" && (!found || semver.CompareLabels(rev.Version, latest.Version) > 0) {
+			latest, found = rev, true
+		}
+	}
+	return latest, found
+}
+
+// checkIDs makes sure none of the drafts or versions of the bundle is stored under another base
+func (s *System) checkIDs(tx Tx, e structs.BundleEntity) error {
+	t := tables[e.Kind]
+	revIds := make([]string, 0, len(e.Revisions))
+	for _, rev := range e.Revisions {
+		revIds = append(revIds, rev.ID)
+	}
+
+	var taken string
+	err := tx.QueryRow(s.Context, `SELECT `+t.ID+`::text FROM `+t.Name+` WHERE `+t.ID+`::text = ANY($1) AND `+t.BaseID+`::text != $2 LIMIT 1`, revIds, e.BaseID).Scan(&taken)
+	if stderrors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return logs.Errorf("failed to look up %s: %v", e.BaseID, err)
+	}
+	return errors.NewValidationError("bundle", fmt.Sprintf("%s of %s belongs to another %s, import with remap=true", taken, e.BaseID, e.Kind))
+}
+
+// create stores every draft and version of the bundle and its metadata
+func (s *System) create(tx Tx, e structs.BundleEntity, result structs.ImportResult, action string) (structs.ImportResult, error) {
+	for _, rev := range e.Revisions {
+		if err := s.insert(tx, e.Kind, e.BaseID, e.Name, rev); err != nil {
+			return result, err
+		}
+	}
+
+	if _, err := tx.Exec(s.Context, `SELECT update_metadata($1, $2, NULL, $3, $4, $5, NULL, $6, $7)`,
+		e.Kind, e.BaseID, nullable(e.Owner), nullable(e.Description), e.Tags, nullable(e.Folder), nullable(e.Team)); err != nil {
+		return result, logs.Errorf("failed to import metadata of %s: %v", e.BaseID, err)
+	}
+
+	result.Action = action
+	result.Revisions = len(e.Revisions)
+	return result, nil
+}
+
+// newVersion publishes the latest version of the bundle, or its draft when it has none, as the
+// next minor version of the stored base. Every draft and version of the bundle leads to it
+func (s *System) newVersion(tx Tx, e structs.BundleEntity, name string, result structs.ImportResult, ids map[string]string) (structs.ImportResult, error) {
+	t := tables[e.Kind]
+
+	latest, found := latestVersion(e.Revisions)
+	if !found && s.Reviews != nil {
+		return result, fmt.Errorf("%w: the bundle only has a draft of %s %s, it is published through review", errors.ErrNotApproved, e.Kind, e.BaseID)
+	}
+
+	rows, err := tx.Query(s.Context, `SELECT version FROM `+t.Name+` WHERE `+t.BaseID+`::text = $1 AND version IS NOT NULL`, e.BaseID)
+	if err != nil {
+		return result, logs.Errorf("failed to load versions: %v", err)
+	}
+	var existing []string
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return result, logs.Errorf("failed to load versions: %v", err)
+		}
+		existing = append(existing, version)
+	}
+	rows.Close()
+
+	version, err := semver.Next(existing, "", semver.Minor)
+	if err != nil {
+		return result, err
+	}
+
+	rev := latest
+	rev.ID = newID()
+	rev.Status = "version"
+	rev.Version = version
+	if strings.TrimSpace(rev.Description) == "" {
+		rev.Description = importedDescription
+	}
+	if err := s.insert(tx, e.Kind, e.BaseID, name, rev); err != nil {
+		return result, err
+	}
+
+	for _, r := range e.Revisions {
+		ids[r.ID] = rev.ID
+	}
+	result.Action = ActionVersioned
+	result.Version = version
+	result.Revisions = 1
+	return result, nil
+}
+
+func (s *System) insert(tx Tx, kind, baseId, name string, rev structs.BundleRevision) error {
+	tests, err := jsonColumn(rev.Tests, "[]")
+	if err != nil {
+		return errors.NewValidationError("tests", err.Error())
+	}
+	var createdAt interface{}
+	if !rev.CreatedAt.IsZero() {
+		createdAt = rev.CreatedAt
+	}
+
+	if kind == decision.KindPolicy {
+		dataModel, err := jsonColumn(rev.DataModel, "{}")
+		if err != nil {
+			return errors.NewValidationError("schema", err.Error())
+		}
+		if _, err := tx.Exec(s.Context, `
+			INSERT INTO policies (policy_id, base_policy_id, name, data_model, tests, rule, version, description, status, strict_validation, created_at, effective_from, effective_until)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, COALESCE($11, CURRENT_TIMESTAMP), $12, $13)`,
+			rev.ID, baseId, name, dataModel, tests, rev.Rule, nullable(rev.Version), nullable(rev.Description), rev.Status, rev.StrictValidation, createdAt, rev.EffectiveFrom, rev.EffectiveUntil); err != nil {
+			return logs.Errorf("failed to import policy %s: %v", rev.ID, err)
+		}
+		return nil
+	}
+
+	nodes, err := jsonColumn(rev.Nodes, "[]")
+	if err != nil {
+		return errors.NewValidationError("nodes", err.Error())
+	}
+	edges, err := jsonColumn(rev.Edges, "[]")
+	if err != nil {
+		return errors.NewValidationError("edges", err.Error())
+	}
+	if _, err := tx.Exec(s.Context, `
+		INSERT INTO flows (flow_id, base_flow_id, name, nodes, edges, tests, flow, version, description, status, created_at, effective_from, effective_until)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, COALESCE($11, CURRENT_TIMESTAMP), $12, $13)`,
+		rev.ID, baseId, name, nodes, edges, tests, rev.FlowFlat, nullable(rev.Version), nullable(rev.Description), rev.Status, createdAt, rev.EffectiveFrom, rev.EffectiveUntil); err != nil {
+		return logs.Errorf("failed to import flow %s: %v", rev.ID, err)
+	}
+	return nil
+}
+
+// unresolved lists the policy references of the flow that don't lead to a stored policy
+func (s *System) unresolved(tx Tx, e structs.BundleEntity) ([]string, error) {
+	var refs []string
+	for _, rev := range e.Revisions {
+		refs = append(refs, flowRefs(rev.FlowFlat)...)
+	}
+
+	var missing []string
+	for _, ref := range unique(refs) {
+		var found bool
+		var err error
+		basePolicyId, version, ok := strings.Cut(ref, "@")
+		switch {
+		case !ok:
+			err = tx.QueryRow(s.Context, `SELECT EXISTS (SELECT 1 FROM policies WHERE policy_id::text = $1 AND archived_at IS NULL)`, ref).Scan(&found)
+		case version == "latest":
+			err = tx.QueryRow(s.Context, `SELECT EXISTS (SELECT 1 FROM policies WHERE base_policy_id::text = $1 AND status = 'version' AND archived_at IS NULL)`, basePolicyId).Scan(&found)
+		default:
+			err = tx.QueryRow(s.Context, `SELECT EXISTS (SELECT 1 FROM policies WHERE base_policy_id::text = $1 AND version = ANY($2) AND archived_at IS NULL)`, basePolicyId, semver.StoredLabels(version)).Scan(&found)
+		}
+		if err != nil {
+			return nil, logs.Errorf("failed to resolve %s: %v", ref, err)
+		}
+		if !found {
+			missing = append(missing, ref)
+		}
+	}
+	return missing, nil
+}
+
+// remapFlow rewrites the policy references in the nodes and flow yaml of every draft and version
+// of a flow to the ids the policies were stored under
+func remapFlow(e structs.BundleEntity, ids map[string]string) structs.BundleEntity {
+	revisions := make([]structs.BundleRevision, len(e.Revisions))
+	for i, rev := range e.Revisions {
+		rev.Nodes = remapValue(rev.Nodes, ids)
+		rev.FlowFlat = remapYAML(rev.FlowFlat, ids)
+		revisions[i] = rev
+	}
+	e.Revisions = revisions
+	return e
+}
+
+// remapRef is the reference to the id a policy was stored under, policy ids and the base of
+// {basePolicyId}@{version} references are looked up
+func remapRef(ref string, ids map[string]string) string {
+	if basePolicyId, version, ok := strings.Cut(ref, "@"); ok {
+		if id, ok := ids[basePolicyId]; ok {
+			return id + "@" + version
+		}
+		return ref
+	}
+	if id, ok := ids[ref]; ok {
+		return id
+	}
+	return ref
+}
+
+// remapValue rewrites every policyId in decoded JSON
+func remapValue(v interface{}, ids map[string]string) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			if ref, ok := val.(string); ok && k == "policyId" {
+				t[k] = remapRef(ref, ids)
+				continue
+			}
+			t[k] = remapValue(val, ids)
+		}
+	case []interface{}:
+		for i, val := range t {
+			t[i] = remapValue(val, ids)
+		}
+	}
+	return v
+}
+
+// remapYAML rewrites every policyId of a flow yaml, it is left as it is when nothing changes
+func remapYAML(flowYAML string, ids map[string]string) string {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(flowYAML), &doc); err != nil {
+		return flowYAML
+	}
+
+	changed := false
+	var walk func(n *yaml.Node)
+	walk = func(n *yaml.Node) {
+		if n.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				key, val := n.Content[i], n.Content[i+1]
+				if key.Value == "policyId" && val.Kind == yaml.ScalarNode {
+					if ref := remapRef(val.Value, ids); ref != val.Value {
+						val.Value = ref
+						changed = true
+					}
+				}
+			}
+		}
+		for _, c := range n.Content {
+			walk(c)
+		}
+	}
+	walk(&doc)
+
+	if !changed {
+		return flowYAML
+	}
+	out, err := yaml.Marshal(&doc)
+	if err != nil {
+		return flowYAML
+	}
+	return string(out)
+}
+
+func jsonColumn(v interface{}, empty string) (string, error) {
+	if v == nil {
+		return empty, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func nullable(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// newID is a random (version 4) UUID
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// validate checks the bundle can be imported before anything is stored
+func validate(entities []structs.BundleEntity) error {
+	seen := make(map[string]bool, len(entities))
+	for i, e := range entities {
+		field := fmt.Sprintf("bundle[%d]", i)
+		if _, ok := tables[e.Kind]; !ok {
+			return errors.NewValidationError(field+".kind", "kind must be policy or flow")
+		}
+		if !isUUID(e.BaseID) {
+			return errors.NewValidationError(field+".baseId", "baseId must be a UUID")
+		}
+		if seen[e.BaseID] {
+			return errors.NewValidationError(field+".baseId", e.BaseID+" is in the bundle twice")
+		}
+		seen[e.BaseID] = true
+		if strings.TrimSpace(e.Name) == "" {
+			return errors.NewValidationError(field+".name", "name is required")
+		}
+		if len(e.Revisions) == 0 {
+			return errors.NewValidationError(field+".revisions", "a draft or version is required")
+		}
+
+		drafts := 0
+		versions := make(map[string]bool, len(e.Revisions))
+		for j, rev := range e.Revisions {
+			field := fmt.Sprintf("%s.revisions[%d]", field, j)
+			if !isUUID(rev.ID) {
+				return errors.NewValidationError(field+".id", "id must be a UUID")
+			}
+			switch rev.Status {
+			case "draft":
+				drafts++
+				if rev.Version != "" {
+					return errors.NewValidationError(field+".version", "a draft has no version")
+				}
+				if rev.EffectiveFrom != nil || rev.EffectiveUntil != nil {
+					return errors.NewValidationError(field+".effectiveFrom", "only versions are in force for a time")
+				}
+			case "version":
+				if rev.Version == "" || versions[rev.Version] {
+					return errors.NewValidationError(field+".version", "each version needs its own label")
+				}
+				if strings.TrimSpace(rev.Description) == "" {
+					return errors.NewValidationError(field+".description", "a version needs a description")
+				}
+				if err := effective.Validate(rev.EffectiveFrom, rev.EffectiveUntil); err != nil {
+					return errors.NewValidationError(field+".effectiveUntil", "effectiveUntil must be after effectiveFrom")
+				}
+				versions[rev.Version] = true
+			default:
+				return errors.NewValidationError(field+".status", "status must be draft or version")
+			}
+		}
+		if drafts > 1 {
+			return errors.NewValidationError(field+".revisions", "there can only be one draft")
+		}
+	}
+	return nil
+}
+
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if c != '-' {
+				return false
+			}
+		case !strings.ContainsRune("0123456789abcdefABCDEF", c):
+			return false
+		}
+	}
+	return true
+}
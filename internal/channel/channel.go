@@ -0,0 +1,271 @@
+package channel
+
+import (
+	"context"
+	"database/sql"
+	stderrors "errors"
+	"fmt"
+	"github.com/1rp-pw/orchestrator/internal/audit"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/semver"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/jackc/pgx/v5"
+	ConfigBuilder "github.com/keloran/go-config"
+	"strings"
+	"time"
+)
+
+const maxNameLength = 50
+
+type System struct {
+	Config  *ConfigBuilder.Config
+	Context context.Context
+	Audit   audit.Recorder
+}
+
+func NewSystem(cfg *ConfigBuilder.Config) *System {
+	return &System{
+		Config:  cfg,
+		Context: context.Background(),
+		Audit:   audit.NewSystem(cfg),
+	}
+}
+
+func (s *System) SetContext(ctx context.Context) *System {
+	s.Context = ctx
+	return s
+}
+
+// SetAudit records every promotion with a, nil records nothing
+func (s *System) SetAudit(a audit.Recorder) *System {
+	s.Audit = a
+	return s
+}
+
+// versions are the table, id column and base id column of the published versions of each kind
+// and the condition for the rows of t that haven't been deleted
+var versions = map[string][4]string{
+	decision.KindPolicy: {"policies", "policy_id", "base_policy_id", "t.archived_at IS NULL"},
+	decision.KindFlow:   {"flows", "flow_id", "base_flow_id", "TRUE"},
+}
+
+// ValidName checks a channel name can't be mistaken for a version, latest or draft in a
+// {baseId}@{label} reference
+func ValidName(name string) error {
+	if name == "" || len(name) > maxNameLength {
+		return errors.NewValidationError("channel", fmt.Sprintf("channel must be 1 to %d characters", maxNameLength))
+	}
+	for i, c := range name {
+		if (c < 'a' || c > 'z') && (i == 0 || (c < '0' || c > '9') && c != '-' && c != '_') {
+			return errors.NewValidationError("channel", "channel must start with a lowercase letter and only have lowercase letters, digits, - and _")
+		}
+	}
+	if _, err := semver.Parse(name); err == nil || name == "latest" || name == "draft" {
+		return errors.NewValidationError("channel", name+" is a version label, not a channel")
+	}
+	return nil
+}
+
+// Promote points a channel at a published version of a base policy or flow, or at the version
+// another channel points at
+func (s *System) Promote(kind, baseId string, p structs.ChannelPromotion) (structs.Channel, error) {
+	c := structs.Channel{
+		Kind:    kind,
+		BaseID:  baseId,
+		Channel: strings.TrimSpace(p.Channel),
+	}
+	if err := ValidName(c.Channel); err != nil {
+		return c, err
+	}
+	if (p.Version == "") == (p.From == "") {
+		return c, errors.NewValidationError("version", "set either version or from")
+	}
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return c, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	label := p.Version
+	if p.From != "" {
+		from, err := s.load(client, kind, baseId, p.From)
+		if err != nil {
+			return c, err
+		}
+		label = from.Version
+	}
+
+	v := versions[kind]
+	var version string
+	err = client.QueryRow(s.Context, fmt.Sprintf(`
+		SELECT t.version
+		FROM %s t
+		WHERE t.%s::text = $1 AND t.status = 'version' AND t.version = ANY($2) AND %s`, v[0], v[2], v[3]),
+		baseId, semver.StoredLabels(label)).Scan(&version)
+	if stderrors.Is(err, pgx.ErrNoRows) {
+		return c, notFound(kind, baseId+"@"+label)
+	}
+	if err != nil {
+		return c, logs.Errorf("failed to load version: %v", err)
+	}
+
+	var note interface{}
+	if p.Note != "" {
+		note = p.Note
+	}
+	change, err := audit.Begin(s.Context, s.Audit, client, kind, audit.ActionPromote, baseId)
+	if err != nil {
+		return c, err
+	}
+	defer change.Close()
+	if _, err := change.Exec(s.Context, `SELECT promote_channel($1, $2, $3, $4, $5)`, kind, baseId, c.Channel, version, note); err != nil {
+		return c, logs.Errorf("failed to promote %s: %v", c.Channel, err)
+	}
+	if c, err = s.load(change, kind, baseId, c.Channel); err != nil {
+		return c, err
+	}
+	if err := change.Done(c.ID, version); err != nil {
+		return c, err
+	}
+
+	return c, nil
+}
+
+// DB is the part of the pool the channel queries need
+type DB interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+func (s *System) load(db DB, kind, baseId, channel string) (structs.Channel, error) {
+	c := structs.Channel{
+		Kind:    kind,
+		BaseID:  baseId,
+		Channel: channel,
+	}
+
+	v := versions[kind]
+	var id sql.NullString
+	err := db.QueryRow(s.Context, fmt.Sprintf(`
+		SELECT
+		    c.version,
+		    c.promoted_at,
+		    t.%s::text
+		FROM channels c
+		LEFT JOIN %s t ON t.%s::text = c.base_id AND t.version = c.version AND %s
+		WHERE c.kind = $1 AND c.base_id = $2 AND c.channel = $3`, v[1], v[0], v[2], v[3]),
+		kind, baseId, channel).Scan(&c.Version, &c.PromotedAt, &id)
+	if stderrors.Is(err, pgx.ErrNoRows) {
+		return c, notFound(kind, baseId+"@"+channel)
+	}
+	if err != nil {
+		return c, logs.Errorf("failed to load channel: %v", err)
+	}
+	c.ID = id.String
+
+	return c, nil
+}
+
+// List lists the channels of a base policy or flow by name, as they are or, with a non zero at,
+// as they were at that time
+func (s *System) List(kind, baseId string, at time.Time) ([]structs.Channel, error) {
+	channels := make([]structs.Channel, 0)
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return channels, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	current := `
+		SELECT channel, version, promoted_at
+		FROM channels
+		WHERE kind = $1 AND base_id = $2`
+	args := []interface{}{kind, baseId}
+	if !at.IsZero() {
+		current = `
+			SELECT DISTINCT ON (channel) channel, version, promoted_at
+			FROM channel_history
+			WHERE kind = $1 AND base_id = $2 AND promoted_at <= $3
+			ORDER BY channel, promoted_at DESC, id DESC`
+		args = append(args, at)
+	}
+
+	v := versions[kind]
+	rows, err := client.Query(s.Context, fmt.Sprintf(`
+		SELECT
+		    c.channel,
+		    c.version,
+		    c.promoted_at,
+		    t.%s::text
+		FROM (%s) c
+		LEFT JOIN %s t ON t.%s::text = $2 AND t.version = c.version AND %s
+		ORDER BY c.channel`, v[1], current, v[0], v[2], v[3]), args...)
+	if err != nil {
+		return channels, logs.Errorf("failed to list channels: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		c := structs.Channel{Kind: kind, BaseID: baseId}
+		var id sql.NullString
+		if err := rows.Scan(&c.Channel, &c.Version, &c.PromotedAt, &id); err != nil {
+			return channels, logs.Errorf("failed to list channels: %v", err)
+		}
+		c.ID = id.String
+		channels = append(channels, c)
+	}
+
+	return channels, nil
+}
+
+// History lists the promotions of a base policy or flow, oldest first, only those of one
+// channel when channel isn't empty
+func (s *System) History(kind, baseId, channel string) ([]structs.ChannelChange, error) {
+	changes := make([]structs.ChannelChange, 0)
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return changes, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	rows, err := client.Query(s.Context, `
+		SELECT
+		    id,
+		    channel,
+		    version,
+		    previous_version,
+		    note,
+		    promoted_at
+		FROM channel_history
+		WHERE kind = $1 AND base_id = $2 AND ($3 = '' OR channel = $3)
+		ORDER BY promoted_at, id`, kind, baseId, channel)
+	if err != nil {
+		return changes, logs.Errorf("failed to load channel history: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		c := structs.ChannelChange{}
+		var previous, note sql.NullString
+		if err := rows.Scan(&c.ID, &c.Channel, &c.Version, &previous, &note, &c.PromotedAt); err != nil {
+			return changes, logs.Errorf("failed to load channel history: %v", err)
+		}
+		c.PreviousVersion = previous.String
+		c.Note = note.String
+		changes = append(changes, c)
+	}
+
+	return changes, nil
+}
+
+func notFound(kind, id string) error {
+	if kind == decision.KindFlow {
+		return errors.WrapFlowError(errors.ErrFlowNotFound, id, "")
+	}
+	return errors.WrapPolicyError(errors.ErrPolicyNotFound, id)
+}
@@ -0,0 +1,226 @@
+package channel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/1rp-pw/orchestrator/internal/audit"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/effective"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/flow"
+	"github.com/1rp-pw/orchestrator/internal/policy"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/1rp-pw/orchestrator/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSystem_Promote(t *testing.T) {
+	cfg := testutil.Postgres(t, "policy.sql", "flow.sql", "channel.sql", "audit.sql")
+
+	ctx := context.Background()
+	client, err := cfg.Database.GetPGXPoolClient(ctx)
+	require.NoError(t, err)
+	defer client.Close()
+
+	var baseId string
+	require.NoError(t, client.QueryRow(ctx, `SELECT create_policy('Licence', '{}', '[]', 'rule one', FALSE)`).Scan(&baseId))
+	_, err = client.Exec(ctx, `SELECT publish_draft_as_version($1, 'v1.0.0', 'first')`, baseId)
+	require.NoError(t, err)
+	_, err = client.Exec(ctx, `SELECT create_draft_from_version($1, 'v1.0.0')`, baseId)
+	require.NoError(t, err)
+	_, err = client.Exec(ctx, `SELECT update_draft($1, NULL, NULL, 'rule two')`, baseId)
+	require.NoError(t, err)
+	_, err = client.Exec(ctx, `SELECT publish_draft_as_version($1, 'v1.1.0', 'second')`, baseId)
+	require.NoError(t, err)
+
+	s := NewSystem(cfg)
+
+	c, err := s.Promote(decision.KindPolicy, baseId, structs.ChannelPromotion{Channel: "staging", Version: "1.0"})
+	require.NoError(t, err)
+	assert.Equal(t, "v1.0.0", c.Version)
+	assert.NotEmpty(t, c.ID)
+
+	_, err = s.Promote(decision.KindPolicy, baseId, structs.ChannelPromotion{Channel: "prod", From: "staging", Note: "passed staging"})
+	require.NoError(t, err)
+	beforeSecond := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	_, err = s.Promote(decision.KindPolicy, baseId, structs.ChannelPromotion{Channel: "prod", Version: "v1.1.0"})
+	require.NoError(t, err)
+
+	_, err = s.Promote(decision.KindPolicy, baseId, structs.ChannelPromotion{Channel: "prod", Version: "v9"})
+	assert.ErrorIs(t, err, errors.ErrPolicyNotFound)
+	_, err = s.Promote(decision.KindPolicy, baseId, structs.ChannelPromotion{Channel: "prod", From: "dev"})
+	assert.ErrorIs(t, err, errors.ErrPolicyNotFound)
+
+	p, err := policy.NewSystem(cfg).ResolvePolicy(baseId + "@prod")
+	require.NoError(t, err)
+	assert.Equal(t, "rule two", p.Rule)
+	p, err = policy.NewSystem(cfg).ResolvePolicy(baseId + "@staging")
+	require.NoError(t, err)
+	assert.Equal(t, "rule one", p.Rule)
+
+	channels, err := s.List(decision.KindPolicy, baseId, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, channels, 2)
+	assert.Equal(t, "prod", channels[0].Channel)
+	assert.Equal(t, "v1.1.0", channels[0].Version)
+
+	channels, err = s.List(decision.KindPolicy, baseId, beforeSecond)
+	require.NoError(t, err)
+	require.Len(t, channels, 2)
+	assert.Equal(t, "v1.0.0", channels[0].Version, "prod was still on the first version")
+
+	history, err := s.History(decision.KindPolicy, baseId, "prod")
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, "passed staging", history[0].Note)
+	assert.Equal(t, "v1.0.0", history[1].PreviousVersion)
+
+	// flows resolve channels the same way
+	var flowId, baseFlowId string
+	require.NoError(t, client.QueryRow(ctx, `SELECT create_flow('Flow', '[]', '[]', '[]', 'flow: {}')`).Scan(&flowId))
+	require.NoError(t, client.QueryRow(ctx, `SELECT base_flow_id FROM flows WHERE flow_id = $1`, flowId).Scan(&baseFlowId))
+	require.NoError(t, client.QueryRow(ctx, `SELECT publish_draft_flow_as_version($1, 'v1.0.0', 'first')`, baseFlowId).Scan(&flowId))
+	_, err = s.Promote(decision.KindFlow, baseFlowId, structs.ChannelPromotion{Channel: "prod", Version: "1"})
+	require.NoError(t, err)
+
+	f, err := flow.NewSystem(cfg).SetContext(ctx).ResolveFlow(baseFlowId + "@prod")
+	require.NoError(t, err)
+	assert.Equal(t, flowId, f.FlowID)
+	_, err = flow.NewSystem(cfg).SetContext(ctx).ResolveFlow(baseFlowId + "@dev")
+	assert.ErrorIs(t, err, errors.ErrFlowNotFound)
+}
+
+func TestSystem_Promote_Audited(t *testing.T) {
+	cfg := testutil.Postgres(t, "policy.sql", "flow.sql", "channel.sql", "audit.sql")
+
+	ctx := context.Background()
+	client, err := cfg.Database.GetPGXPoolClient(ctx)
+	require.NoError(t, err)
+	defer client.Close()
+
+	var baseId string
+	require.NoError(t, client.QueryRow(ctx, `SELECT create_policy('Licence', '{}', '[]', 'rule one', FALSE)`).Scan(&baseId))
+	_, err = client.Exec(ctx, `SELECT publish_draft_as_version($1, 'v1.0.0', 'first')`, baseId)
+	require.NoError(t, err)
+
+	c, err := NewSystem(cfg).SetContext(audit.WithActor(ctx, "alice")).Promote(decision.KindPolicy, baseId, structs.ChannelPromotion{Channel: "prod", Version: "1.0.0"})
+	require.NoError(t, err)
+
+	entries, err := audit.NewSystem(cfg).Query(structs.AuditQuery{Action: audit.ActionPromote, EntityID: baseId})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "alice", entries[0].Actor)
+	assert.Equal(t, c.ID, entries[0].TargetID)
+	assert.Equal(t, "v1.0.0", entries[0].Version)
+	assert.NotEqual(t, entries[0].BeforeHash, entries[0].AfterHash)
+}
+
+func TestArchive_PromotedVersion(t *testing.T) {
+	cfg := testutil.Postgres(t, "policy.sql", "flow.sql", "channel.sql", "audit.sql")
+
+	ctx := context.Background()
+	client, err := cfg.Database.GetPGXPoolClient(ctx)
+	require.NoError(t, err)
+	defer client.Close()
+
+	var baseId, versionId string
+	require.NoError(t, client.QueryRow(ctx, `SELECT create_policy('Licence', '{}', '[]', 'rule one', FALSE)`).Scan(&baseId))
+	require.NoError(t, client.QueryRow(ctx, `SELECT publish_draft_as_version($1, 'v1.0.0', 'first')`, baseId).Scan(&versionId))
+	_, err = client.Exec(ctx, `SELECT create_draft_from_version($1, 'v1.0.0')`, baseId)
+	require.NoError(t, err)
+	_, err = client.Exec(ctx, `SELECT publish_draft_as_version($1, 'v1.1.0', 'second')`, baseId)
+	require.NoError(t, err)
+
+	_, err = NewSystem(cfg).Promote(decision.KindPolicy, baseId, structs.ChannelPromotion{Channel: "prod", Version: "1.0.0"})
+	require.NoError(t, err)
+
+	// a flow on prod breaks when the version prod points at is archived
+	var flowId string
+	flowYAML := "flow:\n  start:\n    - id: check\n      type: start\n      policyId: " + baseId + "@prod\n"
+	require.NoError(t, client.QueryRow(ctx, `SELECT create_flow($1, $2, $3, $4, $5)`, "Uses Prod", `[]`, `[]`, `[]`, flowYAML).Scan(&flowId))
+
+	ps := policy.NewSystem(cfg).SetContext(ctx)
+	_, err = ps.ArchivePolicy(versionId)
+	var inUse *errors.InUseError
+	require.ErrorAs(t, err, &inUse)
+	require.Len(t, inUse.Dependents, 1)
+	assert.Equal(t, flowId, inUse.Dependents[0].FlowID)
+
+	_, err = NewSystem(cfg).Promote(decision.KindPolicy, baseId, structs.ChannelPromotion{Channel: "prod", Version: "1.1.0"})
+	require.NoError(t, err)
+	_, err = ps.ArchivePolicy(versionId)
+	assert.NoError(t, err)
+}
+
+func TestResolve_AsOf(t *testing.T) {
+	cfg := testutil.Postgres(t, "policy.sql", "flow.sql", "channel.sql", "audit.sql")
+
+	ctx := context.Background()
+	client, err := cfg.Database.GetPGXPoolClient(ctx)
+	require.NoError(t, err)
+	defer client.Close()
+
+	var baseId string
+	require.NoError(t, client.QueryRow(ctx, `SELECT create_policy('Licence', '{}', '[]', 'rule one', FALSE)`).Scan(&baseId))
+	_, err = client.Exec(ctx, `SELECT publish_draft_as_version($1, 'v1.0.0', 'first')`, baseId)
+	require.NoError(t, err)
+	_, err = client.Exec(ctx, `SELECT create_draft_from_version($1, 'v1.0.0')`, baseId)
+	require.NoError(t, err)
+	_, err = client.Exec(ctx, `SELECT update_draft($1, NULL, NULL, 'rule two')`, baseId)
+	require.NoError(t, err)
+	_, err = client.Exec(ctx, `SELECT publish_draft_as_version($1, 'v1.1.0', 'second')`, baseId)
+	require.NoError(t, err)
+
+	var firstFlowId, secondFlowId, baseFlowId string
+	require.NoError(t, client.QueryRow(ctx, `SELECT create_flow('Flow', '[]', '[]', '[]', 'flow: {}')`).Scan(&firstFlowId))
+	require.NoError(t, client.QueryRow(ctx, `SELECT base_flow_id FROM flows WHERE flow_id = $1`, firstFlowId).Scan(&baseFlowId))
+	require.NoError(t, client.QueryRow(ctx, `SELECT publish_draft_flow_as_version($1, 'v1.0.0', 'first')`, baseFlowId).Scan(&firstFlowId))
+	_, err = client.Exec(ctx, `SELECT create_draft_flow_from_version($1, 'v1.0.0')`, baseFlowId)
+	require.NoError(t, err)
+	require.NoError(t, client.QueryRow(ctx, `SELECT publish_draft_flow_as_version($1, 'v1.1.0', 'second')`, baseFlowId).Scan(&secondFlowId))
+
+	s := NewSystem(cfg)
+	beforeFirst := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	_, err = s.Promote(decision.KindPolicy, baseId, structs.ChannelPromotion{Channel: "prod", Version: "1.0.0"})
+	require.NoError(t, err)
+	_, err = s.Promote(decision.KindFlow, baseFlowId, structs.ChannelPromotion{Channel: "prod", Version: "1.0.0"})
+	require.NoError(t, err)
+	beforeSecond := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	_, err = s.Promote(decision.KindPolicy, baseId, structs.ChannelPromotion{Channel: "prod", Version: "1.1.0"})
+	require.NoError(t, err)
+	_, err = s.Promote(decision.KindFlow, baseFlowId, structs.ChannelPromotion{Channel: "prod", Version: "1.1.0"})
+	require.NoError(t, err)
+
+	p, err := policy.NewSystem(cfg).SetContext(ctx).ResolvePolicy(baseId + "@prod")
+	require.NoError(t, err)
+	assert.Equal(t, "rule two", p.Rule)
+	p, err = policy.NewSystem(cfg).SetContext(effective.WithAsOf(ctx, beforeSecond)).ResolvePolicy(baseId + "@prod")
+	require.NoError(t, err)
+	assert.Equal(t, "rule one", p.Rule, "prod was still on the first version")
+	_, err = policy.NewSystem(cfg).SetContext(effective.WithAsOf(ctx, beforeFirst)).ResolvePolicy(baseId + "@prod")
+	assert.Error(t, err, "prod wasn't promoted yet")
+
+	f, err := flow.NewSystem(cfg).SetContext(ctx).ResolveFlow(baseFlowId + "@prod")
+	require.NoError(t, err)
+	assert.Equal(t, secondFlowId, f.FlowID)
+	f, err = flow.NewSystem(cfg).SetContext(effective.WithAsOf(ctx, beforeSecond)).ResolveFlow(baseFlowId + "@prod")
+	require.NoError(t, err)
+	assert.Equal(t, firstFlowId, f.FlowID)
+	_, err = flow.NewSystem(cfg).SetContext(effective.WithAsOf(ctx, beforeFirst)).ResolveFlow(baseFlowId + "@prod")
+	assert.ErrorIs(t, err, errors.ErrFlowNotFound)
+}
+
+func TestValidName(t *testing.T) {
+	for _, name := range []string{"prod", "staging", "dev-eu_2"} {
+		assert.NoError(t, ValidName(name), name)
+	}
+	for _, name := range []string{"", "Prod", "2prod", "pr od", "latest", "draft", "v1", "v1.2.0", "p/rod"} {
+		assert.Error(t, ValidName(name), name)
+	}
+}
@@ -0,0 +1,96 @@
+package channel
+
+import (
+	"encoding/json"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"net/http"
+	"time"
+)
+
+func (s *System) PromotePolicy(w http.ResponseWriter, r *http.Request) {
+	s.promote(w, r, decision.KindPolicy, r.PathValue("policyId"))
+}
+
+func (s *System) ListPolicyChannels(w http.ResponseWriter, r *http.Request) {
+	s.listChannels(w, r, decision.KindPolicy, r.PathValue("policyId"))
+}
+
+func (s *System) ListPolicyChannelHistory(w http.ResponseWriter, r *http.Request) {
+	s.listHistory(w, r, decision.KindPolicy, r.PathValue("policyId"))
+}
+
+func (s *System) PromoteFlow(w http.ResponseWriter, r *http.Request) {
+	s.promote(w, r, decision.KindFlow, r.PathValue("flowId"))
+}
+
+func (s *System) ListFlowChannels(w http.ResponseWriter, r *http.Request) {
+	s.listChannels(w, r, decision.KindFlow, r.PathValue("flowId"))
+}
+
+func (s *System) ListFlowChannelHistory(w http.ResponseWriter, r *http.Request) {
+	s.listHistory(w, r, decision.KindFlow, r.PathValue("flowId"))
+}
+
+// promote points the channel in the body at its version, or at the version of its from channel
+func (s *System) promote(w http.ResponseWriter, r *http.Request, kind, baseId string) {
+	s.SetContext(r.Context())
+
+	var p structs.ChannelPromotion
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		errors.WriteHTTPError(w, errors.NewValidationError("body", "invalid JSON format"))
+		return
+	}
+
+	c, err := s.Promote(kind, baseId, p)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	writeJSON(w, c)
+}
+
+// listChannels lists the channels, at=RFC 3339 time lists them as they were then
+func (s *System) listChannels(w http.ResponseWriter, r *http.Request, kind, baseId string) {
+	s.SetContext(r.Context())
+
+	var at time.Time
+	if a := r.URL.Query().Get("at"); a != "" {
+		t, err := time.Parse(time.RFC3339, a)
+		if err != nil {
+			errors.WriteHTTPError(w, errors.NewValidationError("at", "at must be an RFC 3339 time"))
+			return
+		}
+		at = t
+	}
+
+	channels, err := s.List(kind, baseId, at)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	writeJSON(w, channels)
+}
+
+// listHistory lists the promotions, channel=prod only lists those of prod
+func (s *System) listHistory(w http.ResponseWriter, r *http.Request, kind, baseId string) {
+	s.SetContext(r.Context())
+
+	changes, err := s.History(kind, baseId, r.URL.Query().Get("channel"))
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	writeJSON(w, changes)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
+	}
+}
@@ -0,0 +1,337 @@
+package decision
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/jackc/pgx/v5"
+	ConfigBuilder "github.com/keloran/go-config"
+	"strings"
+)
+
+const (
+	KindPolicy = "policy"
+	KindFlow   = "flow"
+
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+// Recorder keeps the decisions made by the engine and flows
+type Recorder interface {
+	Record(ctx context.Context, dd ...structs.Decision) error
+}
+
+// NewRecorder returns the recorder of the service, the decision log in the database, systems
+// that record somewhere else are given theirs with SetRecorder
+func NewRecorder(cfg *ConfigBuilder.Config) Recorder {
+	return NewSystem(cfg)
+}
+
+// Keep records the decisions, failing to record is logged but doesn't fail the evaluation the
+// caller is waiting on
+func Keep(ctx context.Context, r Recorder, dd ...structs.Decision) {
+	if r == nil || len(dd) == 0 {
+		return
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := r.Record(context.WithoutCancel(ctx), dd...); err != nil {
+		_ = logs.Errorf("failed to record decisions: %v", err)
+	}
+}
+
+type System struct {
+	Config  *ConfigBuilder.Config
+	Context context.Context
+}
+
+func NewSystem(cfg *ConfigBuilder.Config) *System {
+	return &System{
+		Config:  cfg,
+		Context: context.Background(),
+	}
+}
+
+func (s *System) SetContext(ctx context.Context) *System {
+	s.Context = ctx
+	return s
+}
+
+// Record writes the decisions to the decision log in a single round trip
+func (s *System) Record(ctx context.Context, dd ...structs.Decision) error {
+	if len(dd) == 0 {
+		return nil
+	}
+
+	client, err := s.Config.Database.GetPGXPoolClient(ctx)
+	if err != nil {
+		return logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	b := &pgx.Batch{}
+	for _, d := range dd {
+		args, err := recordArgs(d)
+		if err != nil {
+			return logs.Errorf("failed to encode decision: %v", err)
+		}
+		b.Queue(`
+			INSERT INTO decisions (
+			    kind,
+			    policy_id,
+			    base_policy_id,
+			    policy_version,
+			    flow_id,
+			    base_flow_id,
+			    flow_version,
+			    request_id,
+			    input,
+			    result,
+			    trace,
+			    labels,
+			    error,
+			    latency_ms,
+			    decided_at
+			) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)`, args...)
+	}
+
+	if err := client.SendBatch(ctx, b).Close(); err != nil {
+		return logs.Errorf("failed to record decisions: %v", err)
+	}
+
+	return nil
+}
+
+func recordArgs(d structs.Decision) ([]interface{}, error) {
+	args := []interface{}{
+		d.Kind,
+		nullString(d.PolicyID),
+		nullString(d.BasePolicyID),
+		nullString(d.PolicyVersion),
+		nullString(d.FlowID),
+		nullString(d.BaseFlowID),
+		nullString(d.FlowVersion),
+		nullString(d.RequestID),
+	}
+	for _, v := range []interface{}{d.Input, d.Result, d.Trace, d.Labels, d.Error} {
+		b, err := jsonb(v)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, b)
+	}
+	return append(args, d.LatencyMs, d.DecidedAt), nil
+}
+
+// Query returns the newest decisions matching q, at most 100 unless q says otherwise
+func (s *System) Query(q structs.DecisionQuery) ([]structs.Decision, error) {
+	dd := make([]structs.Decision, 0)
+
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if q.PolicyID != "" {
+		p := arg(q.PolicyID)
+		where = append(where, fmt.Sprintf("(policy_id = %s OR base_policy_id = %s)", p, p))
+	}
+	if q.FlowID != "" {
+		p := arg(q.FlowID)
+		where = append(where, fmt.Sprintf("(flow_id = %s OR base_flow_id = %s)", p, p))
+	}
+	if q.RequestID != "" {
+		where = append(where, "request_id = "+arg(q.RequestID))
+	}
+	if !q.From.IsZero() {
+		where = append(where, "decided_at >= "+arg(q.From))
+	}
+	if !q.To.IsZero() {
+		where = append(where, "decided_at < "+arg(q.To))
+	}
+	if q.Result != "" {
+		where = append(where, "result = "+arg(resultJSON(q.Result))+"::jsonb")
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+
+	query := decisionSelect
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY decided_at DESC LIMIT " + arg(limit)
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return dd, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	rows, err := client.Query(s.Context, query, args...)
+	if err != nil {
+		return dd, logs.Errorf("failed to load decisions: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		d, err := scanDecision(rows)
+		if err != nil {
+			return dd, logs.Errorf("failed to load decisions: %v", err)
+		}
+		dd = append(dd, d)
+	}
+	if err := rows.Err(); err != nil {
+		return dd, logs.Errorf("failed to load decisions: %v", err)
+	}
+
+	return dd, nil
+}
+
+// LoadDecision loads a single decision
+func (s *System) LoadDecision(decisionId string) (structs.Decision, error) {
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return structs.Decision{}, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	d, err := scanDecision(client.QueryRow(s.Context, decisionSelect+` WHERE decision_id::text = $1`, decisionId))
+	if stderrors.Is(err, pgx.ErrNoRows) {
+		return structs.Decision{}, errors.ErrDecisionNotFound
+	}
+	if err != nil {
+		return structs.Decision{}, logs.Errorf("failed to load decision: %w", err)
+	}
+
+	return d, nil
+}
+
+const decisionSelect = `
+	SELECT
+	    decision_id,
+	    kind,
+	    policy_id,
+	    base_policy_id,
+	    policy_version,
+	    flow_id,
+	    base_flow_id,
+	    flow_version,
+	    request_id,
+	    input,
+	    result,
+	    trace,
+	    labels,
+	    error,
+	    latency_ms,
+	    decided_at
+	FROM decisions`
+
+func scanDecision(row pgx.Row) (structs.Decision, error) {
+	type dataStruct struct {
+		ID            sql.NullString
+		Kind          sql.NullString
+		PolicyID      sql.NullString
+		BasePolicyID  sql.NullString
+		PolicyVersion sql.NullString
+		FlowID        sql.NullString
+		BaseFlowID    sql.NullString
+		FlowVersion   sql.NullString
+		RequestID     sql.NullString
+		Input         []byte
+		Result        []byte
+		Trace         []byte
+		Labels        []byte
+		Error         []byte
+		LatencyMs     sql.NullFloat64
+		DecidedAt     sql.NullTime
+	}
+	d := dataStruct{}
+
+	if err := row.Scan(
+		&d.ID,
+		&d.Kind,
+		&d.PolicyID,
+		&d.BasePolicyID,
+		&d.PolicyVersion,
+		&d.FlowID,
+		&d.BaseFlowID,
+		&d.FlowVersion,
+		&d.RequestID,
+		&d.Input,
+		&d.Result,
+		&d.Trace,
+		&d.Labels,
+		&d.Error,
+		&d.LatencyMs,
+		&d.DecidedAt,
+	); err != nil {
+		return structs.Decision{}, err
+	}
+
+	dec := structs.Decision{
+		ID:            d.ID.String,
+		Kind:          d.Kind.String,
+		PolicyID:      d.PolicyID.String,
+		BasePolicyID:  d.BasePolicyID.String,
+		PolicyVersion: d.PolicyVersion.String,
+		FlowID:        d.FlowID.String,
+		BaseFlowID:    d.BaseFlowID.String,
+		FlowVersion:   d.FlowVersion.String,
+		RequestID:     d.RequestID.String,
+		LatencyMs:     d.LatencyMs.Float64,
+		DecidedAt:     d.DecidedAt.Time,
+	}
+	for _, f := range []struct {
+		raw []byte
+		v   *interface{}
+	}{
+		{d.Input, &dec.Input},
+		{d.Result, &dec.Result},
+		{d.Trace, &dec.Trace},
+		{d.Labels, &dec.Labels},
+		{d.Error, &dec.Error},
+	} {
+		if len(f.raw) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(f.raw, f.v); err != nil {
+			return structs.Decision{}, err
+		}
+	}
+
+	return dec, nil
+}
+
+// jsonb encodes v for a JSONB column, nil stays NULL
+func jsonb(v interface{}) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+// resultJSON turns the result filter into JSON, anything that isn't already JSON is a string
+// result so ?result=approved matches flows that returned "approved"
+func resultJSON(result string) string {
+	if json.Valid([]byte(result)) {
+		return result
+	}
+	b, _ := json.Marshal(result)
+	return string(b)
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
@@ -0,0 +1,112 @@
+package decision
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/1rp-pw/orchestrator/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSystem_RecordAndQuery(t *testing.T) {
+	cfg := testutil.Postgres(t, "decision.sql")
+
+	s := NewSystem(cfg)
+	s.SetContext(context.Background())
+
+	tuesday := time.Date(2025, 1, 7, 10, 0, 0, 0, time.UTC)
+	err := s.Record(context.Background(),
+		structs.Decision{
+			Kind:          KindPolicy,
+			PolicyID:      "policy-1",
+			BasePolicyID:  "base-1",
+			PolicyVersion: "v1.0",
+			RequestID:     "request-1",
+			Input:         map[string]interface{}{"customer": "c-1"},
+			Result:        false,
+			Trace:         map[string]interface{}{"rule": "too young"},
+			Labels:        []string{"minor"},
+			LatencyMs:     12.5,
+			DecidedAt:     tuesday,
+		},
+		structs.Decision{
+			Kind:          KindPolicy,
+			PolicyID:      "policy-1",
+			BasePolicyID:  "base-1",
+			PolicyVersion: "v1.0",
+			Result:        true,
+			DecidedAt:     tuesday.Add(time.Hour),
+		},
+		structs.Decision{
+			Kind:       KindFlow,
+			FlowID:     "flow-1",
+			BaseFlowID: "base-flow-1",
+			Result:     "approved",
+			DecidedAt:  tuesday.Add(48 * time.Hour),
+		},
+	)
+	require.NoError(t, err)
+
+	rejected, err := s.Query(structs.DecisionQuery{
+		PolicyID: "base-1",
+		From:     time.Date(2025, 1, 7, 0, 0, 0, 0, time.UTC),
+		To:       time.Date(2025, 1, 8, 0, 0, 0, 0, time.UTC),
+		Result:   "false",
+	})
+	require.NoError(t, err)
+	require.Len(t, rejected, 1)
+	assert.Equal(t, "request-1", rejected[0].RequestID)
+	assert.Equal(t, map[string]interface{}{"customer": "c-1"}, rejected[0].Input)
+	assert.Equal(t, map[string]interface{}{"rule": "too young"}, rejected[0].Trace)
+	assert.Equal(t, 12.5, rejected[0].LatencyMs)
+
+	all, err := s.Query(structs.DecisionQuery{})
+	require.NoError(t, err)
+	require.Len(t, all, 3)
+	assert.Equal(t, KindFlow, all[0].Kind, "newest first")
+
+	approved, err := s.Query(structs.DecisionQuery{Result: "approved"})
+	require.NoError(t, err)
+	require.Len(t, approved, 1)
+	assert.Equal(t, "flow-1", approved[0].FlowID)
+
+	loaded, err := s.LoadDecision(rejected[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, rejected[0].ID, loaded.ID)
+
+	_, err = s.LoadDecision("00000000-0000-0000-0000-000000000000")
+	assert.ErrorIs(t, err, errors.ErrDecisionNotFound)
+}
+
+func TestParseQuery(t *testing.T) {
+	q, err := parseQuery(url.Values{
+		"policyId": {"base-1"},
+		"from":     {"2025-01-07"},
+		"to":       {"2025-01-08T00:00:00Z"},
+		"result":   {"false"},
+		"limit":    {"10"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "base-1", q.PolicyID)
+	assert.Equal(t, time.Date(2025, 1, 7, 0, 0, 0, 0, time.UTC), q.From)
+	assert.Equal(t, time.Date(2025, 1, 8, 0, 0, 0, 0, time.UTC), q.To)
+	assert.Equal(t, "false", q.Result)
+	assert.Equal(t, 10, q.Limit)
+
+	for _, v := range []url.Values{
+		{"from": {"last tuesday"}},
+		{"from": {"2025-01-08"}, "to": {"2025-01-07"}},
+		{"limit": {"-1"}},
+	} {
+		_, err := parseQuery(v)
+		assert.True(t, errors.IsValidationError(err), v.Encode())
+	}
+
+	assert.Equal(t, `"approved"`, resultJSON("approved"))
+	assert.Equal(t, `false`, resultJSON("false"))
+}
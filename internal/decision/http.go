@@ -0,0 +1,89 @@
+package decision
+
+import (
+	"encoding/json"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ListDecisions answers GET /decisions?policyId=&flowId=&requestId=&from=&to=&result=&limit=, newest first.
+// from is inclusive and to is exclusive so from=2025-01-07&to=2025-01-08 is the whole of the 7th
+func (s *System) ListDecisions(w http.ResponseWriter, r *http.Request) {
+	s.SetContext(r.Context())
+
+	q, err := parseQuery(r.URL.Query())
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	dd, err := s.Query(q)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(dd); err != nil {
+		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
+	}
+}
+
+func (s *System) GetDecision(w http.ResponseWriter, r *http.Request) {
+	s.SetContext(r.Context())
+
+	d, err := s.LoadDecision(r.PathValue("decisionId"))
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(d); err != nil {
+		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
+	}
+}
+
+func parseQuery(v url.Values) (structs.DecisionQuery, error) {
+	q := structs.DecisionQuery{
+		PolicyID:  v.Get("policyId"),
+		FlowID:    v.Get("flowId"),
+		RequestID: v.Get("requestId"),
+		Result:    v.Get("result"),
+	}
+
+	var err error
+	if q.From, err = parseTime(v.Get("from")); err != nil {
+		return q, errors.NewValidationError("from", "from must be an RFC 3339 timestamp or a date")
+	}
+	if q.To, err = parseTime(v.Get("to")); err != nil {
+		return q, errors.NewValidationError("to", "to must be an RFC 3339 timestamp or a date")
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && q.To.Before(q.From) {
+		return q, errors.NewValidationError("to", "to must not be before from")
+	}
+
+	if l := v.Get("limit"); l != "" {
+		if q.Limit, err = strconv.Atoi(l); err != nil || q.Limit < 1 {
+			return q, errors.NewValidationError("limit", "limit must be a positive number")
+		}
+		q.Limit = min(q.Limit, maxLimit)
+	}
+
+	return q, nil
+}
+
+// parseTime accepts a full timestamp or a date, a date means midnight UTC
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, s)
+}
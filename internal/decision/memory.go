@@ -0,0 +1,35 @@
+package decision
+
+import (
+	"context"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"sync"
+)
+
+// MemoryRecorder keeps decisions in memory, it lets the engine and flows be tested without a
+// database
+type MemoryRecorder struct {
+	mu        sync.Mutex
+	decisions []structs.Decision
+}
+
+func NewMemoryRecorder() *MemoryRecorder {
+	return &MemoryRecorder{}
+}
+
+func (m *MemoryRecorder) Record(_ context.Context, dd ...structs.Decision) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.decisions = append(m.decisions, dd...)
+	return nil
+}
+
+// Decisions returns everything recorded so far, in the order it was recorded
+func (m *MemoryRecorder) Decisions() []structs.Decision {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dd := make([]structs.Decision, len(m.decisions))
+	copy(dd, m.decisions)
+	return dd
+}
@@ -0,0 +1,391 @@
+package diff
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"sort"
+	"strings"
+)
+
+const (
+	Context = "context"
+	Added   = "added"
+	Removed = "removed"
+	Retyped = "retyped"
+	Changed = "changed"
+
+	// ContextLines is how many unchanged lines surround the changes of a hunk
+	ContextLines = 3
+)
+
+// Lines diffs two texts line by line and groups the changes into hunks
+func Lines(from, to string) []structs.DiffHunk {
+	return hunks(edits(splitLines(from), splitLines(to)), ContextLines)
+}
+
+func splitLines(text string) []string {
+	text = strings.TrimSuffix(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+// edits is the shortest edit script from a to b, found through their longest common subsequence
+func edits(a, b []string) []structs.DiffLine {
+	// the common start and end don't need the table
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	ma, mb := a[pre:len(a)-suf], b[pre:len(b)-suf]
+
+	lcs := make([][]int, len(ma)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(mb)+1)
+	}
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			if ma[i] == mb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	out := make([]structs.DiffLine, 0, len(a)+len(b)-pre-suf)
+	for _, l := range a[:pre] {
+		out = append(out, structs.DiffLine{Op: Context, Text: l})
+	}
+	i, j := 0, 0
+	for i < len(ma) || j < len(mb) {
+		switch {
+		case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+			out = append(out, structs.DiffLine{Op: Context, Text: ma[i]})
+			i++
+			j++
+		case j < len(mb) && (i == len(ma) || lcs[i][j+1] > lcs[i+1][j]):
+			out = append(out, structs.DiffLine{Op: Added, Text: mb[j]})
+			j++
+		default:
+			out = append(out, structs.DiffLine{Op: Removed, Text: ma[i]})
+			i++
+		}
+	}
+	for _, l := range a[len(a)-suf:] {
+		out = append(out, structs.DiffLine{Op: Context, Text: l})
+	}
+
+	return out
+}
+
+// hunks groups changes that are within 2*context lines of each other
+func hunks(lines []structs.DiffLine, context int) []structs.DiffHunk {
+	hh := make([]structs.DiffHunk, 0)
+
+	var changes []int
+	for i, l := range lines {
+		if l.Op != Context {
+			changes = append(changes, i)
+		}
+	}
+
+	fromPos, toPos, next := 0, 0, 0
+	for c := 0; c < len(changes); {
+		start := max(changes[c]-context, next)
+		end := changes[c]
+		for c < len(changes) && changes[c]-end <= 2*context {
+			end = changes[c]
+			c++
+		}
+		end = min(end+context+1, len(lines))
+
+		// count the lines between the previous hunk and this one
+		for _, l := range lines[next:start] {
+			if l.Op != Added {
+				fromPos++
+			}
+			if l.Op != Removed {
+				toPos++
+			}
+		}
+
+		h := structs.DiffHunk{Lines: lines[start:end]}
+		for _, l := range h.Lines {
+			if l.Op != Added {
+				h.FromLines++
+			}
+			if l.Op != Removed {
+				h.ToLines++
+			}
+		}
+		h.FromStart, h.ToStart = fromPos, toPos
+		if h.FromLines > 0 {
+			h.FromStart++
+		}
+		if h.ToLines > 0 {
+			h.ToStart++
+		}
+		fromPos += h.FromLines
+		toPos += h.ToLines
+		next = end
+
+		hh = append(hh, h)
+	}
+
+	return hh
+}
+
+// Unified writes hunks as a unified diff of the file named from and to
+func Unified(w *strings.Builder, from, to string, hh []structs.DiffHunk) {
+	if len(hh) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", from, to)
+	for _, h := range hh {
+		fmt.Fprintf(w, "@@ -%d,%d +%d,%d @@\n", h.FromStart, h.FromLines, h.ToStart, h.ToLines)
+		for _, l := range h.Lines {
+			switch l.Op {
+			case Added:
+				w.WriteString("+")
+			case Removed:
+				w.WriteString("-")
+			default:
+				w.WriteString(" ")
+			}
+			w.WriteString(l.Text)
+			w.WriteString("\n")
+		}
+	}
+}
+
+// JSONText is v as indented JSON with sorted keys, so equal values give equal text. Stored
+// values are JSON text and are decoded first
+func JSONText(v interface{}) string {
+	v, err := decode(v)
+	if err != nil || v == nil {
+		return ""
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+func decode(v interface{}) (interface{}, error) {
+	var b []byte
+	switch t := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		b = []byte(strings.TrimSpace(t))
+	case []byte:
+		b = bytes.TrimSpace(t)
+	default:
+		var err error
+		if b, err = json.Marshal(t); err != nil {
+			return nil, err
+		}
+	}
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	var out interface{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DataModel compares the fields of two data models. A data model that is a JSON schema has its
+// fields read from properties and items, anything else is taken as example data and its fields
+// are typed by their values
+func DataModel(from, to interface{}) ([]structs.FieldChange, error) {
+	a, err := decode(from)
+	if err != nil {
+		return nil, fmt.Errorf("from data model is not valid JSON: %w", err)
+	}
+	b, err := decode(to)
+	if err != nil {
+		return nil, fmt.Errorf("to data model is not valid JSON: %w", err)
+	}
+	fa, fb := fields(a), fields(b)
+
+	changes := make([]structs.FieldChange, 0)
+	for path, t := range fa {
+		nt, ok := fb[path]
+		switch {
+		case !ok:
+			changes = append(changes, structs.FieldChange{Path: path, Change: Removed, From: t})
+		case nt != t:
+			changes = append(changes, structs.FieldChange{Path: path, Change: Retyped, From: t, To: nt})
+		}
+	}
+	for path, t := range fb {
+		if _, ok := fa[path]; !ok {
+			changes = append(changes, structs.FieldChange{Path: path, Change: Added, To: t})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+
+	return changes, nil
+}
+
+func fields(v interface{}) map[string]string {
+	out := make(map[string]string)
+	if m, ok := v.(map[string]interface{}); ok && isSchema(m) {
+		schemaFields(m, "", out)
+	} else {
+		valueFields(v, "", out)
+	}
+	return out
+}
+
+func isSchema(m map[string]interface{}) bool {
+	if _, ok := m["properties"].(map[string]interface{}); ok {
+		return true
+	}
+	_, ok := m["type"].(string)
+	return ok && schemaType(m) != ""
+}
+
+func schemaFields(schema map[string]interface{}, path string, out map[string]string) {
+	if path != "" {
+		out[path] = schemaType(schema)
+	}
+	if props, ok := schema["properties"].(map[string]interface{}); ok {
+		for name, sub := range props {
+			m, _ := sub.(map[string]interface{})
+			schemaFields(m, join(path, name), out)
+		}
+	}
+	if items, ok := schema["items"].(map[string]interface{}); ok {
+		schemaFields(items, path+"[]", out)
+	}
+}
+
+var schemaTypes = map[string]bool{
+	"array": true, "boolean": true, "integer": true, "null": true, "number": true, "object": true, "string": true,
+}
+
+// schemaType is the type a schema gives, a list of types is joined with |
+func schemaType(schema map[string]interface{}) string {
+	switch t := schema["type"].(type) {
+	case string:
+		if schemaTypes[t] {
+			return t
+		}
+	case []interface{}:
+		var types []string
+		for _, tt := range t {
+			if s, ok := tt.(string); ok {
+				types = append(types, s)
+			}
+		}
+		sort.Strings(types)
+		return strings.Join(types, "|")
+	}
+	if _, ok := schema["properties"]; ok {
+		return "object"
+	}
+	if _, ok := schema["items"]; ok {
+		return "array"
+	}
+	return ""
+}
+
+func valueFields(v interface{}, path string, out map[string]string) {
+	if path != "" {
+		out[path] = valueType(v)
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for name, sub := range t {
+			valueFields(sub, join(path, name), out)
+		}
+	case []interface{}:
+		if len(t) > 0 {
+			valueFields(t[0], path+"[]", out)
+		}
+	}
+}
+
+func valueType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// Tests compares test cases, they are matched by name and by position when they have none
+func Tests(from, to []structs.PolicyTestCase) []structs.TestCaseChange {
+	key := func(i int, c structs.PolicyTestCase) string {
+		if c.Name != "" {
+			return c.Name
+		}
+		return fmt.Sprintf("#%d", i+1)
+	}
+
+	before := make(map[string]structs.PolicyTestCase, len(from))
+	for i, c := range from {
+		before[key(i, c)] = c
+	}
+
+	changes := make([]structs.TestCaseChange, 0)
+	seen := make(map[string]bool, len(to))
+	for i, c := range to {
+		k := key(i, c)
+		seen[k] = true
+		old, ok := before[k]
+		switch {
+		case !ok:
+			changes = append(changes, structs.TestCaseChange{Name: k, Change: Added, To: &to[i]})
+		case !sameTest(old, c):
+			changes = append(changes, structs.TestCaseChange{Name: k, Change: Changed, From: &old, To: &to[i]})
+		}
+	}
+	for i, c := range from {
+		if k := key(i, c); !seen[k] {
+			changes = append(changes, structs.TestCaseChange{Name: k, Change: Removed, From: &from[i]})
+		}
+	}
+
+	return changes
+}
+
+func sameTest(a, b structs.PolicyTestCase) bool {
+	if (a.Expected == nil) != (b.Expected == nil) || (a.Expected != nil && *a.Expected != *b.Expected) {
+		return false
+	}
+	// test data is already decoded, marshalling sorts the keys
+	da, errA := json.Marshal(a.Data)
+	db, errB := json.Marshal(b.Data)
+	return errA == nil && errB == nil && bytes.Equal(da, db)
+}
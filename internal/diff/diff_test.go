@@ -0,0 +1,122 @@
+package diff
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLines(t *testing.T) {
+	from := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\n"
+	to := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\n"
+
+	hh := Lines(from, to)
+	require.Len(t, hh, 2)
+
+	assert.Equal(t, 1, hh[0].FromStart)
+	assert.Equal(t, 5, hh[0].FromLines)
+	assert.Equal(t, 1, hh[0].ToStart)
+	assert.Equal(t, 5, hh[0].ToLines)
+	assert.Equal(t, structs.DiffLine{Op: Removed, Text: "b"}, hh[0].Lines[1])
+	assert.Equal(t, structs.DiffLine{Op: Added, Text: "B"}, hh[0].Lines[2])
+
+	assert.Equal(t, 10, hh[1].FromStart)
+	assert.Equal(t, 3, hh[1].FromLines)
+	assert.Equal(t, 10, hh[1].ToStart)
+	assert.Equal(t, 4, hh[1].ToLines)
+
+	assert.Empty(t, Lines(from, from))
+}
+
+func TestLines_Empty(t *testing.T) {
+	hh := Lines("", "a\nb")
+	require.Len(t, hh, 1)
+	assert.Equal(t, 0, hh[0].FromStart)
+	assert.Equal(t, 0, hh[0].FromLines)
+	assert.Equal(t, 1, hh[0].ToStart)
+	assert.Equal(t, 2, hh[0].ToLines)
+}
+
+func TestUnified(t *testing.T) {
+	var w strings.Builder
+	Unified(&w, "p@v1.0/rule", "p@draft/rule", Lines("a\nb\nc", "a\nc\nd"))
+
+	assert.Equal(t, `--- p@v1.0/rule
++++ p@draft/rule
+@@ -1,3 +1,3 @@
+ a
+-b
+ c
++d
+`, w.String())
+}
+
+func TestDataModel(t *testing.T) {
+	from := `{"type": "object", "properties": {"age": {"type": "integer"}, "name": {"type": "string"}, "tags": {"type": "array", "items": {"type": "string"}}}}`
+	to := map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"age":     map[string]interface{}{"type": "number"},
+			"tags":    map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+			"address": map[string]interface{}{"type": "object", "properties": map[string]interface{}{"city": map[string]interface{}{"type": "string"}}},
+		},
+	}
+
+	changes, err := DataModel(from, to)
+	require.NoError(t, err)
+	assert.Equal(t, []structs.FieldChange{
+		{Path: "address", Change: Added, To: "object"},
+		{Path: "address.city", Change: Added, To: "string"},
+		{Path: "age", Change: Retyped, From: "integer", To: "number"},
+		{Path: "name", Change: Removed, From: "string"},
+	}, changes)
+}
+
+func TestDataModel_Example(t *testing.T) {
+	changes, err := DataModel(`{"person": {"age": 18, "name": "a"}}`, `{"person": {"age": "18"}, "items": [{"id": 1}]}`)
+	require.NoError(t, err)
+	assert.Equal(t, []structs.FieldChange{
+		{Path: "items", Change: Added, To: "array"},
+		{Path: "items[]", Change: Added, To: "object"},
+		{Path: "items[].id", Change: Added, To: "number"},
+		{Path: "person.age", Change: Retyped, From: "number", To: "string"},
+		{Path: "person.name", Change: Removed, From: "string"},
+	}, changes)
+
+	_, err = DataModel(`{not json`, nil)
+	assert.Error(t, err)
+}
+
+func TestTests(t *testing.T) {
+	yes, no := true, false
+	from := []structs.PolicyTestCase{
+		{Name: "adult", Data: map[string]interface{}{"age": 18}, Expected: &yes},
+		{Name: "child", Data: map[string]interface{}{"age": 12}, Expected: &no},
+		{Data: map[string]interface{}{"age": 30}, Expected: &yes},
+	}
+	to := []structs.PolicyTestCase{
+		{Name: "adult", Data: map[string]interface{}{"age": 18}, Expected: &yes},
+		{Name: "child", Data: map[string]interface{}{"age": 12}, Expected: &yes},
+		{Name: "senior", Data: map[string]interface{}{"age": 80}, Expected: &yes},
+	}
+
+	changes := Tests(from, to)
+	require.Len(t, changes, 3)
+	assert.Equal(t, "child", changes[0].Name)
+	assert.Equal(t, Changed, changes[0].Change)
+	assert.Equal(t, "senior", changes[1].Name)
+	assert.Equal(t, Added, changes[1].Change)
+	assert.Nil(t, changes[1].From)
+	assert.Equal(t, "#3", changes[2].Name)
+	assert.Equal(t, Removed, changes[2].Change)
+	assert.Nil(t, changes[2].To)
+}
+
+func TestJSONText(t *testing.T) {
+	assert.Equal(t, JSONText(`{"b": 1, "a": 2}`), JSONText(map[string]interface{}{"a": 2, "b": 1}))
+	assert.Equal(t, "", JSONText(""))
+	assert.Equal(t, "", JSONText(nil))
+}
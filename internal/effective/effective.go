@@ -0,0 +1,72 @@
+package effective
+
+import (
+	"context"
+	"fmt"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Order puts the version that came into force last first, a version without an effectiveFrom
+// came into force when it was published
+const Order = `COALESCE(effective_from, created_at) DESC, created_at DESC`
+
+type asOfKey struct{}
+
+// WithAsOf evaluates at t instead of now
+func WithAsOf(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, asOfKey{}, t)
+}
+
+// AsOf is the time ctx evaluates at, the zero time when it evaluates now
+func AsOf(ctx context.Context) time.Time {
+	if ctx != nil {
+		if t, ok := ctx.Value(asOfKey{}).(time.Time); ok {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Param is the time ctx evaluates at as the query parameter of Condition, NULL for now so the
+// clock of the database decides
+func Param(ctx context.Context) interface{} {
+	if t := AsOf(ctx); !t.IsZero() {
+		return t
+	}
+	return nil
+}
+
+// Condition is the SQL condition for a version being in force at the time in the parameter
+// param, one that was published by then and whose effectiveFrom and effectiveUntil hold it
+func Condition(param string) string {
+	at := fmt.Sprintf("COALESCE(%s::timestamptz, CURRENT_TIMESTAMP)", param)
+	return fmt.Sprintf(`created_at <= %[1]s AND (effective_from IS NULL OR effective_from <= %[1]s) AND (effective_until IS NULL OR effective_until > %[1]s)`, at)
+}
+
+// FromRequest is the context of r evaluating at its asOf query parameter, an RFC 3339 timestamp
+// or a date meaning midnight UTC
+func FromRequest(r *http.Request) (context.Context, error) {
+	asOf := strings.TrimSpace(r.URL.Query().Get("asOf"))
+	if asOf == "" {
+		return r.Context(), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, asOf)
+	if err != nil {
+		if t, err = time.Parse(time.DateOnly, asOf); err != nil {
+			return r.Context(), errors.NewValidationError("asOf", "asOf must be an RFC 3339 timestamp or a date")
+		}
+	}
+	return WithAsOf(r.Context(), t), nil
+}
+
+// Validate checks a version stops being in force after it starts
+func Validate(from, until *time.Time) error {
+	if from != nil && until != nil && !until.After(*from) {
+		return errors.NewValidationError("effectiveUntil", "effectiveUntil must be after effectiveFrom")
+	}
+	return nil
+}
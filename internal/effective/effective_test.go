@@ -0,0 +1,60 @@
+package effective
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromRequest(t *testing.T) {
+	ctx, err := FromRequest(httptest.NewRequest("GET", "/run/abc", nil))
+	require.NoError(t, err)
+	assert.True(t, AsOf(ctx).IsZero())
+	assert.Nil(t, Param(ctx))
+
+	ctx, err = FromRequest(httptest.NewRequest("GET", "/run/abc?asOf=2026-03-01", nil))
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), AsOf(ctx))
+	assert.Equal(t, AsOf(ctx), Param(ctx))
+
+	ctx, err = FromRequest(httptest.NewRequest("GET", "/run/abc?asOf=2026-03-01T12:30:00Z", nil))
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC), AsOf(ctx))
+
+	_, err = FromRequest(httptest.NewRequest("GET", "/run/abc?asOf=yesterday", nil))
+	var validationErr *errors.ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "asOf", validationErr.Field)
+}
+
+func TestAsOf(t *testing.T) {
+	assert.True(t, AsOf(nil).IsZero())
+	assert.True(t, AsOf(context.Background()).IsZero())
+
+	at := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, at, AsOf(WithAsOf(context.Background(), at)))
+}
+
+func TestCondition(t *testing.T) {
+	c := Condition("$2")
+	assert.Contains(t, c, "created_at <= COALESCE($2::timestamptz, CURRENT_TIMESTAMP)")
+	assert.Contains(t, c, "effective_from <= COALESCE($2::timestamptz, CURRENT_TIMESTAMP)")
+	assert.Contains(t, c, "effective_until > COALESCE($2::timestamptz, CURRENT_TIMESTAMP)")
+}
+
+func TestValidate(t *testing.T) {
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	until := from.Add(24 * time.Hour)
+
+	assert.NoError(t, Validate(nil, nil))
+	assert.NoError(t, Validate(&from, nil))
+	assert.NoError(t, Validate(nil, &until))
+	assert.NoError(t, Validate(&from, &until))
+	assert.Error(t, Validate(&until, &from))
+	assert.Error(t, Validate(&from, &from))
+}
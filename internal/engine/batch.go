@@ -0,0 +1,152 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/policy"
+	policymodel "github.com/1rp-pw/orchestrator/internal/structs"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BatchInput is a single record of a batch, Err is set when the record couldn't be decoded
+type BatchInput struct {
+	Data interface{}
+	Err  error
+}
+
+// RunBatch evaluates the policy against every input with at most concurrency evaluations in
+// flight, results are in input order and a failed input doesn't fail the others. Every
+// evaluation is kept in the decision log once the batch is done
+func (s *System) RunBatch(p policymodel.Policy, inputs []BatchInput, concurrency int) policymodel.BatchResponse {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	br := policymodel.BatchResponse{
+		Total:   len(inputs),
+		Results: make([]policymodel.BatchItemResult, len(inputs)),
+	}
+
+	decisions := make([]*policymodel.Decision, len(inputs))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, in := range inputs {
+		br.Results[i].Index = i
+		if in.Err != nil {
+			br.Results[i].Error = batchError(in.Err)
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, data interface{}) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if err := policy.ValidateData(p, data); err != nil {
+				br.Results[i].Error = batchError(err)
+				return
+			}
+
+			ip := p
+			ip.Data = data
+			start := time.Now()
+			pr, err := s.runPolicy(ip)
+			d := s.policyDecision(ip, pr, err, start)
+			decisions[i] = &d
+			if err != nil {
+				br.Results[i].Error = batchError(err)
+				return
+			}
+			br.Results[i].Result = pr
+		}(i, in.Data)
+	}
+	wg.Wait()
+
+	var dd []policymodel.Decision
+	for _, d := range decisions {
+		if d != nil {
+			dd = append(dd, *d)
+		}
+	}
+	s.recordDecisions(dd...)
+
+	for _, r := range br.Results {
+		if r.Error != nil {
+			br.Failed++
+			continue
+		}
+		br.Succeeded++
+	}
+
+	return br
+}
+
+func batchError(err error) errors.HTTPError {
+	_, httpErr := errors.ToHTTPError(err)
+	return httpErr
+}
+
+// decodeBatch reads a JSON array of data objects, or one data object per line when the request
+// is sent as NDJSON
+func decodeBatch(r *http.Request, maxItems int) ([]BatchInput, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-ndjson" || mediaType == "application/ndjson" {
+		return decodeNDJSON(r.Body, maxItems)
+	}
+
+	var items []json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		return nil, errors.NewValidationError("body", "expected a JSON array of data objects")
+	}
+	if maxItems > 0 && len(items) > maxItems {
+		return nil, errors.NewValidationError("body", fmt.Sprintf("batch is limited to %d items", maxItems))
+	}
+
+	inputs := make([]BatchInput, len(items))
+	for i, item := range items {
+		if err := json.Unmarshal(item, &inputs[i].Data); err != nil {
+			inputs[i].Err = errors.NewValidationError(fmt.Sprintf("[%d]", i), "invalid JSON format")
+		}
+	}
+
+	return inputs, nil
+}
+
+func decodeNDJSON(body io.Reader, maxItems int) ([]BatchInput, error) {
+	var inputs []BatchInput
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if maxItems > 0 && len(inputs) >= maxItems {
+			return nil, errors.NewValidationError("body", fmt.Sprintf("batch is limited to %d items", maxItems))
+		}
+
+		var in BatchInput
+		if err := json.Unmarshal([]byte(text), &in.Data); err != nil {
+			in.Err = errors.NewValidationError(fmt.Sprintf("line %d", line), "invalid JSON format")
+		}
+		inputs = append(inputs, in)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.NewValidationError("body", fmt.Sprintf("failed to read NDJSON body: %v", err))
+	}
+
+	return inputs, nil
+}
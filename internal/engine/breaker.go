@@ -0,0 +1,241 @@
+package engine
+
+import (
+	"context"
+	stderrors "errors"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	policymodel "github.com/1rp-pw/orchestrator/internal/structs"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling the engine while its breaker is open
+var ErrCircuitOpen = stderrors.New("circuit breaker is open")
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// BreakerSettings controls when a breaker opens and how long it stays open
+type BreakerSettings struct {
+	FailureThreshold int
+	Cooldown         time.Duration
+}
+
+// BreakerStatus is the visible state of a breaker
+type BreakerStatus struct {
+	Address     string       `json:"address"`
+	State       BreakerState `json:"state"`
+	Failures    int          `json:"failures"`
+	LastError   string       `json:"lastError,omitempty"`
+	OpenedAt    *time.Time   `json:"openedAt,omitempty"`
+	LastChanged time.Time    `json:"lastChanged"`
+}
+
+// Breaker fails fast once an engine address has failed FailureThreshold times in a row, after
+// Cooldown a single trial call is let through to decide whether to close again
+type Breaker struct {
+	mu sync.Mutex
+
+	address     string
+	settings    BreakerSettings
+	state       BreakerState
+	failures    int
+	trial       bool
+	lastError   string
+	openedAt    time.Time
+	lastChanged time.Time
+
+	now func() time.Time
+}
+
+func NewBreaker(address string, settings BreakerSettings) *Breaker {
+	return &Breaker{
+		address:     address,
+		settings:    settings,
+		state:       BreakerClosed,
+		lastChanged: time.Now(),
+		now:         time.Now,
+	}
+}
+
+var breakers = struct {
+	sync.Mutex
+	m map[string]*Breaker
+}{
+	m: make(map[string]*Breaker),
+}
+
+// BreakerFor returns the breaker shared by every evaluator calling address
+func BreakerFor(address string, settings BreakerSettings) *Breaker {
+	breakers.Lock()
+	defer breakers.Unlock()
+
+	b, ok := breakers.m[address]
+	if !ok {
+		b = NewBreaker(address, settings)
+		breakers.m[address] = b
+	}
+	return b
+}
+
+// BreakerStatuses returns the state of every known engine address
+func BreakerStatuses() []BreakerStatus {
+	breakers.Lock()
+	defer breakers.Unlock()
+
+	statuses := make([]BreakerStatus, 0, len(breakers.m))
+	for _, b := range breakers.m {
+		statuses = append(statuses, b.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Address < statuses[j].Address
+	})
+	return statuses
+}
+
+// Allow reports whether a call may go to the engine
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.settings.Cooldown {
+			return errors.WrapEngineError(ErrCircuitOpen, errors.EngineTransport, b.address)
+		}
+		b.setState(BreakerHalfOpen)
+		b.trial = true
+		return nil
+	case BreakerHalfOpen:
+		if b.trial {
+			return errors.WrapEngineError(ErrCircuitOpen, errors.EngineTransport, b.address)
+		}
+		b.trial = true
+	}
+
+	return nil
+}
+
+// Available reports whether Allow would let a call through, without claiming the trial call
+func (b *Breaker) Available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		return b.now().Sub(b.openedAt) >= b.settings.Cooldown
+	case BreakerHalfOpen:
+		return !b.trial
+	}
+	return true
+}
+
+// Success closes the breaker
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.trial = false
+	if b.state != BreakerClosed {
+		b.setState(BreakerClosed)
+	}
+}
+
+// Failure counts a failed call, opening the breaker once the threshold is reached
+func (b *Breaker) Failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.trial = false
+	b.lastError = err.Error()
+	if b.state == BreakerHalfOpen || b.failures >= b.settings.FailureThreshold {
+		b.openedAt = b.now()
+		b.setState(BreakerOpen)
+	}
+}
+
+// Release gives up a trial call that ended without telling us anything about the engine
+func (b *Breaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+func (b *Breaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := BreakerStatus{
+		Address:     b.address,
+		State:       b.state,
+		Failures:    b.failures,
+		LastError:   b.lastError,
+		LastChanged: b.lastChanged,
+	}
+	if b.state != BreakerClosed {
+		openedAt := b.openedAt
+		s.OpenedAt = &openedAt
+	}
+	return s
+}
+
+func (b *Breaker) setState(state BreakerState) {
+	b.state = state
+	b.lastChanged = b.now()
+}
+
+// BreakerEvaluator guards an evaluator with a breaker
+type BreakerEvaluator struct {
+	Next    Evaluator
+	Breaker *Breaker
+}
+
+func NewBreakerEvaluator(next Evaluator, breaker *Breaker) *BreakerEvaluator {
+	return &BreakerEvaluator{
+		Next:    next,
+		Breaker: breaker,
+	}
+}
+
+func (b *BreakerEvaluator) Evaluate(ctx context.Context, policy policymodel.Policy) (*policymodel.EngineResponse, error) {
+	if err := b.Breaker.Allow(); err != nil {
+		return nil, err
+	}
+
+	pr, err := b.Next.Evaluate(ctx, policy)
+	switch {
+	case err == nil:
+		b.Breaker.Success()
+	case ctx.Err() != nil:
+		// the caller went away, that says nothing about the engine
+		b.Breaker.Release()
+	case engineFailure(err):
+		b.Breaker.Failure(err)
+	default:
+		b.Breaker.Success()
+	}
+
+	return pr, err
+}
+
+// engineFailure reports whether the error means the engine itself is unhealthy, as opposed to
+// rejecting what it was sent
+func engineFailure(err error) bool {
+	var engineErr *errors.EngineError
+	if !stderrors.As(err, &engineErr) {
+		return false
+	}
+	if engineErr.Kind == errors.EngineStatus {
+		return engineErr.StatusCode >= http.StatusInternalServerError
+	}
+	return true
+}
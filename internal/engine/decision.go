@@ -0,0 +1,45 @@
+package engine
+
+import (
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	policymodel "github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/bugfixes/go-bugfixes/middleware"
+	"time"
+)
+
+// runAndRecord evaluates the policy and keeps the decision in the decision log
+func (s *System) runAndRecord(p policymodel.Policy) (*policymodel.EngineResponse, error) {
+	start := time.Now()
+	pr, err := s.runPolicy(p)
+	s.recordDecisions(s.policyDecision(p, pr, err, start))
+
+	return pr, err
+}
+
+// policyDecision describes a single evaluation of p for the decision log
+func (s *System) policyDecision(p policymodel.Policy, pr *policymodel.EngineResponse, err error, start time.Time) policymodel.Decision {
+	d := policymodel.Decision{
+		Kind:          decision.KindPolicy,
+		PolicyID:      p.PolicyID,
+		BasePolicyID:  p.BaseID,
+		PolicyVersion: p.Version,
+		RequestID:     middleware.GetReqID(s.Context),
+		Input:         p.Data,
+		LatencyMs:     float64(time.Since(start)) / float64(time.Millisecond),
+		DecidedAt:     start,
+	}
+	if err != nil {
+		_, d.Error = errors.ToHTTPError(err)
+		return d
+	}
+	d.Result = pr.Result
+	d.Trace = pr.Trace
+	d.Labels = pr.Labels
+
+	return d
+}
+
+func (s *System) recordDecisions(dd ...policymodel.Decision) {
+	decision.Keep(s.Context, s.Recorder, dd...)
+}
@@ -1,25 +1,26 @@
 package engine
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"fmt"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/errors"
 	policymodel "github.com/1rp-pw/orchestrator/internal/structs"
-	"github.com/bugfixes/go-bugfixes/logs"
 	ConfigBuilder "github.com/keloran/go-config"
-	"net/http"
 )
 
 type System struct {
-	Config  *ConfigBuilder.Config
-	Context context.Context
+	Config    *ConfigBuilder.Config
+	Context   context.Context
+	Evaluator Evaluator
+	Recorder  decision.Recorder
 }
 
 func NewSystem(cfg *ConfigBuilder.Config) *System {
 	return &System{
-		Config:  cfg,
-		Context: context.Background(),
+		Config:    cfg,
+		Context:   context.Background(),
+		Evaluator: NewEvaluator(cfg),
+		Recorder:  decision.NewRecorder(cfg),
 	}
 }
 
@@ -28,49 +29,36 @@ func (s *System) SetContext(ctx context.Context) *System {
 	return s
 }
 
+// SetEvaluator swaps the engine the policies are evaluated against
+func (s *System) SetEvaluator(e Evaluator) *System {
+	s.Evaluator = e
+	return s
+}
+
+// SetRecorder swaps where the decisions are recorded
+func (s *System) SetRecorder(r decision.Recorder) *System {
+	s.Recorder = r
+	return s
+}
+
+// StartHealthChecks starts probing the configured engine backends until the system context is done
+func (s *System) StartHealthChecks() {
+	poolFromConfig(s.Config, SettingsFromConfig(s.Config)).StartHealthChecks(s.Context)
+}
+
 // RunPolicy executes a structs against the engine and returns the result
 func (s *System) RunPolicyInternal(policy policymodel.Policy) (*policymodel.EngineResponse, error) {
 	return s.runPolicy(policy)
 }
 
 func (s *System) runPolicy(policy policymodel.Policy) (*policymodel.EngineResponse, error) {
-	data, err := json.Marshal(policy)
+	pr, err := s.Evaluator.Evaluate(s.Context, policy)
 	if err != nil {
 		return nil, err
 	}
-
-	req, err := http.NewRequestWithContext(s.Context, "POST", fmt.Sprintf("%s", s.Config.ProjectProperties["engine_address"]), bytes.NewBuffer(data))
-	if err != nil {
-		_ = logs.Errorf("Error building http request: %s", err)
-		return nil, nil
-	}
-	if req == nil {
-		_ = logs.Error("request is nil")
-		return nil, nil
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", "Policy Orchestrator")
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, nil
-	}
-	if resp == nil {
-		_ = logs.Error("response is nil")
-		return nil, nil
-	}
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			_ = logs.Errorf("error closing body: %v", err)
-		}
-	}()
-
-	//var er interface{}
-	er := policymodel.EngineResponse{}
-
-	if err := json.NewDecoder(resp.Body).Decode(&er); err != nil {
-		_ = logs.Errorf("error decoding response: %v", err)
+	if pr == nil {
+		return nil, errors.NewEngineError(errors.EngineBadResponse, "", "engine returned no response")
 	}
 
-	//return nil, nil
-	return &er, nil
+	return pr, nil
 }
@@ -2,12 +2,22 @@ package engine
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/errors"
 	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/bugfixes/go-bugfixes/middleware"
 	ConfigBuilder "github.com/keloran/go-config"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/wait"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -58,3 +68,501 @@ func TestSystem_RunPolicy(t *testing.T) {
 
 	testcontainers.CleanupContainer(t, c)
 }
+
+func TestHTTPEvaluator_Evaluate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p structs.Policy
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&p))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		_ = json.NewEncoder(w).Encode(structs.EngineResponse{
+			Result: true,
+			Rule:   []string{p.Rule},
+		})
+	}))
+	defer srv.Close()
+
+	e := NewHTTPEvaluator(srv.URL)
+	resp, err := e.Evaluate(context.Background(), structs.Policy{Rule: "a rule"})
+	assert.NoError(t, err)
+	require.NotNil(t, resp)
+	assert.True(t, resp.Result)
+	assert.Equal(t, []string{"a rule"}, resp.Rule)
+}
+
+func TestFakeEvaluator_Evaluate(t *testing.T) {
+	f := NewFakeEvaluator().
+		OnPolicy("policy-1", structs.EngineResponse{Result: true}).
+		OnPolicy("base-2", structs.EngineResponse{Result: false, Labels: "base"}).
+		OnInput(map[string]interface{}{"age": 16}, structs.EngineResponse{Result: false, Labels: "input"})
+
+	s := NewSystem(ConfigBuilder.NewConfigNoVault()).SetEvaluator(f)
+
+	resp, err := s.RunPolicyInternal(structs.Policy{PolicyID: "policy-1", Data: map[string]int{"age": 18}})
+	assert.NoError(t, err)
+	assert.True(t, resp.Result)
+
+	resp, err = s.RunPolicyInternal(structs.Policy{PolicyID: "policy-3", BaseID: "base-2"})
+	assert.NoError(t, err)
+	assert.False(t, resp.Result)
+	assert.Equal(t, "base", resp.Labels)
+
+	resp, err = s.RunPolicyInternal(structs.Policy{PolicyID: "policy-1", Data: map[string]int{"age": 16}})
+	assert.NoError(t, err)
+	assert.False(t, resp.Result)
+	assert.Equal(t, "input", resp.Labels)
+
+	_, err = s.RunPolicyInternal(structs.Policy{PolicyID: "unknown"})
+	assert.Error(t, err)
+
+	f.Default(structs.EngineResponse{Result: true})
+	resp, err = s.RunPolicyInternal(structs.Policy{PolicyID: "unknown"})
+	assert.NoError(t, err)
+	assert.True(t, resp.Result)
+
+	assert.Len(t, f.Calls(), 5)
+}
+
+func TestHTTPEvaluator_EvaluateErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		kind    errors.EngineErrorKind
+		status  int
+		code    string
+	}{
+		{
+			name: "non 2xx status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "rule does not parse", http.StatusUnprocessableEntity)
+			},
+			kind:   errors.EngineStatus,
+			status: http.StatusBadGateway,
+			code:   "ENGINE_BAD_RESPONSE",
+		},
+		{
+			name: "malformed body",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("not json"))
+			},
+			kind:   errors.EngineBadResponse,
+			status: http.StatusBadGateway,
+			code:   "ENGINE_BAD_RESPONSE",
+		},
+		{
+			name: "timeout",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(200 * time.Millisecond)
+			},
+			kind:   errors.EngineTimeout,
+			status: http.StatusGatewayTimeout,
+			code:   "ENGINE_TIMEOUT",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+
+			e := NewHTTPEvaluator(srv.URL)
+			e.Client = &http.Client{Timeout: 50 * time.Millisecond}
+			resp, err := e.Evaluate(context.Background(), structs.Policy{})
+			assert.Nil(t, resp)
+			require.Error(t, err)
+
+			var engineErr *errors.EngineError
+			require.ErrorAs(t, err, &engineErr)
+			assert.Equal(t, tt.kind, engineErr.Kind)
+
+			rec := httptest.NewRecorder()
+			errors.WriteHTTPError(rec, err)
+			assert.Equal(t, tt.status, rec.Code)
+			assert.Contains(t, rec.Body.String(), tt.code)
+		})
+	}
+}
+
+func TestHTTPEvaluator_EvaluateUnavailable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	_, err := NewHTTPEvaluator(srv.URL).Evaluate(context.Background(), structs.Policy{})
+	var engineErr *errors.EngineError
+	require.ErrorAs(t, err, &engineErr)
+	assert.Equal(t, errors.EngineTransport, engineErr.Kind)
+
+	rec := httptest.NewRecorder()
+	errors.WriteHTTPError(rec, err)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), "ENGINE_UNAVAILABLE")
+}
+
+type flakyEvaluator struct {
+	failures int
+	err      error
+	calls    int
+}
+
+func (f *flakyEvaluator) Evaluate(ctx context.Context, policy structs.Policy) (*structs.EngineResponse, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return nil, f.err
+	}
+	return &structs.EngineResponse{Result: true}, nil
+}
+
+func TestRetryEvaluator_Evaluate(t *testing.T) {
+	noSleep := func(ctx context.Context, d time.Duration) error { return nil }
+
+	t.Run("retries unavailable engine", func(t *testing.T) {
+		next := &flakyEvaluator{failures: 2, err: errors.NewEngineError(errors.EngineTransport, "", "refused")}
+		r := NewRetryEvaluator(next, RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond})
+		r.sleep = noSleep
+
+		resp, err := r.Evaluate(context.Background(), structs.Policy{})
+		assert.NoError(t, err)
+		assert.True(t, resp.Result)
+		assert.Equal(t, 3, next.calls)
+	})
+
+	t.Run("gives up after max attempts", func(t *testing.T) {
+		next := &flakyEvaluator{failures: 5, err: errors.NewEngineStatusError("", http.StatusBadGateway, "")}
+		r := NewRetryEvaluator(next, RetryPolicy{MaxAttempts: 3})
+		r.sleep = noSleep
+
+		_, err := r.Evaluate(context.Background(), structs.Policy{})
+		assert.True(t, errors.IsEngineError(err))
+		assert.Equal(t, 3, next.calls)
+	})
+
+	t.Run("does not retry client errors", func(t *testing.T) {
+		next := &flakyEvaluator{failures: 5, err: errors.NewEngineStatusError("", http.StatusBadRequest, "")}
+		r := NewRetryEvaluator(next, RetryPolicy{MaxAttempts: 3})
+		r.sleep = noSleep
+
+		_, err := r.Evaluate(context.Background(), structs.Policy{})
+		assert.Error(t, err)
+		assert.Equal(t, 1, next.calls)
+	})
+
+	t.Run("cancelled while backing off", func(t *testing.T) {
+		next := &flakyEvaluator{failures: 5, err: errors.NewEngineError(errors.EngineTransport, "", "refused")}
+		r := NewRetryEvaluator(next, RetryPolicy{MaxAttempts: 3, BaseDelay: time.Minute})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		r.sleep = func(ctx context.Context, d time.Duration) error {
+			cancel()
+			return sleepContext(ctx, d)
+		}
+
+		_, err := r.Evaluate(ctx, structs.Policy{})
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.False(t, errors.IsEngineError(err))
+		assert.Equal(t, 1, next.calls)
+	})
+
+	t.Run("backoff is capped", func(t *testing.T) {
+		r := NewRetryEvaluator(nil, RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond})
+		for attempt := 1; attempt < 10; attempt++ {
+			assert.LessOrEqual(t, r.backoff(attempt), 300*time.Millisecond)
+		}
+	})
+}
+
+func TestBreakerEvaluator_Evaluate(t *testing.T) {
+	now := time.Now()
+	b := NewBreaker("http://engine", BreakerSettings{FailureThreshold: 2, Cooldown: time.Minute})
+	b.now = func() time.Time { return now }
+
+	next := &flakyEvaluator{failures: 2, err: errors.NewEngineError(errors.EngineTimeout, "", "slow")}
+	e := NewBreakerEvaluator(next, b)
+
+	for i := 0; i < 2; i++ {
+		_, err := e.Evaluate(context.Background(), structs.Policy{})
+		assert.Error(t, err)
+	}
+	assert.Equal(t, BreakerOpen, b.Status().State)
+
+	_, err := e.Evaluate(context.Background(), structs.Policy{})
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, 2, next.calls)
+
+	now = now.Add(2 * time.Minute)
+	resp, err := e.Evaluate(context.Background(), structs.Policy{})
+	assert.NoError(t, err)
+	assert.True(t, resp.Result)
+	assert.Equal(t, BreakerClosed, b.Status().State)
+}
+
+func TestSystem_Status(t *testing.T) {
+	BreakerFor("http://status-engine", BreakerSettings{FailureThreshold: 1}).Failure(fmt.Errorf("down"))
+
+	rec := httptest.NewRecorder()
+	NewSystem(ConfigBuilder.NewConfigNoVault()).Status(rec, httptest.NewRequest(http.MethodGet, "/engine/status", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var body struct {
+		Breakers []BreakerStatus `json:"breakers"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+	found := false
+	for _, b := range body.Breakers {
+		if b.Address == "http://status-engine" {
+			found = true
+			assert.Equal(t, BreakerOpen, b.State)
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestPool_Evaluate(t *testing.T) {
+	var healthy [2]atomic.Bool
+	healthy[0].Store(true)
+	healthy[1].Store(true)
+	var hits [2]atomic.Int32
+	counts := func() []int32 { return []int32{hits[0].Load(), hits[1].Load()} }
+
+	servers := make([]*httptest.Server, 2)
+	addresses := make([]string, 2)
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" {
+				if !healthy[i].Load() {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+				return
+			}
+			hits[i].Add(1)
+			_ = json.NewEncoder(w).Encode(structs.EngineResponse{Result: true})
+		}))
+		defer servers[i].Close()
+		addresses[i] = servers[i].URL
+	}
+
+	settings := Settings{
+		Timeout:  time.Second,
+		Breaker:  BreakerSettings{FailureThreshold: 5, Cooldown: time.Minute},
+		Balancer: BalanceRoundRobin,
+		Health:   HealthSettings{Timeout: time.Second, UnhealthyThreshold: 1, HealthyThreshold: 1},
+	}
+	p := NewPool(addresses, settings)
+
+	for i := 0; i < 4; i++ {
+		_, err := p.Evaluate(context.Background(), structs.Policy{})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []int32{2, 2}, counts())
+
+	healthy[1].Store(false)
+	p.Check(context.Background())
+	for i := 0; i < 4; i++ {
+		_, err := p.Evaluate(context.Background(), structs.Policy{})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []int32{6, 2}, counts())
+
+	healthy[0].Store(false)
+	p.Check(context.Background())
+	_, err := p.Evaluate(context.Background(), structs.Policy{})
+	assert.ErrorIs(t, err, ErrNoHealthyBackends)
+
+	healthy[0].Store(true)
+	healthy[1].Store(true)
+	p.Check(context.Background())
+	_, err = p.Evaluate(context.Background(), structs.Policy{})
+	assert.NoError(t, err)
+
+	statuses := p.Statuses()
+	require.Len(t, statuses, 2)
+	assert.Equal(t, int64(9), statuses[0].Requests+statuses[1].Requests)
+	assert.True(t, statuses[0].Healthy)
+	assert.NotNil(t, statuses[0].LastChecked)
+}
+
+func TestPool_LeastOutstanding(t *testing.T) {
+	p := NewPool([]string{"http://busy", "http://idle"}, Settings{
+		Breaker:  BreakerSettings{FailureThreshold: 5},
+		Balancer: BalanceLeastOutstanding,
+	})
+	p.backends[0].outstanding.Add(3)
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "http://idle", p.pick().address)
+	}
+}
+
+func TestParseAddresses(t *testing.T) {
+	assert.Equal(t, []string{"http://a:3000", "http://b:3000"}, ParseAddresses(" http://a:3000, ,http://b:3000 "))
+	assert.Nil(t, ParseAddresses(""))
+}
+
+func TestSystem_RunBatch(t *testing.T) {
+	f := NewFakeEvaluator().
+		Default(structs.EngineResponse{Result: true}).
+		OnInput(map[string]interface{}{"age": 16}, structs.EngineResponse{Result: false})
+
+	rec := decision.NewMemoryRecorder()
+	s := NewSystem(ConfigBuilder.NewConfigNoVault()).SetEvaluator(f).SetRecorder(rec)
+
+	inputs := []BatchInput{
+		{Data: map[string]interface{}{"age": 18}},
+		{Err: errors.NewValidationError("[1]", "invalid JSON format")},
+		{Data: map[string]interface{}{"age": 16}},
+	}
+	for i := 0; i < 20; i++ {
+		inputs = append(inputs, BatchInput{Data: map[string]interface{}{"age": 20 + i}})
+	}
+
+	br := s.RunBatch(structs.Policy{PolicyID: "policy-1"}, inputs, 4)
+	assert.Equal(t, 23, br.Total)
+	assert.Equal(t, 22, br.Succeeded)
+	assert.Equal(t, 1, br.Failed)
+	require.Len(t, br.Results, 23)
+
+	for i, r := range br.Results {
+		assert.Equal(t, i, r.Index)
+	}
+	assert.True(t, br.Results[0].Result.Result)
+	assert.Nil(t, br.Results[1].Result)
+	assert.Equal(t, "VALIDATION_ERROR", br.Results[1].Error.(errors.HTTPError).Code)
+	assert.False(t, br.Results[2].Result.Result)
+	assert.Equal(t, map[string]interface{}{"age": 21}, br.Results[4].Result.Data)
+	assert.Len(t, f.Calls(), 22)
+	assert.Len(t, rec.Decisions(), 22)
+}
+
+func TestSystem_Run_RecordsDecision(t *testing.T) {
+	f := NewFakeEvaluator().
+		OnPolicy("policy-1", structs.EngineResponse{Result: true, Trace: "trace", Labels: []string{"adult"}}).
+		OnPolicyError("policy-2", errors.NewEngineError(errors.EngineTransport, "", "connection refused"))
+	rec := decision.NewMemoryRecorder()
+	s := NewSystem(ConfigBuilder.NewConfigNoVault()).SetEvaluator(f).SetRecorder(rec)
+	handler := middleware.RequestID(http.HandlerFunc(s.Run))
+
+	r := httptest.NewRequest(http.MethodPost, "/run", strings.NewReader(`{"id":"policy-1","baseId":"base-1","version":"v1.0","data":{"age":18}}`))
+	r.Header.Set(middleware.RequestIDHeader, "request-1")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	r = httptest.NewRequest(http.MethodPost, "/run", strings.NewReader(`{"id":"policy-2","data":{"age":18}}`))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	dd := rec.Decisions()
+	require.Len(t, dd, 2)
+	assert.Equal(t, decision.KindPolicy, dd[0].Kind)
+	assert.Equal(t, "policy-1", dd[0].PolicyID)
+	assert.Equal(t, "base-1", dd[0].BasePolicyID)
+	assert.Equal(t, "v1.0", dd[0].PolicyVersion)
+	assert.Equal(t, "request-1", dd[0].RequestID)
+	assert.Equal(t, map[string]interface{}{"age": float64(18)}, dd[0].Input)
+	assert.Equal(t, true, dd[0].Result)
+	assert.Equal(t, "trace", dd[0].Trace)
+	assert.Equal(t, []string{"adult"}, dd[0].Labels)
+	assert.Nil(t, dd[0].Error)
+	assert.False(t, dd[0].DecidedAt.IsZero())
+
+	assert.Equal(t, "policy-2", dd[1].PolicyID)
+	assert.NotEmpty(t, dd[1].RequestID)
+	assert.Nil(t, dd[1].Result)
+	assert.Equal(t, "ENGINE_UNAVAILABLE", dd[1].Error.(errors.HTTPError).Code)
+}
+
+func TestDecodeBatch(t *testing.T) {
+	t.Run("json array", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/run/p/batch", strings.NewReader(`[{"a":1},{"a":2}]`))
+		inputs, err := decodeBatch(r, 10)
+		require.NoError(t, err)
+		require.Len(t, inputs, 2)
+		assert.Equal(t, map[string]interface{}{"a": float64(2)}, inputs[1].Data)
+	})
+
+	t.Run("ndjson with a bad line", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/run/p/batch", strings.NewReader("{\"a\":1}\n\nnot json\n{\"a\":3}\n"))
+		r.Header.Set("Content-Type", "application/x-ndjson")
+		inputs, err := decodeBatch(r, 10)
+		require.NoError(t, err)
+		require.Len(t, inputs, 3)
+		assert.NoError(t, inputs[0].Err)
+		assert.Error(t, inputs[1].Err)
+		assert.Equal(t, map[string]interface{}{"a": float64(3)}, inputs[2].Data)
+	})
+
+	t.Run("too many items", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/run/p/batch", strings.NewReader(`[1,2,3]`))
+		_, err := decodeBatch(r, 2)
+		assert.True(t, errors.IsValidationError(err))
+	})
+
+	t.Run("not an array", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/run/p/batch", strings.NewReader(`{"a":1}`))
+		_, err := decodeBatch(r, 2)
+		assert.True(t, errors.IsValidationError(err))
+	})
+}
+
+func TestLiftDeadline(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		LiftDeadline(w, time.Second)
+		time.Sleep(100 * time.Millisecond)
+		_, _ = w.Write([]byte("done"))
+	}))
+	srv.Config.WriteTimeout = 20 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "done", string(body), "the request outlived the server's write timeout")
+
+	// a recorder can't take deadlines, that isn't an error
+	LiftDeadline(httptest.NewRecorder(), time.Second)
+}
+
+func TestSystem_RunTests(t *testing.T) {
+	f := NewFakeEvaluator().
+		Default(structs.EngineResponse{Result: true, Trace: "over 18"}).
+		OnInput(map[string]interface{}{"age": float64(16)}, structs.EngineResponse{Result: false, Trace: "under 18"})
+	rec := decision.NewMemoryRecorder()
+	s := NewSystem(ConfigBuilder.NewConfigNoVault()).SetEvaluator(f).SetRecorder(rec)
+
+	p := structs.Policy{
+		PolicyID:  "policy-1",
+		DataModel: `{"type": "object", "properties": {"age": {"type": "number"}}}`,
+		Tests: `[
+			{"name": "adult", "data": {"age": 21}, "expectPass": true},
+			{"name": "child", "data": {"age": 16}, "expectPass": false},
+			{"name": "wrong", "data": {"age": 16}, "expectPass": true},
+			{"name": "invalid", "data": {"age": "x"}, "expectPass": true},
+			{"name": "no expectation", "data": {"age": 21}}
+		]`,
+	}
+
+	report, err := s.RunTests(context.Background(), p)
+	require.NoError(t, err)
+	assert.Equal(t, "policy-1", report.PolicyID)
+	assert.Equal(t, 5, report.Total)
+	assert.Equal(t, 2, report.Passed)
+	assert.Equal(t, 3, report.Failed)
+
+	require.Len(t, report.Results, 5)
+	assert.True(t, report.Results[0].Passed)
+	assert.Equal(t, "over 18", report.Results[0].Trace)
+	assert.True(t, report.Results[1].Passed)
+	assert.False(t, report.Results[2].Passed)
+	assert.False(t, *report.Results[2].Actual)
+	assert.Equal(t, "under 18", report.Results[2].Trace)
+	assert.Nil(t, report.Results[3].Actual)
+	assert.Equal(t, "VALIDATION_ERROR", report.Results[3].Error.(errors.HTTPError).Code)
+	assert.Equal(t, "VALIDATION_ERROR", report.Results[4].Error.(errors.HTTPError).Code)
+
+	assert.Empty(t, rec.Decisions(), "test runs aren't decisions")
+}
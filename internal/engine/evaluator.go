@@ -0,0 +1,162 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	policymodel "github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/bugfixes/go-bugfixes/logs"
+	ConfigBuilder "github.com/keloran/go-config"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxErrorBody is how much of a failed engine response is kept for the error message
+const maxErrorBody = 4096
+
+// Evaluator runs a policy (rule and data) against a policy engine
+type Evaluator interface {
+	Evaluate(ctx context.Context, policy policymodel.Policy) (*policymodel.EngineResponse, error)
+}
+
+// Settings controls how the engine is called
+type Settings struct {
+	Timeout  time.Duration
+	Retry    RetryPolicy
+	Breaker  BreakerSettings
+	Balancer string
+	Health   HealthSettings
+}
+
+// SettingsFromConfig reads the engine settings from the project properties, falling back to
+// defaults for anything that isn't set
+func SettingsFromConfig(cfg *ConfigBuilder.Config) Settings {
+	return Settings{
+		Timeout: durationProperty(cfg, "engine_timeout", 3*time.Second),
+		Retry: RetryPolicy{
+			MaxAttempts: intProperty(cfg, "engine_retry_attempts", 3),
+			BaseDelay:   durationProperty(cfg, "engine_retry_base_delay", 100*time.Millisecond),
+			MaxDelay:    durationProperty(cfg, "engine_retry_max_delay", 2*time.Second),
+		},
+		Breaker: BreakerSettings{
+			FailureThreshold: intProperty(cfg, "engine_breaker_threshold", 5),
+			Cooldown:         durationProperty(cfg, "engine_breaker_cooldown", 30*time.Second),
+		},
+		Balancer: stringProperty(cfg, "engine_balancer", BalanceRoundRobin),
+		Health: HealthSettings{
+			Interval:           durationProperty(cfg, "engine_health_interval", 10*time.Second),
+			Timeout:            durationProperty(cfg, "engine_health_timeout", 2*time.Second),
+			UnhealthyThreshold: intProperty(cfg, "engine_health_unhealthy_threshold", 2),
+			HealthyThreshold:   intProperty(cfg, "engine_health_healthy_threshold", 2),
+		},
+	}
+}
+
+// BatchSettings limits the size, parallelism and duration of batch evaluations, a batch has
+// Timeout to be read and evaluated instead of the server's own timeouts
+type BatchSettings struct {
+	MaxItems    int
+	Concurrency int
+	Timeout     time.Duration
+}
+
+func BatchSettingsFromConfig(cfg *ConfigBuilder.Config) BatchSettings {
+	return BatchSettings{
+		MaxItems:    intProperty(cfg, "engine_batch_max_items", 10000),
+		Concurrency: intProperty(cfg, "engine_batch_concurrency", 8),
+		Timeout:     durationProperty(cfg, "engine_batch_timeout", 2*time.Minute),
+	}
+}
+
+// NewEvaluator returns the evaluator configured for the service, the HTTP engines at
+// engine_address, use SetEvaluator to evaluate against anything else
+func NewEvaluator(cfg *ConfigBuilder.Config) Evaluator {
+	settings := SettingsFromConfig(cfg)
+	return NewRetryEvaluator(poolFromConfig(cfg, settings), settings.Retry)
+}
+
+// poolFromConfig returns the shared pool for the comma separated engine_address list
+func poolFromConfig(cfg *ConfigBuilder.Config, settings Settings) *Pool {
+	address, _ := cfg.ProjectProperties["engine_address"].(string)
+	return PoolFor(ParseAddresses(address), settings)
+}
+
+// newAddressEvaluator calls a single engine address behind that address's breaker
+func newAddressEvaluator(address string, settings Settings) Evaluator {
+	h := NewHTTPEvaluator(address)
+	h.Client = &http.Client{Timeout: settings.Timeout}
+
+	return NewBreakerEvaluator(h, BreakerFor(address, settings.Breaker))
+}
+
+func durationProperty(cfg *ConfigBuilder.Config, key string, fallback time.Duration) time.Duration {
+	if d, ok := cfg.ProjectProperties[key].(time.Duration); ok && d > 0 {
+		return d
+	}
+	return fallback
+}
+
+func stringProperty(cfg *ConfigBuilder.Config, key string, fallback string) string {
+	if v, ok := cfg.ProjectProperties[key].(string); ok && v != "" {
+		return v
+	}
+	return fallback
+}
+
+func intProperty(cfg *ConfigBuilder.Config, key string, fallback int) int {
+	if i, ok := cfg.ProjectProperties[key].(int); ok && i > 0 {
+		return i
+	}
+	return fallback
+}
+
+// HTTPEvaluator talks to a policy engine over HTTP
+type HTTPEvaluator struct {
+	Address string
+	Client  *http.Client
+}
+
+func NewHTTPEvaluator(address string) *HTTPEvaluator {
+	return &HTTPEvaluator{
+		Address: address,
+		Client:  http.DefaultClient,
+	}
+}
+
+func (h *HTTPEvaluator) Evaluate(ctx context.Context, policy policymodel.Policy) (*policymodel.EngineResponse, error) {
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", h.Address, bytes.NewBuffer(data))
+	if err != nil {
+		return nil, errors.WrapEngineError(err, errors.EngineTransport, h.Address)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Policy Orchestrator")
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return nil, errors.WrapEngineTransportError(err, h.Address)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			_ = logs.Errorf("error closing body: %v", err)
+		}
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return nil, errors.NewEngineStatusError(h.Address, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	er := policymodel.EngineResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&er); err != nil {
+		return nil, errors.WrapEngineError(err, errors.EngineBadResponse, h.Address)
+	}
+
+	return &er, nil
+}
@@ -0,0 +1,134 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	policymodel "github.com/1rp-pw/orchestrator/internal/structs"
+	"sync"
+)
+
+// FakeEvaluator is an in-memory Evaluator that returns canned responses, it lets flows and
+// handlers be tested without a running policy engine
+type FakeEvaluator struct {
+	mu sync.Mutex
+
+	policies map[string]fakeResult
+	inputs   []fakeInput
+	fallback *fakeResult
+	calls    []policymodel.Policy
+}
+
+type fakeResult struct {
+	response policymodel.EngineResponse
+	err      error
+}
+
+type fakeInput struct {
+	data   string
+	result fakeResult
+}
+
+func NewFakeEvaluator() *FakeEvaluator {
+	return &FakeEvaluator{
+		policies: make(map[string]fakeResult),
+	}
+}
+
+// OnPolicy returns the response whenever the policy with this id (or base id) is evaluated
+func (f *FakeEvaluator) OnPolicy(policyId string, response policymodel.EngineResponse) *FakeEvaluator {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.policies[policyId] = fakeResult{response: response}
+	return f
+}
+
+// OnPolicyError fails every evaluation of the policy with this id (or base id)
+func (f *FakeEvaluator) OnPolicyError(policyId string, err error) *FakeEvaluator {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.policies[policyId] = fakeResult{err: err}
+	return f
+}
+
+// OnInput returns the response whenever the evaluated data is equal to data, input matches
+// take precedence over policy matches
+func (f *FakeEvaluator) OnInput(data interface{}, response policymodel.EngineResponse) *FakeEvaluator {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inputs = append(f.inputs, fakeInput{
+		data:   normalizeInput(data),
+		result: fakeResult{response: response},
+	})
+	return f
+}
+
+// Default is returned when nothing else matches
+func (f *FakeEvaluator) Default(response policymodel.EngineResponse) *FakeEvaluator {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fallback = &fakeResult{response: response}
+	return f
+}
+
+// Calls returns every policy that has been evaluated, in order
+func (f *FakeEvaluator) Calls() []policymodel.Policy {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := make([]policymodel.Policy, len(f.calls))
+	copy(calls, f.calls)
+	return calls
+}
+
+func (f *FakeEvaluator) Evaluate(ctx context.Context, policy policymodel.Policy) (*policymodel.EngineResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, policy)
+
+	data := normalizeInput(policy.Data)
+	for _, in := range f.inputs {
+		if in.data == data {
+			return in.result.get(policy)
+		}
+	}
+	if r, ok := f.policies[policy.PolicyID]; ok {
+		return r.get(policy)
+	}
+	if r, ok := f.policies[policy.BaseID]; ok {
+		return r.get(policy)
+	}
+	if f.fallback != nil {
+		return f.fallback.get(policy)
+	}
+
+	return nil, fmt.Errorf("fake evaluator has no response for policy %s", policy.PolicyID)
+}
+
+func (r fakeResult) get(policy policymodel.Policy) (*policymodel.EngineResponse, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	resp := r.response
+	if resp.Data == nil {
+		resp.Data = policy.Data
+	}
+	return &resp, nil
+}
+
+// normalizeInput gives equal data the same representation regardless of its go type
+func normalizeInput(data interface{}) string {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Sprintf("%v", data)
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return string(b)
+	}
+	b, _ = json.Marshal(v)
+	return string(b)
+}
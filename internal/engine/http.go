@@ -1,20 +1,24 @@
 package engine
 
 import (
+	"context"
 	"encoding/json"
+	stderrors "errors"
+	"github.com/1rp-pw/orchestrator/internal/effective"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/explain"
 	"github.com/1rp-pw/orchestrator/internal/policy"
 	policymodel "github.com/1rp-pw/orchestrator/internal/structs"
 	"github.com/bugfixes/go-bugfixes/logs"
 	"io"
 	"net/http"
+	"time"
 )
 
 func (s *System) Run(w http.ResponseWriter, r *http.Request) {
-	s.Context = r.Context()
-
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		errors.WriteHTTPError(w, errors.NewValidationError("body", "failed to read body"))
 		return
 	}
 	defer func() {
@@ -25,55 +29,170 @@ func (s *System) Run(w http.ResponseWriter, r *http.Request) {
 
 	var p policymodel.Policy
 	if err := json.Unmarshal(bodyBytes, &p); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		errors.WriteHTTPError(w, errors.NewValidationError("body", "invalid JSON format"))
 		return
 	}
 
-	pr, err := s.runPolicy(p)
+	rs := *s
+	rs.Context = r.Context()
+	pr, err := rs.runAndRecord(p)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		errors.WriteHTTPError(w, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(pr); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
 	}
 }
 
 func (s *System) RunPolicy(w http.ResponseWriter, r *http.Request) {
-	s.Context = r.Context()
+	pr, err := s.runStoredPolicy(r)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(pr); err != nil {
+		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
+	}
+}
+
+// ExplainPolicy runs the policy like RunPolicy and explains how the result came about
+func (s *System) ExplainPolicy(w http.ResponseWriter, r *http.Request) {
+	pr, err := s.runStoredPolicy(r)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(policymodel.ExplainResponse{
+		Response:    pr,
+		Explanation: explain.Policy(*pr),
+	}); err != nil {
+		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
+	}
+}
+
+// runStoredPolicy runs the stored policy named in the path against the data in the body, asOf
+// runs the version that was latest then
+func (s *System) runStoredPolicy(r *http.Request) (*policymodel.EngineResponse, error) {
 	policyId := r.PathValue("policyId")
 
+	ctx, err := effective.FromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	rs := *s
+	rs.Context = ctx
+
 	// get the structs from storage
-	st := policy.NewSystem(s.Config).SetContext(s.Context)
-	p, err := st.LoadPolicy(policyId)
+	st := policy.NewSystem(s.Config).SetContext(ctx)
+	p, err := st.ResolvePolicy(policyId)
+	if stderrors.Is(err, errors.ErrPolicyNotFound) {
+		return nil, errors.WrapPolicyError(errors.ErrPolicyNotFound, policyId)
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		return
+		return nil, err
 	}
 
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		return nil, errors.NewValidationError("body", "failed to read body")
 	}
 	var policyData policymodel.Policy
 	if err := json.Unmarshal(bodyBytes, &policyData); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		return nil, errors.NewValidationError("body", "invalid JSON format")
 	}
 
 	p.Data = policyData.Data
+	if err := policy.ValidateData(p, p.Data); err != nil {
+		return nil, errors.WrapPolicyError(err, policyId)
+	}
+
+	pr, err := rs.runAndRecord(p)
+	if err != nil {
+		return nil, errors.WrapPolicyError(err, policyId)
+	}
+
+	return pr, nil
+}
+
+func (s *System) RunPolicyBatch(w http.ResponseWriter, r *http.Request) {
+	policyId := r.PathValue("policyId")
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			_ = logs.Errorf("error closing body: %v", err)
+		}
+	}()
+
+	settings := BatchSettingsFromConfig(s.Config)
+	LiftDeadline(w, settings.Timeout)
+
+	ctx, err := effective.FromRequest(r)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+	// evaluations that are still running at the deadline fail so the results can be written,
+	// the batch gets its own copy of the system so the deadline is only its own
+	ctx, cancel := context.WithTimeout(ctx, settings.Timeout)
+	defer cancel()
+	bs := *s
+	bs.Context = ctx
+
+	// load the policy once for the whole batch
+	st := policy.NewSystem(s.Config).SetContext(ctx)
+	p, err := st.ResolvePolicy(policyId)
+	if stderrors.Is(err, errors.ErrPolicyNotFound) {
+		errors.WriteHTTPError(w, errors.WrapPolicyError(errors.ErrPolicyNotFound, policyId))
+		return
+	}
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
 
-	pr, err := s.runPolicy(p)
+	inputs, err := decodeBatch(r, settings.MaxItems)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		errors.WriteHTTPError(w, err)
 		return
 	}
 
+	br := bs.RunBatch(p, inputs, settings.Concurrency)
+
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(pr); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	if err := json.NewEncoder(w).Encode(br); err != nil {
+		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
+	}
+}
+
+// writeGrace is how long the results of a long request have to be written after its timeout
+const writeGrace = 10 * time.Second
+
+// LiftDeadline lifts the server's read and write timeouts for a request that takes longer than
+// a single run, a batch or a replay, to its own timeout
+func LiftDeadline(w http.ResponseWriter, timeout time.Duration) {
+	rc := http.NewResponseController(w)
+	now := time.Now()
+	if err := rc.SetReadDeadline(now.Add(timeout)); err != nil && !stderrors.Is(err, http.ErrNotSupported) {
+		_ = logs.Errorf("failed to set read deadline: %v", err)
+	}
+	if err := rc.SetWriteDeadline(now.Add(timeout + writeGrace)); err != nil && !stderrors.Is(err, http.ErrNotSupported) {
+		_ = logs.Errorf("failed to set write deadline: %v", err)
+	}
+}
+
+// Status shows the health, load and circuit breaker of every engine backend that has been configured
+func (s *System) Status(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"backends": BackendStatuses(),
+		"breakers": BreakerStatuses(),
+	}); err != nil {
+		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
 	}
 }
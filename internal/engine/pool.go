@@ -0,0 +1,309 @@
+package engine
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	policymodel "github.com/1rp-pw/orchestrator/internal/structs"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoHealthyBackends is returned when every engine backend is ejected or has an open breaker
+var ErrNoHealthyBackends = stderrors.New("no healthy engine backends")
+
+const (
+	BalanceRoundRobin       = "round-robin"
+	BalanceLeastOutstanding = "least-outstanding"
+)
+
+// HealthSettings controls the active probing of engine backends
+type HealthSettings struct {
+	Interval           time.Duration
+	Timeout            time.Duration
+	UnhealthyThreshold int
+	HealthyThreshold   int
+}
+
+// BackendStatus shows how a single engine backend is doing
+type BackendStatus struct {
+	Address          string       `json:"address"`
+	Healthy          bool         `json:"healthy"`
+	Breaker          BreakerState `json:"breaker"`
+	Outstanding      int64        `json:"outstanding"`
+	Requests         int64        `json:"requests"`
+	Errors           int64        `json:"errors"`
+	AverageLatencyMs float64      `json:"averageLatencyMs"`
+	LastLatencyMs    float64      `json:"lastLatencyMs"`
+	LastChecked      *time.Time   `json:"lastChecked,omitempty"`
+	LastCheckError   string       `json:"lastCheckError,omitempty"`
+}
+
+type backend struct {
+	address   string
+	evaluator Evaluator
+	breaker   *Breaker
+
+	outstanding atomic.Int64
+
+	mu           sync.Mutex
+	healthy      bool
+	passes       int
+	fails        int
+	requests     int64
+	failed       int64
+	totalLatency time.Duration
+	lastLatency  time.Duration
+	lastChecked  time.Time
+	lastCheckErr string
+}
+
+// Pool spreads evaluations over several engine backends, skipping the ones that fail their
+// health probe or have an open breaker
+type Pool struct {
+	backends []*backend
+	balancer string
+	health   HealthSettings
+	client   *http.Client
+	next     atomic.Uint64
+	started  sync.Once
+}
+
+func NewPool(addresses []string, settings Settings) *Pool {
+	p := &Pool{
+		balancer: settings.Balancer,
+		health:   settings.Health,
+		client:   &http.Client{Timeout: settings.Health.Timeout},
+	}
+	for _, address := range addresses {
+		b := BreakerFor(address, settings.Breaker)
+		p.backends = append(p.backends, &backend{
+			address:   address,
+			evaluator: newAddressEvaluator(address, settings),
+			breaker:   b,
+			healthy:   true,
+		})
+	}
+	return p
+}
+
+var pools = struct {
+	sync.Mutex
+	m map[string]*Pool
+}{
+	m: make(map[string]*Pool),
+}
+
+// PoolFor returns the pool shared by every evaluator calling these addresses
+func PoolFor(addresses []string, settings Settings) *Pool {
+	pools.Lock()
+	defer pools.Unlock()
+
+	key := strings.Join(addresses, ",")
+	p, ok := pools.m[key]
+	if !ok {
+		p = NewPool(addresses, settings)
+		pools.m[key] = p
+	}
+	return p
+}
+
+// BackendStatuses returns the state of every backend in every pool
+func BackendStatuses() []BackendStatus {
+	pools.Lock()
+	defer pools.Unlock()
+
+	var statuses []BackendStatus
+	for _, p := range pools.m {
+		statuses = append(statuses, p.Statuses()...)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Address < statuses[j].Address
+	})
+	return statuses
+}
+
+// ParseAddresses splits a comma separated ENGINE_ADDRESS into its backends
+func ParseAddresses(addresses string) []string {
+	var aa []string
+	for _, a := range strings.Split(addresses, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			aa = append(aa, a)
+		}
+	}
+	return aa
+}
+
+func (p *Pool) Evaluate(ctx context.Context, policy policymodel.Policy) (*policymodel.EngineResponse, error) {
+	b := p.pick()
+	if b == nil {
+		return nil, errors.WrapEngineError(ErrNoHealthyBackends, errors.EngineTransport, "")
+	}
+
+	b.outstanding.Add(1)
+	start := time.Now()
+	pr, err := b.evaluator.Evaluate(ctx, policy)
+	b.record(time.Since(start), err)
+	b.outstanding.Add(-1)
+
+	return pr, err
+}
+
+// pick chooses the backend for the next evaluation, nil when none are available
+func (p *Pool) pick() *backend {
+	n := len(p.backends)
+	if n == 0 {
+		return nil
+	}
+
+	offset := int(p.next.Add(1) - 1)
+	var chosen *backend
+	for i := 0; i < n; i++ {
+		b := p.backends[(offset+i)%n]
+		if !b.isHealthy() || !b.breaker.Available() {
+			continue
+		}
+		if p.balancer != BalanceLeastOutstanding {
+			return b
+		}
+		if chosen == nil || b.outstanding.Load() < chosen.outstanding.Load() {
+			chosen = b
+		}
+	}
+
+	return chosen
+}
+
+// StartHealthChecks probes every backend's /health endpoint until ctx is done, it only starts once
+func (p *Pool) StartHealthChecks(ctx context.Context) {
+	if p.health.Interval <= 0 {
+		return
+	}
+
+	p.started.Do(func() {
+		go func() {
+			t := time.NewTicker(p.health.Interval)
+			defer t.Stop()
+
+			for {
+				p.Check(ctx)
+				select {
+				case <-ctx.Done():
+					return
+				case <-t.C:
+				}
+			}
+		}()
+	})
+}
+
+// Check probes every backend once
+func (p *Pool) Check(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, b := range p.backends {
+		wg.Add(1)
+		go func(b *backend) {
+			defer wg.Done()
+			b.probed(p.probe(ctx, b.address), p.health)
+		}(b)
+	}
+	wg.Wait()
+}
+
+func (p *Pool) probe(ctx context.Context, address string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(address, "/")+"/health", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "Policy Orchestrator")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("health check returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (p *Pool) Statuses() []BackendStatus {
+	statuses := make([]BackendStatus, 0, len(p.backends))
+	for _, b := range p.backends {
+		statuses = append(statuses, b.status())
+	}
+	return statuses
+}
+
+func (b *backend) isHealthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.healthy
+}
+
+func (b *backend) record(latency time.Duration, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.requests++
+	b.totalLatency += latency
+	b.lastLatency = latency
+	if err != nil {
+		b.failed++
+	}
+}
+
+// probed ejects the backend after UnhealthyThreshold failed probes in a row and re-admits it
+// after HealthyThreshold passing probes in a row
+func (b *backend) probed(err error, settings HealthSettings) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastChecked = time.Now()
+	if err != nil {
+		b.lastCheckErr = err.Error()
+		b.passes = 0
+		b.fails++
+		if b.fails >= max(settings.UnhealthyThreshold, 1) {
+			b.healthy = false
+		}
+		return
+	}
+
+	b.lastCheckErr = ""
+	b.fails = 0
+	b.passes++
+	if b.passes >= max(settings.HealthyThreshold, 1) {
+		b.healthy = true
+	}
+}
+
+func (b *backend) status() BackendStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := BackendStatus{
+		Address:        b.address,
+		Healthy:        b.healthy,
+		Breaker:        b.breaker.Status().State,
+		Outstanding:    b.outstanding.Load(),
+		Requests:       b.requests,
+		Errors:         b.failed,
+		LastLatencyMs:  float64(b.lastLatency) / float64(time.Millisecond),
+		LastCheckError: b.lastCheckErr,
+	}
+	if b.requests > 0 {
+		s.AverageLatencyMs = float64(b.totalLatency) / float64(b.requests) / float64(time.Millisecond)
+	}
+	if !b.lastChecked.IsZero() {
+		lastChecked := b.lastChecked
+		s.LastChecked = &lastChecked
+	}
+	return s
+}
@@ -0,0 +1,107 @@
+package engine
+
+import (
+	"context"
+	stderrors "errors"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	policymodel "github.com/1rp-pw/orchestrator/internal/structs"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy controls how failed engine evaluations are retried
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// RetryEvaluator retries evaluations that failed because the engine was unavailable, evaluating a
+// policy has no side effects so every evaluation is safe to repeat
+type RetryEvaluator struct {
+	Next   Evaluator
+	Policy RetryPolicy
+
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func NewRetryEvaluator(next Evaluator, policy RetryPolicy) *RetryEvaluator {
+	return &RetryEvaluator{
+		Next:   next,
+		Policy: policy,
+		sleep:  sleepContext,
+	}
+}
+
+func (r *RetryEvaluator) Evaluate(ctx context.Context, policy policymodel.Policy) (*policymodel.EngineResponse, error) {
+	attempts := r.Policy.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			// a cancelled request isn't an engine failure
+			if serr := r.sleep(ctx, r.backoff(attempt)); serr != nil {
+				return nil, serr
+			}
+		}
+
+		var pr *policymodel.EngineResponse
+		pr, err = r.Next.Evaluate(ctx, policy)
+		if err == nil || !retryable(err) || ctx.Err() != nil {
+			return pr, err
+		}
+	}
+
+	return nil, err
+}
+
+// backoff is exponential with full jitter, capped at MaxDelay
+func (r *RetryEvaluator) backoff(attempt int) time.Duration {
+	if r.Policy.BaseDelay <= 0 {
+		return 0
+	}
+
+	delay := r.Policy.BaseDelay << (attempt - 1)
+	if r.Policy.MaxDelay > 0 && (delay > r.Policy.MaxDelay || delay <= 0) {
+		delay = r.Policy.MaxDelay
+	}
+
+	return time.Duration(rand.Int64N(int64(delay) + 1))
+}
+
+// retryable reports whether the engine might answer if asked again
+func retryable(err error) bool {
+	if stderrors.Is(err, ErrCircuitOpen) || stderrors.Is(err, ErrNoHealthyBackends) {
+		return false
+	}
+
+	var engineErr *errors.EngineError
+	if !stderrors.As(err, &engineErr) {
+		return false
+	}
+
+	switch engineErr.Kind {
+	case errors.EngineTransport, errors.EngineTimeout:
+		return true
+	case errors.EngineStatus:
+		return engineErr.StatusCode >= http.StatusInternalServerError || engineErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	return false
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
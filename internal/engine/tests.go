@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/policy"
+	policymodel "github.com/1rp-pw/orchestrator/internal/structs"
+	"net/http"
+	"sync"
+)
+
+// RunTests runs every stored test case of the policy against the engine, test runs aren't
+// kept in the decision log
+func (s *System) RunTests(ctx context.Context, p policymodel.Policy) (policymodel.PolicyTestReport, error) {
+	cases := policy.TestCases(p.Tests)
+	report := policymodel.PolicyTestReport{
+		PolicyID: p.PolicyID,
+		Total:    len(cases),
+		Results:  make([]policymodel.PolicyTestResult, len(cases)),
+	}
+
+	ts := *s
+	ts.Context = ctx
+
+	sem := make(chan struct{}, BatchSettingsFromConfig(s.Config).Concurrency)
+	var wg sync.WaitGroup
+	for i, c := range cases {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, c policymodel.PolicyTestCase) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			report.Results[i] = ts.runTest(p, i, c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, r := range report.Results {
+		if r.Passed {
+			report.Passed++
+		} else {
+			report.Failed++
+		}
+	}
+
+	return report, nil
+}
+
+func (s *System) runTest(p policymodel.Policy, i int, c policymodel.PolicyTestCase) policymodel.PolicyTestResult {
+	r := policymodel.PolicyTestResult{
+		Index:    i,
+		Name:     c.Name,
+		Expected: c.Expected,
+	}
+	if c.Expected == nil {
+		r.Error = batchError(errors.NewValidationError("expected", "test case has no expected outcome"))
+		return r
+	}
+	if err := policy.ValidateData(p, c.Data); err != nil {
+		r.Error = batchError(err)
+		return r
+	}
+
+	tp := p
+	tp.Data = c.Data
+	pr, err := s.runPolicy(tp)
+	if err != nil {
+		r.Error = batchError(err)
+		return r
+	}
+	r.Actual = &pr.Result
+	r.Trace = pr.Trace
+	r.Passed = pr.Result == *c.Expected
+
+	return r
+}
+
+// RunPolicyTests runs the stored tests of the policy in the path
+func (s *System) RunPolicyTests(w http.ResponseWriter, r *http.Request) {
+	policyId := r.PathValue("policyId")
+
+	p, err := policy.NewSystem(s.Config).SetContext(r.Context()).ResolvePolicy(policyId)
+	if stderrors.Is(err, errors.ErrPolicyNotFound) {
+		errors.WriteHTTPError(w, errors.WrapPolicyError(errors.ErrPolicyNotFound, policyId))
+		return
+	}
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	report, err := s.RunTests(r.Context(), p)
+	if err != nil {
+		errors.WriteHTTPError(w, errors.WrapPolicyError(err, policyId))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
+	}
+}
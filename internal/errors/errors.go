@@ -1,8 +1,10 @@
 package errors
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net"
 )
 
 // Sentinel errors for common cases
@@ -19,12 +21,53 @@ var (
 
 	// ErrFlowNotFound is returned when a flow cannot be found
 	ErrFlowNotFound = errors.New("flow not found")
+
+	// ErrDecisionNotFound is returned when a decision isn't in the decision log
+	ErrDecisionNotFound = errors.New("decision not found")
+
+	// ErrPolicyInUse is returned when a policy can't be deleted because flows refer to it
+	ErrPolicyInUse = errors.New("policy is used by flows")
+
+	// ErrPolicyRetained is returned when an archived policy is purged before its retention period is over
+	ErrPolicyRetained = errors.New("policy is still in its retention period")
+
+	// ErrDraftExists is returned when a draft is restored while the policy already has a draft
+	ErrDraftExists = errors.New("policy already has a draft")
+
+	// ErrTestsFailed is returned when a draft is published while its tests fail
+	ErrTestsFailed = errors.New("policy tests failed")
+
+	// ErrNotApproved is returned when a draft is published without an approved review
+	ErrNotApproved = errors.New("draft has not been approved")
+
+	// ErrReviewForbidden is returned when a reviewer may not review a draft, such as its author
+	ErrReviewForbidden = errors.New("not allowed to review this draft")
+
+	// ErrReviewState is returned when a review can't move to the state asked for
+	ErrReviewState = errors.New("review can't do that in its current state")
+
+	// ErrPreconditionRequired is returned when a draft is edited without an If-Match header
+	ErrPreconditionRequired = errors.New("an If-Match header is required to edit a draft")
+
+	// ErrRevisionConflict is returned when a draft is edited from a revision that isn't its latest
+	ErrRevisionConflict = errors.New("draft was changed by someone else")
+
+	// ErrAlreadyActive is returned when rolling back to the version that is already the latest
+	ErrAlreadyActive = errors.New("version is already the latest")
 )
 
 // ValidationError represents a validation error with field information
 type ValidationError struct {
-	Field   string
-	Message string
+	Field      string
+	Message    string
+	Violations []Violation
+}
+
+// Violation is a single reason data doesn't match a schema, Pointer is the JSON pointer to the
+// offending value
+type Violation struct {
+	Pointer string `json:"pointer"`
+	Reason  string `json:"reason"`
 }
 
 func (e *ValidationError) Error() string {
@@ -42,6 +85,14 @@ func NewValidationError(field, message string) error {
 	}
 }
 
+// NewSchemaValidationError creates a validation error listing every schema violation
+func NewSchemaValidationError(message string, violations []Violation) error {
+	return &ValidationError{
+		Message:    message,
+		Violations: violations,
+	}
+}
+
 // FlowError represents errors specific to flow operations
 type FlowError struct {
 	FlowID  string
@@ -120,6 +171,179 @@ func WrapPolicyError(err error, policyID string) error {
 	}
 }
 
+// Dependent is a flow that refers to a policy, NodeIDs are the nodes that do
+type Dependent struct {
+	FlowID     string   `json:"flowId"`
+	BaseFlowID string   `json:"baseFlowId"`
+	Name       string   `json:"name"`
+	Version    string   `json:"version,omitempty"`
+	NodeIDs    []string `json:"nodeIds"`
+}
+
+// InUseError lists the flows that would break if the policy was deleted
+type InUseError struct {
+	PolicyID   string
+	Dependents []Dependent
+}
+
+func (e *InUseError) Error() string {
+	return fmt.Sprintf("policy %s is used by %d flows", e.PolicyID, len(e.Dependents))
+}
+
+// Unwrap allows errors.Is to match ErrPolicyInUse
+func (e *InUseError) Unwrap() error {
+	return ErrPolicyInUse
+}
+
+// NewInUseError creates a new in use error
+func NewInUseError(policyID string, dependents []Dependent) error {
+	return &InUseError{
+		PolicyID:   policyID,
+		Dependents: dependents,
+	}
+}
+
+// FailedTest is a policy test case that didn't return what it expected
+type FailedTest struct {
+	Index    int         `json:"index"`
+	Name     string      `json:"name,omitempty"`
+	Expected *bool       `json:"expected"`
+	Actual   *bool       `json:"actual,omitempty"`
+	Error    interface{} `json:"error,omitempty"`
+}
+
+// TestsFailedError lists the test cases that stopped a draft from being published
+type TestsFailedError struct {
+	PolicyID string
+	Failures []FailedTest
+}
+
+func (e *TestsFailedError) Error() string {
+	return fmt.Sprintf("%d tests of policy %s failed", len(e.Failures), e.PolicyID)
+}
+
+// Unwrap allows errors.Is to match ErrTestsFailed
+func (e *TestsFailedError) Unwrap() error {
+	return ErrTestsFailed
+}
+
+// NewTestsFailedError creates a new tests failed error
+func NewTestsFailedError(policyID string, failures []FailedTest) error {
+	return &TestsFailedError{
+		PolicyID: policyID,
+		Failures: failures,
+	}
+}
+
+// RevisionConflictError is a stale edit of the draft of a base policy or flow along with the
+// revision the draft is at now
+type RevisionConflictError struct {
+	BaseID   string
+	Revision int64
+	ETag     string
+}
+
+func (e *RevisionConflictError) Error() string {
+	return fmt.Sprintf("draft of %s was changed by someone else, it is at revision %d", e.BaseID, e.Revision)
+}
+
+// Unwrap allows errors.Is to match ErrRevisionConflict
+func (e *RevisionConflictError) Unwrap() error {
+	return ErrRevisionConflict
+}
+
+// NewRevisionConflictError creates a new revision conflict error
+func NewRevisionConflictError(baseID string, revision int64, etag string) error {
+	return &RevisionConflictError{
+		BaseID:   baseID,
+		Revision: revision,
+		ETag:     etag,
+	}
+}
+
+// EngineErrorKind describes why a call to the policy engine failed
+type EngineErrorKind string
+
+const (
+	// EngineTransport is returned when the engine can't be reached
+	EngineTransport EngineErrorKind = "transport"
+	// EngineTimeout is returned when the engine didn't answer in time
+	EngineTimeout EngineErrorKind = "timeout"
+	// EngineStatus is returned when the engine answered with a non-2xx status
+	EngineStatus EngineErrorKind = "status"
+	// EngineBadResponse is returned when the engine answered with a body that can't be decoded
+	EngineBadResponse EngineErrorKind = "bad_response"
+)
+
+// EngineError represents a failed call to the policy engine
+type EngineError struct {
+	Kind       EngineErrorKind
+	Address    string
+	StatusCode int
+	Message    string
+	Err        error
+}
+
+func (e *EngineError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("engine error (%s, status %d): %s", e.Kind, e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("engine error (%s): %s", e.Kind, e.Message)
+}
+
+// Unwrap allows errors.Is and errors.As to work with wrapped errors
+func (e *EngineError) Unwrap() error {
+	return e.Err
+}
+
+// NewEngineError creates a new engine error
+func NewEngineError(kind EngineErrorKind, address, message string) error {
+	return &EngineError{
+		Kind:    kind,
+		Address: address,
+		Message: message,
+	}
+}
+
+// NewEngineStatusError creates an engine error for a non-2xx response
+func NewEngineStatusError(address string, statusCode int, message string) error {
+	return &EngineError{
+		Kind:       EngineStatus,
+		Address:    address,
+		StatusCode: statusCode,
+		Message:    message,
+	}
+}
+
+// WrapEngineError wraps an existing error with engine context
+func WrapEngineError(err error, kind EngineErrorKind, address string) error {
+	return &EngineError{
+		Kind:    kind,
+		Address: address,
+		Message: err.Error(),
+		Err:     err,
+	}
+}
+
+// WrapEngineTransportError wraps a failed engine request, telling timeouts apart from other transport failures
+func WrapEngineTransportError(err error, address string) error {
+	kind := EngineTransport
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		kind = EngineTimeout
+	}
+	return WrapEngineError(err, kind, address)
+}
+
+// WithFlowID adds the flow id to a flow error that was raised without one
+func WithFlowID(err error, flowID string) error {
+	var flowErr *FlowError
+	if errors.As(err, &flowErr) && flowErr.FlowID == "" {
+		flowErr.FlowID = flowID
+	}
+	return err
+}
+
 // Helper functions to check error types
 
 // IsMissingPolicyID checks if the error is due to missing policy ID
@@ -145,6 +369,12 @@ func IsPolicyError(err error) bool {
 	return errors.As(err, &policyErr)
 }
 
+// IsEngineError checks if the error is an engine error
+func IsEngineError(err error) bool {
+	var engineErr *EngineError
+	return errors.As(err, &engineErr)
+}
+
 // NewInternalError creates a new internal server error
 func NewInternalError(message string) error {
 	return fmt.Errorf("internal server error: %s", message)
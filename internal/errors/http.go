@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"strconv"
 )
 
 // HTTPError represents the structure of error responses sent to clients
@@ -15,12 +16,26 @@ type HTTPError struct {
 
 // WriteHTTPError writes an error response to the HTTP response writer
 func WriteHTTPError(w http.ResponseWriter, err error) {
+	statusCode, httpErr := ToHTTPError(err)
+
+	// Write the response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": httpErr,
+	})
+}
+
+// ToHTTPError converts an error to the status code and body it is reported with
+func ToHTTPError(err error) (int, HTTPError) {
 	statusCode := http.StatusInternalServerError
 	httpErr := HTTPError{
 		Code:    "INTERNAL_ERROR",
 		Message: "An internal error occurred",
 	}
 
+	details := make(map[string]interface{})
+
 	// Check for validation errors
 	var validationErr *ValidationError
 	if errors.As(err, &validationErr) {
@@ -28,10 +43,37 @@ func WriteHTTPError(w http.ResponseWriter, err error) {
 		httpErr.Code = "VALIDATION_ERROR"
 		httpErr.Message = validationErr.Error()
 		if validationErr.Field != "" {
-			httpErr.Details = map[string]string{"field": validationErr.Field}
+			details["field"] = validationErr.Field
+		}
+		if len(validationErr.Violations) > 0 {
+			details["violations"] = validationErr.Violations
 		}
 	}
 
+	// Check for engine errors
+	var engineErr *EngineError
+	if errors.As(err, &engineErr) {
+		switch engineErr.Kind {
+		case EngineTransport:
+			statusCode = http.StatusServiceUnavailable
+			httpErr.Code = "ENGINE_UNAVAILABLE"
+		case EngineTimeout:
+			statusCode = http.StatusGatewayTimeout
+			httpErr.Code = "ENGINE_TIMEOUT"
+		default:
+			statusCode = http.StatusBadGateway
+			httpErr.Code = "ENGINE_BAD_RESPONSE"
+		}
+		httpErr.Message = engineErr.Error()
+		details["kind"] = string(engineErr.Kind)
+		if engineErr.StatusCode != 0 {
+			details["statusCode"] = strconv.Itoa(engineErr.StatusCode)
+		}
+	}
+
+	// flow and policy errors keep the code of the validation or engine error they wrap
+	wrapsKnown := validationErr != nil || engineErr != nil
+
 	// Check for flow errors
 	var flowErr *FlowError
 	if errors.As(err, &flowErr) {
@@ -42,21 +84,17 @@ func WriteHTTPError(w http.ResponseWriter, err error) {
 		} else if errors.Is(flowErr.Err, ErrFlowNotFound) {
 			statusCode = http.StatusNotFound
 			httpErr.Code = "FLOW_NOT_FOUND"
-		} else {
+		} else if !wrapsKnown {
 			statusCode = http.StatusBadRequest
 			httpErr.Code = "FLOW_ERROR"
 		}
 		httpErr.Message = flowErr.Error()
-		details := make(map[string]string)
 		if flowErr.FlowID != "" {
 			details["flowId"] = flowErr.FlowID
 		}
 		if flowErr.NodeID != "" {
 			details["nodeId"] = flowErr.NodeID
 		}
-		if len(details) > 0 {
-			httpErr.Details = details
-		}
 	}
 
 	// Check for policy errors
@@ -65,16 +103,42 @@ func WriteHTTPError(w http.ResponseWriter, err error) {
 		if errors.Is(policyErr.Err, ErrPolicyNotFound) {
 			statusCode = http.StatusNotFound
 			httpErr.Code = "POLICY_NOT_FOUND"
-		} else {
+		} else if !wrapsKnown {
 			statusCode = http.StatusBadRequest
 			httpErr.Code = "POLICY_ERROR"
 		}
 		httpErr.Message = policyErr.Error()
 		if policyErr.PolicyID != "" {
-			httpErr.Details = map[string]string{"policyId": policyErr.PolicyID}
+			details["policyId"] = policyErr.PolicyID
 		}
 	}
 
+	// Check for policies that are still used
+	var inUseErr *InUseError
+	if errors.As(err, &inUseErr) {
+		details["policyId"] = inUseErr.PolicyID
+		details["flows"] = inUseErr.Dependents
+	}
+
+	// Check for drafts whose tests fail
+	var testsErr *TestsFailedError
+	if errors.As(err, &testsErr) {
+		details["policyId"] = testsErr.PolicyID
+		details["failures"] = testsErr.Failures
+	}
+
+	// Check for stale edits of drafts
+	var conflictErr *RevisionConflictError
+	if errors.As(err, &conflictErr) {
+		details["baseId"] = conflictErr.BaseID
+		details["revision"] = conflictErr.Revision
+		details["etag"] = conflictErr.ETag
+	}
+
+	if len(details) > 0 {
+		httpErr.Details = details
+	}
+
 	// Check for sentinel errors
 	switch {
 	case errors.Is(err, ErrMissingPolicyID):
@@ -93,14 +157,53 @@ func WriteHTTPError(w http.ResponseWriter, err error) {
 		statusCode = http.StatusNotFound
 		httpErr.Code = "FLOW_NOT_FOUND"
 		httpErr.Message = err.Error()
+	case errors.Is(err, ErrDecisionNotFound):
+		statusCode = http.StatusNotFound
+		httpErr.Code = "DECISION_NOT_FOUND"
+		httpErr.Message = err.Error()
+	case errors.Is(err, ErrPolicyInUse):
+		statusCode = http.StatusConflict
+		httpErr.Code = "POLICY_IN_USE"
+		httpErr.Message = err.Error()
+	case errors.Is(err, ErrPolicyRetained):
+		statusCode = http.StatusConflict
+		httpErr.Code = "POLICY_RETAINED"
+		httpErr.Message = err.Error()
+	case errors.Is(err, ErrDraftExists):
+		statusCode = http.StatusConflict
+		httpErr.Code = "DRAFT_EXISTS"
+		httpErr.Message = err.Error()
+	case errors.Is(err, ErrTestsFailed):
+		statusCode = http.StatusUnprocessableEntity
+		httpErr.Code = "TESTS_FAILED"
+		httpErr.Message = err.Error()
+	case errors.Is(err, ErrNotApproved):
+		statusCode = http.StatusConflict
+		httpErr.Code = "NOT_APPROVED"
+		httpErr.Message = err.Error()
+	case errors.Is(err, ErrReviewForbidden):
+		statusCode = http.StatusForbidden
+		httpErr.Code = "REVIEW_FORBIDDEN"
+		httpErr.Message = err.Error()
+	case errors.Is(err, ErrReviewState):
+		statusCode = http.StatusConflict
+		httpErr.Code = "INVALID_REVIEW_STATE"
+		httpErr.Message = err.Error()
+	case errors.Is(err, ErrPreconditionRequired):
+		statusCode = http.StatusPreconditionRequired
+		httpErr.Code = "PRECONDITION_REQUIRED"
+		httpErr.Message = err.Error()
+	case errors.Is(err, ErrRevisionConflict):
+		statusCode = http.StatusConflict
+		httpErr.Code = "REVISION_CONFLICT"
+		httpErr.Message = err.Error()
+	case errors.Is(err, ErrAlreadyActive):
+		statusCode = http.StatusConflict
+		httpErr.Code = "ALREADY_ACTIVE"
+		httpErr.Message = err.Error()
 	}
 
-	// Write the response
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"error": httpErr,
-	})
+	return statusCode, httpErr
 }
 
 // WriteHTTPSuccess writes a success response to the HTTP response writer
@@ -0,0 +1,77 @@
+package etag
+
+import (
+	stderrors "errors"
+	"fmt"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/jackc/pgx/v5/pgconn"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ETag is the entity tag of a revision of a draft, revisions are unique so it can't match
+// another draft
+func ETag(revision int64) string {
+	return `"` + strconv.FormatInt(revision, 10) + `"`
+}
+
+// Set sends the ETag of the revision of a draft
+func Set(w http.ResponseWriter, revision int64) {
+	w.Header().Set("ETag", ETag(revision))
+}
+
+// Match is the revision an If-Match header asks for, Any for * which matches any revision
+type Match struct {
+	Any      bool
+	Revision int64
+}
+
+// Matches is whether the draft at revision is the one m asks for
+func (m Match) Matches(revision int64) bool {
+	return m.Any || m.Revision == revision
+}
+
+// IfMatch reads the If-Match header every draft edit needs, an ETag or a bare revision
+func IfMatch(r *http.Request) (Match, error) {
+	h := strings.TrimSpace(r.Header.Get("If-Match"))
+	if h == "" {
+		return Match{}, errors.ErrPreconditionRequired
+	}
+	if h == "*" {
+		return Match{Any: true}, nil
+	}
+
+	tag := strings.Trim(strings.TrimPrefix(h, "W/"), `"`)
+	revision, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil || revision <= 0 {
+		return Match{}, errors.NewValidationError("If-Match", fmt.Sprintf("%s isn't the ETag or revision of a draft", h))
+	}
+	return Match{Revision: revision}, nil
+}
+
+// movedCode is the SQLSTATE publishing a draft raises when the draft isn't at the revision it
+// was asked to publish
+const movedCode = "P0409"
+
+// Moved is whether err is the database refusing to publish a draft that was edited since the
+// revision it was asked to publish
+func Moved(err error) bool {
+	var pgErr *pgconn.PgError
+	return stderrors.As(err, &pgErr) && pgErr.Code == movedCode
+}
+
+// Conflict is the error for an edit that didn't match the draft of a base policy or flow, which
+// is at revision
+func Conflict(baseId string, revision int64) error {
+	return errors.NewRevisionConflictError(baseId, revision, ETag(revision))
+}
+
+// WriteError writes err, with the ETag of the revision the draft is at when it is a conflict
+func WriteError(w http.ResponseWriter, err error) {
+	var conflict *errors.RevisionConflictError
+	if stderrors.As(err, &conflict) {
+		Set(w, conflict.Revision)
+	}
+	errors.WriteHTTPError(w, err)
+}
@@ -0,0 +1,57 @@
+package etag
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIfMatch(t *testing.T) {
+	r := httptest.NewRequest("PUT", "/policy/abc", nil)
+	_, err := IfMatch(r)
+	assert.ErrorIs(t, err, errors.ErrPreconditionRequired)
+
+	for header, want := range map[string]Match{
+		`*`:      {Any: true},
+		`"12"`:   {Revision: 12},
+		`W/"12"`: {Revision: 12},
+		`12`:     {Revision: 12},
+	} {
+		r.Header.Set("If-Match", header)
+		m, err := IfMatch(r)
+		require.NoError(t, err, header)
+		assert.Equal(t, want, m, header)
+	}
+
+	for _, header := range []string{`"abc"`, `"0"`, `"1", "2"`} {
+		r.Header.Set("If-Match", header)
+		_, err := IfMatch(r)
+		assert.Error(t, err, header)
+	}
+}
+
+func TestMatch_Matches(t *testing.T) {
+	assert.True(t, Match{Any: true}.Matches(5))
+	assert.True(t, Match{Revision: 5}.Matches(5))
+	assert.False(t, Match{Revision: 4}.Matches(5))
+}
+
+func TestWriteError(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteError(w, Conflict("abc", 7))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, `"7"`, w.Header().Get("ETag"))
+	assert.Contains(t, w.Body.String(), `"revision":7`)
+}
+
+func TestMoved(t *testing.T) {
+	assert.True(t, Moved(fmt.Errorf("publish: %w", &pgconn.PgError{Code: "P0409"})))
+	assert.False(t, Moved(&pgconn.PgError{Code: "P0001"}))
+	assert.False(t, Moved(errors.ErrRevisionConflict))
+}
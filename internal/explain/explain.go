@@ -0,0 +1,382 @@
+package explain
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Policy explains a policy run from the execution entries of its trace, the engine evaluates
+// the golden rule first so the first entry is the one the result comes from
+func Policy(er structs.EngineResponse) structs.Explanation {
+	e := structs.Explanation{
+		Result: er.Result,
+		Steps:  steps(er.Trace),
+	}
+
+	e.Summary = fmt.Sprintf("The result is %s.", value(er.Result))
+	if len(e.Steps) == 0 {
+		e.Summary += " The engine did not return an execution trace to explain."
+	} else {
+		e.Summary += " " + e.Steps[0].Text
+	}
+
+	var md strings.Builder
+	fmt.Fprintf(&md, "**Result:** `%s`\n\n%s\n", value(er.Result), e.Summary)
+	for i, st := range e.Steps {
+		writeStep(&md, "###", i+1, st)
+	}
+	e.Markdown = md.String()
+
+	return e
+}
+
+// Flow explains a flow run node by node, each policy node is followed by the rules it evaluated
+func Flow(fr structs.FlowResponse) structs.Explanation {
+	e := structs.Explanation{
+		Result: fr.Result,
+		Steps:  make([]structs.ExplanationStep, 0),
+	}
+
+	var md strings.Builder
+	for i, nr := range fr.NodeResponse {
+		ruleSteps := steps(nr.Response.Trace)
+
+		node := structs.ExplanationStep{
+			NodeID:     nr.NodeID,
+			NodeType:   nr.NodeType,
+			Passed:     nr.Response.Result,
+			Conditions: make([]structs.ExplainedCondition, 0),
+		}
+		if nr.NodeType == "custom" && len(ruleSteps) > 0 {
+			node.Outcome = ruleSteps[0].Outcome
+			node.Text = fmt.Sprintf("Node %q responded with %q.", nr.NodeID, node.Outcome)
+			ruleSteps = nil
+		} else {
+			node.Text = fmt.Sprintf("Node %q (%s) returned %s, so the flow followed its %s branch.", nr.NodeID, nr.NodeType, value(nr.Response.Result), branch(nr.Response.Result))
+		}
+		e.Steps = append(e.Steps, node)
+
+		fmt.Fprintf(&md, "\n### %d. Node `%s` (%s)\n\n%s\n", i+1, nr.NodeID, nr.NodeType, node.Text)
+		for j, st := range ruleSteps {
+			st.NodeID = nr.NodeID
+			st.NodeType = nr.NodeType
+			e.Steps = append(e.Steps, st)
+			writeStep(&md, "####", j+1, st)
+		}
+	}
+
+	e.Summary = fmt.Sprintf("The flow returned %s after running %s.", value(fr.Result), plural(len(fr.NodeResponse), "node"))
+	e.Markdown = fmt.Sprintf("**Result:** `%s`\n\n%s\n%s", value(fr.Result), e.Summary, md.String())
+
+	return e
+}
+
+func writeStep(md *strings.Builder, heading string, n int, st structs.ExplanationStep) {
+	title := st.Outcome
+	if title == "" {
+		title = st.Selector
+	}
+	fmt.Fprintf(md, "\n%s %d. %s\n\n%s\n", heading, n, title, st.Text)
+	if len(st.Conditions) > 0 {
+		md.WriteString("\n")
+	}
+	for _, c := range st.Conditions {
+		mark := "passed"
+		if !c.Passed {
+			mark = "**failed**"
+		}
+		fmt.Fprintf(md, "- %s: %s\n", mark, c.Text)
+	}
+}
+
+// steps reads the execution entries of a trace, anything that isn't shaped like one is skipped
+func steps(trace interface{}) []structs.ExplanationStep {
+	ss := make([]structs.ExplanationStep, 0)
+
+	// the trace can come straight from the engine or be built in process, a round trip gives
+	// both the same shape
+	var t struct {
+		Execution []map[string]interface{} `json:"execution"`
+	}
+	b, err := json.Marshal(trace)
+	if err != nil || json.Unmarshal(b, &t) != nil {
+		return ss
+	}
+
+	for _, ex := range t.Execution {
+		st := structs.ExplanationStep{
+			Selector:   text(ex["selector"]),
+			Outcome:    text(ex["outcome"]),
+			Passed:     ex["result"] == true,
+			Conditions: make([]structs.ExplainedCondition, 0),
+		}
+		conditions, _ := ex["conditions"].([]interface{})
+		for _, c := range conditions {
+			st.Conditions = append(st.Conditions, condition(c))
+		}
+		st.Text = stepText(st)
+		ss = append(ss, st)
+	}
+
+	return ss
+}
+
+func stepText(st structs.ExplanationStep) string {
+	rule := fmt.Sprintf("The rule %q", st.Outcome)
+	if st.Outcome == "" {
+		rule = "The rule"
+	}
+	if st.Selector != "" && st.Selector != "custom_response" {
+		rule += fmt.Sprintf(" for %s", st.Selector)
+	}
+
+	if len(st.Conditions) == 0 {
+		if st.Passed {
+			return rule + " applied, it has no conditions."
+		}
+		return rule + " did not apply."
+	}
+
+	var failed []string
+	for _, c := range st.Conditions {
+		if !c.Passed {
+			failed = append(failed, c.Text)
+		}
+	}
+	if st.Passed {
+		return fmt.Sprintf("%s passed because %s met.", rule, metCount(len(st.Conditions)-len(failed), len(st.Conditions)))
+	}
+	if len(failed) == 0 {
+		return rule + " failed."
+	}
+	return fmt.Sprintf("%s failed because %s not met: %s.", rule, notMetCount(len(failed), len(st.Conditions)), strings.Join(failed, "; "))
+}
+
+// condition explains one condition, either a comparison of a property with a value or a
+// reference to another rule
+func condition(c interface{}) structs.ExplainedCondition {
+	m, ok := c.(map[string]interface{})
+	if !ok {
+		return structs.ExplainedCondition{Text: value(c)}
+	}
+	ec := structs.ExplainedCondition{Passed: m["result"] == true}
+
+	if d := text(m["description"]); d != "" {
+		ec.Text = d
+		return ec
+	}
+	for _, k := range []string{"rule", "rule_name", "referenced_rule", "referenced_rule_outcome"} {
+		if r := text(m[k]); r != "" {
+			ec.Text = fmt.Sprintf("the rule %q %s", r, passedWord(ec.Passed))
+			return ec
+		}
+	}
+
+	property, actual, hasActual := propertyOf(m["property"])
+	operator := humanOperator(text(m["operator"]))
+	expected := m["value"]
+	if v, ok := expected.(map[string]interface{}); ok {
+		if inner, ok := v["value"]; ok {
+			expected = inner
+		}
+	}
+
+	if property == "" {
+		ec.Text = fmt.Sprintf("condition %s", passedWord(ec.Passed))
+		if len(m) > 1 {
+			ec.Text += " " + compact(m)
+		}
+		return ec
+	}
+
+	want := operator
+	if expected != nil {
+		want = strings.TrimSpace(want + " " + value(expected))
+	}
+	switch {
+	case !hasActual:
+		ec.Text = fmt.Sprintf("`%s` must be %s, which was %s", property, want, metWord(ec.Passed))
+	case ec.Passed:
+		ec.Text = fmt.Sprintf("`%s` is %s, which is %s", property, value(actual), want)
+	default:
+		ec.Text = fmt.Sprintf("`%s` is %s, which is not %s", property, value(actual), want)
+	}
+
+	return ec
+}
+
+// propertyOf finds the path and the value of the property a condition looked at
+func propertyOf(p interface{}) (string, interface{}, bool) {
+	switch v := p.(type) {
+	case string:
+		return v, nil, false
+	case map[string]interface{}:
+		path := text(v["path"])
+		if path == "" {
+			path = text(v["name"])
+		}
+		actual, ok := v["value"]
+		return path, actual, ok
+	}
+	return "", nil, false
+}
+
+var operators = map[string]string{
+	"eq":                   "equal to",
+	"equal":                "equal to",
+	"equals":               "equal to",
+	"equalto":              "equal to",
+	"is":                   "equal to",
+	"==":                   "equal to",
+	"ne":                   "not equal to",
+	"notequal":             "not equal to",
+	"notequalto":           "not equal to",
+	"isnot":                "not equal to",
+	"!=":                   "not equal to",
+	"gt":                   "greater than",
+	"greaterthan":          "greater than",
+	">":                    "greater than",
+	"gte":                  "at least",
+	"greaterthanorequal":   "at least",
+	"greaterthanorequalto": "at least",
+	"atleast":              "at least",
+	">=":                   "at least",
+	"lt":                   "less than",
+	"lessthan":             "less than",
+	"<":                    "less than",
+	"lte":                  "at most",
+	"lessthanorequal":      "at most",
+	"lessthanorequalto":    "at most",
+	"atmost":               "at most",
+	"<=":                   "at most",
+	"in":                   "one of",
+	"isin":                 "one of",
+	"notin":                "not one of",
+	"contains":             "containing",
+}
+
+// humanOperator turns an engine operator such as GreaterThanOrEqual into words
+func humanOperator(op string) string {
+	key := strings.Map(func(r rune) rune {
+		if r == '_' || r == '-' || unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, op)
+	if h, ok := operators[key]; ok {
+		return h
+	}
+
+	var words []string
+	var word []rune
+	for _, r := range op {
+		switch {
+		case r == '_' || r == '-' || unicode.IsSpace(r):
+			if len(word) > 0 {
+				words = append(words, string(word))
+				word = nil
+			}
+		case unicode.IsUpper(r) && len(word) > 0:
+			words = append(words, string(word))
+			word = []rune{unicode.ToLower(r)}
+		default:
+			word = append(word, unicode.ToLower(r))
+		}
+	}
+	if len(word) > 0 {
+		words = append(words, string(word))
+	}
+	return strings.Join(words, " ")
+}
+
+// text reads a trace field that is either a plain string or an object holding it under value
+func text(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case map[string]interface{}:
+		if s, ok := t["value"].(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+// value formats a value the way it appears in JSON
+func value(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(b)
+}
+
+// compact lists the fields of a condition we couldn't make sense of, without the result
+func compact(m map[string]interface{}) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		if k != "result" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k+"="+value(m[k]))
+	}
+	return "(" + strings.Join(parts, ", ") + ")"
+}
+
+func passedWord(passed bool) string {
+	if passed {
+		return "passed"
+	}
+	return "failed"
+}
+
+func metWord(passed bool) string {
+	if passed {
+		return "met"
+	}
+	return "not met"
+}
+
+func branch(result bool) string {
+	if result {
+		return "true"
+	}
+	return "false"
+}
+
+func metCount(met, total int) string {
+	if met == total {
+		if total == 1 {
+			return "its only condition was"
+		}
+		return fmt.Sprintf("all %d conditions were", total)
+	}
+	return fmt.Sprintf("%d of %d conditions were", met, total)
+}
+
+func notMetCount(failed, total int) string {
+	verb := "were"
+	if failed == 1 {
+		verb = "was"
+	}
+	if total == 1 {
+		return "its only condition was"
+	}
+	return fmt.Sprintf("%d of %d conditions %s", failed, total, verb)
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
@@ -0,0 +1,127 @@
+package explain
+
+import (
+	"testing"
+
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func licenceTrace(age float64, passed bool) map[string]interface{} {
+	return map[string]interface{}{
+		"execution": []interface{}{
+			map[string]interface{}{
+				"selector": map[string]interface{}{"value": "Person"},
+				"outcome":  map[string]interface{}{"value": "gets a driving licence"},
+				"result":   passed,
+				"conditions": []interface{}{
+					map[string]interface{}{
+						"property": map[string]interface{}{"path": "$.person.age", "value": age},
+						"operator": "GreaterThanOrEqual",
+						"value":    map[string]interface{}{"value": float64(18)},
+						"result":   age >= 18,
+					},
+					map[string]interface{}{
+						"rule_name": "passed the driving test",
+						"result":    true,
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	e := Policy(structs.EngineResponse{Result: false, Trace: licenceTrace(16, false)})
+
+	assert.Equal(t, false, e.Result)
+	require.Len(t, e.Steps, 1)
+	st := e.Steps[0]
+	assert.Equal(t, "Person", st.Selector)
+	assert.Equal(t, "gets a driving licence", st.Outcome)
+	assert.False(t, st.Passed)
+
+	require.Len(t, st.Conditions, 2)
+	assert.False(t, st.Conditions[0].Passed)
+	assert.Equal(t, "`$.person.age` is 16, which is not at least 18", st.Conditions[0].Text)
+	assert.True(t, st.Conditions[1].Passed)
+	assert.Equal(t, `the rule "passed the driving test" passed`, st.Conditions[1].Text)
+
+	assert.Equal(t, `The rule "gets a driving licence" for Person failed because 1 of 2 conditions was not met: `+"`$.person.age` is 16, which is not at least 18.", st.Text)
+	assert.Equal(t, "The result is false. "+st.Text, e.Summary)
+	assert.Contains(t, e.Markdown, "**Result:** `false`")
+	assert.Contains(t, e.Markdown, "### 1. gets a driving licence")
+	assert.Contains(t, e.Markdown, "- **failed**: `$.person.age` is 16, which is not at least 18")
+	assert.Contains(t, e.Markdown, `- passed: the rule "passed the driving test" passed`)
+}
+
+func TestPolicy_Passed(t *testing.T) {
+	e := Policy(structs.EngineResponse{Result: true, Trace: licenceTrace(21, true)})
+
+	require.Len(t, e.Steps, 1)
+	assert.Equal(t, `The rule "gets a driving licence" for Person passed because all 2 conditions were met.`, e.Steps[0].Text)
+	assert.Equal(t, "`$.person.age` is 21, which is at least 18", e.Steps[0].Conditions[0].Text)
+}
+
+func TestPolicy_NoTrace(t *testing.T) {
+	e := Policy(structs.EngineResponse{Result: true, Trace: "trace"})
+
+	assert.Empty(t, e.Steps)
+	assert.Equal(t, "The result is true. The engine did not return an execution trace to explain.", e.Summary)
+}
+
+func TestFlow(t *testing.T) {
+	outcome := "referred"
+	fr := structs.FlowResponse{
+		Result: outcome,
+		NodeResponse: []structs.FlowNodeResponse{
+			{
+				NodeID:   "start",
+				NodeType: "start",
+				Response: structs.EngineResponse{Result: false, Trace: licenceTrace(16, false)},
+			},
+			{
+				NodeID:   "refer",
+				NodeType: "custom",
+				// the shape executeNode builds for custom nodes
+				Response: structs.EngineResponse{Result: true, Trace: map[string]interface{}{
+					"execution": []map[string]interface{}{
+						{
+							"conditions": []interface{}{},
+							"outcome":    map[string]interface{}{"value": outcome},
+							"result":     true,
+							"selector":   map[string]interface{}{"value": "custom_response"},
+						},
+					},
+				}},
+			},
+		},
+	}
+
+	e := Flow(fr)
+
+	assert.Equal(t, `The flow returned "referred" after running 2 nodes.`, e.Summary)
+	require.Len(t, e.Steps, 3)
+	assert.Equal(t, `Node "start" (start) returned false, so the flow followed its false branch.`, e.Steps[0].Text)
+	assert.Equal(t, "start", e.Steps[1].NodeID)
+	assert.Equal(t, "gets a driving licence", e.Steps[1].Outcome)
+	assert.Equal(t, `Node "refer" responded with "referred".`, e.Steps[2].Text)
+	assert.Contains(t, e.Markdown, "### 1. Node `start` (start)")
+	assert.Contains(t, e.Markdown, "#### 1. gets a driving licence")
+	assert.Contains(t, e.Markdown, "### 2. Node `refer` (custom)")
+}
+
+func TestHumanOperator(t *testing.T) {
+	tests := map[string]string{
+		"GreaterThanOrEqual": "at least",
+		"less_than":          "less than",
+		"==":                 "equal to",
+		"NotIn":              "not one of",
+		"StartsWith":         "starts with",
+		"is_within_range":    "is within range",
+	}
+	for op, want := range tests {
+		assert.Equal(t, want, humanOperator(op), op)
+	}
+}
@@ -0,0 +1,51 @@
+package flow
+
+import (
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/bugfixes/go-bugfixes/middleware"
+	"time"
+)
+
+// RunStoredFlow runs a saved flow and keeps the outcome in the decision log
+func (s *System) RunStoredFlow(f *structs.StoredFlow, data interface{}) (structs.FlowResponse, error) {
+	start := time.Now()
+	fr, err := s.RunFlowInternal(f.FlowConfig, data)
+	decision.Keep(s.Context, s.Recorder, s.flowDecision(f, data, fr, err, start))
+
+	return fr, err
+}
+
+// flowDecision describes a single run of a flow for the decision log, the trace is every node
+// that ran and the labels are those returned by each policy node
+func (s *System) flowDecision(f *structs.StoredFlow, data interface{}, fr structs.FlowResponse, err error, start time.Time) structs.Decision {
+	d := structs.Decision{
+		Kind:        decision.KindFlow,
+		FlowID:      f.FlowID,
+		BaseFlowID:  f.BaseID,
+		FlowVersion: f.Version,
+		RequestID:   middleware.GetReqID(s.Context),
+		Input:       data,
+		LatencyMs:   float64(time.Since(start)) / float64(time.Millisecond),
+		DecidedAt:   start,
+	}
+	if err != nil {
+		_, d.Error = errors.ToHTTPError(errors.WithFlowID(err, f.FlowID))
+		return d
+	}
+	d.Result = fr.Result
+	d.Trace = fr.NodeResponse
+
+	labels := make(map[string]interface{})
+	for _, nr := range fr.NodeResponse {
+		if nr.Response.Labels != nil {
+			labels[nr.NodeID] = nr.Response.Labels
+		}
+	}
+	if len(labels) > 0 {
+		d.Labels = labels
+	}
+
+	return d
+}
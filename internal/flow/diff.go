@@ -0,0 +1,99 @@
+package flow
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"github.com/1rp-pw/orchestrator/internal/diff"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/etag"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/jackc/pgx/v5"
+	"net/http"
+	"strconv"
+)
+
+// DraftChanges compares an earlier revision of the draft of a base flow with its current one
+func (s *System) DraftChanges(baseFlowId string, since int64) (structs.DraftChanges, error) {
+	c := structs.DraftChanges{
+		BaseID: baseFlowId,
+		Since:  since,
+	}
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return c, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	err = client.QueryRow(s.Context, `SELECT flow_id FROM flows WHERE base_flow_id = $1 AND status = 'draft'`, baseFlowId).Scan(&c.DraftID)
+	if stderrors.Is(err, pgx.ErrNoRows) {
+		return c, errors.WrapFlowError(errors.ErrFlowNotFound, baseFlowId+"@draft", "")
+	}
+	if err != nil {
+		return c, logs.Errorf("failed to load draft: %v", err)
+	}
+
+	draft, err := s.GetFullFlow(c.DraftID)
+	if err != nil {
+		return c, err
+	}
+	c.Revision = draft.Revision
+
+	from := *draft
+	if since != draft.Revision {
+		from.Revision = since
+		err := client.QueryRow(s.Context, `
+			SELECT nodes, edges, tests, flow
+			FROM flow_draft_revisions
+			WHERE flow_id = $1 AND revision = $2`, c.DraftID, since).Scan(&from.Nodes, &from.Edges, &from.Tests, &from.FlatYAML)
+		if stderrors.Is(err, pgx.ErrNoRows) {
+			return c, errors.WrapFlowError(errors.ErrFlowNotFound, fmt.Sprintf("%s@draft revision %d", baseFlowId, since), "")
+		}
+		if err != nil {
+			return c, logs.Errorf("failed to load draft revision: %v", err)
+		}
+	}
+
+	d := FlowDiff(from, *draft)
+	c.Changed = len(d.Flow.Hunks) > 0 || len(d.Nodes.Hunks) > 0 || len(d.Edges.Hunks) > 0 || len(d.Tests.Hunks) > 0
+	c.Flow = &d
+
+	return c, nil
+}
+
+// FlowDiff compares the flow YAML, nodes, edges and tests of two flows
+func FlowDiff(from, to structs.StoredFlow) structs.FlowDiff {
+	return structs.FlowDiff{
+		Flow:  structs.TextDiff{Hunks: diff.Lines(from.FlatYAML, to.FlatYAML)},
+		Nodes: structs.TextDiff{Hunks: diff.Lines(diff.JSONText(from.Nodes), diff.JSONText(to.Nodes))},
+		Edges: structs.TextDiff{Hunks: diff.Lines(diff.JSONText(from.Edges), diff.JSONText(to.Edges))},
+		Tests: structs.TextDiff{Hunks: diff.Lines(diff.JSONText(from.Tests), diff.JSONText(to.Tests))},
+	}
+}
+
+// GetFlowDraftChanges lists what changed in the draft since the revision in since, such as that
+// of an edit that was refused as a conflict
+func (s *System) GetFlowDraftChanges(w http.ResponseWriter, r *http.Request) {
+	s.SetContext(r.Context())
+	flowId := r.PathValue("flowId")
+
+	since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	if err != nil || since <= 0 {
+		errors.WriteHTTPError(w, errors.NewValidationError("since", "since must be a revision of the draft"))
+		return
+	}
+
+	c, err := s.DraftChanges(flowId, since)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	etag.Set(w, c.Revision)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c); err != nil {
+		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
+	}
+}
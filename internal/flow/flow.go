@@ -3,24 +3,47 @@ package flow
 import (
 	"context"
 	"database/sql"
+	stderrors "errors"
 	"fmt"
+	"github.com/1rp-pw/orchestrator/internal/audit"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/effective"
 	"github.com/1rp-pw/orchestrator/internal/engine"
 	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/etag"
+	"github.com/1rp-pw/orchestrator/internal/listing"
 	"github.com/1rp-pw/orchestrator/internal/policy"
+	"github.com/1rp-pw/orchestrator/internal/semver"
 	"github.com/1rp-pw/orchestrator/internal/structs"
 	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/jackc/pgx/v5"
 	ConfigBuilder "github.com/keloran/go-config"
 	"gopkg.in/yaml.v3"
+	"sort"
+	"strings"
 )
 
+// PolicyLoader loads the stored policy a flow node refers to, by policy id or by a
+// {basePolicyId}@{version|latest} reference
+type PolicyLoader interface {
+	ResolvePolicy(ref string) (structs.Policy, error)
+}
+
 type System struct {
-	Config  *ConfigBuilder.Config
-	Context context.Context
+	Config    *ConfigBuilder.Config
+	Context   context.Context
+	Evaluator engine.Evaluator
+	Policies  PolicyLoader
+	Recorder  decision.Recorder
+	Reviews   policy.Reviews
+	Audit     audit.Recorder
 }
 
 func NewSystem(cfg *ConfigBuilder.Config) *System {
 	return &System{
-		Config: cfg,
+		Config:   cfg,
+		Recorder: decision.NewRecorder(cfg),
+		Audit:    audit.NewSystem(cfg),
 	}
 }
 
@@ -29,6 +52,36 @@ func (s *System) SetContext(ctx context.Context) *System {
 	return s
 }
 
+// SetEvaluator evaluates the policy nodes against e instead of the configured engine
+func (s *System) SetEvaluator(e engine.Evaluator) *System {
+	s.Evaluator = e
+	return s
+}
+
+// SetPolicyLoader loads the policy nodes from l instead of the database
+func (s *System) SetPolicyLoader(l PolicyLoader) *System {
+	s.Policies = l
+	return s
+}
+
+// SetReviews only publishes drafts whose review r approved
+func (s *System) SetReviews(r policy.Reviews) *System {
+	s.Reviews = r
+	return s
+}
+
+// SetAudit records every change to flows with a, nil records nothing
+func (s *System) SetAudit(a audit.Recorder) *System {
+	s.Audit = a
+	return s
+}
+
+// SetRecorder swaps where the flow decisions are recorded
+func (s *System) SetRecorder(r decision.Recorder) *System {
+	s.Recorder = r
+	return s
+}
+
 func (s *System) RunTestFlow(f structs.FlowTestRequest) (structs.FlowResponse, error) {
 	flow := f.Flow
 	data := f.Data
@@ -67,7 +120,7 @@ func (s *System) executeNode(node structs.FlowNode, data interface{}) (interface
 		// Execute policy (start nodes also have policyId)
 		response, err := s.flowPolicy(node.PolicyID, data)
 		if err != nil {
-			return nil, nil, logs.Errorf("failed to execute policy node %s: %v", node.ID, err)
+			return nil, nil, errors.WrapFlowError(err, "", node.ID)
 		}
 
 		allResponses = append(allResponses, structs.FlowNodeResponse{
@@ -181,17 +234,26 @@ func (s *System) returnParse(ResponseResult bool, ReturnValue interface{}) bool
 }
 
 func (s *System) flowPolicy(policyId string, data interface{}) (structs.EngineResponse, error) {
-	st := policy.NewSystem(s.Config).SetContext(s.Context)
-	p, err := st.LoadPolicy(policyId)
+	var st PolicyLoader = s.Policies
+	if st == nil {
+		st = policy.NewSystem(s.Config).SetContext(s.Context)
+	}
+	p, err := st.ResolvePolicy(policyId)
 	if err != nil {
-		return structs.EngineResponse{}, logs.Errorf("failed to load policy: %v", err)
+		return structs.EngineResponse{}, logs.Errorf("failed to load policy %s: %w", policyId, err)
 	}
 	p.Data = data
+	if err := policy.ValidateData(p, data); err != nil {
+		return structs.EngineResponse{}, errors.WrapPolicyError(err, policyId)
+	}
 
 	pe := engine.NewSystem(s.Config).SetContext(s.Context)
+	if s.Evaluator != nil {
+		pe.SetEvaluator(s.Evaluator)
+	}
 	pr, err := pe.RunPolicyInternal(p)
 	if err != nil {
-		return structs.EngineResponse{}, logs.Errorf("failed to run policy: %v", err)
+		return structs.EngineResponse{}, logs.Errorf("failed to run policy %s: %w", policyId, err)
 	}
 
 	return *pr, nil
@@ -258,10 +320,56 @@ func (s *System) AllFlows() ([]structs.StoredFlow, error) {
 		}
 		ff = append(ff, f)
 	}
+	if err := rows.Err(); err != nil {
+		return ff, logs.Errorf("failed to load flows: %v", err)
+	}
 
 	return ff, nil
 }
 
+// flowListing lists flow_summary, searching the name, description and flow of every draft and version
+var flowListing = listing.Source{
+	Kind:     decision.KindFlow,
+	View:     "flow_summary",
+	BaseID:   "base_flow_id",
+	Table:    "flows",
+	Document: "t.name || ' ' || COALESCE(t.description, '') || ' ' || t.flow",
+	Live:     "TRUE",
+}
+
+// ListFlows is a page of the flows that match q, along with how many match
+func (s *System) ListFlows(q listing.Query) ([]structs.StoredFlow, listing.Page, error) {
+	ff := make([]structs.StoredFlow, 0)
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return ff, listing.Page{}, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	page, err := listing.Run(s.Context, client, flowListing, q)
+	if err != nil {
+		return ff, page, err
+	}
+
+	for _, row := range page.Rows {
+		ff = append(ff, structs.StoredFlow{
+			BaseID:          row.BaseID,
+			Name:            row.Name,
+			HasDraft:        row.HasDraft,
+			CreatedAt:       row.CreatedAt,
+			UpdatedAt:       row.UpdatedAt,
+			LastPublishedAt: row.LastPublishedAt,
+			Owner:           row.Owner,
+			Tags:            row.Tags,
+			Folder:          row.Folder,
+			Team:            row.Team,
+		})
+	}
+
+	return ff, page, nil
+}
+
 func (s *System) GetFlowVersions(baseFlowId string) ([]structs.StoredFlow, error) {
 	var ff []structs.StoredFlow
 
@@ -280,6 +388,8 @@ func (s *System) GetFlowVersions(baseFlowId string) ([]structs.StoredFlow, error
 			edges,
 			description,
 			status,
+			effective_from,
+			effective_until,
 			created_at,
 			updated_at
 		FROM flows
@@ -301,6 +411,8 @@ func (s *System) GetFlowVersions(baseFlowId string) ([]structs.StoredFlow, error
 		Edges       sql.NullString
 		Description sql.NullString
 		Status      sql.NullString
+		From        sql.NullTime
+		Until       sql.NullTime
 		CreatedAt   sql.NullTime
 		UpdatedAt   sql.NullTime
 	}
@@ -315,6 +427,8 @@ func (s *System) GetFlowVersions(baseFlowId string) ([]structs.StoredFlow, error
 			&d.Edges,
 			&d.Description,
 			&d.Status,
+			&d.From,
+			&d.Until,
 			&d.CreatedAt,
 			&d.UpdatedAt,
 		); err != nil {
@@ -338,10 +452,24 @@ func (s *System) GetFlowVersions(baseFlowId string) ([]structs.StoredFlow, error
 		if d.Version.String != "" {
 			f.Version = d.Version.String
 		}
+		if d.From.Valid {
+			f.EffectiveFrom = &d.From.Time
+		}
+		if d.Until.Valid {
+			f.EffectiveUntil = &d.Until.Time
+		}
 
 		ff = append(ff, f)
 	}
 
+	// drafts first, then the versions from oldest to newest
+	sort.SliceStable(ff, func(i, j int) bool {
+		if ff[i].IsDraft != ff[j].IsDraft {
+			return ff[i].IsDraft
+		}
+		return semver.CompareLabels(ff[i].Version, ff[j].Version) < 0
+	})
+
 	return ff, nil
 }
 
@@ -352,18 +480,31 @@ func (s *System) StoreInitialFlow(f *structs.StoredFlow) (*structs.StoredFlow, e
 	}
 	defer client.Close()
 
-	if err := client.QueryRow(s.Context, `SELECT create_flow($1, $2, $3, $4, $5)`, f.Name, f.Nodes, f.Edges, f.Tests, f.FlatYAML).Scan(&f.FlowID); err != nil {
+	change, err := audit.Begin(s.Context, s.Audit, client, decision.KindFlow, audit.ActionCreate, "")
+	if err != nil {
+		return nil, err
+	}
+	defer change.Close()
+	if err := policy.ShareReferences(s.Context, change); err != nil {
+		return nil, err
+	}
+	if err := change.QueryRow(s.Context, `SELECT create_flow($1, $2, $3, $4, $5)`, f.Name, f.Nodes, f.Edges, f.Tests, f.FlatYAML).Scan(&f.FlowID); err != nil {
 		return nil, logs.Errorf("failed to store initial structs: %v", err)
 	}
 
-	if err := client.QueryRow(s.Context, `SELECT base_flow_id FROM flows WHERE flow_id = $1`, f.FlowID).Scan(&f.BaseID); err != nil {
+	if err := change.QueryRow(s.Context, `SELECT base_flow_id FROM flows WHERE flow_id = $1`, f.FlowID).Scan(&f.BaseID); err != nil {
 		return nil, logs.Errorf("failed to store initial structs: %v", err)
 	}
 	f.Version = "draft"
+	if err := change.Done(f.FlowID, ""); err != nil {
+		return nil, err
+	}
 
 	return f, nil
 }
 
+// StoreFlow updates the draft when it is still at f.Revision, or whatever its revision when that
+// is 0, and sets f.Revision to the revision the draft is at after the edit
 func (s *System) StoreFlow(f *structs.StoredFlow) (*structs.StoredFlow, error) {
 	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
 	if err != nil {
@@ -371,22 +512,123 @@ func (s *System) StoreFlow(f *structs.StoredFlow) (*structs.StoredFlow, error) {
 	}
 	defer client.Close()
 
-	if _, err := client.Exec(s.Context, `SELECT update_draft_flow($1, $2, $3, $4, $5, $6)`, f.BaseID, f.Nodes, f.Edges, f.Tests, f.FlatYAML, f.Description); err != nil {
+	var expected interface{}
+	if f.Revision != 0 {
+		expected = f.Revision
+	}
+
+	change, err := audit.Begin(s.Context, s.Audit, client, decision.KindFlow, audit.ActionUpdate, f.BaseID)
+	if err != nil {
+		return nil, err
+	}
+	defer change.Close()
+	if err := policy.ShareReferences(s.Context, change); err != nil {
+		return nil, err
+	}
+	var updated bool
+	var revision sql.NullInt64
+	if err := change.QueryRow(s.Context, `
+		SELECT updated, current_revision
+		FROM update_draft_flow($1, $2, $3, $4, $5, $6, $7)`,
+		f.BaseID, f.Nodes, f.Edges, f.Tests, f.FlatYAML, f.Description, expected).Scan(&updated, &revision); err != nil {
 		return nil, logs.Errorf("failed to store initial structs: %v", err)
 	}
+	if !revision.Valid {
+		return nil, errors.WrapFlowError(errors.ErrFlowNotFound, f.BaseID, "")
+	}
+	if !updated {
+		return nil, etag.Conflict(f.BaseID, revision.Int64)
+	}
+	f.Revision = revision.Int64
+	if err := change.Done(f.BaseID, ""); err != nil {
+		return nil, err
+	}
 
 	return f, nil
 }
 
+// checkDraftRevision fails with a conflict when the draft that is about to be published isn't
+// at the revision m asks for
+func (s *System) checkDraftRevision(baseFlowId string, m etag.Match) error {
+	revision, err := s.draftRevision(baseFlowId)
+	if err != nil {
+		return err
+	}
+	if revision != 0 && !m.Matches(revision) {
+		return etag.Conflict(baseFlowId, revision)
+	}
+	return nil
+}
+
+// draftRevision is the revision the draft of a base flow is at, 0 when there is none as
+// publishing reports the missing draft
+func (s *System) draftRevision(baseFlowId string) (int64, error) {
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return 0, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	var revision int64
+	err = client.QueryRow(s.Context, `SELECT revision FROM flows WHERE base_flow_id = $1 AND status = 'draft'`, baseFlowId).Scan(&revision)
+	if stderrors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, logs.Errorf("failed to load draft: %v", err)
+	}
+	return revision, nil
+}
+
 func (s *System) CreateVersion(f *structs.StoredFlow) (*structs.StoredFlow, error) {
+	if err := effective.Validate(f.EffectiveFrom, f.EffectiveUntil); err != nil {
+		return f, err
+	}
+
+	version, err := s.nextVersion(f)
+	if err != nil {
+		return f, err
+	}
+	f.Version = version
+
+	// the draft is published at the revision it is at now, an edit since stops the publish
+	revision := f.Revision
+	if revision == 0 {
+		if revision, err = s.draftRevision(f.BaseID); err != nil {
+			return f, err
+		}
+	}
+	var expected interface{}
+	if revision != 0 {
+		expected = revision
+	}
+
 	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
 	if err != nil {
 		return f, logs.Errorf("failed to connect to database: %v", err)
 	}
 	defer client.Close()
 
+	change, err := audit.Begin(s.Context, s.Audit, client, decision.KindFlow, audit.ActionPublish, f.BaseID)
+	if err != nil {
+		return nil, err
+	}
+	defer change.Close()
+	if err := policy.ShareReferences(s.Context, change); err != nil {
+		return nil, err
+	}
+	var reviewId int64
+	if s.Reviews != nil {
+		if reviewId, err = s.Reviews.Approved(s.Context, change, decision.KindFlow, f.BaseID); err != nil {
+			return nil, err
+		}
+	}
 	var flowId sql.NullString
-	if err := client.QueryRow(s.Context, `SELECT publish_draft_flow_as_version($1, $2, $3)`, f.BaseID, f.Version, f.Description).Scan(&flowId); err != nil {
+	if err := change.QueryRow(s.Context, `SELECT publish_draft_flow_as_version($1, $2, $3, $4, $5, $6)`, f.BaseID, f.Version, f.Description, f.EffectiveFrom, f.EffectiveUntil, expected).Scan(&flowId); err != nil {
+		if etag.Moved(err) {
+			current, _ := s.draftRevision(f.BaseID)
+			return nil, etag.Conflict(f.BaseID, current)
+		}
 		return nil, logs.Errorf("failed to create version: %v", err)
 	}
 
@@ -395,10 +637,47 @@ func (s *System) CreateVersion(f *structs.StoredFlow) (*structs.StoredFlow, erro
 	} else {
 		return f, logs.Errorf("failed to create version: %v", err)
 	}
+	if reviewId != 0 {
+		if err := s.Reviews.Published(s.Context, change, reviewId, f.Version); err != nil {
+			return nil, err
+		}
+	}
+	if err := change.Done(f.FlowID, f.Version); err != nil {
+		return nil, err
+	}
 
 	return f, nil
 }
 
+// nextVersion is the label f is published as
+func (s *System) nextVersion(f *structs.StoredFlow) (string, error) {
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return "", logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	rows, err := client.Query(s.Context, `SELECT version FROM flows WHERE base_flow_id = $1 AND version IS NOT NULL`, f.BaseID)
+	if err != nil {
+		return "", logs.Errorf("failed to load versions: %v", err)
+	}
+	defer rows.Close()
+
+	var existing []string
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			return "", logs.Errorf("failed to load versions: %v", err)
+		}
+		existing = append(existing, version)
+	}
+	if err := rows.Err(); err != nil {
+		return "", logs.Errorf("failed to load versions: %v", err)
+	}
+
+	return semver.Next(existing, f.Version, f.Bump)
+}
+
 func (s *System) GetStoredFlow(flowId string) (*structs.FlowConfig, error) {
 	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
 	if err != nil {
@@ -438,6 +717,9 @@ func (s *System) GetFullFlow(flowId string) (*structs.StoredFlow, error) {
 		    tests,
 		    version,
 		    status,
+		    revision,
+		    effective_from,
+		    effective_until,
 		    created_at,
 		    updated_at
 		FROM flows 
@@ -452,6 +734,9 @@ func (s *System) GetFullFlow(flowId string) (*structs.StoredFlow, error) {
 		&f.Tests,
 		&f.VerNull,
 		&f.Status,
+		&f.Revision,
+		&f.EffectiveFrom,
+		&f.EffectiveUntil,
 		&f.CreatedAt,
 		&f.UpdatedAt); err != nil {
 		return nil, logs.Errorf("failed to get flow: %v", err)
@@ -465,11 +750,75 @@ func (s *System) GetFullFlow(flowId string) (*structs.StoredFlow, error) {
 	}
 	if f.Status == "draft" {
 		f.IsDraft = true
+	} else {
+		f.Revision = 0
 	}
 
 	return &f, nil
 }
 
+// ResolveFlow loads a flow by its flow id or by a {baseFlowId}@{version|latest|channel}
+// reference, latest is the version in force at the asOf of the system context, or now, and a
+// channel such as prod leads to the version it points at
+func (s *System) ResolveFlow(ref string) (*structs.StoredFlow, error) {
+	baseFlowId, version, ok := strings.Cut(ref, "@")
+	if !ok {
+		return s.GetFullFlow(ref)
+	}
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return nil, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	var flowId string
+	if version == "latest" {
+		err = client.QueryRow(s.Context, `
+			SELECT flow_id
+			FROM flows
+			WHERE base_flow_id = $1 AND status = 'version' AND `+effective.Condition("$2")+`
+			ORDER BY `+effective.Order+`
+			LIMIT 1`, baseFlowId, effective.Param(s.Context)).Scan(&flowId)
+	} else {
+		err = pgx.ErrNoRows
+		if _, perr := semver.Parse(version); perr != nil {
+			if asOf := effective.AsOf(s.Context); !asOf.IsZero() {
+				// the version the channel pointed at then, it may have been promoted since
+				err = client.QueryRow(s.Context, `
+					SELECT flow_id
+					FROM flows
+					WHERE base_flow_id::text = $1 AND version = (
+					    SELECT version
+					    FROM channel_history
+					    WHERE kind = 'flow' AND base_id = $1 AND channel = $2 AND promoted_at <= $3
+					    ORDER BY promoted_at DESC, id DESC
+					    LIMIT 1)`, baseFlowId, version, asOf).Scan(&flowId)
+			} else {
+				err = client.QueryRow(s.Context, `
+					SELECT f.flow_id
+					FROM channels c
+					JOIN flows f ON f.base_flow_id::text = c.base_id AND f.version = c.version
+					WHERE c.kind = 'flow' AND c.base_id = $1 AND c.channel = $2`, baseFlowId, version).Scan(&flowId)
+			}
+		}
+		if err != nil {
+			err = client.QueryRow(s.Context, `
+				SELECT flow_id
+				FROM flows
+				WHERE base_flow_id = $1 AND version = ANY($2)`, baseFlowId, semver.StoredLabels(version)).Scan(&flowId)
+		}
+	}
+	if stderrors.Is(err, pgx.ErrNoRows) {
+		return nil, errors.WrapFlowError(errors.ErrFlowNotFound, ref, "")
+	}
+	if err != nil {
+		return nil, logs.Errorf("failed to resolve flow %s: %v", ref, err)
+	}
+
+	return s.GetFullFlow(flowId)
+}
+
 func (s *System) DraftFromVersion(flowId string) (*structs.StoredFlow, error) {
 	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
 	if err != nil {
@@ -486,9 +835,20 @@ func (s *System) DraftFromVersion(flowId string) (*structs.StoredFlow, error) {
 
 	var newFlowId sql.NullString
 	if baseFlowId.Valid {
-		if err := client.QueryRow(s.Context, `SELECT create_draft_flow_from_version($1, $2)`, baseFlowId.String, version.String).Scan(&newFlowId); err != nil {
+		change, err := audit.Begin(s.Context, s.Audit, client, decision.KindFlow, audit.ActionDraft, flowId)
+		if err != nil {
+			return nil, err
+		}
+		defer change.Close()
+		if err := policy.ShareReferences(s.Context, change); err != nil {
+			return nil, err
+		}
+		if err := change.QueryRow(s.Context, `SELECT create_draft_flow_from_version($1, $2)`, baseFlowId.String, version.String).Scan(&newFlowId); err != nil {
 			return nil, logs.Errorf("failed to get flow: %v", err)
 		}
+		if err := change.Done(newFlowId.String, ""); err != nil {
+			return nil, err
+		}
 	}
 
 	return s.GetFullFlow(newFlowId.String)
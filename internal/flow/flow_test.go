@@ -3,10 +3,17 @@ package flow
 import (
 	"context"
 	"database/sql"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/effective"
+	"github.com/1rp-pw/orchestrator/internal/engine"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/listing"
 	"github.com/1rp-pw/orchestrator/internal/structs"
 	ConfigBuilder "github.com/keloran/go-config"
 	"github.com/stretchr/testify/assert"
@@ -61,6 +68,20 @@ func setupTestDatabase(t *testing.T) (*postgres.PostgresContainer, *ConfigBuilde
 		t.Fatalf("Failed to execute flow schema SQL: %v", err)
 	}
 
+	metadataSQL, err := os.ReadFile("../../sql/metadata.sql")
+	require.NoError(t, err)
+	_, err = client.Exec(ctx, string(metadataSQL))
+	if err != nil {
+		t.Fatalf("Failed to execute metadata schema SQL: %v", err)
+	}
+
+	auditSQL, err := os.ReadFile("../../sql/audit.sql")
+	require.NoError(t, err)
+	_, err = client.Exec(ctx, string(auditSQL))
+	if err != nil {
+		t.Fatalf("Failed to execute audit schema SQL: %v", err)
+	}
+
 	return pgContainer, cfg
 }
 
@@ -163,6 +184,63 @@ func TestSystem_StoreFlow(t *testing.T) {
 	assert.Equal(t, updatedFlow.FlatYAML, loaded.FlatYAML)
 }
 
+func TestSystem_StoreFlowRevision(t *testing.T) {
+	pgContainer, cfg := setupTestDatabase(t)
+	defer func() {
+		if pgContainer != nil {
+			if err := pgContainer.Terminate(context.Background()); err != nil {
+				t.Logf("failed to terminate container: %v", err)
+			}
+		}
+	}()
+
+	s := NewSystem(cfg)
+	s.SetContext(context.Background())
+
+	created, err := s.StoreInitialFlow(&structs.StoredFlow{
+		Name:     "Revision Flow",
+		Nodes:    []interface{}{},
+		Edges:    []interface{}{},
+		Tests:    []interface{}{},
+		FlatYAML: `flow: initial`,
+	})
+	require.NoError(t, err)
+
+	draft, err := s.GetFullFlow(created.FlowID)
+	require.NoError(t, err)
+	require.NotZero(t, draft.Revision)
+
+	first, err := s.StoreFlow(&structs.StoredFlow{BaseID: created.BaseID, FlatYAML: `flow: first`, Revision: draft.Revision})
+	require.NoError(t, err)
+	assert.NotEqual(t, draft.Revision, first.Revision)
+
+	_, err = s.StoreFlow(&structs.StoredFlow{BaseID: created.BaseID, FlatYAML: `flow: second`, Revision: draft.Revision})
+	var conflict *errors.RevisionConflictError
+	require.ErrorAs(t, err, &conflict)
+	assert.Equal(t, first.Revision, conflict.Revision)
+
+	changes, err := s.DraftChanges(created.BaseID, draft.Revision)
+	require.NoError(t, err)
+	assert.True(t, changes.Changed)
+	require.NotNil(t, changes.Flow)
+	assert.Len(t, changes.Flow.Flow.Hunks, 1)
+	assert.Empty(t, changes.Flow.Nodes.Hunks)
+
+	published, err := s.CreateVersion(&structs.StoredFlow{BaseID: created.BaseID, Version: "v1.0", Description: "first"})
+	require.NoError(t, err)
+	version, err := s.GetFullFlow(published.FlowID)
+	require.NoError(t, err)
+	assert.Zero(t, version.Revision, "only drafts have revisions")
+}
+
+func TestUpdateFlow_RequiresIfMatch(t *testing.T) {
+	s := &System{}
+
+	w := httptest.NewRecorder()
+	s.UpdateFlow(w, httptest.NewRequest("PUT", "/flow/abc", nil))
+	assert.Equal(t, http.StatusPreconditionRequired, w.Code)
+}
+
 func TestSystem_CreateVersion(t *testing.T) {
 	pgContainer, cfg := setupTestDatabase(t)
 	defer func() {
@@ -211,6 +289,124 @@ func TestSystem_CreateVersion(t *testing.T) {
 	assert.Equal(t, "First version release", versions[0].Description)
 }
 
+func TestSystem_ResolveFlow_Effective(t *testing.T) {
+	pgContainer, cfg := setupTestDatabase(t)
+	defer func() {
+		if pgContainer != nil {
+			if err := pgContainer.Terminate(context.Background()); err != nil {
+				t.Logf("failed to terminate container: %v", err)
+			}
+		}
+	}()
+
+	s := NewSystem(cfg)
+	s.SetContext(context.Background())
+
+	created, err := s.StoreInitialFlow(&structs.StoredFlow{
+		Name:     "Scheduled Flow",
+		Nodes:    []interface{}{},
+		Edges:    []interface{}{},
+		Tests:    []interface{}{},
+		FlatYAML: `flow: current`,
+	})
+	require.NoError(t, err)
+	until := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	v1, err := s.CreateVersion(&structs.StoredFlow{BaseID: created.BaseID, Version: "1.0.0", Description: "Expiring release", EffectiveUntil: &until})
+	require.NoError(t, err)
+	_, err = s.DraftFromVersion(v1.FlowID)
+	require.NoError(t, err)
+	_, err = s.StoreFlow(&structs.StoredFlow{BaseID: created.BaseID, FlatYAML: `flow: scheduled`})
+	require.NoError(t, err)
+	_, err = s.CreateVersion(&structs.StoredFlow{BaseID: created.BaseID, Version: "1.1.0", Description: "Scheduled release", EffectiveFrom: &until})
+	require.NoError(t, err)
+
+	latest, err := s.ResolveFlow(created.BaseID + "@latest")
+	require.NoError(t, err)
+	assert.Equal(t, v1.FlowID, latest.FlowID)
+	require.NotNil(t, latest.EffectiveUntil)
+	assert.True(t, until.Equal(*latest.EffectiveUntil))
+
+	s.SetContext(effective.WithAsOf(context.Background(), until))
+	latest, err = s.ResolveFlow(created.BaseID + "@latest")
+	require.NoError(t, err)
+	assert.Equal(t, "flow: scheduled", latest.FlatYAML)
+
+	versions, err := s.GetFlowVersions(created.BaseID)
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	for _, v := range versions {
+		assert.True(t, v.EffectiveFrom != nil || v.EffectiveUntil != nil)
+	}
+}
+
+func TestSystem_CreateVersion_EffectiveValidation(t *testing.T) {
+	s := &System{}
+
+	from := time.Now()
+	_, err := s.CreateVersion(&structs.StoredFlow{BaseID: "abc", EffectiveFrom: &from, EffectiveUntil: &from})
+	var validationErr *errors.ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "effectiveUntil", validationErr.Field)
+}
+
+func TestSystem_Rollback(t *testing.T) {
+	pgContainer, cfg := setupTestDatabase(t)
+	defer func() {
+		if pgContainer != nil {
+			if err := pgContainer.Terminate(context.Background()); err != nil {
+				t.Logf("failed to terminate container: %v", err)
+			}
+		}
+	}()
+
+	s := NewSystem(cfg)
+	s.SetContext(context.Background())
+
+	created, err := s.StoreInitialFlow(&structs.StoredFlow{
+		Name:     "Rollback Flow",
+		Nodes:    []interface{}{},
+		Edges:    []interface{}{},
+		Tests:    []interface{}{},
+		FlatYAML: `flow: good`,
+	})
+	require.NoError(t, err)
+	v1, err := s.CreateVersion(&structs.StoredFlow{BaseID: created.BaseID, Version: "1.0.0", Description: "Good release"})
+	require.NoError(t, err)
+	_, err = s.DraftFromVersion(v1.FlowID)
+	require.NoError(t, err)
+	_, err = s.StoreFlow(&structs.StoredFlow{BaseID: created.BaseID, FlatYAML: `flow: bad`})
+	require.NoError(t, err)
+	_, err = s.CreateVersion(&structs.StoredFlow{BaseID: created.BaseID, Version: "1.1.0", Description: "Bad release"})
+	require.NoError(t, err)
+
+	_, err = s.Rollback(created.BaseID, structs.RollbackRequest{Version: "1.1.0", Reason: "already latest"})
+	assert.ErrorIs(t, err, errors.ErrAlreadyActive)
+
+	rb, err := s.Rollback(created.BaseID, structs.RollbackRequest{Version: "1.0.0", Reason: "bad routing"})
+	require.NoError(t, err)
+	assert.Equal(t, "v1.1.1", rb.PublishedAs)
+	assert.Empty(t, rb.DraftID)
+
+	latest, err := s.ResolveFlow(created.BaseID + "@latest")
+	require.NoError(t, err)
+	assert.Equal(t, rb.ID, latest.FlowID)
+	assert.Equal(t, "flow: good", latest.FlatYAML)
+	assert.Equal(t, "Rollback to v1.0.0: bad routing", latest.Description)
+
+	versions, err := s.GetFlowVersions(created.BaseID)
+	require.NoError(t, err)
+	assert.Len(t, versions, 3)
+}
+
+func TestSystem_Rollback_Validation(t *testing.T) {
+	s := &System{}
+
+	_, err := s.Rollback("abc", structs.RollbackRequest{Version: "1.0.0"})
+	var validationErr *errors.ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "reason", validationErr.Field)
+}
+
 func TestSystem_GetStoredFlow(t *testing.T) {
 	pgContainer, cfg := setupTestDatabase(t)
 	defer func() {
@@ -411,6 +607,49 @@ func TestSystem_AllFlows(t *testing.T) {
 	}
 }
 
+func TestSystem_ListFlows(t *testing.T) {
+	pgContainer, cfg := setupTestDatabase(t)
+	defer func() {
+		if pgContainer != nil {
+			if err := pgContainer.Terminate(context.Background()); err != nil {
+				t.Logf("failed to terminate container: %v", err)
+			}
+		}
+	}()
+
+	s := NewSystem(cfg)
+	s.SetContext(context.Background())
+
+	for i := 0; i < 3; i++ {
+		flow := &structs.StoredFlow{
+			Name: "Test Flow " + string(rune('A'+i)),
+			Nodes: []interface{}{
+				map[string]interface{}{"id": "node"},
+			},
+			Edges: []interface{}{
+				map[string]interface{}{"id": "edge"},
+			},
+			Tests: []interface{}{
+				map[string]interface{}{"id": "test"},
+			},
+			FlatYAML: `flow: test`,
+		}
+		_, err := s.StoreInitialFlow(flow)
+		require.NoError(t, err)
+	}
+
+	flows, page, err := s.ListFlows(listing.Query{Sort: "name", Limit: listing.DefaultLimit})
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, len(flows), 3)
+	assert.Equal(t, len(flows), page.Total)
+
+	for _, f := range flows {
+		assert.NotEmpty(t, f.BaseID)
+		assert.NotEmpty(t, f.Name)
+		assert.True(t, f.HasDraft)
+	}
+}
+
 func TestSystem_GetFlowVersions(t *testing.T) {
 	pgContainer, cfg := setupTestDatabase(t)
 	defer func() {
@@ -617,4 +856,191 @@ func TestSystem_CompleteWorkflow(t *testing.T) {
 	assert.Len(t, versions, 2)
 	assert.Equal(t, "v1.0", versions[0].Version)
 	assert.Equal(t, "v2.0", versions[1].Version)
-}
\ No newline at end of file
+}
+
+type fakePolicies map[string]structs.Policy
+
+func (f fakePolicies) ResolvePolicy(ref string) (structs.Policy, error) {
+	p, ok := f[ref]
+	if !ok {
+		return structs.Policy{}, errors.ErrPolicyNotFound
+	}
+	return p, nil
+}
+
+func TestSystem_RunFlowInternal_FakeEvaluator(t *testing.T) {
+	fe := engine.NewFakeEvaluator().
+		OnPolicy("age-check", structs.EngineResponse{Result: true}).
+		OnPolicy("score-check", structs.EngineResponse{Result: false})
+
+	s := NewSystem(ConfigBuilder.NewConfigNoVault()).
+		SetContext(context.Background()).
+		SetEvaluator(fe).
+		SetPolicyLoader(fakePolicies{
+			"age-check":   {PolicyID: "age-check", Rule: "age rule"},
+			"score-check": {PolicyID: "score-check", Rule: "score rule"},
+		})
+
+	flowConfig := structs.FlowConfig{
+		Flow: structs.Flow{
+			Start: []structs.FlowNode{
+				{
+					ID:       "start-1",
+					Type:     "start",
+					PolicyID: "age-check",
+					OnTrue: []structs.FlowNode{
+						{
+							ID:       "policy-1",
+							Type:     "policy",
+							PolicyID: "score-check",
+							OnTrue:   []structs.FlowNode{{ID: "return-1", Type: "return", ReturnValue: "approved"}},
+							OnFalse:  []structs.FlowNode{{ID: "return-2", Type: "return", ReturnValue: "rejected"}},
+						},
+					},
+					OnFalse: []structs.FlowNode{{ID: "return-3", Type: "return", ReturnValue: "too young"}},
+				},
+			},
+		},
+	}
+
+	response, err := s.RunFlowInternal(flowConfig, map[string]interface{}{"age": 18})
+	require.NoError(t, err)
+	assert.Equal(t, "rejected", response.Result)
+	require.Len(t, response.NodeResponse, 2)
+	assert.Equal(t, "start-1", response.NodeResponse[0].NodeID)
+	assert.Equal(t, "policy-1", response.NodeResponse[1].NodeID)
+
+	calls := fe.Calls()
+	require.Len(t, calls, 2)
+	assert.Equal(t, "age rule", calls[0].Rule)
+	assert.Equal(t, map[string]interface{}{"age": 18}, calls[1].Data)
+}
+
+func TestSystem_RunFlowInternal_EngineError(t *testing.T) {
+	fe := engine.NewFakeEvaluator().
+		OnPolicy("age-check", structs.EngineResponse{Result: true}).
+		OnPolicyError("score-check", errors.NewEngineError(errors.EngineTransport, "", "connection refused"))
+
+	s := NewSystem(ConfigBuilder.NewConfigNoVault()).
+		SetContext(context.Background()).
+		SetEvaluator(fe).
+		SetPolicyLoader(fakePolicies{
+			"age-check":   {PolicyID: "age-check"},
+			"score-check": {PolicyID: "score-check"},
+		})
+
+	flowConfig := structs.FlowConfig{
+		Flow: structs.Flow{
+			Start: []structs.FlowNode{
+				{
+					ID:       "start-1",
+					Type:     "start",
+					PolicyID: "age-check",
+					OnTrue:   []structs.FlowNode{{ID: "policy-1", Type: "policy", PolicyID: "score-check"}},
+				},
+			},
+		},
+	}
+
+	_, err := s.RunFlowInternal(flowConfig, map[string]interface{}{"age": 18})
+	require.Error(t, err)
+	assert.True(t, errors.IsEngineError(err))
+
+	var flowErr *errors.FlowError
+	require.ErrorAs(t, err, &flowErr)
+	assert.Equal(t, "policy-1", flowErr.NodeID)
+
+	rec := httptest.NewRecorder()
+	errors.WriteHTTPError(rec, errors.WithFlowID(err, "flow-1"))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"code":"ENGINE_UNAVAILABLE"`)
+	assert.Contains(t, rec.Body.String(), `"nodeId":"policy-1"`)
+	assert.Contains(t, rec.Body.String(), `"flowId":"flow-1"`)
+}
+
+func TestSystem_RunFlowInternal_ValidationError(t *testing.T) {
+	fe := engine.NewFakeEvaluator().Default(structs.EngineResponse{Result: true})
+
+	s := NewSystem(ConfigBuilder.NewConfigNoVault()).
+		SetContext(context.Background()).
+		SetEvaluator(fe).
+		SetPolicyLoader(fakePolicies{
+			"age-check": {
+				PolicyID:  "age-check",
+				DataModel: `{"type": "object", "properties": {"age": {"type": "integer"}}}`,
+			},
+		})
+
+	flowConfig := structs.FlowConfig{
+		Flow: structs.Flow{
+			Start: []structs.FlowNode{{ID: "start-1", Type: "start", PolicyID: "age-check"}},
+		},
+	}
+
+	_, err := s.RunFlowInternal(flowConfig, map[string]interface{}{"age": "eighteen"})
+	require.Error(t, err)
+	assert.Empty(t, fe.Calls())
+
+	rec := httptest.NewRecorder()
+	errors.WriteHTTPError(rec, errors.WithFlowID(err, "flow-1"))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"code":"VALIDATION_ERROR"`)
+	assert.Contains(t, rec.Body.String(), `"pointer":"/age"`)
+	assert.Contains(t, rec.Body.String(), `"nodeId":"start-1"`)
+	assert.Contains(t, rec.Body.String(), `"policyId":"age-check"`)
+}
+
+func TestSystem_RunStoredFlow_RecordsDecision(t *testing.T) {
+	fe := engine.NewFakeEvaluator().
+		OnPolicy("age-check", structs.EngineResponse{Result: true, Labels: "adult"})
+	rec := decision.NewMemoryRecorder()
+
+	s := NewSystem(ConfigBuilder.NewConfigNoVault()).
+		SetContext(context.Background()).
+		SetEvaluator(fe).
+		SetRecorder(rec).
+		SetPolicyLoader(fakePolicies{
+			"age-check": {PolicyID: "age-check"},
+		})
+
+	f := &structs.StoredFlow{
+		FlowID:  "flow-1",
+		BaseID:  "base-flow-1",
+		Version: "v1.0",
+		FlowConfig: structs.FlowConfig{
+			Flow: structs.Flow{
+				Start: []structs.FlowNode{
+					{
+						ID:       "start-1",
+						Type:     "start",
+						PolicyID: "age-check",
+						OnTrue:   []structs.FlowNode{{ID: "return-1", Type: "return", ReturnValue: "approved"}},
+					},
+				},
+			},
+		},
+	}
+
+	response, err := s.RunStoredFlow(f, map[string]interface{}{"age": 18})
+	require.NoError(t, err)
+	assert.Equal(t, "approved", response.Result)
+
+	dd := rec.Decisions()
+	require.Len(t, dd, 1)
+	assert.Equal(t, decision.KindFlow, dd[0].Kind)
+	assert.Equal(t, "flow-1", dd[0].FlowID)
+	assert.Equal(t, "base-flow-1", dd[0].BaseFlowID)
+	assert.Equal(t, "v1.0", dd[0].FlowVersion)
+	assert.Equal(t, "approved", dd[0].Result)
+	assert.Equal(t, map[string]interface{}{"start-1": "adult"}, dd[0].Labels)
+	assert.Equal(t, response.NodeResponse, dd[0].Trace)
+
+	f.FlowConfig.Flow.Start[0].PolicyID = "missing"
+	_, err = s.RunStoredFlow(f, map[string]interface{}{"age": 18})
+	require.Error(t, err)
+
+	dd = rec.Decisions()
+	require.Len(t, dd, 2)
+	assert.Nil(t, dd[1].Result)
+	assert.NotNil(t, dd[1].Error)
+}
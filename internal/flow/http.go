@@ -2,7 +2,11 @@ package flow
 
 import (
 	"encoding/json"
+	"github.com/1rp-pw/orchestrator/internal/effective"
 	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/etag"
+	"github.com/1rp-pw/orchestrator/internal/explain"
+	"github.com/1rp-pw/orchestrator/internal/listing"
 	"github.com/1rp-pw/orchestrator/internal/structs"
 	"github.com/bugfixes/go-bugfixes/logs"
 	"net/http"
@@ -41,15 +45,24 @@ func (s *System) TestFlow(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// GetAllFlows lists a page of the flows, see listing.FromRequest for the query. The total count
+// and the cursor of the next page are sent as headers
 func (s *System) GetAllFlows(w http.ResponseWriter, r *http.Request) {
 	s.SetContext(r.Context())
 
-	f, err := s.AllFlows()
+	q, err := listing.FromRequest(r)
 	if err != nil {
 		errors.WriteHTTPError(w, err)
 		return
 	}
 
+	f, page, err := s.ListFlows(q)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	listing.WriteHeaders(w, r, page)
 	if err := json.NewEncoder(w).Encode(f); err != nil {
 		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
 	}
@@ -108,29 +121,68 @@ func (s *System) ListFlowVersions(w http.ResponseWriter, r *http.Request) {
 
 func (s *System) RunFlow(w http.ResponseWriter, r *http.Request) {
 	s.SetContext(r.Context())
-	flowId := r.PathValue("flowId")
 
-	f, err := s.GetStoredFlow(flowId)
+	flowResult, err := s.runFlowRequest(r)
 	if err != nil {
 		errors.WriteHTTPError(w, err)
 		return
 	}
-
-	var flowRequest interface{}
-	if err := json.NewDecoder(r.Body).Decode(&flowRequest); err != nil {
-		errors.WriteHTTPError(w, errors.NewValidationError("body", "invalid JSON format"))
-		return
+	if err := json.NewEncoder(w).Encode(flowResult); err != nil {
+		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
 	}
+}
 
-	flowResult, err := s.RunFlowInternal(*f, flowRequest)
+// ExplainFlow runs the flow like RunFlow and explains each node that ran
+func (s *System) ExplainFlow(w http.ResponseWriter, r *http.Request) {
+	s.SetContext(r.Context())
+
+	flowResult, err := s.runFlowRequest(r)
 	if err != nil {
 		errors.WriteHTTPError(w, err)
+		return
 	}
-	if err := json.NewEncoder(w).Encode(flowResult); err != nil {
+	if err := json.NewEncoder(w).Encode(structs.ExplainResponse{
+		Response:    flowResult,
+		Explanation: explain.Flow(flowResult),
+	}); err != nil {
 		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
 	}
 }
 
+// runFlowRequest runs the stored flow named in the path against the body, by flow id or by a
+// {baseFlowId}@{version|latest|channel} reference. asOf runs the flow and the policies that
+// were latest then
+func (s *System) runFlowRequest(r *http.Request) (structs.FlowResponse, error) {
+	flowId := r.PathValue("flowId")
+
+	ctx, err := effective.FromRequest(r)
+	if err != nil {
+		return structs.FlowResponse{}, err
+	}
+	fs := *s
+	fs.Context = ctx
+
+	f, err := fs.ResolveFlow(flowId)
+	if err != nil {
+		return structs.FlowResponse{}, err
+	}
+	if err := yaml.Unmarshal([]byte(f.FlatYAML), &f.FlowConfig); err != nil {
+		return structs.FlowResponse{}, errors.WrapFlowError(errors.ErrInvalidFlow, flowId, "")
+	}
+
+	var flowRequest interface{}
+	if err := json.NewDecoder(r.Body).Decode(&flowRequest); err != nil {
+		return structs.FlowResponse{}, errors.NewValidationError("body", "invalid JSON format")
+	}
+
+	flowResult, err := fs.RunStoredFlow(f, flowRequest)
+	if err != nil {
+		return structs.FlowResponse{}, errors.WithFlowID(err, flowId)
+	}
+
+	return flowResult, nil
+}
+
 func (s *System) GetFlow(w http.ResponseWriter, r *http.Request) {
 	s.SetContext(r.Context())
 	flowId := r.PathValue("flowId")
@@ -141,14 +193,25 @@ func (s *System) GetFlow(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if f.IsDraft {
+		etag.Set(w, f.Revision)
+	}
 	if err := json.NewEncoder(w).Encode(f); err != nil {
 		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
 	}
 }
 
+// UpdateFlow edits or publishes the draft, If-Match has to hold the ETag or revision of the
+// draft as it was loaded so an edit made since isn't overwritten
 func (s *System) UpdateFlow(w http.ResponseWriter, r *http.Request) {
 	s.SetContext(r.Context())
 
+	m, err := etag.IfMatch(r)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
 	var f structs.FlowRequest
 	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
 		errors.WriteHTTPError(w, errors.NewValidationError("body", "invalid JSON format"))
@@ -174,23 +237,33 @@ func (s *System) UpdateFlow(w http.ResponseWriter, r *http.Request) {
 	}
 	if f.Status == "published" {
 		sf.Version = f.Version
+		sf.Bump = f.Bump
+		sf.EffectiveFrom = f.EffectiveFrom
+		sf.EffectiveUntil = f.EffectiveUntil
 	}
 
 	var rf interface{}
 
 	if f.Status != "draft" {
+		if err := s.checkDraftRevision(sf.BaseID, m); err != nil {
+			etag.WriteError(w, err)
+			return
+		}
+		sf.Revision = m.Revision
 		rff, err := s.CreateVersion(&sf)
 		if err != nil {
-			errors.WriteHTTPError(w, err)
+			etag.WriteError(w, err)
 			return
 		}
 		rf = rff
 	} else {
+		sf.Revision = m.Revision
 		rff, err := s.StoreFlow(&sf)
 		if err != nil {
-			errors.WriteHTTPError(w, err)
+			etag.WriteError(w, err)
 			return
 		}
+		etag.Set(w, rff.Revision)
 		rf = rff
 	}
 
@@ -199,6 +272,29 @@ func (s *System) UpdateFlow(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// RollbackFlow makes the version in the body the latest again, the draft is kept
+func (s *System) RollbackFlow(w http.ResponseWriter, r *http.Request) {
+	s.SetContext(r.Context())
+
+	var req structs.RollbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errors.WriteHTTPError(w, errors.NewValidationError("body", "invalid JSON format"))
+		return
+	}
+
+	rb, err := s.Rollback(r.PathValue("flowId"), req)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(rb); err != nil {
+		_ = logs.Errorf("failed to encode rollback: %v", err)
+	}
+}
+
 func (s *System) CreateDraftFromVersion(w http.ResponseWriter, r *http.Request) {
 	s.SetContext(r.Context())
 	flowId := r.PathValue("flowId")
@@ -208,6 +304,7 @@ func (s *System) CreateDraftFromVersion(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	etag.Set(w, f.Revision)
 	if err := json.NewEncoder(w).Encode(f); err != nil {
 		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
 	}
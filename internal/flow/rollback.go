@@ -0,0 +1,76 @@
+package flow
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/1rp-pw/orchestrator/internal/audit"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/policy"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"strings"
+)
+
+// Rollback makes a published version the latest again by publishing a copy of it as the next
+// patch version. The versions in between stay in the history and the draft is left as it is.
+// The copy was published before so it doesn't go through review again
+func (s *System) Rollback(baseFlowId string, req structs.RollbackRequest) (structs.Rollback, error) {
+	rb := structs.Rollback{
+		BaseID: baseFlowId,
+		Reason: strings.TrimSpace(req.Reason),
+	}
+	if strings.TrimSpace(req.Version) == "" {
+		return rb, errors.NewValidationError("version", "the version to roll back to is required")
+	}
+	if rb.Reason == "" {
+		return rb, errors.NewValidationError("reason", "a reason for the rollback is required")
+	}
+
+	target, err := s.ResolveFlow(baseFlowId + "@" + req.Version)
+	if err != nil {
+		return rb, errors.WrapFlowError(errors.ErrFlowNotFound, baseFlowId+"@"+req.Version, "")
+	}
+	latest, err := s.ResolveFlow(baseFlowId + "@latest")
+	if err != nil {
+		return rb, errors.WrapFlowError(errors.ErrFlowNotFound, baseFlowId+"@latest", "")
+	}
+	rb.Version = target.Version
+	rb.PreviousVersion = latest.Version
+	if target.FlowID == latest.FlowID {
+		return rb, errors.WrapFlowError(errors.ErrAlreadyActive, baseFlowId+"@"+target.Version, "")
+	}
+
+	if rb.PublishedAs, err = s.nextVersion(&structs.StoredFlow{BaseID: baseFlowId, Bump: "patch"}); err != nil {
+		return rb, err
+	}
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return rb, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	change, err := audit.Begin(s.Context, s.Audit, client, decision.KindFlow, audit.ActionRollback, baseFlowId)
+	if err != nil {
+		return rb, err
+	}
+	defer change.Close()
+	if err := policy.ShareReferences(s.Context, change); err != nil {
+		return rb, err
+	}
+	description := fmt.Sprintf("Rollback to %s: %s", target.Version, rb.Reason)
+	if err := change.QueryRow(s.Context, `SELECT rollback_flow_to_version($1, $2, $3)`, target.FlowID, rb.PublishedAs, description).Scan(&rb.ID); err != nil {
+		return rb, logs.Errorf("failed to roll back flow: %v", err)
+	}
+	if err := change.Done(rb.ID, rb.PublishedAs); err != nil {
+		return rb, err
+	}
+
+	var draftId sql.NullString
+	if err := client.QueryRow(s.Context, `SELECT flow_id::text FROM flows WHERE base_flow_id = $1 AND status = 'draft'`, baseFlowId).Scan(&draftId); err == nil {
+		rb.DraftID = draftId.String
+	}
+
+	return rb, nil
+}
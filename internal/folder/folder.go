@@ -0,0 +1,218 @@
+package folder
+
+import (
+	"context"
+	"github.com/1rp-pw/orchestrator/internal/audit"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/flow"
+	"github.com/1rp-pw/orchestrator/internal/listing"
+	"github.com/1rp-pw/orchestrator/internal/policy"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/bugfixes/go-bugfixes/logs"
+	ConfigBuilder "github.com/keloran/go-config"
+	"sort"
+	"strings"
+)
+
+type System struct {
+	Config  *ConfigBuilder.Config
+	Context context.Context
+	Audit   audit.Recorder
+}
+
+func NewSystem(cfg *ConfigBuilder.Config) *System {
+	return &System{
+		Config:  cfg,
+		Context: context.Background(),
+		Audit:   audit.NewSystem(cfg),
+	}
+}
+
+func (s *System) SetContext(ctx context.Context) *System {
+	s.Context = ctx
+	return s
+}
+
+// SetAudit records every folder move with a, nil records nothing
+func (s *System) SetAudit(a audit.Recorder) *System {
+	s.Audit = a
+	return s
+}
+
+// count is how many policies or flows are directly in a folder
+type count struct {
+	Folder string
+	Kind   string
+	Count  int
+}
+
+// Tree lists the folders beneath a folder, or every folder for the top, sorted by path
+func (s *System) Tree(under string) ([]structs.Folder, error) {
+	under, err := listing.CleanFolder(under)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return nil, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	// metadata outlives purged policies, only count the ones the listings show
+	rows, err := client.Query(s.Context, `
+		SELECT m.folder, m.kind, COUNT(*)
+		FROM metadata m
+		WHERE m.folder IS NOT NULL AND (
+		    (m.kind = 'policy' AND EXISTS (SELECT 1 FROM policy_summary s WHERE s.base_policy_id::text = m.base_id))
+		    OR (m.kind = 'flow' AND EXISTS (SELECT 1 FROM flow_summary s WHERE s.base_flow_id::text = m.base_id)))
+		GROUP BY m.folder, m.kind`)
+	if err != nil {
+		return nil, logs.Errorf("failed to list folders: %v", err)
+	}
+	defer rows.Close()
+
+	var counts []count
+	for rows.Next() {
+		c := count{}
+		if err := rows.Scan(&c.Folder, &c.Kind, &c.Count); err != nil {
+			return nil, logs.Errorf("failed to list folders: %v", err)
+		}
+		counts = append(counts, c)
+	}
+
+	return tree(counts, under), nil
+}
+
+// tree adds the counts of each folder to the folders above it and keeps the ones beneath under
+func tree(counts []count, under string) []structs.Folder {
+	folders := make(map[string]*structs.Folder)
+	for _, c := range counts {
+		parts := strings.Split(c.Folder, "/")
+		for i := range parts {
+			path := strings.Join(parts[:i+1], "/")
+			if !beneath(path, under) {
+				continue
+			}
+			f, ok := folders[path]
+			if !ok {
+				f = &structs.Folder{Path: path, Name: parts[i]}
+				folders[path] = f
+			}
+			switch c.Kind {
+			case decision.KindPolicy:
+				f.Policies += c.Count
+			case decision.KindFlow:
+				f.Flows += c.Count
+			}
+		}
+	}
+
+	ff := make([]structs.Folder, 0, len(folders))
+	for _, f := range folders {
+		ff = append(ff, *f)
+	}
+	sort.Slice(ff, func(i, j int) bool {
+		return ff[i].Path < ff[j].Path
+	})
+	return ff
+}
+
+// beneath is whether path is a folder inside under, at any depth
+func beneath(path, under string) bool {
+	return under == "" || strings.HasPrefix(path, under+"/")
+}
+
+// Contents lists the folders directly in a folder and a page each of the policies and flows that
+// match q in it. Each kind is paged with its own cursor
+func (s *System) Contents(path string, q listing.Query, policyCursor, flowCursor string) (structs.FolderContents, error) {
+	path, err := listing.CleanFolder(path)
+	if err != nil {
+		return structs.FolderContents{}, err
+	}
+	q.Folder = path
+
+	c := structs.FolderContents{
+		Path:    path,
+		Folders: make([]structs.Folder, 0),
+	}
+
+	folders, err := s.Tree(path)
+	if err != nil {
+		return c, err
+	}
+	depth := strings.Count(path, "/") + 1
+	if path == "" {
+		depth = 0
+	}
+	for _, f := range folders {
+		if strings.Count(f.Path, "/") == depth {
+			c.Folders = append(c.Folders, f)
+		}
+	}
+
+	pq, err := q.After(policyCursor)
+	if err != nil {
+		return c, errors.NewValidationError("policyCursor", "policyCursor is not from this listing")
+	}
+	pp, page, err := policy.NewSystem(s.Config).SetContext(s.Context).ListPolicies(pq)
+	if err != nil {
+		return c, err
+	}
+	c.Policies, c.PolicyTotal, c.NextPolicyCursor = pp, page.Total, page.Next
+
+	fq, err := q.After(flowCursor)
+	if err != nil {
+		return c, errors.NewValidationError("flowCursor", "flowCursor is not from this listing")
+	}
+	ff, page, err := flow.NewSystem(s.Config).SetContext(s.Context).ListFlows(fq)
+	if err != nil {
+		return c, err
+	}
+	c.Flows, c.FlowTotal, c.NextFlowCursor = ff, page.Total, page.Next
+
+	return c, nil
+}
+
+// Move moves a folder and the folders beneath it under a new path, keeping each move in the
+// metadata history of the policy or flow
+func (s *System) Move(from, to string) (structs.FolderMove, error) {
+	m := structs.FolderMove{}
+
+	from, err := listing.CleanFolder(from)
+	if err != nil {
+		return m, err
+	}
+	if from == "" {
+		return m, errors.NewValidationError("from", "from has to be a folder")
+	}
+	to, err = listing.CleanFolder(to)
+	if err != nil {
+		return m, err
+	}
+	if to == from || beneath(to, from) {
+		return m, errors.NewValidationError("to", "a folder can't be moved into itself")
+	}
+	m.From, m.To = from, to
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return m, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	change, err := audit.Begin(s.Context, s.Audit, client, audit.KindFolder, audit.ActionMove, from)
+	if err != nil {
+		return m, err
+	}
+	defer change.Close()
+	if err := change.QueryRow(s.Context, `SELECT move_folder($1, $2)`, from, to).Scan(&m.Moved); err != nil {
+		return m, logs.Errorf("failed to move folder: %v", err)
+	}
+	if err := change.Done(to, ""); err != nil {
+		return m, err
+	}
+
+	return m, nil
+}
@@ -0,0 +1,124 @@
+package folder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/1rp-pw/orchestrator/internal/audit"
+	"github.com/1rp-pw/orchestrator/internal/listing"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/1rp-pw/orchestrator/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSystem_Move(t *testing.T) {
+	cfg := testutil.Postgres(t, "policy.sql", "flow.sql", "metadata.sql", "audit.sql")
+
+	ctx := context.Background()
+	client, err := cfg.Database.GetPGXPoolClient(ctx)
+	require.NoError(t, err)
+	defer client.Close()
+
+	for name, folder := range map[string]string{
+		"Mortgage": "credit",
+		"Loan":     "credit/retail",
+		"Card":     "credit/retail/cards",
+		"Other":    "credit_other",
+	} {
+		var id string
+		require.NoError(t, client.QueryRow(ctx, `SELECT create_policy($1, '{}', '[]', 'rule', FALSE)`, name).Scan(&id))
+		_, err = client.Exec(ctx, `SELECT update_metadata('policy', $1, NULL, NULL, NULL, NULL, NULL, $2)`, id, folder)
+		require.NoError(t, err)
+	}
+
+	s := NewSystem(cfg)
+
+	folders, err := s.Tree("")
+	require.NoError(t, err)
+	require.Len(t, folders, 4)
+	assert.Equal(t, structs.Folder{Path: "credit", Name: "credit", Policies: 3}, folders[0])
+
+	c, err := s.Contents("credit/retail/", listing.Query{Sort: "name", Limit: 10}, "", "")
+	require.NoError(t, err)
+	assert.Equal(t, "credit/retail", c.Path)
+	require.Len(t, c.Folders, 1)
+	assert.Equal(t, "credit/retail/cards", c.Folders[0].Path)
+	assert.Equal(t, 2, c.PolicyTotal)
+	assert.Empty(t, c.Flows)
+
+	m, err := s.Move("credit/retail", "lending")
+	require.NoError(t, err)
+	assert.Equal(t, 2, m.Moved)
+
+	folders, err = s.Tree("lending")
+	require.NoError(t, err)
+	require.Len(t, folders, 1)
+	assert.Equal(t, "lending/cards", folders[0].Path)
+
+	var history int
+	require.NoError(t, client.QueryRow(ctx, `SELECT COUNT(*) FROM metadata_history WHERE field = 'folder' AND new_value::text LIKE '"lending%'`).Scan(&history))
+	assert.Equal(t, 2, history)
+
+	m, err = s.Move("credit", "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, m.Moved, "credit_other isn't in credit")
+}
+
+func TestSystem_Move_Audited(t *testing.T) {
+	cfg := testutil.Postgres(t, "policy.sql", "flow.sql", "metadata.sql", "audit.sql")
+
+	ctx := context.Background()
+	client, err := cfg.Database.GetPGXPoolClient(ctx)
+	require.NoError(t, err)
+	defer client.Close()
+
+	var id string
+	require.NoError(t, client.QueryRow(ctx, `SELECT create_policy('Loan', '{}', '[]', 'rule', FALSE)`).Scan(&id))
+	_, err = client.Exec(ctx, `SELECT update_metadata('policy', $1, NULL, NULL, NULL, NULL, NULL, 'credit/retail')`, id)
+	require.NoError(t, err)
+
+	_, err = NewSystem(cfg).SetContext(audit.WithActor(ctx, "alice")).Move("credit", "lending")
+	require.NoError(t, err)
+
+	entries, err := audit.NewSystem(cfg).Query(structs.AuditQuery{Action: audit.ActionMove})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "alice", entries[0].Actor)
+	assert.Equal(t, audit.KindFolder, entries[0].Kind)
+	assert.Equal(t, "credit", entries[0].EntityID)
+	assert.Equal(t, "lending", entries[0].TargetID)
+	assert.NotEqual(t, entries[0].BeforeHash, entries[0].AfterHash)
+}
+
+func TestTree(t *testing.T) {
+	counts := []count{
+		{Folder: "credit/retail", Kind: "policy", Count: 2},
+		{Folder: "credit/retail", Kind: "flow", Count: 1},
+		{Folder: "credit/business/loans", Kind: "policy", Count: 1},
+		{Folder: "fraud", Kind: "flow", Count: 3},
+	}
+
+	folders := tree(counts, "")
+	require.Len(t, folders, 5)
+	assert.Equal(t, structs.Folder{Path: "credit", Name: "credit", Policies: 3, Flows: 1}, folders[0])
+	assert.Equal(t, structs.Folder{Path: "credit/business", Name: "business", Policies: 1}, folders[1])
+	assert.Equal(t, "fraud", folders[4].Path)
+
+	folders = tree(counts, "credit")
+	require.Len(t, folders, 3, "only the folders beneath credit")
+	assert.Equal(t, "credit/business", folders[0].Path)
+}
+
+func TestSystem_MoveValidation(t *testing.T) {
+	s := NewSystem(nil)
+	for _, m := range []structs.FolderMove{
+		{From: "", To: "credit"},
+		{From: "credit", To: "credit/"},
+		{From: "credit", To: "credit/retail"},
+		{From: "credit//retail", To: "lending"},
+	} {
+		_, err := s.Move(m.From, m.To)
+		assert.Error(t, err, m.From+" to "+m.To)
+	}
+}
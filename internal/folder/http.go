@@ -0,0 +1,71 @@
+package folder
+
+import (
+	"encoding/json"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/listing"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"net/http"
+)
+
+// ListFolders lists every folder with its policy and flow counts, folder=credit only lists the
+// ones beneath credit
+func (s *System) ListFolders(w http.ResponseWriter, r *http.Request) {
+	s.SetContext(r.Context())
+
+	ff, err := s.Tree(r.URL.Query().Get("folder"))
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	writeJSON(w, ff)
+}
+
+// GetFolder lists the folder in the path, e.g. /folders/credit/retail/, with the listing query
+// of listing.FromRequest applied to its policies and flows. Those of the folders beneath it are
+// included unless recursive=false, policyCursor and flowCursor continue each listing
+func (s *System) GetFolder(w http.ResponseWriter, r *http.Request) {
+	s.SetContext(r.Context())
+
+	q, err := listing.FromRequest(r)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	v := r.URL.Query()
+	c, err := s.Contents(r.PathValue("folder"), q, v.Get("policyCursor"), v.Get("flowCursor"))
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	writeJSON(w, c)
+}
+
+// MoveFolder moves the folder in from, and everything in it, to the folder in to
+func (s *System) MoveFolder(w http.ResponseWriter, r *http.Request) {
+	s.SetContext(r.Context())
+
+	var m structs.FolderMove
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		errors.WriteHTTPError(w, errors.NewValidationError("body", "invalid JSON format"))
+		return
+	}
+
+	m, err := s.Move(m.From, m.To)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	writeJSON(w, m)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
+	}
+}
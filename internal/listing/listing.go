@@ -0,0 +1,411 @@
+package listing
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/jackc/pgx/v5"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultLimit = 50
+	MaxLimit     = 200
+
+	maxFolderLength = 255
+
+	StatusDraft     = "draft"
+	StatusPublished = "published"
+)
+
+// Query is what a listing asks for, the filters all have to match
+type Query struct {
+	Search       string
+	HasDraft     *bool
+	Status       string
+	Tags         []string
+	Owner        string
+	Team         string
+	Folder       string
+	Direct       bool // only Folder itself, not the folders beneath it
+	UpdatedSince time.Time
+	Sort         string
+	Desc         bool
+	Limit        int
+	Cursor       *Cursor
+}
+
+// Cursor is where the previous page ended, it only continues a listing with the same sort
+type Cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+func (c Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func DecodeCursor(s string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cursor{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// sortField is the column a sort orders by and the type its cursor value is cast back to
+type sortField struct {
+	Expr string
+	Type string
+}
+
+// sorts are the sort options, a leading - sorts descending. Never published sorts before the
+// oldest publish
+var sorts = map[string]sortField{
+	"name":        {"s.current_name", "text"},
+	"createdAt":   {"s.first_created_date", "timestamptz"},
+	"updatedAt":   {"s.latest_activity_date", "timestamptz"},
+	"publishedAt": {"COALESCE(s.latest_version_date, '-infinity'::timestamptz)", "timestamptz"},
+}
+
+// CleanFolder normalizes a folder path, credit/retail/ and /credit/retail are both
+// credit/retail. The top folder is empty
+func CleanFolder(path string) (string, error) {
+	path = strings.Trim(strings.TrimSpace(path), "/")
+	if path == "" {
+		return "", nil
+	}
+
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" || part == "." || part == ".." {
+			return "", errors.NewValidationError("folder", "folder can't have empty, . or .. parts")
+		}
+		parts[i] = part
+	}
+
+	path = strings.Join(parts, "/")
+	if len(path) > maxFolderLength {
+		return "", errors.NewValidationError("folder", fmt.Sprintf("folder can be at most %d characters", maxFolderLength))
+	}
+	return path, nil
+}
+
+// FromRequest reads the listing query parameters, q, hasDraft, status, tag, owner, team,
+// folder, recursive, updatedSince, sort, limit and cursor
+func FromRequest(r *http.Request) (Query, error) {
+	v := r.URL.Query()
+	q := Query{
+		Search: strings.TrimSpace(v.Get("q")),
+		Status: v.Get("status"),
+		Owner:  v.Get("owner"),
+		Team:   v.Get("team"),
+		Sort:   "name",
+		Limit:  DefaultLimit,
+	}
+
+	if hd := v.Get("hasDraft"); hd != "" {
+		b, err := strconv.ParseBool(hd)
+		if err != nil {
+			return q, errors.NewValidationError("hasDraft", "hasDraft must be true or false")
+		}
+		q.HasDraft = &b
+	}
+
+	if q.Status != "" && q.Status != StatusDraft && q.Status != StatusPublished {
+		return q, errors.NewValidationError("status", "status must be draft or published")
+	}
+
+	for _, t := range v["tag"] {
+		if t = strings.TrimSpace(t); t != "" {
+			q.Tags = append(q.Tags, t)
+		}
+	}
+
+	if f := v.Get("folder"); f != "" {
+		folder, err := CleanFolder(f)
+		if err != nil {
+			return q, err
+		}
+		q.Folder = folder
+	}
+	if rec := v.Get("recursive"); rec != "" {
+		b, err := strconv.ParseBool(rec)
+		if err != nil {
+			return q, errors.NewValidationError("recursive", "recursive must be true or false")
+		}
+		q.Direct = !b
+	}
+
+	if us := v.Get("updatedSince"); us != "" {
+		t, err := time.Parse(time.RFC3339, us)
+		if err != nil {
+			if t, err = time.Parse(time.DateOnly, us); err != nil {
+				return q, errors.NewValidationError("updatedSince", "updatedSince must be an RFC 3339 time or a date")
+			}
+		}
+		q.UpdatedSince = t
+	}
+
+	if s := v.Get("sort"); s != "" {
+		q.Desc = strings.HasPrefix(s, "-")
+		q.Sort = strings.TrimPrefix(s, "-")
+		if _, ok := sorts[q.Sort]; !ok {
+			return q, errors.NewValidationError("sort", "sort must be name, createdAt, updatedAt or publishedAt, with a leading - for descending")
+		}
+	}
+	if q.Desc {
+		q.Sort = "-" + q.Sort
+	}
+
+	if l := v.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			return q, errors.NewValidationError("limit", "limit must be a positive number")
+		}
+		q.Limit = min(n, MaxLimit)
+	}
+
+	return q.After(v.Get("cursor"))
+}
+
+// After continues the listing from a cursor of a previous page, an empty cursor starts at the
+// first page
+func (q Query) After(cursor string) (Query, error) {
+	q.Cursor = nil
+	if cursor == "" {
+		return q, nil
+	}
+
+	c, err := DecodeCursor(cursor)
+	if err != nil || c.Sort != q.Sort {
+		return q, errors.NewValidationError("cursor", "cursor is not from this listing")
+	}
+	q.Cursor = c
+	return q, nil
+}
+
+// Source is a summary view to list and the table whose rows are searched
+type Source struct {
+	Kind     string // kind of the metadata
+	View     string // summary view, one row per base
+	BaseID   string // base id column of the view and the table
+	Table    string
+	Document string // text of a table row that is searched
+	Live     string // condition for the table rows that count
+}
+
+// Row is a base policy or flow of a listing
+type Row struct {
+	BaseID          string
+	Name            string
+	Versions        int
+	DraftID         string
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	LastPublishedAt time.Time
+	HasDraft        bool
+	Owner           string
+	Tags            []string
+	Folder          string
+	Team            string
+}
+
+// Page is a page of a listing, Next is empty on the last page
+type Page struct {
+	Rows  []Row
+	Total int
+	Next  string
+}
+
+// DB is the part of the pool a listing needs
+type DB interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+type builder struct {
+	conds []string
+	args  []interface{}
+}
+
+func (b *builder) arg(v interface{}) string {
+	b.args = append(b.args, v)
+	return fmt.Sprintf("$%d", len(b.args))
+}
+
+// where is the filter of the query, without the cursor
+func (q Query) where(src Source) *builder {
+	b := &builder{}
+	b.arg(src.Kind)
+
+	if q.Search != "" {
+		search, like := b.arg(q.Search), b.arg("%"+escapeLike(q.Search)+"%")
+		b.conds = append(b.conds, fmt.Sprintf(`(
+			EXISTS (
+			    SELECT 1
+			    FROM %s t
+			    WHERE t.%s = s.%s AND %s AND to_tsvector('simple', %s) @@ websearch_to_tsquery('simple', %s)
+			) OR s.current_name ILIKE %s OR m.description ILIKE %s)`,
+			src.Table, src.BaseID, src.BaseID, src.Live, src.Document, search, like, like))
+	}
+	if q.HasDraft != nil {
+		b.conds = append(b.conds, "s.has_draft = "+b.arg(*q.HasDraft))
+	}
+	switch q.Status {
+	case StatusDraft:
+		b.conds = append(b.conds, "s.version_count = 0")
+	case StatusPublished:
+		b.conds = append(b.conds, "s.version_count > 0")
+	}
+	if len(q.Tags) > 0 {
+		b.conds = append(b.conds, "m.tags @> "+b.arg(q.Tags)+"::text[]")
+	}
+	if q.Owner != "" {
+		b.conds = append(b.conds, "m.owner = "+b.arg(q.Owner))
+	}
+	if q.Team != "" {
+		b.conds = append(b.conds, "m.team = "+b.arg(q.Team))
+	}
+	switch {
+	case q.Direct && q.Folder == "":
+		b.conds = append(b.conds, "m.folder IS NULL")
+	case q.Direct:
+		b.conds = append(b.conds, "m.folder = "+b.arg(q.Folder))
+	case q.Folder != "":
+		b.conds = append(b.conds, fmt.Sprintf("(m.folder = %s OR m.folder LIKE %s)", b.arg(q.Folder), b.arg(escapeLike(q.Folder)+"/%")))
+	}
+	if !q.UpdatedSince.IsZero() {
+		b.conds = append(b.conds, "s.latest_activity_date >= "+b.arg(q.UpdatedSince))
+	}
+
+	return b
+}
+
+func (b *builder) sql() string {
+	if len(b.conds) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(b.conds, " AND ")
+}
+
+func from(src Source) string {
+	return fmt.Sprintf(`FROM %s s
+		LEFT JOIN metadata m ON m.kind = $1 AND m.base_id = s.%s::text`, src.View, src.BaseID)
+}
+
+// Run loads a page of the listing and the number of rows all pages have
+func Run(ctx context.Context, db DB, src Source, q Query) (Page, error) {
+	page := Page{Rows: make([]Row, 0)}
+
+	count := q.where(src)
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) `+from(src)+` `+count.sql(), count.args...).Scan(&page.Total); err != nil {
+		return page, logs.Errorf("failed to count %s: %v", src.View, err)
+	}
+
+	field := sorts[strings.TrimPrefix(q.Sort, "-")]
+	dir, cmp := "ASC", ">"
+	if q.Desc {
+		dir, cmp = "DESC", "<"
+	}
+
+	b := q.where(src)
+	if q.Cursor != nil {
+		b.conds = append(b.conds, fmt.Sprintf("(%s, s.%s::text) %s (%s::%s, %s)",
+			field.Expr, src.BaseID, cmp, b.arg(q.Cursor.Value), field.Type, b.arg(q.Cursor.ID)))
+	}
+	limit := b.arg(q.Limit + 1)
+
+	rows, err := db.Query(ctx, fmt.Sprintf(`
+		SELECT
+		    s.%s::text,
+		    s.current_name,
+		    s.version_count,
+		    s.draft_id::text,
+		    s.first_created_date,
+		    s.latest_version_date,
+		    s.latest_activity_date,
+		    s.has_draft,
+		    m.owner,
+		    m.tags,
+		    m.folder,
+		    m.team,
+		    (%s)::text
+		%s
+		%s
+		ORDER BY %s %s, s.%s::text %s
+		LIMIT %s`,
+		src.BaseID, field.Expr, from(src), b.sql(), field.Expr, dir, src.BaseID, dir, limit), b.args...)
+	if err != nil {
+		return page, logs.Errorf("failed to list %s: %v", src.View, err)
+	}
+	defer rows.Close()
+
+	var last Cursor
+	for rows.Next() {
+		var name, draftId, owner, folder, team sql.NullString
+		var versions sql.NullInt32
+		var createdAt, publishedAt, updatedAt sql.NullTime
+		var hasDraft sql.NullBool
+		var sortValue sql.NullString
+		row := Row{}
+		if err := rows.Scan(&row.BaseID, &name, &versions, &draftId, &createdAt, &publishedAt, &updatedAt, &hasDraft, &owner, &row.Tags, &folder, &team, &sortValue); err != nil {
+			return page, logs.Errorf("failed to list %s: %v", src.View, err)
+		}
+		if len(page.Rows) == q.Limit {
+			page.Next = last.Encode()
+			break
+		}
+
+		row.Name = name.String
+		row.Versions = int(versions.Int32)
+		row.DraftID = draftId.String
+		row.CreatedAt = createdAt.Time
+		row.UpdatedAt = updatedAt.Time
+		row.LastPublishedAt = publishedAt.Time
+		row.HasDraft = hasDraft.Bool
+		row.Owner = owner.String
+		row.Folder = folder.String
+		row.Team = team.String
+		page.Rows = append(page.Rows, row)
+		last = Cursor{Sort: q.Sort, Value: sortValue.String, ID: row.BaseID}
+	}
+	if err := rows.Err(); err != nil {
+		return page, logs.Errorf("failed to list %s: %v", src.View, err)
+	}
+
+	return page, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// WriteHeaders sets the total count and, when there is another page, the cursor and link to it
+func WriteHeaders(w http.ResponseWriter, r *http.Request, page Page) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	if page.Next == "" {
+		return
+	}
+	w.Header().Set("X-Next-Cursor", page.Next)
+
+	u := *r.URL
+	v := u.Query()
+	v.Set("cursor", page.Next)
+	u.RawQuery = v.Encode()
+	w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, u.RequestURI()))
+}
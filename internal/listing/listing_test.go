@@ -0,0 +1,220 @@
+package listing
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1rp-pw/orchestrator/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var policies = Source{
+	Kind:     "policy",
+	View:     "policy_summary",
+	BaseID:   "base_policy_id",
+	Table:    "policies",
+	Document: "t.name || ' ' || COALESCE(t.description, '') || ' ' || t.rule",
+	Live:     "t.archived_at IS NULL",
+}
+
+func TestRun(t *testing.T) {
+	cfg := testutil.Postgres(t, "policy.sql", "metadata.sql", "audit.sql")
+
+	ctx := context.Background()
+	client, err := cfg.Database.GetPGXPoolClient(ctx)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// the schema comes with a sample policy, there are 6 with these
+	ids := make(map[string]string)
+	for i, name := range []string{"Alpha", "Bravo", "Charlie", "Delta", "Echo"} {
+		var id string
+		require.NoError(t, client.QueryRow(ctx, `SELECT create_policy($1, '{}', '[]', $2, FALSE)`,
+			name, fmt.Sprintf("A **Person** passes if the __score__ of the **Person** is greater than %d.", i)).Scan(&id))
+		ids[name] = id
+	}
+	_, err = client.Exec(ctx, `SELECT publish_draft_as_version($1, 'v1.0.0', 'first')`, ids["Bravo"])
+	require.NoError(t, err)
+	_, err = client.Exec(ctx, `SELECT update_metadata('policy', $1, NULL, 'licensing', NULL, ARRAY['dvla', 'licence'])`, ids["Charlie"])
+	require.NoError(t, err)
+	_, err = client.Exec(ctx, `SELECT update_metadata('policy', $1, NULL, NULL, NULL, NULL, NULL, 'credit/retail', 'risk')`, ids["Delta"])
+	require.NoError(t, err)
+	_, err = client.Exec(ctx, `SELECT update_metadata('policy', $1, NULL, NULL, NULL, NULL, NULL, 'credit', 'risk')`, ids["Echo"])
+	require.NoError(t, err)
+	_, err = client.Exec(ctx, `SELECT update_metadata('policy', $1, NULL, NULL, NULL, NULL, NULL, 'credit_card')`, ids["Alpha"])
+	require.NoError(t, err)
+
+	t.Run("pages", func(t *testing.T) {
+		q := Query{Sort: "name", Limit: 4}
+		page, err := Run(ctx, client, policies, q)
+		require.NoError(t, err)
+		assert.Equal(t, 6, page.Total)
+		require.Len(t, page.Rows, 4)
+		assert.Equal(t, "Alpha", page.Rows[0].Name)
+		require.NotEmpty(t, page.Next)
+
+		q.Cursor, err = DecodeCursor(page.Next)
+		require.NoError(t, err)
+		page, err = Run(ctx, client, policies, q)
+		require.NoError(t, err)
+		require.Len(t, page.Rows, 2)
+		assert.Equal(t, "Echo", page.Rows[0].Name)
+		assert.Empty(t, page.Next)
+	})
+
+	t.Run("descending by published", func(t *testing.T) {
+		page, err := Run(ctx, client, policies, Query{Sort: "-publishedAt", Desc: true, Limit: 1})
+		require.NoError(t, err)
+		require.Len(t, page.Rows, 1)
+		assert.Equal(t, "Bravo", page.Rows[0].Name)
+
+		q := Query{Sort: "-publishedAt", Desc: true, Limit: 10}
+		q.Cursor, err = DecodeCursor(page.Next)
+		require.NoError(t, err)
+		page, err = Run(ctx, client, policies, q)
+		require.NoError(t, err)
+		assert.Len(t, page.Rows, 5, "the never published follow")
+	})
+
+	t.Run("filters", func(t *testing.T) {
+		published := Query{Sort: "name", Limit: 10, Status: StatusPublished}
+		page, err := Run(ctx, client, policies, published)
+		require.NoError(t, err)
+		assert.Equal(t, 1, page.Total)
+
+		hasDraft := false
+		page, err = Run(ctx, client, policies, Query{Sort: "name", Limit: 10, HasDraft: &hasDraft})
+		require.NoError(t, err)
+		require.Len(t, page.Rows, 1)
+		assert.Equal(t, "Bravo", page.Rows[0].Name)
+
+		page, err = Run(ctx, client, policies, Query{Sort: "name", Limit: 10, Tags: []string{"dvla"}, Owner: "licensing"})
+		require.NoError(t, err)
+		require.Len(t, page.Rows, 1)
+		assert.Equal(t, "Charlie", page.Rows[0].Name)
+		assert.Equal(t, []string{"dvla", "licence"}, page.Rows[0].Tags)
+
+		page, err = Run(ctx, client, policies, Query{Sort: "name", Limit: 10, UpdatedSince: time.Now().Add(time.Hour)})
+		require.NoError(t, err)
+		assert.Equal(t, 0, page.Total)
+	})
+
+	t.Run("folders", func(t *testing.T) {
+		page, err := Run(ctx, client, policies, Query{Sort: "name", Limit: 10, Folder: "credit"})
+		require.NoError(t, err)
+		require.Len(t, page.Rows, 2, "the folders beneath match, credit_card doesn't")
+		assert.Equal(t, "Delta", page.Rows[0].Name)
+		assert.Equal(t, "credit/retail", page.Rows[0].Folder)
+		assert.Equal(t, "risk", page.Rows[0].Team)
+		assert.Equal(t, "Echo", page.Rows[1].Name)
+
+		page, err = Run(ctx, client, policies, Query{Sort: "name", Limit: 10, Folder: "credit", Direct: true})
+		require.NoError(t, err)
+		require.Len(t, page.Rows, 1)
+		assert.Equal(t, "Echo", page.Rows[0].Name)
+
+		page, err = Run(ctx, client, policies, Query{Sort: "name", Limit: 10, Direct: true})
+		require.NoError(t, err)
+		assert.Equal(t, 3, page.Total, "only the ones without a folder are at the top")
+
+		page, err = Run(ctx, client, policies, Query{Sort: "name", Limit: 10, Team: "risk"})
+		require.NoError(t, err)
+		assert.Equal(t, 2, page.Total)
+	})
+
+	t.Run("search", func(t *testing.T) {
+		page, err := Run(ctx, client, policies, Query{Sort: "name", Limit: 10, Search: "greater than 3"})
+		require.NoError(t, err)
+		require.Len(t, page.Rows, 1)
+		assert.Equal(t, "Delta", page.Rows[0].Name)
+
+		page, err = Run(ctx, client, policies, Query{Sort: "name", Limit: 10, Search: "ech"})
+		require.NoError(t, err)
+		require.Len(t, page.Rows, 1, "part of a name matches")
+		assert.Equal(t, "Echo", page.Rows[0].Name)
+	})
+}
+
+func TestFromRequest(t *testing.T) {
+	q, err := FromRequest(httptest.NewRequest("GET", "/policies", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "name", q.Sort)
+	assert.False(t, q.Desc)
+	assert.Equal(t, DefaultLimit, q.Limit)
+
+	q, err = FromRequest(httptest.NewRequest("GET", "/policies?q=licence&hasDraft=true&status=published&tag=a&tag=b&owner=me&updatedSince=2025-01-02&sort=-updatedAt&limit=1000", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "licence", q.Search)
+	require.NotNil(t, q.HasDraft)
+	assert.True(t, *q.HasDraft)
+	assert.Equal(t, StatusPublished, q.Status)
+	assert.Equal(t, []string{"a", "b"}, q.Tags)
+	assert.Equal(t, "me", q.Owner)
+	assert.Equal(t, time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC), q.UpdatedSince)
+	assert.Equal(t, "-updatedAt", q.Sort)
+	assert.True(t, q.Desc)
+	assert.Equal(t, MaxLimit, q.Limit)
+
+	q, err = FromRequest(httptest.NewRequest("GET", "/policies?folder=/credit/retail/&recursive=false&team=risk", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "credit/retail", q.Folder)
+	assert.True(t, q.Direct)
+	assert.Equal(t, "risk", q.Team)
+
+	cursor := Cursor{Sort: "-updatedAt", Value: "2025-01-02 00:00:00+00", ID: "base-1"}
+	q, err = FromRequest(httptest.NewRequest("GET", "/policies?sort=-updatedAt&cursor="+cursor.Encode(), nil))
+	require.NoError(t, err)
+	assert.Equal(t, &cursor, q.Cursor)
+
+	for _, bad := range []string{
+		"hasDraft=maybe",
+		"status=archived",
+		"updatedSince=yesterday",
+		"sort=size",
+		"limit=0",
+		"folder=credit//retail",
+		"recursive=sometimes",
+		"cursor=not-a-cursor",
+		"sort=name&cursor=" + cursor.Encode(),
+	} {
+		_, err := FromRequest(httptest.NewRequest("GET", "/policies?"+bad, nil))
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestCleanFolder(t *testing.T) {
+	for in, want := range map[string]string{
+		"":                  "",
+		"/":                 "",
+		"credit":            "credit",
+		"credit/retail/":    "credit/retail",
+		" /credit/ retail ": "credit/retail",
+	} {
+		got, err := CleanFolder(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+
+	for _, bad := range []string{"credit//retail", "credit/../retail", "./credit", strings.Repeat("a", 256)} {
+		_, err := CleanFolder(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestWriteHeaders(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteHeaders(w, httptest.NewRequest("GET", "/policies?limit=2", nil), Page{Total: 5, Next: "abc"})
+	assert.Equal(t, "5", w.Header().Get("X-Total-Count"))
+	assert.Equal(t, "abc", w.Header().Get("X-Next-Cursor"))
+	assert.Equal(t, `</policies?cursor=abc&limit=2>; rel="next"`, w.Header().Get("Link"))
+
+	w = httptest.NewRecorder()
+	WriteHeaders(w, httptest.NewRequest("GET", "/policies", nil), Page{Total: 0})
+	assert.Equal(t, "0", w.Header().Get("X-Total-Count"))
+	assert.Empty(t, w.Header().Get("Link"))
+}
@@ -0,0 +1,82 @@
+package metadata
+
+import (
+	"encoding/json"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"net/http"
+)
+
+func (s *System) GetPolicyMetadata(w http.ResponseWriter, r *http.Request) {
+	s.getMetadata(w, r, decision.KindPolicy, r.PathValue("policyId"))
+}
+
+func (s *System) UpdatePolicyMetadata(w http.ResponseWriter, r *http.Request) {
+	s.updateMetadata(w, r, decision.KindPolicy, r.PathValue("policyId"))
+}
+
+func (s *System) ListPolicyMetadataHistory(w http.ResponseWriter, r *http.Request) {
+	s.listHistory(w, r, decision.KindPolicy, r.PathValue("policyId"))
+}
+
+func (s *System) GetFlowMetadata(w http.ResponseWriter, r *http.Request) {
+	s.getMetadata(w, r, decision.KindFlow, r.PathValue("flowId"))
+}
+
+func (s *System) UpdateFlowMetadata(w http.ResponseWriter, r *http.Request) {
+	s.updateMetadata(w, r, decision.KindFlow, r.PathValue("flowId"))
+}
+
+func (s *System) ListFlowMetadataHistory(w http.ResponseWriter, r *http.Request) {
+	s.listHistory(w, r, decision.KindFlow, r.PathValue("flowId"))
+}
+
+func (s *System) getMetadata(w http.ResponseWriter, r *http.Request, kind, baseId string) {
+	s.SetContext(r.Context())
+
+	m, err := s.Load(kind, baseId)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	writeJSON(w, m)
+}
+
+func (s *System) updateMetadata(w http.ResponseWriter, r *http.Request, kind, baseId string) {
+	s.SetContext(r.Context())
+
+	var u structs.MetadataUpdate
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		errors.WriteHTTPError(w, errors.NewValidationError("body", "invalid JSON format"))
+		return
+	}
+
+	m, err := s.Update(kind, baseId, u)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	writeJSON(w, m)
+}
+
+func (s *System) listHistory(w http.ResponseWriter, r *http.Request, kind, baseId string) {
+	s.SetContext(r.Context())
+
+	changes, err := s.History(kind, baseId)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	writeJSON(w, changes)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
+	}
+}
@@ -0,0 +1,267 @@
+package metadata
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"github.com/1rp-pw/orchestrator/internal/audit"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/listing"
+	"github.com/1rp-pw/orchestrator/internal/semver"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	ConfigBuilder "github.com/keloran/go-config"
+	"strings"
+)
+
+const maxNameLength = 255
+
+type System struct {
+	Config  *ConfigBuilder.Config
+	Context context.Context
+	Audit   audit.Recorder
+}
+
+func NewSystem(cfg *ConfigBuilder.Config) *System {
+	return &System{
+		Config:  cfg,
+		Context: context.Background(),
+		Audit:   audit.NewSystem(cfg),
+	}
+}
+
+func (s *System) SetContext(ctx context.Context) *System {
+	s.Context = ctx
+	return s
+}
+
+// SetAudit records every metadata edit with a, nil records nothing
+func (s *System) SetAudit(a audit.Recorder) *System {
+	s.Audit = a
+	return s
+}
+
+// summaries are the summary view and base id column of each kind, the name comes from the view
+// so it is what the policy and flow lists show
+var summaries = map[string][2]string{
+	decision.KindPolicy: {"policy_summary", "base_policy_id"},
+	decision.KindFlow:   {"flow_summary", "base_flow_id"},
+}
+
+// Load gets the metadata of a base policy or flow, one that was never edited has no owner,
+// description, tags, folder or team
+func (s *System) Load(kind, baseId string) (structs.Metadata, error) {
+	m := structs.Metadata{
+		Kind:   kind,
+		BaseID: baseId,
+		Tags:   make([]string, 0),
+	}
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return m, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	summary := summaries[kind]
+	var name, owner, description, folder, team sql.NullString
+	var updatedAt, activityAt sql.NullTime
+	var tags []string
+	err = client.QueryRow(s.Context, fmt.Sprintf(`
+		SELECT
+		    s.current_name,
+		    m.owner,
+		    m.description,
+		    m.tags,
+		    m.folder,
+		    m.team,
+		    m.updated_at,
+		    s.latest_activity_date
+		FROM %s s
+		LEFT JOIN metadata m ON m.kind = $1 AND m.base_id = s.%s::text
+		WHERE s.%s::text = $2`, summary[0], summary[1], summary[1]), kind, baseId,
+	).Scan(&name, &owner, &description, &tags, &folder, &team, &updatedAt, &activityAt)
+	if stderrors.Is(err, pgx.ErrNoRows) {
+		return m, notFound(kind, baseId)
+	}
+	if err != nil {
+		return m, logs.Errorf("failed to load metadata: %v", err)
+	}
+
+	m.Name = name.String
+	m.Owner = owner.String
+	m.Description = description.String
+	if tags != nil {
+		m.Tags = tags
+	}
+	m.Folder = folder.String
+	m.Team = team.String
+	m.UpdatedAt = updatedAt.Time
+	if !updatedAt.Valid {
+		m.UpdatedAt = activityAt.Time
+	}
+
+	return m, nil
+}
+
+// Update edits the metadata of a base policy or flow, a new name is given to every draft and
+// version of it. Each changed field is kept in the history
+func (s *System) Update(kind, baseId string, u structs.MetadataUpdate) (structs.Metadata, error) {
+	u, err := validate(u)
+	if err != nil {
+		return structs.Metadata{}, err
+	}
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return structs.Metadata{}, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	var tags, versions interface{}
+	if u.Tags != nil {
+		tags = *u.Tags
+	}
+	if u.Version != "" {
+		versions = semver.StoredLabels(u.Version)
+	}
+
+	change, err := audit.Begin(s.Context, s.Audit, client, kind, audit.ActionMetadata, baseId)
+	if err != nil {
+		return structs.Metadata{}, err
+	}
+	defer change.Close()
+	var found bool
+	if err := change.QueryRow(s.Context, `SELECT update_metadata($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		kind, baseId, u.Name, u.Owner, u.Description, tags, versions, u.Folder, u.Team).Scan(&found); err != nil {
+		var pgErr *pgconn.PgError
+		if stderrors.As(err, &pgErr) && pgErr.Code == "P0002" {
+			return structs.Metadata{}, notFound(kind, baseId+"@"+u.Version)
+		}
+		return structs.Metadata{}, logs.Errorf("failed to update metadata: %v", err)
+	}
+	if !found {
+		return structs.Metadata{}, notFound(kind, baseId)
+	}
+	if err := change.Done(baseId, u.Version); err != nil {
+		return structs.Metadata{}, err
+	}
+
+	return s.Load(kind, baseId)
+}
+
+// validate trims the update and checks it can be saved, tags lose their duplicates and the
+// folder is normalized
+func validate(u structs.MetadataUpdate) (structs.MetadataUpdate, error) {
+	if u.Name != nil {
+		name := strings.TrimSpace(*u.Name)
+		if name == "" {
+			return u, errors.NewValidationError("name", "name can't be empty")
+		}
+		if len(name) > maxNameLength {
+			return u, errors.NewValidationError("name", fmt.Sprintf("name can be at most %d characters", maxNameLength))
+		}
+		u.Name = &name
+	}
+
+	if u.Owner != nil {
+		owner := strings.TrimSpace(*u.Owner)
+		u.Owner = &owner
+	}
+
+	if u.Team != nil {
+		team := strings.TrimSpace(*u.Team)
+		u.Team = &team
+	}
+
+	if u.Folder != nil {
+		folder, err := listing.CleanFolder(*u.Folder)
+		if err != nil {
+			return u, err
+		}
+		u.Folder = &folder
+	}
+
+	if u.Tags != nil {
+		tags := make([]string, 0, len(*u.Tags))
+		seen := make(map[string]bool, len(*u.Tags))
+		for _, t := range *u.Tags {
+			t = strings.TrimSpace(t)
+			if t == "" || seen[t] {
+				continue
+			}
+			seen[t] = true
+			tags = append(tags, t)
+		}
+		u.Tags = &tags
+	}
+
+	if u.Version != "" {
+		// published versions have to keep a description
+		if u.Description == nil || strings.TrimSpace(*u.Description) == "" {
+			return u, errors.NewValidationError("description", "a description is required to edit a version")
+		}
+	}
+
+	return u, nil
+}
+
+// History lists the metadata edits of a base policy or flow, oldest first
+func (s *System) History(kind, baseId string) ([]structs.MetadataChange, error) {
+	changes := make([]structs.MetadataChange, 0)
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return changes, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	rows, err := client.Query(s.Context, `
+		SELECT
+		    id,
+		    version,
+		    field,
+		    old_value,
+		    new_value,
+		    changed_at
+		FROM metadata_history
+		WHERE kind = $1 AND base_id = $2
+		ORDER BY id`, kind, baseId)
+	if err != nil {
+		return changes, logs.Errorf("failed to load metadata history: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		c := structs.MetadataChange{}
+		var version sql.NullString
+		var oldValue, newValue []byte
+		var changedAt sql.NullTime
+		if err := rows.Scan(&c.ID, &version, &c.Field, &oldValue, &newValue, &changedAt); err != nil {
+			return changes, logs.Errorf("failed to load metadata history: %v", err)
+		}
+		c.Version = version.String
+		c.ChangedAt = changedAt.Time
+		if len(oldValue) > 0 {
+			_ = json.Unmarshal(oldValue, &c.OldValue)
+		}
+		if len(newValue) > 0 {
+			_ = json.Unmarshal(newValue, &c.NewValue)
+		}
+		changes = append(changes, c)
+	}
+
+	return changes, nil
+}
+
+func notFound(kind, id string) error {
+	if kind == decision.KindFlow {
+		return errors.WrapFlowError(errors.ErrFlowNotFound, id, "")
+	}
+	return errors.WrapPolicyError(errors.ErrPolicyNotFound, id)
+}
@@ -0,0 +1,162 @@
+package metadata
+
+import (
+	"context"
+	"testing"
+
+	"github.com/1rp-pw/orchestrator/internal/audit"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/1rp-pw/orchestrator/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestSystem_Update(t *testing.T) {
+	cfg := testutil.Postgres(t, "policy.sql", "flow.sql", "metadata.sql", "audit.sql")
+
+	ctx := context.Background()
+	client, err := cfg.Database.GetPGXPoolClient(ctx)
+	require.NoError(t, err)
+	defer client.Close()
+
+	var baseId string
+	require.NoError(t, client.QueryRow(ctx, `SELECT create_policy('Licence', '{}', '[]', 'rule', FALSE)`).Scan(&baseId))
+	_, err = client.Exec(ctx, `SELECT publish_draft_as_version($1, 'v1.0', 'first')`, baseId)
+	require.NoError(t, err)
+	_, err = client.Exec(ctx, `SELECT create_draft_from_version($1, 'v1.0')`, baseId)
+	require.NoError(t, err)
+
+	s := NewSystem(cfg)
+
+	m, err := s.Load(decision.KindPolicy, baseId)
+	require.NoError(t, err)
+	assert.Equal(t, "Licence", m.Name)
+	assert.Empty(t, m.Owner)
+	assert.Empty(t, m.Tags)
+
+	m, err = s.Update(decision.KindPolicy, baseId, structs.MetadataUpdate{
+		Name:  ptr("Driving Licence"),
+		Owner: ptr("licensing"),
+		Tags:  &[]string{"dvla", " dvla ", "licence"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Driving Licence", m.Name)
+	assert.Equal(t, "licensing", m.Owner)
+	assert.Equal(t, []string{"dvla", "licence"}, m.Tags)
+
+	var stale int
+	require.NoError(t, client.QueryRow(ctx, `SELECT COUNT(*) FROM policies WHERE base_policy_id = $1 AND name != 'Driving Licence'`, baseId).Scan(&stale))
+	assert.Equal(t, 0, stale, "every draft and version is renamed")
+	var currentName string
+	require.NoError(t, client.QueryRow(ctx, `SELECT current_name FROM policy_summary WHERE base_policy_id = $1`, baseId).Scan(&currentName))
+	assert.Equal(t, "Driving Licence", currentName)
+
+	_, err = s.Update(decision.KindPolicy, baseId, structs.MetadataUpdate{Version: "1.0", Description: ptr("first release")})
+	require.NoError(t, err)
+	var description string
+	require.NoError(t, client.QueryRow(ctx, `SELECT description FROM policies WHERE base_policy_id = $1 AND version = 'v1.0'`, baseId).Scan(&description))
+	assert.Equal(t, "first release", description)
+
+	_, err = s.Update(decision.KindPolicy, baseId, structs.MetadataUpdate{Version: "v9", Description: ptr("missing")})
+	assert.ErrorIs(t, err, errors.ErrPolicyNotFound)
+
+	// an unchanged value isn't an edit
+	_, err = s.Update(decision.KindPolicy, baseId, structs.MetadataUpdate{Owner: ptr("licensing")})
+	require.NoError(t, err)
+
+	history, err := s.History(decision.KindPolicy, baseId)
+	require.NoError(t, err)
+	require.Len(t, history, 4)
+	assert.Equal(t, "name", history[0].Field)
+	assert.Equal(t, "Licence", history[0].OldValue)
+	assert.Equal(t, "Driving Licence", history[0].NewValue)
+	assert.Equal(t, "owner", history[1].Field)
+	assert.Nil(t, history[1].OldValue)
+	assert.Equal(t, "tags", history[2].Field)
+	assert.Equal(t, "description", history[3].Field)
+	assert.Equal(t, "v1.0", history[3].Version)
+
+	m, err = s.Update(decision.KindPolicy, baseId, structs.MetadataUpdate{Folder: ptr("/credit/retail/"), Team: ptr("risk")})
+	require.NoError(t, err)
+	assert.Equal(t, "credit/retail", m.Folder)
+	assert.Equal(t, "risk", m.Team)
+
+	m, err = s.Update(decision.KindPolicy, baseId, structs.MetadataUpdate{Folder: ptr("")})
+	require.NoError(t, err)
+	assert.Empty(t, m.Folder, "an empty folder moves it to the top")
+	assert.Equal(t, "risk", m.Team)
+
+	history, err = s.History(decision.KindPolicy, baseId)
+	require.NoError(t, err)
+	require.Len(t, history, 7)
+	assert.Equal(t, "folder", history[4].Field)
+	assert.Equal(t, "team", history[5].Field)
+	assert.Equal(t, "credit/retail", history[6].OldValue)
+	assert.Nil(t, history[6].NewValue)
+
+	_, err = s.Update(decision.KindPolicy, "00000000-0000-0000-0000-000000000000", structs.MetadataUpdate{Owner: ptr("nobody")})
+	assert.ErrorIs(t, err, errors.ErrPolicyNotFound)
+}
+
+func TestSystem_Update_Audited(t *testing.T) {
+	cfg := testutil.Postgres(t, "policy.sql", "flow.sql", "metadata.sql", "audit.sql")
+
+	ctx := context.Background()
+	client, err := cfg.Database.GetPGXPoolClient(ctx)
+	require.NoError(t, err)
+	defer client.Close()
+
+	var baseId string
+	require.NoError(t, client.QueryRow(ctx, `SELECT create_policy('Licence', '{}', '[]', 'rule', FALSE)`).Scan(&baseId))
+
+	s := NewSystem(cfg).SetContext(audit.WithActor(ctx, "alice"))
+	_, err = s.Update(decision.KindPolicy, baseId, structs.MetadataUpdate{Owner: ptr("licensing")})
+	require.NoError(t, err)
+
+	entries, err := audit.NewSystem(cfg).Query(structs.AuditQuery{Action: audit.ActionMetadata, EntityID: baseId})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "alice", entries[0].Actor)
+	assert.Equal(t, decision.KindPolicy, entries[0].Kind)
+	assert.NotEqual(t, entries[0].BeforeHash, entries[0].AfterHash)
+}
+
+func TestValidate(t *testing.T) {
+	_, err := validate(structs.MetadataUpdate{Name: ptr("  ")})
+	assert.Error(t, err)
+
+	long := make([]byte, maxNameLength+1)
+	for i := range long {
+		long[i] = 'a'
+	}
+	_, err = validate(structs.MetadataUpdate{Name: ptr(string(long))})
+	assert.Error(t, err)
+
+	_, err = validate(structs.MetadataUpdate{Version: "v1.0"})
+	assert.Error(t, err, "a version has to keep a description")
+	_, err = validate(structs.MetadataUpdate{Version: "v1.0", Description: ptr(" ")})
+	assert.Error(t, err)
+
+	u, err := validate(structs.MetadataUpdate{Name: ptr(" Licence "), Tags: &[]string{"a", "", " b", "a"}})
+	require.NoError(t, err)
+	assert.Equal(t, "Licence", *u.Name)
+	assert.Equal(t, []string{"a", "b"}, *u.Tags)
+
+	_, err = validate(structs.MetadataUpdate{Folder: ptr("credit/../retail")})
+	assert.Error(t, err)
+
+	u, err = validate(structs.MetadataUpdate{Folder: ptr("credit/retail/"), Team: ptr(" risk ")})
+	require.NoError(t, err)
+	assert.Equal(t, "credit/retail", *u.Folder)
+	assert.Equal(t, "risk", *u.Team)
+
+	u, err = validate(structs.MetadataUpdate{Tags: &[]string{}})
+	require.NoError(t, err)
+	assert.NotNil(t, u.Tags, "an empty list clears the tags")
+}
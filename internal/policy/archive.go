@@ -0,0 +1,491 @@
+package policy
+
+import (
+	"context"
+	"database/sql"
+	stderrors "errors"
+	"github.com/1rp-pw/orchestrator/internal/audit"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/semver"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	ConfigBuilder "github.com/keloran/go-config"
+	"gopkg.in/yaml.v3"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetention     = 30 * 24 * time.Hour
+	defaultPurgeInterval = time.Hour
+)
+
+// Retention is how long archived policies are kept before they are purged
+func Retention(cfg *ConfigBuilder.Config) time.Duration {
+	if d, ok := cfg.ProjectProperties["policy_retention"].(time.Duration); ok && d > 0 {
+		return d
+	}
+	return defaultRetention
+}
+
+// referencesLock is held by ArchivePolicy from the check for dependents until the archive is
+// committed, and shared by every change to flows, so no flow starts referring to a policy that
+// is being archived
+const referencesLock = 0x706f6c6963797265
+
+// DB is the transaction policies are changed in
+type DB interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// LockReferences keeps flows from changing until db is committed, so what InUse finds stays true
+func LockReferences(ctx context.Context, db DB) error {
+	if _, err := db.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, int64(referencesLock)); err != nil {
+		return logs.Errorf("failed to lock policy references: %v", err)
+	}
+	return nil
+}
+
+// ShareReferences is taken by changes to flows, they wait while a policy is being archived
+func ShareReferences(ctx context.Context, db DB) error {
+	if _, err := db.Exec(ctx, `SELECT pg_advisory_xact_lock_shared($1)`, int64(referencesLock)); err != nil {
+		return logs.Errorf("failed to lock policy references: %v", err)
+	}
+	return nil
+}
+
+// ArchivePolicy archives a whole policy when id is a base policy id, or a single draft or
+// version when it is a policy id. Flows that still refer to what would be archived stop it
+func (s *System) ArchivePolicy(id string) (structs.PolicyDeletion, error) {
+	del := structs.PolicyDeletion{ID: id, Action: "archived"}
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return del, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	change, err := audit.Begin(s.Context, s.Audit, client, decision.KindPolicy, audit.ActionArchive, id)
+	if err != nil {
+		return del, err
+	}
+	defer change.Close()
+	if err := LockReferences(s.Context, change); err != nil {
+		return del, err
+	}
+
+	dependents, err := s.InUse(change, id)
+	if err != nil {
+		return del, err
+	}
+	if len(dependents) > 0 {
+		return del, errors.NewInUseError(id, dependents)
+	}
+
+	if err := change.QueryRow(s.Context, `SELECT archive_policy($1)`, id).Scan(&del.Affected); err != nil {
+		return del, logs.Errorf("failed to archive policy: %v", err)
+	}
+	if err := change.Done(id, ""); err != nil {
+		return del, err
+	}
+	purgeAfter := time.Now().Add(Retention(s.Config))
+	del.PurgeAfter = &purgeAfter
+
+	return del, nil
+}
+
+// InUse finds the flows that would break without id, a base policy id or the policy id of a
+// single draft or version. The policies are locked until db is committed
+func (s *System) InUse(db DB, id string) ([]errors.Dependent, error) {
+	return s.inUse(db, id, nil, nil)
+}
+
+// Overwritten finds the flows that would break when every draft and version of a base policy is
+// replaced by ones with policyIds and versions, references to those ids and labels still lead
+// somewhere. The policies are locked until db is committed
+func (s *System) Overwritten(db DB, basePolicyId string, policyIds, versions []string) ([]errors.Dependent, error) {
+	return s.inUse(db, basePolicyId, policyIds, versions)
+}
+
+func (s *System) inUse(db DB, id string, keepIds, keepVersions []string) ([]errors.Dependent, error) {
+	rows, err := db.Query(s.Context, `
+		SELECT
+		    policy_id::text,
+		    base_policy_id::text,
+		    version
+		FROM policies
+		WHERE (base_policy_id::text = $1 OR policy_id::text = $1) AND archived_at IS NULL
+		FOR UPDATE`, id)
+	if err != nil {
+		return nil, logs.Errorf("failed to load policies: %v", err)
+	}
+	var refs, policyIds, versions []string
+	var basePolicyId string
+	for rows.Next() {
+		var policyId string
+		var version sql.NullString
+		if err := rows.Scan(&policyId, &basePolicyId, &version); err != nil {
+			rows.Close()
+			return nil, logs.Errorf("failed to load policies: %v", err)
+		}
+		policyIds = append(policyIds, policyId)
+		if !slices.Contains(keepIds, policyId) {
+			refs = append(refs, policyId)
+		}
+		if version.Valid && !slices.Contains(keepVersions, version.String) {
+			versions = append(versions, version.String)
+			refs = append(refs, versionRefs(basePolicyId, version.String)...)
+		}
+	}
+	rows.Close()
+	if len(policyIds) == 0 {
+		return nil, errors.WrapPolicyError(errors.ErrPolicyNotFound, id)
+	}
+
+	// latest only breaks when no published version is left
+	var remaining int
+	if err := db.QueryRow(s.Context, `
+		SELECT COUNT(*)
+		FROM policies
+		WHERE base_policy_id::text = $1 AND status = 'version' AND archived_at IS NULL AND NOT (policy_id::text = ANY($2))`,
+		basePolicyId, policyIds).Scan(&remaining); err != nil {
+		return nil, logs.Errorf("failed to load policies: %v", err)
+	}
+	if remaining == 0 && len(keepVersions) == 0 {
+		refs = append(refs, basePolicyId+"@latest")
+	}
+
+	// and channels pointing at an archived version
+	channels, err := db.Query(s.Context, `
+		SELECT channel
+		FROM channels
+		WHERE kind = 'policy' AND base_id = $1 AND version = ANY($2)`, basePolicyId, versions)
+	if err != nil {
+		return nil, logs.Errorf("failed to load channels: %v", err)
+	}
+	for channels.Next() {
+		var channel string
+		if err := channels.Scan(&channel); err != nil {
+			channels.Close()
+			return nil, logs.Errorf("failed to load channels: %v", err)
+		}
+		refs = append(refs, basePolicyId+"@"+channel)
+	}
+	channels.Close()
+
+	return s.Dependents(db, refs...)
+}
+
+// versionRefs are the references that resolve to a stored version, v1, 1.0 and v1.0.0 all
+// resolve to v1.0.0
+func versionRefs(basePolicyId, version string) []string {
+	labels := []string{version}
+	if v, err := semver.Parse(version); err == nil {
+		labels = v.Labels()
+	}
+
+	refs := make([]string, 0, 2*len(labels))
+	for _, label := range labels {
+		refs = append(refs, basePolicyId+"@"+label, basePolicyId+"@"+strings.TrimPrefix(label, "v"))
+	}
+	return refs
+}
+
+// RestoreArchived brings back what ArchivePolicy archived
+func (s *System) RestoreArchived(id string) (structs.PolicyDeletion, error) {
+	del := structs.PolicyDeletion{ID: id, Action: "restored"}
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return del, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	change, err := audit.Begin(s.Context, s.Audit, client, decision.KindPolicy, audit.ActionRestore, id)
+	if err != nil {
+		return del, err
+	}
+	defer change.Close()
+	if err := change.QueryRow(s.Context, `SELECT restore_policy($1)`, id).Scan(&del.Affected); err != nil {
+		var pgErr *pgconn.PgError
+		if stderrors.As(err, &pgErr) && pgErr.ConstraintName == "unique_draft_per_policy" {
+			return del, errors.WrapPolicyError(errors.ErrDraftExists, id)
+		}
+		return del, logs.Errorf("failed to restore policy: %v", err)
+	}
+	if del.Affected == 0 {
+		return del, errors.WrapPolicyError(errors.ErrPolicyNotFound, id)
+	}
+	if err := change.Done(id, ""); err != nil {
+		return del, err
+	}
+
+	return del, nil
+}
+
+// PurgePolicy deletes an archived policy for good, it has to have been archived for longer
+// than the retention period
+func (s *System) PurgePolicy(id string) (structs.PolicyDeletion, error) {
+	del := structs.PolicyDeletion{ID: id, Action: "purged"}
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return del, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	var archived, retained int
+	if err := client.QueryRow(s.Context, `
+		SELECT
+		    COUNT(*),
+		    COUNT(*) FILTER (WHERE archived_at > $2)
+		FROM policies
+		WHERE (base_policy_id::text = $1 OR policy_id::text = $1) AND archived_at IS NOT NULL`,
+		id, time.Now().Add(-Retention(s.Config))).Scan(&archived, &retained); err != nil {
+		return del, logs.Errorf("failed to load archived policies: %v", err)
+	}
+	if archived == 0 {
+		return del, errors.WrapPolicyError(errors.ErrPolicyNotFound, id)
+	}
+	if retained > 0 {
+		return del, errors.WrapPolicyError(errors.ErrPolicyRetained, id)
+	}
+
+	change, err := audit.Begin(s.Context, s.Audit, client, decision.KindPolicy, audit.ActionPurge, id)
+	if err != nil {
+		return del, err
+	}
+	defer change.Close()
+	if err := change.QueryRow(s.Context, `SELECT purge_archived_policies($1, $2)`, id, time.Now().Add(-Retention(s.Config))).Scan(&del.Affected); err != nil {
+		return del, logs.Errorf("failed to purge policy: %v", err)
+	}
+	if err := change.Done(id, ""); err != nil {
+		return del, err
+	}
+
+	return del, nil
+}
+
+// PurgeArchived deletes every policy that was archived longer ago than the retention period
+func (s *System) PurgeArchived() (int, error) {
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return 0, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	cutoff := time.Now().Add(-Retention(s.Config))
+	change, err := s.beginPurge(client, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	defer change.Close()
+
+	var purged int
+	if err := change.QueryRow(s.Context, `SELECT purge_archived_policies(NULL, $1)`, cutoff).Scan(&purged); err != nil {
+		return 0, logs.Errorf("failed to purge archived policies: %v", err)
+	}
+	if purged > 0 {
+		if err := change.Done("", ""); err != nil {
+			return purged, err
+		}
+	}
+
+	return purged, nil
+}
+
+// beginPurge starts the purge, audited against each base policy with something archived before
+// cutoff
+func (s *System) beginPurge(client *pgxpool.Pool, cutoff time.Time) (*audit.Change, error) {
+	if s.Audit == nil {
+		return audit.Begin(s.Context, nil, client, decision.KindPolicy, audit.ActionPurge)
+	}
+
+	rows, err := client.Query(s.Context, `SELECT DISTINCT base_policy_id::text FROM policies WHERE archived_at < $1`, cutoff)
+	if err != nil {
+		return nil, logs.Errorf("failed to load archived policies: %v", err)
+	}
+	var basePolicyIds []string
+	for rows.Next() {
+		var basePolicyId string
+		if err := rows.Scan(&basePolicyId); err != nil {
+			rows.Close()
+			return nil, logs.Errorf("failed to load archived policies: %v", err)
+		}
+		basePolicyIds = append(basePolicyIds, basePolicyId)
+	}
+	rows.Close()
+	if len(basePolicyIds) == 0 {
+		return audit.Begin(s.Context, nil, client, decision.KindPolicy, audit.ActionPurge)
+	}
+
+	return audit.Begin(s.Context, s.Audit, client, decision.KindPolicy, audit.ActionPurge, basePolicyIds...)
+}
+
+// StartPurge purges archived policies every policy_purge_interval until the system context is done
+func (s *System) StartPurge() {
+	interval, ok := s.Config.ProjectProperties["policy_purge_interval"].(time.Duration)
+	if !ok || interval <= 0 {
+		interval = defaultPurgeInterval
+	}
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			if purged, err := s.PurgeArchived(); err != nil {
+				_ = logs.Errorf("failed to purge archived policies: %v", err)
+			} else if purged > 0 {
+				logs.Logf("purged %d archived policies", purged)
+			}
+			select {
+			case <-s.Context.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+// ArchivedPolicies lists the policies that have archived drafts or versions
+func (s *System) ArchivedPolicies() ([]structs.ArchivedPolicy, error) {
+	pp := make([]structs.ArchivedPolicy, 0)
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return pp, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	rows, err := client.Query(s.Context, `
+		SELECT
+		    base_policy_id,
+		    current_name,
+		    archived_count,
+		    fully_archived,
+		    latest_archived_date
+		FROM archived_policy_summary
+		ORDER BY latest_archived_date DESC`)
+	if err != nil {
+		return pp, logs.Errorf("failed to load archived policies: %v", err)
+	}
+	defer rows.Close()
+
+	retention := Retention(s.Config)
+	for rows.Next() {
+		var id, name sql.NullString
+		var archivedAt sql.NullTime
+		p := structs.ArchivedPolicy{}
+		if err := rows.Scan(&id, &name, &p.ArchivedCount, &p.FullyArchived, &archivedAt); err != nil {
+			return pp, logs.Errorf("failed to load archived policies: %v", err)
+		}
+		p.BaseID = id.String
+		p.Name = name.String
+		p.ArchivedAt = archivedAt.Time
+		p.PurgeAfter = archivedAt.Time.Add(retention)
+		pp = append(pp, p)
+	}
+
+	return pp, nil
+}
+
+// Dependents finds the flows whose nodes refer to any of the policy ids or references. A flow
+// whose yaml can't be read is counted when it mentions one, it can't be told apart
+func (s *System) Dependents(db DB, refs ...string) ([]errors.Dependent, error) {
+	dependents := make([]errors.Dependent, 0)
+
+	// the text match only narrows it down, the yaml decides
+	patterns := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		patterns = append(patterns, "%"+ref+"%")
+	}
+	rows, err := db.Query(s.Context, `
+		SELECT
+		    flow_id,
+		    base_flow_id,
+		    name,
+		    version,
+		    flow
+		FROM flows
+		WHERE flow LIKE ANY($1)
+		ORDER BY name, created_at`, patterns)
+	if err != nil {
+		return dependents, logs.Errorf("failed to load flows: %v", err)
+	}
+	defer rows.Close()
+
+	type dataStruct struct {
+		ID      sql.NullString
+		BaseID  sql.NullString
+		Name    sql.NullString
+		Version sql.NullString
+		Flow    sql.NullString
+	}
+
+	for rows.Next() {
+		d := dataStruct{}
+		if err := rows.Scan(&d.ID, &d.BaseID, &d.Name, &d.Version, &d.Flow); err != nil {
+			return dependents, logs.Errorf("failed to load flows: %v", err)
+		}
+
+		nodeIds, err := referringNodes(d.Flow.String, refs)
+		if err != nil {
+			_ = logs.Errorf("failed to read flow %s, counting it as a dependent: %v", d.ID.String, err)
+			nodeIds = []string{}
+		} else if len(nodeIds) == 0 {
+			continue
+		}
+		dependents = append(dependents, errors.Dependent{
+			FlowID:     d.ID.String,
+			BaseFlowID: d.BaseID.String,
+			Name:       d.Name.String,
+			Version:    d.Version.String,
+			NodeIDs:    nodeIds,
+		})
+	}
+
+	return dependents, nil
+}
+
+// referringNodes lists the nodes of the flow yaml that run one of the policy ids or references
+func referringNodes(flowYAML string, refs []string) ([]string, error) {
+	var fc structs.FlowConfig
+	if err := yaml.Unmarshal([]byte(flowYAML), &fc); err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool, len(refs))
+	for _, ref := range refs {
+		wanted[ref] = true
+	}
+
+	seen := make(map[string]bool)
+	var walk func(nodes []structs.FlowNode)
+	walk = func(nodes []structs.FlowNode) {
+		for _, n := range nodes {
+			if n.PolicyID != "" && wanted[n.PolicyID] {
+				seen[n.ID] = true
+			}
+			walk(n.OnTrue)
+			walk(n.OnFalse)
+		}
+	}
+	walk(fc.Flow.Start)
+
+	nodeIds := make([]string, 0, len(seen))
+	for id := range seen {
+		nodeIds = append(nodeIds, id)
+	}
+	sort.Strings(nodeIds)
+
+	return nodeIds, nil
+}
@@ -0,0 +1,206 @@
+package policy
+
+import (
+	"database/sql"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"github.com/1rp-pw/orchestrator/internal/diff"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/etag"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/jackc/pgx/v5"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// LoadPolicyRevision loads the draft of a base policy, or one of its versions by label or latest
+func (s *System) LoadPolicyRevision(basePolicyId, label string) (structs.Policy, error) {
+	if label == "draft" {
+		return s.loadPolicy(`base_policy_id = $1 AND status = 'draft'`, basePolicyId)
+	}
+	return s.LoadPolicyVersion(basePolicyId, label)
+}
+
+// Diff compares two revisions of a base policy, each is draft, latest or a version label
+func (s *System) Diff(basePolicyId, from, to string) (structs.PolicyDiff, error) {
+	d := structs.PolicyDiff{
+		BaseID: basePolicyId,
+		From:   from,
+		To:     to,
+	}
+
+	fp, err := s.LoadPolicyRevision(basePolicyId, from)
+	if err != nil {
+		return d, errors.WrapPolicyError(errors.ErrPolicyNotFound, basePolicyId+"@"+from)
+	}
+	tp, err := s.LoadPolicyRevision(basePolicyId, to)
+	if err != nil {
+		return d, errors.WrapPolicyError(errors.ErrPolicyNotFound, basePolicyId+"@"+to)
+	}
+
+	return PolicyDiff(fp, tp, from, to)
+}
+
+// PolicyDiff compares the rule, data model and tests of two policies
+func PolicyDiff(from, to structs.Policy, fromLabel, toLabel string) (structs.PolicyDiff, error) {
+	d := structs.PolicyDiff{
+		BaseID:       to.BaseID,
+		From:         fromLabel,
+		To:           toLabel,
+		FromPolicyID: from.PolicyID,
+		ToPolicyID:   to.PolicyID,
+	}
+
+	fields, err := diff.DataModel(from.DataModel, to.DataModel)
+	if err != nil {
+		return d, errors.NewValidationError("schema", err.Error())
+	}
+
+	d.Rule.Hunks = diff.Lines(from.Rule, to.Rule)
+	d.DataModel.Fields = fields
+	d.DataModel.Hunks = diff.Lines(diff.JSONText(from.DataModel), diff.JSONText(to.DataModel))
+	d.Tests.Cases = diff.Tests(TestCases(from.Tests), TestCases(to.Tests))
+	d.Tests.Hunks = diff.Lines(diff.JSONText(from.Tests), diff.JSONText(to.Tests))
+	d.Changed = len(d.Rule.Hunks) > 0 || len(d.DataModel.Hunks) > 0 || len(d.Tests.Hunks) > 0
+
+	return d, nil
+}
+
+// DraftChanges compares an earlier revision of the draft of a base policy with its current one
+func (s *System) DraftChanges(basePolicyId string, since int64) (structs.DraftChanges, error) {
+	c := structs.DraftChanges{
+		BaseID: basePolicyId,
+		Since:  since,
+	}
+
+	draft, err := s.loadPolicy(`base_policy_id = $1 AND status = 'draft'`, basePolicyId)
+	if err != nil {
+		return c, errors.WrapPolicyError(errors.ErrPolicyNotFound, basePolicyId+"@draft")
+	}
+	c.DraftID = draft.PolicyID
+	c.Revision = draft.Revision
+
+	from := draft
+	if since != draft.Revision {
+		if from, err = s.loadDraftRevision(draft, since); err != nil {
+			return c, err
+		}
+	}
+
+	d, err := PolicyDiff(from, draft, strconv.FormatInt(since, 10), strconv.FormatInt(draft.Revision, 10))
+	if err != nil {
+		return c, err
+	}
+	c.Changed = d.Changed
+	c.Policy = &d
+
+	return c, nil
+}
+
+// loadDraftRevision loads an earlier revision of a draft, kept when the draft was edited
+func (s *System) loadDraftRevision(draft structs.Policy, revision int64) (structs.Policy, error) {
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return draft, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	p := draft
+	p.Revision = revision
+	var dataModel, tests string
+	var description sql.NullString
+	var strict bool
+	err = client.QueryRow(s.Context, `
+		SELECT data_model::text, tests::text, rule, description, strict_validation
+		FROM policy_draft_revisions
+		WHERE policy_id = $1 AND revision = $2`, draft.PolicyID, revision).Scan(&dataModel, &tests, &p.Rule, &description, &strict)
+	if stderrors.Is(err, pgx.ErrNoRows) {
+		return p, errors.WrapPolicyError(errors.ErrPolicyNotFound, fmt.Sprintf("%s@draft revision %d", draft.BaseID, revision))
+	}
+	if err != nil {
+		return p, logs.Errorf("failed to load draft revision: %v", err)
+	}
+	p.DataModel = dataModel
+	p.Tests = tests
+	p.Description = description.String
+	p.StrictValidation = &strict
+
+	return p, nil
+}
+
+// UnifiedDiff writes the diff as one unified diff with a file each for the rule, data model and tests
+func UnifiedDiff(d structs.PolicyDiff) string {
+	var w strings.Builder
+	from := d.BaseID + "@" + d.From
+	to := d.BaseID + "@" + d.To
+	diff.Unified(&w, from+"/rule", to+"/rule", d.Rule.Hunks)
+	diff.Unified(&w, from+"/schema.json", to+"/schema.json", d.DataModel.Hunks)
+	diff.Unified(&w, from+"/tests.json", to+"/tests.json", d.Tests.Hunks)
+	return w.String()
+}
+
+// DiffPolicy compares two revisions of the base policy in the path, from defaults to latest and
+// to to draft. format=unified returns a unified diff instead of JSON
+func (s *System) DiffPolicy(w http.ResponseWriter, r *http.Request) {
+	s.SetContext(r.Context())
+	policyId := r.PathValue("policyId")
+
+	q := r.URL.Query()
+	from, to := q.Get("from"), q.Get("to")
+	if from == "" {
+		from = "latest"
+	}
+	if to == "" {
+		to = "draft"
+	}
+	format := q.Get("format")
+	if format != "" && format != "json" && format != "unified" {
+		errors.WriteHTTPError(w, errors.NewValidationError("format", "format must be json or unified"))
+		return
+	}
+
+	d, err := s.Diff(policyId, from, to)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	if format == "unified" {
+		w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+		_, _ = w.Write([]byte(UnifiedDiff(d)))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(d); err != nil {
+		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
+	}
+}
+
+// GetPolicyDraftChanges lists what changed in the draft since the revision in since, such as
+// that of an edit that was refused as a conflict
+func (s *System) GetPolicyDraftChanges(w http.ResponseWriter, r *http.Request) {
+	s.SetContext(r.Context())
+	policyId := r.PathValue("policyId")
+
+	since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	if err != nil || since <= 0 {
+		errors.WriteHTTPError(w, errors.NewValidationError("since", "since must be a revision of the draft"))
+		return
+	}
+
+	c, err := s.DraftChanges(policyId, since)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	etag.Set(w, c.Revision)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c); err != nil {
+		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
+	}
+}
@@ -2,6 +2,11 @@ package policy
 
 import (
 	"encoding/json"
+	stderrors "errors"
+	"github.com/1rp-pw/orchestrator/internal/effective"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/etag"
+	"github.com/1rp-pw/orchestrator/internal/listing"
 	"github.com/1rp-pw/orchestrator/internal/structs"
 	"github.com/bugfixes/go-bugfixes/logs"
 	"net/http"
@@ -38,11 +43,55 @@ func (s *System) CreatePolicy(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// DeletePolicy archives the base policy or the single draft or version policyId names, with
+// purge=true it deletes what was archived for good once the retention period is over
 func (s *System) DeletePolicy(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusNotImplemented)
+	s.SetContext(r.Context())
+	policyId := r.PathValue("policyId")
+
+	archive := s.ArchivePolicy
+	if r.URL.Query().Get("purge") == "true" {
+		archive = s.PurgePolicy
+	}
+	del, err := archive(policyId)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(del); err != nil {
+		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
+	}
+}
+
+// RestorePolicy brings back an archived policy, draft or version
+func (s *System) RestorePolicy(w http.ResponseWriter, r *http.Request) {
+	s.SetContext(r.Context())
+
+	del, err := s.RestoreArchived(r.PathValue("policyId"))
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(del); err != nil {
+		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
+	}
 }
 
+// UpdatePolicy edits or publishes the draft, If-Match has to hold the ETag or revision of the
+// draft as it was loaded so an edit made since isn't overwritten
 func (s *System) UpdatePolicy(w http.ResponseWriter, r *http.Request) {
+	s.SetContext(r.Context())
+
+	m, err := etag.IfMatch(r)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
 	var i structs.Policy
 	if err := json.NewDecoder(r.Body).Decode(&i); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -50,21 +99,53 @@ func (s *System) UpdatePolicy(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if i.Status == "draft" {
-		if err := s.UpdateDraft(i); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		i.Revision = m.Revision
+		revision, err := s.UpdateDraftRevision(i)
+		if err != nil {
+			etag.WriteError(w, err)
 			return
 		}
 
+		etag.Set(w, revision)
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
+	if err := s.checkDraftRevision(i.BaseID, m); err != nil {
+		etag.WriteError(w, err)
+		return
+	}
+	i.Revision = m.Revision
 	if err := s.CreateVersion(i); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		etag.WriteError(w, err)
+		return
 	}
 	w.WriteHeader(http.StatusCreated)
 }
 
+// RollbackPolicy makes the version in the body the latest again, the draft is kept
+func (s *System) RollbackPolicy(w http.ResponseWriter, r *http.Request) {
+	s.SetContext(r.Context())
+
+	var req structs.RollbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errors.WriteHTTPError(w, errors.NewValidationError("body", "invalid JSON format"))
+		return
+	}
+
+	rb, err := s.Rollback(r.PathValue("policyId"), req)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(rb); err != nil {
+		_ = logs.Errorf("failed to encode rollback: %v", err)
+	}
+}
+
 func (s *System) GetPolicy(w http.ResponseWriter, r *http.Request) {
 	policyId := r.PathValue("policyId")
 	p, err := s.LoadPolicy(policyId)
@@ -73,12 +154,16 @@ func (s *System) GetPolicy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if p.IsDraft {
+		etag.Set(w, p.Revision)
+	}
 	if err := json.NewEncoder(w).Encode(p); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 	}
 }
 
 func (s *System) CreateDraftFromVersion(w http.ResponseWriter, r *http.Request) {
+	s.SetContext(r.Context())
 	policyId := r.PathValue("policyId")
 	p, err := s.DraftFromVersion(policyId)
 	if err != nil {
@@ -86,13 +171,39 @@ func (s *System) CreateDraftFromVersion(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	etag.Set(w, p.Revision)
 	if err := json.NewEncoder(w).Encode(p); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 	}
 }
 
+// GetPolicyVersion loads a published version of the base policy by its label or latest, asOf
+// loads the version that was latest then
 func (s *System) GetPolicyVersion(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusNotImplemented)
+	ctx, err := effective.FromRequest(r)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+	policyId := r.PathValue("policyId")
+	versionId := r.PathValue("versionId")
+
+	ps := *s
+	ps.Context = ctx
+	p, err := ps.LoadPolicyVersion(policyId, versionId)
+	if stderrors.Is(err, errors.ErrPolicyNotFound) {
+		errors.WriteHTTPError(w, errors.WrapPolicyError(errors.ErrPolicyNotFound, policyId+"@"+versionId))
+		return
+	}
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
+	}
 }
 
 func (s *System) ListPolicyVersions(w http.ResponseWriter, r *http.Request) {
@@ -110,15 +221,36 @@ func (s *System) ListPolicyVersions(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// GetAllPolicies lists a page of the policies, see listing.FromRequest for the query. The total
+// count and the cursor of the next page are sent as headers. archived=true lists archived policies
 func (s *System) GetAllPolicies(w http.ResponseWriter, r *http.Request) {
 	s.SetContext(r.Context())
 
-	p, err := s.AllPolicies()
+	if r.URL.Query().Get("archived") == "true" {
+		pp, err := s.ArchivedPolicies()
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(pp); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	q, err := listing.FromRequest(r)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	p, page, err := s.ListPolicies(q)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
 		return
 	}
 
+	listing.WriteHeaders(w, r, page)
 	if err := json.NewEncoder(w).Encode(p); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 	}
@@ -3,21 +3,42 @@ package policy
 import (
 	"context"
 	"database/sql"
-	"fmt"
+	stderrors "errors"
+	"github.com/1rp-pw/orchestrator/internal/audit"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/effective"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/etag"
+	"github.com/1rp-pw/orchestrator/internal/listing"
+	"github.com/1rp-pw/orchestrator/internal/semver"
 	"github.com/1rp-pw/orchestrator/internal/structs"
 	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/jackc/pgx/v5"
 	ConfigBuilder "github.com/keloran/go-config"
+	"sort"
+	"strings"
 )
 
 type System struct {
 	Config  *ConfigBuilder.Config
 	Context context.Context
+	Tests   TestRunner
+	Reviews Reviews
+	Audit   audit.Recorder
+}
+
+// Reviews is the review a draft has to pass before it is published, both are run on the change
+// that publishes it so the publish fails when either does
+type Reviews interface {
+	Approved(ctx context.Context, change *audit.Change, kind, baseId string) (int64, error)
+	Published(ctx context.Context, change *audit.Change, reviewId int64, version string) error
 }
 
 func NewSystem(cfg *ConfigBuilder.Config) *System {
 	return &System{
 		Config:  cfg,
 		Context: context.Background(),
+		Audit:   audit.NewSystem(cfg),
 	}
 }
 
@@ -26,6 +47,18 @@ func (s *System) SetContext(ctx context.Context) *System {
 	return s
 }
 
+// SetReviews only publishes drafts whose review r approved
+func (s *System) SetReviews(r Reviews) *System {
+	s.Reviews = r
+	return s
+}
+
+// SetAudit records every change to policies with a, nil records nothing
+func (s *System) SetAudit(a audit.Recorder) *System {
+	s.Audit = a
+	return s
+}
+
 func (s *System) StoreInitialPolicy(p *structs.Policy) (*structs.Policy, error) {
 	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
 	if err != nil {
@@ -33,50 +66,245 @@ func (s *System) StoreInitialPolicy(p *structs.Policy) (*structs.Policy, error)
 	}
 	defer client.Close()
 
-	if err := client.QueryRow(s.Context, `SELECT create_policy ($1, $2, $3, $4)`, p.Name, p.DataModel, p.Tests, p.Rule).Scan(&p.BaseID); err != nil {
+	change, err := audit.Begin(s.Context, s.Audit, client, decision.KindPolicy, audit.ActionCreate, "")
+	if err != nil {
+		return nil, err
+	}
+	defer change.Close()
+	if err := change.QueryRow(s.Context, `SELECT create_policy ($1, $2, $3, $4, $5)`, p.Name, p.DataModel, p.Tests, p.Rule, p.StrictValidation).Scan(&p.BaseID); err != nil {
 		return nil, logs.Errorf("failed to store initial structs: %v", err)
 	}
 	p.Version = "draft"
+	if err := change.Done(p.BaseID, ""); err != nil {
+		return nil, err
+	}
 
 	return p, nil
 }
 
 func (s *System) UpdateDraft(p structs.Policy) error {
+	_, err := s.UpdateDraftRevision(p)
+	return err
+}
+
+// UpdateDraftRevision updates the draft when it is still at p.Revision, or whatever its revision
+// when that is 0, and returns the revision the draft is at after the edit
+func (s *System) UpdateDraftRevision(p structs.Policy) (int64, error) {
 	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
 	if err != nil {
-		return logs.Errorf("failed to connect to database: %v", err)
+		return 0, logs.Errorf("failed to connect to database: %v", err)
 	}
 	defer client.Close()
-	if _, err := client.Exec(s.Context, `SELECT update_draft($1, $2, $3, $4, $5)`, p.BaseID, p.DataModel, p.Tests, p.Rule, p.Description); err != nil {
-		return logs.Errorf("failed to update draft: %v", err)
+
+	var expected interface{}
+	if p.Revision != 0 {
+		expected = p.Revision
 	}
 
+	change, err := audit.Begin(s.Context, s.Audit, client, decision.KindPolicy, audit.ActionUpdate, p.BaseID)
+	if err != nil {
+		return 0, err
+	}
+	defer change.Close()
+	var updated bool
+	var revision sql.NullInt64
+	if err := change.QueryRow(s.Context, `
+		SELECT updated, current_revision
+		FROM update_draft($1, $2, $3, $4, $5, $6, $7)`,
+		p.BaseID, p.DataModel, p.Tests, p.Rule, p.Description, p.StrictValidation, expected).Scan(&updated, &revision); err != nil {
+		return 0, logs.Errorf("failed to update draft: %v", err)
+	}
+	if !revision.Valid {
+		return 0, errors.WrapPolicyError(errors.ErrPolicyNotFound, p.BaseID)
+	}
+	if !updated {
+		return revision.Int64, etag.Conflict(p.BaseID, revision.Int64)
+	}
+	if err := change.Done(p.BaseID, ""); err != nil {
+		return revision.Int64, err
+	}
+
+	return revision.Int64, nil
+}
+
+// checkDraftRevision fails with a conflict when the draft that is about to be published isn't
+// at the revision m asks for
+func (s *System) checkDraftRevision(basePolicyId string, m etag.Match) error {
+	revision := s.draftRevision(basePolicyId)
+	if revision != 0 && !m.Matches(revision) {
+		return etag.Conflict(basePolicyId, revision)
+	}
 	return nil
 }
 
+// draftRevision is the revision the draft of a base policy is at, 0 when there is none as
+// publishing reports the missing draft
+func (s *System) draftRevision(basePolicyId string) int64 {
+	draft, err := s.loadPolicy(`base_policy_id = $1 AND status = 'draft'`, basePolicyId)
+	if err != nil {
+		return 0
+	}
+	return draft.Revision
+}
+
 func (s *System) CreateVersion(p structs.Policy) error {
+	if err := effective.Validate(p.EffectiveFrom, p.EffectiveUntil); err != nil {
+		return err
+	}
+
+	version, err := s.nextVersion(p)
+	if err != nil {
+		return err
+	}
+
+	// the draft is published at the revision it was when the tests were checked, an edit since
+	// stops the publish
+	revision := p.Revision
+	if revision == 0 {
+		revision = s.draftRevision(p.BaseID)
+	}
+	var expected interface{}
+	if revision != 0 {
+		expected = revision
+	}
+
+	if requirePassingTests(s) {
+		if err := s.checkDraftTests(p.BaseID); err != nil {
+			return err
+		}
+	}
+
 	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
 	if err != nil {
 		return logs.Errorf("failed to connect to database: %v", err)
 	}
 	defer client.Close()
 
-	if _, err := client.Exec(s.Context, `SELECT publish_draft_as_version($1, $2, $3)`, p.BaseID, fmt.Sprintf("v%s", p.Version), p.Description); err != nil {
+	change, err := audit.Begin(s.Context, s.Audit, client, decision.KindPolicy, audit.ActionPublish, p.BaseID)
+	if err != nil {
+		return err
+	}
+	defer change.Close()
+	var reviewId int64
+	if s.Reviews != nil {
+		if reviewId, err = s.Reviews.Approved(s.Context, change, decision.KindPolicy, p.BaseID); err != nil {
+			return err
+		}
+	}
+	if _, err := change.Exec(s.Context, `SELECT publish_draft_as_version($1, $2, $3, $4, $5, $6)`, p.BaseID, version, p.Description, p.EffectiveFrom, p.EffectiveUntil, expected); err != nil {
+		if etag.Moved(err) {
+			return etag.Conflict(p.BaseID, s.draftRevision(p.BaseID))
+		}
 		return logs.Errorf("failed to create version: %v", err)
 	}
+	if reviewId != 0 {
+		if err := s.Reviews.Published(s.Context, change, reviewId, version); err != nil {
+			return err
+		}
+	}
+	if err := change.Done(p.BaseID, version); err != nil {
+		return err
+	}
 
 	return nil
 }
 
+// nextVersion is the label p is published as, archived versions count as the labels stay taken
+func (s *System) nextVersion(p structs.Policy) (string, error) {
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return "", logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	rows, err := client.Query(s.Context, `SELECT version FROM policies WHERE base_policy_id = $1 AND version IS NOT NULL`, p.BaseID)
+	if err != nil {
+		return "", logs.Errorf("failed to load versions: %v", err)
+	}
+	defer rows.Close()
+
+	var existing []string
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			return "", logs.Errorf("failed to load versions: %v", err)
+		}
+		existing = append(existing, version)
+	}
+	if err := rows.Err(); err != nil {
+		return "", logs.Errorf("failed to load versions: %v", err)
+	}
+
+	return semver.Next(existing, p.Version, p.Bump)
+}
+
 func (s *System) LoadPolicy(policyId string) (structs.Policy, error) {
+	return s.loadPolicy(`policy_id = $1`, policyId)
+}
+
+// LoadPolicyVersion loads a published version of a base policy by its label, "latest" is the
+// version in force at the asOf of the system context, or now, and a channel such as prod the
+// version it points at
+func (s *System) LoadPolicyVersion(basePolicyId, version string) (structs.Policy, error) {
+	if version == "latest" {
+		return s.loadPolicy(`base_policy_id = $1 AND status = 'version' AND `+effective.Condition("$2")+` ORDER BY `+effective.Order+` LIMIT 1`, basePolicyId, effective.Param(s.Context))
+	}
+	if _, err := semver.Parse(version); err != nil {
+		channel := `SELECT version FROM channels WHERE kind = 'policy' AND base_id = $2 AND channel = $3`
+		args := []interface{}{basePolicyId, basePolicyId, version}
+		if asOf := effective.AsOf(s.Context); !asOf.IsZero() {
+			// the version the channel pointed at then, it may have been promoted since
+			channel = `
+				SELECT version
+				FROM channel_history
+				WHERE kind = 'policy' AND base_id = $2 AND channel = $3 AND promoted_at <= $4
+				ORDER BY promoted_at DESC, id DESC
+				LIMIT 1`
+			args = append(args, asOf)
+		}
+		p, err := s.loadPolicy(`base_policy_id = $1 AND version = (`+channel+`)`, args...)
+		if !stderrors.Is(err, errors.ErrPolicyNotFound) {
+			return p, err
+		}
+	}
+	return s.loadPolicy(`base_policy_id = $1 AND version = ANY($2)`, basePolicyId, semver.StoredLabels(version))
+}
+
+// ResolvePolicy loads a policy by its policy id or by a {basePolicyId}@{version|latest|channel}
+// reference
+func (s *System) ResolvePolicy(ref string) (structs.Policy, error) {
+	basePolicyId, version, ok := strings.Cut(ref, "@")
+	if !ok {
+		return s.LoadPolicy(ref)
+	}
+	return s.LoadPolicyVersion(basePolicyId, version)
+}
+
+// VersionLabel is the stored label of a version, versions are stored with a leading v
+func VersionLabel(version string) string {
+	if version == "" || strings.HasPrefix(version, "v") {
+		return version
+	}
+	return "v" + version
+}
+
+func (s *System) loadPolicy(where string, args ...interface{}) (structs.Policy, error) {
 	type dataStruct struct {
-		Name      sql.NullString
-		BaseID    sql.NullString
-		Version   sql.NullString
-		DataModel sql.NullString
-		Tests     sql.NullString
-		Rule      sql.NullString
-		Status    sql.NullString
+		ID          sql.NullString
+		Name        sql.NullString
+		BaseID      sql.NullString
+		Version     sql.NullString
+		DataModel   sql.NullString
+		Tests       sql.NullString
+		Rule        sql.NullString
+		Description sql.NullString
+		Status      sql.NullString
+		Strict      sql.NullBool
+		Revision    sql.NullInt64
+		From        sql.NullTime
+		Until       sql.NullTime
+		CreatedAt   sql.NullTime
+		UpdatedAt   sql.NullTime
 	}
 	d := dataStruct{}
 
@@ -87,39 +315,69 @@ func (s *System) LoadPolicy(policyId string) (structs.Policy, error) {
 	defer client.Close()
 	if err := client.QueryRow(s.Context, `
 		SELECT 
+		    policy_id, 
 		    name, 
 		    base_policy_id, 
 		    version, 
 		    data_model, 
 		    tests, 
 		    rule, 
-		    status 
+		    description, 
+		    status, 
+		    strict_validation, 
+		    revision, 
+		    effective_from, 
+		    effective_until, 
+		    created_at, 
+		    updated_at 
 		FROM public.policies 
-		WHERE policy_id = $1`, policyId,
+		WHERE archived_at IS NULL AND `+where, args...,
 	).Scan(
+		&d.ID,
 		&d.Name,
 		&d.BaseID,
 		&d.Version,
 		&d.DataModel,
 		&d.Tests,
 		&d.Rule,
+		&d.Description,
 		&d.Status,
-	); err != nil {
+		&d.Strict,
+		&d.Revision,
+		&d.From,
+		&d.Until,
+		&d.CreatedAt,
+		&d.UpdatedAt,
+	); stderrors.Is(err, pgx.ErrNoRows) {
+		return structs.Policy{}, errors.ErrPolicyNotFound
+	} else if err != nil {
 		return structs.Policy{}, logs.Errorf("failed to load structs: %v", err)
 	}
 	p := structs.Policy{
-		PolicyID:  policyId,
-		BaseID:    d.BaseID.String,
-		Name:      d.Name.String,
-		Version:   d.Version.String,
-		DataModel: d.DataModel.String,
-		Tests:     d.Tests.String,
-		Rule:      d.Rule.String,
-		Status:    d.Status.String,
+		PolicyID:    d.ID.String,
+		BaseID:      d.BaseID.String,
+		Name:        d.Name.String,
+		Version:     d.Version.String,
+		DataModel:   d.DataModel.String,
+		Tests:       d.Tests.String,
+		Rule:        d.Rule.String,
+		Description: d.Description.String,
+		Status:      d.Status.String,
+		CreatedAt:   d.CreatedAt.Time,
+		UpdatedAt:   d.UpdatedAt.Time,
+
+		StrictValidation: &d.Strict.Bool,
 	}
 
 	if d.Status.String == "draft" {
 		p.IsDraft = true
+		p.Revision = d.Revision.Int64
+	}
+	if d.From.Valid {
+		p.EffectiveFrom = &d.From.Time
+	}
+	if d.Until.Valid {
+		p.EffectiveUntil = &d.Until.Time
 	}
 
 	return p, nil
@@ -137,16 +395,24 @@ func (s *System) DraftFromVersion(policyId string) (structs.Policy, error) {
 	var basePolicyId sql.NullString
 	var version sql.NullString
 
-	if err := client.QueryRow(s.Context, `SELECT base_policy_id, version FROM policies WHERE policy_id = $1`, policyId).Scan(&basePolicyId, &version); err != nil {
+	if err := client.QueryRow(s.Context, `SELECT base_policy_id, version FROM policies WHERE policy_id = $1 AND archived_at IS NULL`, policyId).Scan(&basePolicyId, &version); err != nil {
 		return p, logs.Errorf("failed to load structs: %v", err)
 	}
 
 	var newPolicyId sql.NullString
 
 	if basePolicyId.Valid {
-		if err := client.QueryRow(s.Context, `SELECT create_draft_from_version($1, $2)`, basePolicyId.String, version.String).Scan(&newPolicyId); err != nil {
+		change, err := audit.Begin(s.Context, s.Audit, client, decision.KindPolicy, audit.ActionDraft, policyId)
+		if err != nil {
+			return p, err
+		}
+		defer change.Close()
+		if err := change.QueryRow(s.Context, `SELECT create_draft_from_version($1, $2)`, basePolicyId.String, version.String).Scan(&newPolicyId); err != nil {
 			return p, logs.Errorf("failed to load structs: %v", err)
 		}
+		if err := change.Done(newPolicyId.String, ""); err != nil {
+			return p, err
+		}
 	}
 
 	return s.LoadPolicy(newPolicyId.String)
@@ -214,10 +480,58 @@ func (s *System) AllPolicies() ([]structs.Policy, error) {
 		}
 		pp = append(pp, p)
 	}
+	if err := rows.Err(); err != nil {
+		return pp, logs.Errorf("failed to load policies: %v", err)
+	}
 
 	return pp, nil
 }
 
+// policyListing lists policy_summary, searching the name, description and rule of every draft
+// and version that isn't archived
+var policyListing = listing.Source{
+	Kind:     decision.KindPolicy,
+	View:     "policy_summary",
+	BaseID:   "base_policy_id",
+	Table:    "policies",
+	Document: "t.name || ' ' || COALESCE(t.description, '') || ' ' || t.rule",
+	Live:     "t.archived_at IS NULL",
+}
+
+// ListPolicies is a page of the policies that match q, along with how many match
+func (s *System) ListPolicies(q listing.Query) ([]structs.Policy, listing.Page, error) {
+	pp := make([]structs.Policy, 0)
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return pp, listing.Page{}, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	page, err := listing.Run(s.Context, client, policyListing, q)
+	if err != nil {
+		return pp, page, err
+	}
+
+	for _, row := range page.Rows {
+		pp = append(pp, structs.Policy{
+			BaseID:          row.BaseID,
+			Name:            row.Name,
+			DraftID:         row.DraftID,
+			HasDraft:        row.HasDraft,
+			CreatedAt:       row.CreatedAt,
+			UpdatedAt:       row.UpdatedAt,
+			LastPublishedAt: row.LastPublishedAt,
+			Owner:           row.Owner,
+			Tags:            row.Tags,
+			Folder:          row.Folder,
+			Team:            row.Team,
+		})
+	}
+
+	return pp, page, nil
+}
+
 func (s *System) GetPolicyVersions(basePolicyId string) ([]structs.Policy, error) {
 	var pp []structs.Policy
 
@@ -235,10 +549,12 @@ func (s *System) GetPolicyVersions(basePolicyId string) ([]structs.Policy, error
 		    data_model, 
 		    description, 
 		    status, 
+		    effective_from, 
+		    effective_until, 
 		    created_at, 
 		    updated_at 
 		FROM policies 
-		WHERE base_policy_id = $1
+		WHERE base_policy_id = $1 AND archived_at IS NULL
 		ORDER BY 
 		    CASE WHEN status = 'draft' THEN 0 ELSE 1 END,
 		    CASE WHEN version IS NULL THEN '' ELSE version END`, basePolicyId)
@@ -255,6 +571,8 @@ func (s *System) GetPolicyVersions(basePolicyId string) ([]structs.Policy, error
 		DataModel   sql.NullString
 		Description sql.NullString
 		Status      sql.NullString
+		From        sql.NullTime
+		Until       sql.NullTime
 		CreatedAt   sql.NullTime
 		UpdatedAt   sql.NullTime
 	}
@@ -269,6 +587,8 @@ func (s *System) GetPolicyVersions(basePolicyId string) ([]structs.Policy, error
 			&d.DataModel,
 			&d.Description,
 			&d.Status,
+			&d.From,
+			&d.Until,
 			&d.CreatedAt,
 			&d.UpdatedAt,
 		); err != nil {
@@ -294,9 +614,23 @@ func (s *System) GetPolicyVersions(basePolicyId string) ([]structs.Policy, error
 		if d.Version.String != "" {
 			p.Version = d.Version.String
 		}
+		if d.From.Valid {
+			p.EffectiveFrom = &d.From.Time
+		}
+		if d.Until.Valid {
+			p.EffectiveUntil = &d.Until.Time
+		}
 
 		pp = append(pp, p)
 	}
 
+	// drafts first, then the versions from oldest to newest
+	sort.SliceStable(pp, func(i, j int) bool {
+		if pp[i].IsDraft != pp[j].IsDraft {
+			return pp[i].IsDraft
+		}
+		return semver.CompareLabels(pp[i].Version, pp[j].Version) < 0
+	})
+
 	return pp, nil
 }
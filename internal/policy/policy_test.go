@@ -3,10 +3,16 @@ package policy
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/1rp-pw/orchestrator/internal/effective"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/listing"
 	"github.com/1rp-pw/orchestrator/internal/structs"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -46,11 +52,12 @@ func setupTestDatabase(t *testing.T) (*postgres.PostgresContainer, *ConfigBuilde
 	require.NoError(t, err)
 	defer client.Close()
 
-	schemaSQL, err := os.ReadFile("../../sql/policy.sql")
-	require.NoError(t, err)
-	_, err = client.Exec(ctx, string(schemaSQL))
-	if err != nil {
-		t.Fatalf("Failed to execute policy schema SQL: %v", err)
+	for _, file := range []string{"policy.sql", "channel.sql", "metadata.sql", "audit.sql"} {
+		schemaSQL, err := os.ReadFile("../../sql/" + file)
+		require.NoError(t, err)
+		if _, err := client.Exec(ctx, string(schemaSQL)); err != nil {
+			t.Fatalf("Failed to execute %s: %v", file, err)
+		}
 	}
 
 	return pgContainer, cfg
@@ -137,6 +144,159 @@ func TestSystem_UpdateDraft(t *testing.T) {
 	assert.Equal(t, updatedPolicy.Rule, loaded.Rule)
 }
 
+func TestSystem_CreateVersion_DraftMoved(t *testing.T) {
+	pgContainer, cfg := setupTestDatabase(t)
+	defer func() {
+		if pgContainer != nil {
+			if err := pgContainer.Terminate(context.Background()); err != nil {
+				t.Logf("failed to terminate container: %v", err)
+			}
+		}
+	}()
+
+	s := NewSystem(cfg)
+	s.SetContext(context.Background())
+
+	created, err := s.StoreInitialPolicy(&structs.Policy{
+		Name:      "Moving Policy",
+		DataModel: `{"test": "data"}`,
+		Tests:     `[]`,
+		Rule:      "Reviewed rule",
+	})
+	require.NoError(t, err)
+	reviewed, err := s.LoadPolicyRevision(created.BaseID, "draft")
+	require.NoError(t, err)
+
+	// an edit after the review was checked isn't published
+	current, err := s.UpdateDraftRevision(structs.Policy{BaseID: created.BaseID, Rule: "Unreviewed rule"})
+	require.NoError(t, err)
+	err = s.CreateVersion(structs.Policy{BaseID: created.BaseID, Version: "1.0", Description: "Release", Revision: reviewed.Revision})
+	var conflict *errors.RevisionConflictError
+	require.ErrorAs(t, err, &conflict)
+	assert.Equal(t, current, conflict.Revision)
+
+	_, err = s.LoadPolicyVersion(created.BaseID, "1.0")
+	assert.Error(t, err, "nothing was published")
+
+	require.NoError(t, s.CreateVersion(structs.Policy{BaseID: created.BaseID, Version: "1.0", Description: "Release", Revision: current}))
+}
+
+func TestSystem_UpdateDraft_KeepsStrictValidation(t *testing.T) {
+	pgContainer, cfg := setupTestDatabase(t)
+	defer func() {
+		if pgContainer != nil {
+			if err := pgContainer.Terminate(context.Background()); err != nil {
+				t.Logf("failed to terminate container: %v", err)
+			}
+		}
+	}()
+
+	s := NewSystem(cfg)
+	s.SetContext(context.Background())
+
+	strict := true
+	created, err := s.StoreInitialPolicy(&structs.Policy{
+		Name:             "Strict Policy",
+		DataModel:        `{"type": "object"}`,
+		Tests:            `[]`,
+		Rule:             "Initial rule",
+		StrictValidation: &strict,
+	})
+	require.NoError(t, err)
+
+	// an edit of the rule alone leaves strict mode as it is
+	var edit structs.Policy
+	require.NoError(t, json.Unmarshal([]byte(`{"rule": "Edited rule", "status": "draft"}`), &edit))
+	assert.Nil(t, edit.StrictValidation)
+	edit.BaseID = created.BaseID
+	require.NoError(t, s.UpdateDraft(edit))
+
+	draft, err := s.LoadPolicyRevision(created.BaseID, "draft")
+	require.NoError(t, err)
+	assert.Equal(t, "Edited rule", draft.Rule)
+	require.NotNil(t, draft.StrictValidation)
+	assert.True(t, *draft.StrictValidation)
+
+	off := false
+	require.NoError(t, s.UpdateDraft(structs.Policy{BaseID: created.BaseID, Rule: "Edited rule", StrictValidation: &off}))
+	draft, err = s.LoadPolicyRevision(created.BaseID, "draft")
+	require.NoError(t, err)
+	require.NotNil(t, draft.StrictValidation)
+	assert.False(t, *draft.StrictValidation)
+}
+
+func TestSystem_UpdateDraftRevision(t *testing.T) {
+	pgContainer, cfg := setupTestDatabase(t)
+	defer func() {
+		if pgContainer != nil {
+			if err := pgContainer.Terminate(context.Background()); err != nil {
+				t.Logf("failed to terminate container: %v", err)
+			}
+		}
+	}()
+
+	s := NewSystem(cfg)
+	s.SetContext(context.Background())
+
+	created, err := s.StoreInitialPolicy(&structs.Policy{
+		Name:      "Revision Policy",
+		DataModel: `{"initial": "data"}`,
+		Tests:     `[]`,
+		Rule:      "Initial rule",
+	})
+	require.NoError(t, err)
+
+	draft, err := s.LoadPolicyRevision(created.BaseID, "draft")
+	require.NoError(t, err)
+	require.NotZero(t, draft.Revision)
+
+	// two editors load the same revision, the second edit is refused
+	first, err := s.UpdateDraftRevision(structs.Policy{BaseID: created.BaseID, Rule: "First editor", Revision: draft.Revision})
+	require.NoError(t, err)
+	assert.NotEqual(t, draft.Revision, first)
+
+	current, err := s.UpdateDraftRevision(structs.Policy{BaseID: created.BaseID, Rule: "Second editor", Revision: draft.Revision})
+	assert.ErrorIs(t, err, errors.ErrRevisionConflict)
+	assert.Equal(t, first, current)
+
+	loaded, err := s.LoadPolicy(draft.PolicyID)
+	require.NoError(t, err)
+	assert.Equal(t, "First editor", loaded.Rule)
+	assert.Equal(t, first, loaded.Revision)
+
+	changes, err := s.DraftChanges(created.BaseID, draft.Revision)
+	require.NoError(t, err)
+	assert.True(t, changes.Changed)
+	assert.Equal(t, first, changes.Revision)
+	require.NotNil(t, changes.Policy)
+	require.Len(t, changes.Policy.Rule.Hunks, 1)
+
+	changes, err = s.DraftChanges(created.BaseID, first)
+	require.NoError(t, err)
+	assert.False(t, changes.Changed)
+
+	_, err = s.DraftChanges(created.BaseID, first+1000)
+	assert.ErrorIs(t, err, errors.ErrPolicyNotFound)
+
+	// without a revision the edit is made whatever the revision
+	_, err = s.UpdateDraftRevision(structs.Policy{BaseID: created.BaseID, Rule: "Forced"})
+	require.NoError(t, err)
+}
+
+func TestUpdatePolicy_RequiresIfMatch(t *testing.T) {
+	s := NewSystem(nil)
+
+	w := httptest.NewRecorder()
+	s.UpdatePolicy(w, httptest.NewRequest("PUT", "/policy/abc", nil))
+	assert.Equal(t, http.StatusPreconditionRequired, w.Code)
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("PUT", "/policy/abc", nil)
+	r.Header.Set("If-Match", `"abc"`)
+	s.UpdatePolicy(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
 func TestSystem_CreateVersion(t *testing.T) {
 	pgContainer, cfg := setupTestDatabase(t)
 	defer func() {
@@ -303,6 +463,42 @@ func TestSystem_AllPolicies(t *testing.T) {
 	}
 }
 
+func TestSystem_ListPolicies(t *testing.T) {
+	pgContainer, cfg := setupTestDatabase(t)
+	defer func() {
+		if pgContainer != nil {
+			if err := pgContainer.Terminate(context.Background()); err != nil {
+				t.Logf("failed to terminate container: %v", err)
+			}
+		}
+	}()
+
+	s := NewSystem(cfg)
+	s.SetContext(context.Background())
+
+	for i := 0; i < 3; i++ {
+		policy := &structs.Policy{
+			Name:      "Test Policy " + string(rune('A'+i)),
+			DataModel: `{"test": "data"}`,
+			Tests:     `{"test": "case"}`,
+			Rule:      "Test rule",
+		}
+		_, err := s.StoreInitialPolicy(policy)
+		require.NoError(t, err)
+	}
+
+	policies, page, err := s.ListPolicies(listing.Query{Sort: "name", Limit: listing.DefaultLimit})
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, len(policies), 3)
+	assert.Equal(t, len(policies), page.Total)
+
+	for _, p := range policies {
+		assert.NotEmpty(t, p.BaseID)
+		assert.NotEmpty(t, p.Name)
+		assert.True(t, p.HasDraft)
+	}
+}
+
 func TestSystem_GetPolicyVersions(t *testing.T) {
 	pgContainer, cfg := setupTestDatabase(t)
 	defer func() {
@@ -441,4 +637,646 @@ func TestSystem_CompleteWorkflow(t *testing.T) {
 	versions, err := s.GetPolicyVersions(created.BaseID)
 	require.NoError(t, err)
 	assert.Len(t, versions, 2)
-}
\ No newline at end of file
+}
+func TestValidateData(t *testing.T) {
+	strict := true
+	dataModel := `{
+		"type": "object",
+		"required": ["age", "person"],
+		"properties": {
+			"age": {"type": "integer", "minimum": 18},
+			"person": {
+				"type": "object",
+				"properties": {
+					"name": {"type": "string"}
+				}
+			}
+		}
+	}`
+
+	tests := []struct {
+		name       string
+		policy     structs.Policy
+		data       interface{}
+		violations []errors.Violation
+	}{
+		{
+			name:   "valid data",
+			policy: structs.Policy{DataModel: dataModel},
+			data:   map[string]interface{}{"age": 21, "person": map[string]interface{}{"name": "bob"}, "extra": true},
+		},
+		{
+			name:   "no data model",
+			policy: structs.Policy{DataModel: ""},
+			data:   map[string]interface{}{"anything": "goes"},
+		},
+		{
+			name:   "violations",
+			policy: structs.Policy{DataModel: dataModel},
+			data:   map[string]interface{}{"age": 12, "person": map[string]interface{}{"name": 4}},
+			violations: []errors.Violation{
+				{Pointer: "/age", Reason: "must be >= 18 but found 12"},
+				{Pointer: "/person/name", Reason: "expected string, but got number"},
+			},
+		},
+		{
+			name:   "missing required",
+			policy: structs.Policy{DataModel: dataModel},
+			data:   map[string]interface{}{"age": 21},
+			violations: []errors.Violation{
+				{Pointer: "", Reason: "missing properties: 'person'"},
+			},
+		},
+		{
+			name:   "strict rejects unknown fields",
+			policy: structs.Policy{DataModel: dataModel, StrictValidation: &strict},
+			data:   map[string]interface{}{"age": 21, "person": map[string]interface{}{"name": "bob", "nickname": "b"}, "extra": true},
+			violations: []errors.Violation{
+				{Pointer: "", Reason: "additionalProperties 'extra' not allowed"},
+				{Pointer: "/person", Reason: "additionalProperties 'nickname' not allowed"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateData(tt.policy, tt.data)
+			if tt.violations == nil {
+				assert.NoError(t, err)
+				return
+			}
+
+			var validationErr *errors.ValidationError
+			require.ErrorAs(t, err, &validationErr)
+			assert.Equal(t, tt.violations, validationErr.Violations)
+
+			rec := httptest.NewRecorder()
+			errors.WriteHTTPError(rec, errors.WrapPolicyError(err, "policy-1"))
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			assert.Contains(t, rec.Body.String(), `"code":"VALIDATION_ERROR"`)
+			assert.Contains(t, rec.Body.String(), `"violations"`)
+		})
+	}
+}
+
+func TestValidateData_InvalidDataModel(t *testing.T) {
+	err := ValidateData(structs.Policy{PolicyID: "policy-1", DataModel: `{"type": 12}`}, map[string]interface{}{})
+
+	var policyErr *errors.PolicyError
+	require.ErrorAs(t, err, &policyErr)
+	assert.Equal(t, "policy-1", policyErr.PolicyID)
+}
+
+func TestCompiledSchema(t *testing.T) {
+	p := structs.Policy{PolicyID: "policy-cached", Revision: 1, DataModel: `{"type": "object"}`}
+
+	first, err := compiledSchema(p)
+	require.NoError(t, err)
+	second, err := compiledSchema(p)
+	require.NoError(t, err)
+	assert.Same(t, first, second, "a revision is compiled once")
+
+	p.Revision = 2
+	third, err := compiledSchema(p)
+	require.NoError(t, err)
+	assert.NotSame(t, first, third)
+
+	// a policy sent with the id but a data model of its own isn't validated against the stored one
+	p.DataModel = `{"type": "object", "required": ["age"]}`
+	assert.Error(t, ValidateData(p, map[string]interface{}{}))
+
+	// policies that aren't stored aren't cached
+	p.PolicyID = ""
+	fourth, err := compiledSchema(p)
+	require.NoError(t, err)
+	fifth, err := compiledSchema(p)
+	require.NoError(t, err)
+	assert.NotSame(t, fourth, fifth)
+}
+
+func TestSystem_ArchivePolicy_ShortVersionRef(t *testing.T) {
+	pgContainer, cfg := setupTestDatabase(t)
+	defer func() {
+		if pgContainer != nil {
+			if err := pgContainer.Terminate(context.Background()); err != nil {
+				t.Logf("failed to terminate container: %v", err)
+			}
+		}
+	}()
+
+	ctx := context.Background()
+	client, err := cfg.Database.GetPGXPoolClient(ctx)
+	require.NoError(t, err)
+	flowSQL, err := os.ReadFile("../../sql/flow.sql")
+	require.NoError(t, err)
+	_, err = client.Exec(ctx, string(flowSQL))
+	require.NoError(t, err)
+
+	s := NewSystem(cfg)
+	s.SetContext(ctx)
+
+	created, err := s.StoreInitialPolicy(&structs.Policy{
+		Name:      "Short Ref Policy",
+		DataModel: `{"test": "data"}`,
+		Tests:     `{"test": "case"}`,
+		Rule:      "Test rule",
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.CreateVersion(structs.Policy{BaseID: created.BaseID, Version: "1.0.0", Description: "Initial release"}))
+	first, err := s.LoadPolicyVersion(created.BaseID, "v1")
+	require.NoError(t, err)
+	assert.Equal(t, "v1.0.0", first.Version)
+
+	// base@v1 resolves to v1.0.0, so archiving v1.0.0 would break the flow
+	var flowId string
+	flowYAML := "flow:\n  start:\n    - id: check\n      type: start\n      policyId: " + created.BaseID + "@v1\n"
+	require.NoError(t, client.QueryRow(ctx, `SELECT create_flow($1, $2, $3, $4, $5)`, "Uses Short Ref", `[]`, `[]`, `[]`, flowYAML).Scan(&flowId))
+
+	_, err = s.ArchivePolicy(first.PolicyID)
+	var inUse *errors.InUseError
+	require.ErrorAs(t, err, &inUse)
+	require.Len(t, inUse.Dependents, 1)
+	assert.Equal(t, flowId, inUse.Dependents[0].FlowID)
+}
+
+func TestSystem_ArchivePolicy_UnreadableFlow(t *testing.T) {
+	pgContainer, cfg := setupTestDatabase(t)
+	defer func() {
+		if pgContainer != nil {
+			if err := pgContainer.Terminate(context.Background()); err != nil {
+				t.Logf("failed to terminate container: %v", err)
+			}
+		}
+	}()
+
+	ctx := context.Background()
+	client, err := cfg.Database.GetPGXPoolClient(ctx)
+	require.NoError(t, err)
+	flowSQL, err := os.ReadFile("../../sql/flow.sql")
+	require.NoError(t, err)
+	_, err = client.Exec(ctx, string(flowSQL))
+	require.NoError(t, err)
+
+	s := NewSystem(cfg)
+	s.SetContext(ctx)
+
+	created, err := s.StoreInitialPolicy(&structs.Policy{
+		Name:      "Unreadable Ref Policy",
+		DataModel: `{"test": "data"}`,
+		Tests:     `{"test": "case"}`,
+		Rule:      "Test rule",
+	})
+	require.NoError(t, err)
+
+	// a flow that can't be parsed blocks the archive instead of failing it
+	var flowId string
+	flowYAML := "flow: [" + created.BaseID
+	require.NoError(t, client.QueryRow(ctx, `SELECT create_flow($1, $2, $3, $4, $5)`, "Broken Flow", `[]`, `[]`, `[]`, flowYAML).Scan(&flowId))
+
+	_, err = s.ArchivePolicy(created.PolicyID)
+	var inUse *errors.InUseError
+	require.ErrorAs(t, err, &inUse)
+	require.Len(t, inUse.Dependents, 1)
+	assert.Equal(t, flowId, inUse.Dependents[0].FlowID)
+	assert.Empty(t, inUse.Dependents[0].NodeIDs)
+}
+
+func TestVersionRefs(t *testing.T) {
+	assert.ElementsMatch(t, []string{"p@v1.0.0", "p@1.0.0", "p@v1.0", "p@1.0", "p@v1", "p@1"}, versionRefs("p", "v1.0.0"))
+	assert.ElementsMatch(t, []string{"p@v1.2.3", "p@1.2.3"}, versionRefs("p", "v1.2.3"))
+	assert.ElementsMatch(t, []string{"p@vnext", "p@next"}, versionRefs("p", "vnext"))
+}
+
+func TestSystem_ArchivePolicy(t *testing.T) {
+	pgContainer, cfg := setupTestDatabase(t)
+	defer func() {
+		if pgContainer != nil {
+			if err := pgContainer.Terminate(context.Background()); err != nil {
+				t.Logf("failed to terminate container: %v", err)
+			}
+		}
+	}()
+
+	ctx := context.Background()
+	client, err := cfg.Database.GetPGXPoolClient(ctx)
+	require.NoError(t, err)
+	flowSQL, err := os.ReadFile("../../sql/flow.sql")
+	require.NoError(t, err)
+	_, err = client.Exec(ctx, string(flowSQL))
+	require.NoError(t, err)
+
+	s := NewSystem(cfg)
+	s.SetContext(ctx)
+
+	created, err := s.StoreInitialPolicy(&structs.Policy{
+		Name:      "Archived Policy",
+		DataModel: `{"test": "data"}`,
+		Tests:     `{"test": "case"}`,
+		Rule:      "Test rule",
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.CreateVersion(structs.Policy{BaseID: created.BaseID, Version: "1.0", Description: "Initial release"}))
+
+	var versionId string
+	require.NoError(t, client.QueryRow(ctx, `SELECT policy_id FROM policies WHERE base_policy_id = $1 AND version = 'v1.0'`, created.BaseID).Scan(&versionId))
+
+	// a flow running the version stops it being archived
+	var flowId string
+	flowYAML := "flow:\n  start:\n    - id: check\n      type: start\n      policyId: " + versionId + "\n"
+	require.NoError(t, client.QueryRow(ctx, `SELECT create_flow($1, $2, $3, $4, $5)`, "Uses Policy", `[]`, `[]`, `[]`, flowYAML).Scan(&flowId))
+
+	_, err = s.ArchivePolicy(created.BaseID)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, errors.ErrPolicyInUse)
+	var inUse *errors.InUseError
+	require.ErrorAs(t, err, &inUse)
+	require.Len(t, inUse.Dependents, 1)
+	assert.Equal(t, flowId, inUse.Dependents[0].FlowID)
+	assert.Equal(t, []string{"check"}, inUse.Dependents[0].NodeIDs)
+
+	status, _ := errors.ToHTTPError(err)
+	assert.Equal(t, http.StatusConflict, status)
+
+	_, err = client.Exec(ctx, `DELETE FROM flows WHERE flow_id = $1`, flowId)
+	require.NoError(t, err)
+
+	del, err := s.ArchivePolicy(created.BaseID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, del.Affected)
+	require.NotNil(t, del.PurgeAfter)
+
+	_, err = s.LoadPolicy(versionId)
+	assert.Error(t, err, "archived versions can't be loaded")
+	policies, _, err := s.ListPolicies(listing.Query{Sort: "name", Limit: listing.DefaultLimit})
+	require.NoError(t, err)
+	for _, p := range policies {
+		assert.NotEqual(t, created.BaseID, p.BaseID, "archived policies drop out of the summary")
+	}
+	archived, err := s.ArchivedPolicies()
+	require.NoError(t, err)
+	require.Len(t, archived, 1)
+	assert.True(t, archived[0].FullyArchived)
+
+	_, err = s.PurgePolicy(created.BaseID)
+	assert.ErrorIs(t, err, errors.ErrPolicyRetained)
+
+	del, err = s.RestoreArchived(created.BaseID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, del.Affected)
+	_, err = s.LoadPolicy(versionId)
+	assert.NoError(t, err)
+
+	// with no retention the archived version is purged straight away
+	cfg.ProjectProperties = map[string]interface{}{"policy_retention": time.Nanosecond}
+	_, err = s.ArchivePolicy(versionId)
+	require.NoError(t, err)
+	time.Sleep(time.Millisecond)
+	del, err = s.PurgePolicy(versionId)
+	require.NoError(t, err)
+	assert.Equal(t, 1, del.Affected)
+
+	var count int
+	require.NoError(t, client.QueryRow(ctx, `SELECT COUNT(*) FROM policies WHERE base_policy_id = $1`, created.BaseID).Scan(&count))
+	assert.Equal(t, 0, count)
+	client.Close()
+}
+
+func TestSystem_Rollback(t *testing.T) {
+	pgContainer, cfg := setupTestDatabase(t)
+	defer func() {
+		if pgContainer != nil {
+			if err := pgContainer.Terminate(context.Background()); err != nil {
+				t.Logf("failed to terminate container: %v", err)
+			}
+		}
+	}()
+
+	s := NewSystem(cfg)
+	s.SetContext(context.Background())
+
+	created, err := s.StoreInitialPolicy(&structs.Policy{
+		Name:      "Rollback Policy",
+		DataModel: `{}`,
+		Tests:     `[]`,
+		Rule:      "Good rule",
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.CreateVersion(structs.Policy{BaseID: created.BaseID, Version: "1.0.0", Description: "Good release"}))
+	v1, err := s.LoadPolicyVersion(created.BaseID, "1.0.0")
+	require.NoError(t, err)
+	_, err = s.DraftFromVersion(v1.PolicyID)
+	require.NoError(t, err)
+	require.NoError(t, s.UpdateDraft(structs.Policy{BaseID: created.BaseID, Rule: "Bad rule"}))
+	require.NoError(t, s.CreateVersion(structs.Policy{BaseID: created.BaseID, Version: "1.1.0", Description: "Bad release"}))
+
+	// work in progress on the next version is kept
+	_, err = s.DraftFromVersion(v1.PolicyID)
+	require.NoError(t, err)
+	require.NoError(t, s.UpdateDraft(structs.Policy{BaseID: created.BaseID, Rule: "Work in progress"}))
+
+	_, err = s.Rollback(created.BaseID, structs.RollbackRequest{Version: "1.1.0", Reason: "already latest"})
+	assert.ErrorIs(t, err, errors.ErrAlreadyActive)
+	_, err = s.Rollback(created.BaseID, structs.RollbackRequest{Version: "9.0.0", Reason: "missing"})
+	assert.ErrorIs(t, err, errors.ErrPolicyNotFound)
+
+	rb, err := s.Rollback(created.BaseID, structs.RollbackRequest{Version: "1.0.0", Reason: "1.1.0 rejects valid data"})
+	require.NoError(t, err)
+	assert.Equal(t, "v1.0.0", rb.Version)
+	assert.Equal(t, "v1.1.0", rb.PreviousVersion)
+	assert.Equal(t, "v1.1.1", rb.PublishedAs)
+	assert.NotEmpty(t, rb.DraftID)
+
+	latest, err := s.LoadPolicyVersion(created.BaseID, "latest")
+	require.NoError(t, err)
+	assert.Equal(t, rb.ID, latest.PolicyID)
+	assert.Equal(t, "Good rule", latest.Rule)
+	assert.Equal(t, "Rollback to v1.0.0: 1.1.0 rejects valid data", latest.Description)
+
+	versions, err := s.GetPolicyVersions(created.BaseID)
+	require.NoError(t, err)
+	assert.Len(t, versions, 4, "the draft and every version are kept")
+
+	draft, err := s.LoadPolicy(rb.DraftID)
+	require.NoError(t, err)
+	assert.Equal(t, "Work in progress", draft.Rule)
+}
+
+func TestSystem_Rollback_Validation(t *testing.T) {
+	s := NewSystem(nil)
+
+	_, err := s.Rollback("abc", structs.RollbackRequest{Reason: "no version"})
+	var validationErr *errors.ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "version", validationErr.Field)
+
+	_, err = s.Rollback("abc", structs.RollbackRequest{Version: "1.0.0", Reason: "  "})
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "reason", validationErr.Field)
+}
+
+func TestReferringNodes(t *testing.T) {
+	flowYAML := `
+flow:
+  start:
+    - id: start
+      type: start
+      policyId: policy-a
+      onTrue:
+        - id: second
+          type: policy
+          policyId: policy-b
+          onFalse:
+            - id: third
+              type: policy
+              policyId: policy-a
+      onFalse:
+        - id: done
+          type: return
+          returnValue: false
+`
+	nodeIds, err := referringNodes(flowYAML, []string{"policy-a"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"start", "third"}, nodeIds)
+
+	nodeIds, err = referringNodes(flowYAML, []string{"policy-c"})
+	require.NoError(t, err)
+	assert.Empty(t, nodeIds)
+
+	_, err = referringNodes("flow: [", []string{"policy-a"})
+	assert.Error(t, err)
+}
+
+func TestSystem_LoadPolicyVersion(t *testing.T) {
+	pgContainer, cfg := setupTestDatabase(t)
+	defer func() {
+		if pgContainer != nil {
+			if err := pgContainer.Terminate(context.Background()); err != nil {
+				t.Logf("failed to terminate container: %v", err)
+			}
+		}
+	}()
+
+	s := NewSystem(cfg)
+	s.SetContext(context.Background())
+
+	created, err := s.StoreInitialPolicy(&structs.Policy{
+		Name:      "Versioned Policy",
+		DataModel: `{"test": "data"}`,
+		Tests:     `{"test": "case"}`,
+		Rule:      "First rule",
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.CreateVersion(structs.Policy{BaseID: created.BaseID, Version: "1.0", Description: "Initial release"}))
+
+	first, err := s.LoadPolicyVersion(created.BaseID, "latest")
+	require.NoError(t, err)
+	_, err = s.DraftFromVersion(first.PolicyID)
+	require.NoError(t, err)
+	require.NoError(t, s.UpdateDraft(structs.Policy{BaseID: created.BaseID, Rule: "Second rule"}))
+	require.NoError(t, s.CreateVersion(structs.Policy{BaseID: created.BaseID, Version: "1.1", Description: "Second release"}))
+
+	v10, err := s.LoadPolicyVersion(created.BaseID, "v1.0")
+	require.NoError(t, err)
+	assert.Equal(t, first.PolicyID, v10.PolicyID)
+	assert.Equal(t, "First rule", v10.Rule)
+	assert.Equal(t, "Initial release", v10.Description)
+	assert.Equal(t, `{"test": "case"}`, v10.Tests)
+
+	latest, err := s.ResolvePolicy(created.BaseID + "@latest")
+	require.NoError(t, err)
+	assert.Equal(t, "v1.1", latest.Version)
+	assert.Equal(t, "Second rule", latest.Rule)
+
+	byLabel, err := s.ResolvePolicy(created.BaseID + "@1.1")
+	require.NoError(t, err)
+	assert.Equal(t, latest.PolicyID, byLabel.PolicyID)
+
+	byId, err := s.ResolvePolicy(latest.PolicyID)
+	require.NoError(t, err)
+	assert.Equal(t, "v1.1", byId.Version)
+
+	_, err = s.ResolvePolicy(created.BaseID + "@v9.9")
+	assert.Error(t, err)
+}
+
+func TestSystem_LoadPolicyVersion_Effective(t *testing.T) {
+	pgContainer, cfg := setupTestDatabase(t)
+	defer func() {
+		if pgContainer != nil {
+			if err := pgContainer.Terminate(context.Background()); err != nil {
+				t.Logf("failed to terminate container: %v", err)
+			}
+		}
+	}()
+
+	s := NewSystem(cfg)
+	s.SetContext(context.Background())
+
+	created, err := s.StoreInitialPolicy(&structs.Policy{
+		Name:      "Scheduled Policy",
+		DataModel: `{"test": "data"}`,
+		Tests:     `{"test": "case"}`,
+		Rule:      "First rule",
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.CreateVersion(structs.Policy{BaseID: created.BaseID, Version: "1.0", Description: "Initial release"}))
+
+	first, err := s.LoadPolicyVersion(created.BaseID, "latest")
+	require.NoError(t, err)
+	_, err = s.DraftFromVersion(first.PolicyID)
+	require.NoError(t, err)
+	require.NoError(t, s.UpdateDraft(structs.Policy{BaseID: created.BaseID, Rule: "Second rule"}))
+
+	from := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Second)
+	err = s.CreateVersion(structs.Policy{BaseID: created.BaseID, Version: "1.1", Description: "Scheduled release", EffectiveFrom: &from, EffectiveUntil: &from})
+	var validationErr *errors.ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "effectiveUntil", validationErr.Field)
+	require.NoError(t, s.CreateVersion(structs.Policy{BaseID: created.BaseID, Version: "1.1", Description: "Scheduled release", EffectiveFrom: &from}))
+
+	latest, err := s.ResolvePolicy(created.BaseID + "@latest")
+	require.NoError(t, err)
+	assert.Equal(t, "v1.0", latest.Version, "v1.1 isn't in force yet")
+
+	scheduled, err := s.LoadPolicyVersion(created.BaseID, "v1.1")
+	require.NoError(t, err)
+	require.NotNil(t, scheduled.EffectiveFrom)
+	assert.True(t, from.Equal(*scheduled.EffectiveFrom))
+	assert.Nil(t, scheduled.EffectiveUntil)
+
+	s.SetContext(effective.WithAsOf(context.Background(), from.Add(time.Hour)))
+	latest, err = s.ResolvePolicy(created.BaseID + "@latest")
+	require.NoError(t, err)
+	assert.Equal(t, "v1.1", latest.Version)
+	assert.Equal(t, "Second rule", latest.Rule)
+
+	s.SetContext(effective.WithAsOf(context.Background(), first.CreatedAt.Add(-time.Hour)))
+	_, err = s.ResolvePolicy(created.BaseID + "@latest")
+	assert.Error(t, err, "nothing was published then")
+
+	versions, err := s.GetPolicyVersions(created.BaseID)
+	require.NoError(t, err)
+	scheduledCount := 0
+	for _, v := range versions {
+		if v.EffectiveFrom != nil {
+			scheduledCount++
+		}
+	}
+	assert.Equal(t, 1, scheduledCount)
+}
+
+func TestVersionLabel(t *testing.T) {
+	assert.Equal(t, "v1.2", VersionLabel("1.2"))
+	assert.Equal(t, "v1.2", VersionLabel("v1.2"))
+	assert.Equal(t, "", VersionLabel(""))
+}
+
+func TestTestCases(t *testing.T) {
+	cases := TestCases(`{"tests": [{"name": "adult", "data": {"age": 21}, "expectPass": true}, {"description": "child", "input": {"age": 16}, "expectedOutcome": false}, "broken"]}`)
+	require.Len(t, cases, 3)
+	assert.Equal(t, "adult", cases[0].Name)
+	assert.Equal(t, map[string]interface{}{"age": float64(21)}, cases[0].Data)
+	require.NotNil(t, cases[0].Expected)
+	assert.True(t, *cases[0].Expected)
+	assert.Equal(t, "child", cases[1].Name)
+	require.NotNil(t, cases[1].Expected)
+	assert.False(t, *cases[1].Expected)
+	assert.Nil(t, cases[2].Expected)
+
+	list := TestCases([]interface{}{map[string]interface{}{"name": "a", "data": map[string]interface{}{}, "expected": true}})
+	require.Len(t, list, 1)
+	assert.Equal(t, "a", list[0].Name)
+
+	assert.Empty(t, TestCases(`{"test": "case"}`))
+	assert.Empty(t, TestCases(nil))
+	assert.Empty(t, TestCases(`not json`))
+}
+
+type fakeTestRunner struct {
+	report structs.PolicyTestReport
+}
+
+func (f fakeTestRunner) RunTests(_ context.Context, p structs.Policy) (structs.PolicyTestReport, error) {
+	f.report.PolicyID = p.PolicyID
+	return f.report, nil
+}
+
+func TestSystem_CreateVersion_RequiresPassingTests(t *testing.T) {
+	pgContainer, cfg := setupTestDatabase(t)
+	defer func() {
+		if pgContainer != nil {
+			if err := pgContainer.Terminate(context.Background()); err != nil {
+				t.Logf("failed to terminate container: %v", err)
+			}
+		}
+	}()
+	cfg.ProjectProperties = map[string]interface{}{"policy_require_passing_tests": true}
+
+	expected, actual := true, false
+	s := NewSystem(cfg).SetTestRunner(fakeTestRunner{report: structs.PolicyTestReport{
+		Total:  2,
+		Passed: 1,
+		Failed: 1,
+		Results: []structs.PolicyTestResult{
+			{Index: 0, Name: "adult", Expected: &expected, Actual: &expected, Passed: true},
+			{Index: 1, Name: "child", Expected: &expected, Actual: &actual},
+		},
+	}})
+	s.SetContext(context.Background())
+
+	created, err := s.StoreInitialPolicy(&structs.Policy{
+		Name:      "Tested Policy",
+		DataModel: `{"test": "data"}`,
+		Tests:     `[]`,
+		Rule:      "Test rule",
+	})
+	require.NoError(t, err)
+
+	err = s.CreateVersion(structs.Policy{BaseID: created.BaseID, Version: "1.0", Description: "Initial release"})
+	require.Error(t, err)
+	var testsErr *errors.TestsFailedError
+	require.ErrorAs(t, err, &testsErr)
+	require.Len(t, testsErr.Failures, 1)
+	assert.Equal(t, "child", testsErr.Failures[0].Name)
+	status, httpErr := errors.ToHTTPError(err)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Equal(t, "TESTS_FAILED", httpErr.Code)
+
+	_, err = s.LoadPolicyVersion(created.BaseID, "1.0")
+	assert.Error(t, err, "the draft wasn't published")
+
+	cfg.ProjectProperties["policy_require_passing_tests"] = false
+	require.NoError(t, s.CreateVersion(structs.Policy{BaseID: created.BaseID, Version: "1.0", Description: "Initial release"}))
+}
+
+func TestPolicyDiff(t *testing.T) {
+	from := structs.Policy{
+		PolicyID:  "p1",
+		BaseID:    "base",
+		Rule:      "A **Person** gets a licence\n  if the __age__ of the **Person** is greater than or equal to 18.",
+		DataModel: `{"type": "object", "properties": {"age": {"type": "integer"}}}`,
+		Tests:     `[{"name": "adult", "data": {"age": 18}, "expected": true}]`,
+	}
+	to := from
+	to.PolicyID = "p2"
+	to.Rule = "A **Person** gets a licence\n  if the __age__ of the **Person** is greater than or equal to 17."
+
+	d, err := PolicyDiff(from, to, "v1.0", "draft")
+	require.NoError(t, err)
+	assert.True(t, d.Changed)
+	assert.Equal(t, "p1", d.FromPolicyID)
+	assert.Equal(t, "p2", d.ToPolicyID)
+	require.Len(t, d.Rule.Hunks, 1)
+	assert.Empty(t, d.DataModel.Fields)
+	assert.Empty(t, d.DataModel.Hunks)
+	assert.Empty(t, d.Tests.Cases)
+
+	unified := UnifiedDiff(d)
+	assert.Contains(t, unified, "--- base@v1.0/rule\n+++ base@draft/rule\n")
+	assert.Contains(t, unified, "+  if the __age__ of the **Person** is greater than or equal to 17.\n")
+	assert.NotContains(t, unified, "schema.json")
+
+	same, err := PolicyDiff(from, from, "v1.0", "v1.0")
+	require.NoError(t, err)
+	assert.False(t, same.Changed)
+}
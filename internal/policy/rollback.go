@@ -0,0 +1,75 @@
+package policy
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/1rp-pw/orchestrator/internal/audit"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"strings"
+)
+
+// Rollback makes a published version the latest again by publishing a copy of it as the next
+// patch version. The versions in between stay in the history and the draft is left as it is.
+// The copy was published before so it doesn't go through review or the tests again
+func (s *System) Rollback(basePolicyId string, req structs.RollbackRequest) (structs.Rollback, error) {
+	rb := structs.Rollback{
+		BaseID: basePolicyId,
+		Reason: strings.TrimSpace(req.Reason),
+	}
+	if strings.TrimSpace(req.Version) == "" {
+		return rb, errors.NewValidationError("version", "the version to roll back to is required")
+	}
+	if rb.Reason == "" {
+		return rb, errors.NewValidationError("reason", "a reason for the rollback is required")
+	}
+
+	target, err := s.LoadPolicyVersion(basePolicyId, req.Version)
+	if err != nil {
+		return rb, errors.WrapPolicyError(errors.ErrPolicyNotFound, basePolicyId+"@"+req.Version)
+	}
+	latest, err := s.LoadPolicyVersion(basePolicyId, "latest")
+	if err != nil {
+		return rb, errors.WrapPolicyError(errors.ErrPolicyNotFound, basePolicyId+"@latest")
+	}
+	rb.Version = target.Version
+	rb.PreviousVersion = latest.Version
+	if target.PolicyID == latest.PolicyID {
+		return rb, errors.WrapPolicyError(errors.ErrAlreadyActive, basePolicyId+"@"+target.Version)
+	}
+
+	if rb.PublishedAs, err = s.nextVersion(structs.Policy{BaseID: basePolicyId, Bump: "patch"}); err != nil {
+		return rb, err
+	}
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return rb, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	change, err := audit.Begin(s.Context, s.Audit, client, decision.KindPolicy, audit.ActionRollback, basePolicyId)
+	if err != nil {
+		return rb, err
+	}
+	defer change.Close()
+	description := fmt.Sprintf("Rollback to %s: %s", target.Version, rb.Reason)
+	if err := change.QueryRow(s.Context, `SELECT rollback_to_version($1, $2, $3)`, target.PolicyID, rb.PublishedAs, description).Scan(&rb.ID); err != nil {
+		return rb, logs.Errorf("failed to roll back policy: %v", err)
+	}
+	if err := change.Done(rb.ID, rb.PublishedAs); err != nil {
+		return rb, err
+	}
+
+	var draftId sql.NullString
+	if err := client.QueryRow(s.Context, `
+		SELECT policy_id::text
+		FROM policies
+		WHERE base_policy_id = $1 AND status = 'draft' AND archived_at IS NULL`, basePolicyId).Scan(&draftId); err == nil {
+		rb.DraftID = draftId.String
+	}
+
+	return rb, nil
+}
@@ -0,0 +1,138 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/bugfixes/go-bugfixes/logs"
+)
+
+// TestRunner runs the stored tests of a policy, the engine does it
+type TestRunner interface {
+	RunTests(ctx context.Context, p structs.Policy) (structs.PolicyTestReport, error)
+}
+
+// SetTestRunner runs the tests of a draft with r before it is published, with
+// policy_require_passing_tests set a draft whose tests fail isn't published
+func (s *System) SetTestRunner(r TestRunner) *System {
+	s.Tests = r
+	return s
+}
+
+func requirePassingTests(s *System) bool {
+	required, _ := s.Config.ProjectProperties["policy_require_passing_tests"].(bool)
+	return required && s.Tests != nil
+}
+
+// checkDraftTests runs the tests of the draft that is about to be published
+func (s *System) checkDraftTests(basePolicyId string) error {
+	draft, err := s.loadPolicy(`base_policy_id = $1 AND status = 'draft'`, basePolicyId)
+	if err != nil {
+		// publishing reports the missing draft
+		return nil
+	}
+
+	report, err := s.Tests.RunTests(s.Context, draft)
+	if err != nil {
+		return logs.Errorf("failed to run policy tests: %v", err)
+	}
+	if report.Failed == 0 {
+		return nil
+	}
+
+	failures := make([]errors.FailedTest, 0, report.Failed)
+	for _, r := range report.Results {
+		if !r.Passed {
+			failures = append(failures, errors.FailedTest{
+				Index:    r.Index,
+				Name:     r.Name,
+				Expected: r.Expected,
+				Actual:   r.Actual,
+				Error:    r.Error,
+			})
+		}
+	}
+	return errors.NewTestsFailedError(draft.PolicyID, failures)
+}
+
+// TestCases reads the test cases out of the stored tests, which are either a list of cases or
+// an object holding them under tests, test_cases or cases. Anything else has no cases
+func TestCases(tests interface{}) []structs.PolicyTestCase {
+	raw, err := decodeTests(tests)
+	if err != nil {
+		return nil
+	}
+
+	var list []interface{}
+	switch t := raw.(type) {
+	case []interface{}:
+		list = t
+	case map[string]interface{}:
+		for _, k := range []string{"tests", "test_cases", "cases"} {
+			if l, ok := t[k].([]interface{}); ok {
+				list = l
+				break
+			}
+		}
+	}
+
+	cases := make([]structs.PolicyTestCase, 0, len(list))
+	for _, item := range list {
+		c := structs.PolicyTestCase{}
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			cases = append(cases, c)
+			continue
+		}
+		c.Name = firstString(m, "name", "description", "id")
+		for _, k := range []string{"data", "input"} {
+			if v, ok := m[k]; ok {
+				c.Data = v
+				break
+			}
+		}
+		for _, k := range []string{"expectPass", "expectedOutcome", "expected", "expect", "outcome", "result"} {
+			if b, ok := m[k].(bool); ok {
+				c.Expected = &b
+				break
+			}
+		}
+		cases = append(cases, c)
+	}
+
+	return cases
+}
+
+// decodeTests gives stored tests, which are JSON text, and tests sent as JSON the same shape
+func decodeTests(tests interface{}) (interface{}, error) {
+	var b []byte
+	switch t := tests.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		b = []byte(t)
+	case []byte:
+		b = t
+	default:
+		var err error
+		if b, err = json.Marshal(t); err != nil {
+			return nil, err
+		}
+	}
+
+	var raw interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+func firstString(m map[string]interface{}, keys ...string) string {
+	for _, k := range keys {
+		if s, ok := m[k].(string); ok && s != "" {
+			return s
+		}
+	}
+	return ""
+}
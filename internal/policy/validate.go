@@ -0,0 +1,269 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ValidateData checks data against the policy's data model as a JSON schema, a policy without a
+// data model accepts anything. In strict mode objects reject properties the schema doesn't list
+func ValidateData(p structs.Policy, data interface{}) error {
+	compiled, err := compiledSchema(p)
+	if err != nil {
+		return err
+	}
+	if compiled == nil {
+		return nil
+	}
+
+	instance, err := jsonValue(data)
+	if err != nil {
+		return errors.NewValidationError("data", "data is not valid JSON")
+	}
+
+	if err := compiled.Validate(instance); err != nil {
+		ve, ok := err.(*jsonschema.ValidationError)
+		if !ok {
+			return errors.NewValidationError("data", err.Error())
+		}
+		violations := leafViolations(ve)
+		return errors.NewSchemaValidationError(fmt.Sprintf("data does not match the data model (%d violations)", len(violations)), violations)
+	}
+
+	return nil
+}
+
+// maxCachedSchemas bounds the compiled schemas kept, the cache starts over once it is full
+const maxCachedSchemas = 1024
+
+// schemas holds the compiled data model of each stored policy revision so a batch, a replay or
+// a flow doesn't compile it again for every input
+var schemas = struct {
+	sync.Mutex
+	m map[schemaKey]cachedSchema
+}{
+	m: make(map[schemaKey]cachedSchema),
+}
+
+type schemaKey struct {
+	policyId string
+	revision int64
+	strict   bool
+}
+
+// cachedSchema is nil when the policy has no data model, the data model it was compiled from
+// is kept so a policy sent with a stored id but its own data model isn't given the stored one
+type cachedSchema struct {
+	dataModel string
+	schema    *jsonschema.Schema
+}
+
+// compiledSchema is the policy's data model compiled as a JSON schema, nil when it has none
+func compiledSchema(p structs.Policy) (*jsonschema.Schema, error) {
+	raw, err := dataModelJSON(p.DataModel)
+	if err != nil {
+		return nil, errors.WrapPolicyError(fmt.Errorf("data model is not valid JSON: %w", err), p.PolicyID)
+	}
+
+	key := schemaKey{
+		policyId: p.PolicyID,
+		revision: p.Revision,
+		strict:   p.StrictValidation != nil && *p.StrictValidation,
+	}
+	if key.policyId != "" {
+		schemas.Lock()
+		c, ok := schemas.m[key]
+		schemas.Unlock()
+		if ok && c.dataModel == string(raw) {
+			return c.schema, nil
+		}
+	}
+
+	compiled, err := compileSchema(raw, key.strict)
+	if err != nil {
+		return nil, errors.WrapPolicyError(err, p.PolicyID)
+	}
+
+	if key.policyId != "" {
+		schemas.Lock()
+		if len(schemas.m) >= maxCachedSchemas {
+			schemas.m = make(map[schemaKey]cachedSchema)
+		}
+		schemas.m[key] = cachedSchema{dataModel: string(raw), schema: compiled}
+		schemas.Unlock()
+	}
+	return compiled, nil
+}
+
+func compileSchema(raw []byte, strict bool) (*jsonschema.Schema, error) {
+	schema, err := dataModelSchema(raw)
+	if err != nil {
+		return nil, fmt.Errorf("data model is not valid JSON: %w", err)
+	}
+	if schema == nil {
+		return nil, nil
+	}
+	if strict {
+		schema = strictSchema(schema)
+	}
+
+	b, err := json.Marshal(schema)
+	if err != nil {
+		return nil, err
+	}
+	c := jsonschema.NewCompiler()
+	c.Draft = jsonschema.Draft2020
+	if err := c.AddResource("datamodel.json", bytes.NewReader(b)); err != nil {
+		return nil, fmt.Errorf("data model is not a valid JSON schema: %w", err)
+	}
+	compiled, err := c.Compile("datamodel.json")
+	if err != nil {
+		return nil, fmt.Errorf("data model is not a valid JSON schema: %w", err)
+	}
+	return compiled, nil
+}
+
+// dataModelJSON is the stored data model as JSON text, it is JSON text when loaded from the
+// database and a decoded value when sent in a request
+func dataModelJSON(dataModel interface{}) ([]byte, error) {
+	switch dm := dataModel.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []byte(strings.TrimSpace(dm)), nil
+	case []byte:
+		return bytes.TrimSpace(dm), nil
+	default:
+		return json.Marshal(dm)
+	}
+}
+
+// dataModelSchema parses the data model, empty data models return nil
+func dataModelSchema(raw []byte) (map[string]interface{}, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	var schema map[string]interface{}
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		return nil, err
+	}
+	if len(schema) == 0 {
+		return nil, nil
+	}
+	return schema, nil
+}
+
+// schemaKeywords holds a single subschema, schemaMapKeywords a map of them and schemaListKeywords a
+// list of them. Anything else is left alone so enum and const values aren't rewritten
+var (
+	schemaKeywords     = []string{"additionalItems", "contains", "else", "if", "items", "not", "propertyNames", "then", "unevaluatedItems"}
+	schemaMapKeywords  = []string{"$defs", "definitions", "dependentSchemas", "patternProperties", "properties"}
+	schemaListKeywords = []string{"allOf", "anyOf", "oneOf", "prefixItems"}
+)
+
+// strictSchema closes every object schema that doesn't say what to do with unknown properties
+func strictSchema(schema map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(schema)+1)
+	for k, v := range schema {
+		out[k] = v
+	}
+
+	for _, k := range schemaKeywords {
+		switch sub := out[k].(type) {
+		case map[string]interface{}:
+			out[k] = strictSchema(sub)
+		case []interface{}:
+			out[k] = strictSchemaList(sub)
+		}
+	}
+	for _, k := range schemaMapKeywords {
+		if subs, ok := out[k].(map[string]interface{}); ok {
+			closed := make(map[string]interface{}, len(subs))
+			for name, sub := range subs {
+				if m, ok := sub.(map[string]interface{}); ok {
+					sub = strictSchema(m)
+				}
+				closed[name] = sub
+			}
+			out[k] = closed
+		}
+	}
+	for _, k := range schemaListKeywords {
+		if subs, ok := out[k].([]interface{}); ok {
+			out[k] = strictSchemaList(subs)
+		}
+	}
+
+	_, hasProperties := schema["properties"]
+	_, hasAdditional := schema["additionalProperties"]
+	_, hasUnevaluated := schema["unevaluatedProperties"]
+	if (hasProperties || schema["type"] == "object") && !hasAdditional && !hasUnevaluated {
+		out["additionalProperties"] = false
+	}
+
+	return out
+}
+
+func strictSchemaList(subs []interface{}) []interface{} {
+	out := make([]interface{}, len(subs))
+	for i, sub := range subs {
+		if m, ok := sub.(map[string]interface{}); ok {
+			sub = strictSchema(m)
+		}
+		out[i] = sub
+	}
+	return out
+}
+
+// jsonValue turns any go value into the generic form the schema validator expects
+func jsonValue(data interface{}) (interface{}, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// leafViolations flattens the validator's error tree into the individual failures
+func leafViolations(ve *jsonschema.ValidationError) []errors.Violation {
+	var violations []errors.Violation
+	seen := make(map[errors.Violation]bool)
+
+	var walk func(e *jsonschema.ValidationError)
+	walk = func(e *jsonschema.ValidationError) {
+		if len(e.Causes) == 0 {
+			v := errors.Violation{
+				Pointer: e.InstanceLocation,
+				Reason:  e.Message,
+			}
+			if !seen[v] {
+				seen[v] = true
+				violations = append(violations, v)
+			}
+			return
+		}
+		for _, c := range e.Causes {
+			walk(c)
+		}
+	}
+	walk(ve)
+
+	sort.SliceStable(violations, func(i, j int) bool {
+		return violations[i].Pointer < violations[j].Pointer
+	})
+	return violations
+}
@@ -0,0 +1,94 @@
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/1rp-pw/orchestrator/internal/engine"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"io"
+	"net/http"
+)
+
+// ReplayPolicy answers POST /policy/{policyId}/replay, policyId is the base policy id
+func (s *System) ReplayPolicy(w http.ResponseWriter, r *http.Request) {
+	rs, cancel := s.forRequest(w, r)
+	defer cancel()
+
+	req, err := decodeRequest(r)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	report, err := rs.PolicyReport(r.PathValue("policyId"), req)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
+	}
+}
+
+// ReplayFlow answers POST /flow/{flowId}/replay, flowId is the base flow id
+func (s *System) ReplayFlow(w http.ResponseWriter, r *http.Request) {
+	rs, cancel := s.forRequest(w, r)
+	defer cancel()
+
+	req, err := decodeRequest(r)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	report, err := rs.FlowReport(r.PathValue("flowId"), req)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
+	}
+}
+
+// forRequest is the system a replay runs on, a replay evaluates up to maxLimit decisions so it
+// gets Timeout to do it rather than the server's timeouts. Decisions still being replayed at
+// the timeout fail so the report can be written
+func (s *System) forRequest(w http.ResponseWriter, r *http.Request) (*System, context.CancelFunc) {
+	timeout := Timeout(s.Config)
+	engine.LiftDeadline(w, timeout)
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	rs := *s
+	rs.Context = ctx
+	return &rs, cancel
+}
+
+// decodeRequest reads the replay request, an empty body replays the latest decisions against
+// the draft
+func decodeRequest(r *http.Request) (structs.ReplayRequest, error) {
+	var req structs.ReplayRequest
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			_ = logs.Errorf("error closing body: %v", err)
+		}
+	}()
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return req, errors.NewValidationError("body", "invalid JSON format")
+	}
+	if !req.From.IsZero() && !req.To.IsZero() && req.To.Before(req.From) {
+		return req, errors.NewValidationError("to", "to must not be before from")
+	}
+	if req.Limit < 0 {
+		return req, errors.NewValidationError("limit", "limit must be a positive number")
+	}
+
+	return req, nil
+}
@@ -0,0 +1,379 @@
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/engine"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/flow"
+	"github.com/1rp-pw/orchestrator/internal/policy"
+	"github.com/1rp-pw/orchestrator/internal/semver"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	ConfigBuilder "github.com/keloran/go-config"
+	"gopkg.in/yaml.v3"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLimit      = 1000
+	maxLimit          = 10000
+	defaultSampleSize = 10
+	maxSampleSize     = 100
+	defaultTimeout    = 5 * time.Minute
+)
+
+type System struct {
+	Config    *ConfigBuilder.Config
+	Context   context.Context
+	Evaluator engine.Evaluator
+}
+
+func NewSystem(cfg *ConfigBuilder.Config) *System {
+	return &System{
+		Config:  cfg,
+		Context: context.Background(),
+	}
+}
+
+func (s *System) SetContext(ctx context.Context) *System {
+	s.Context = ctx
+	return s
+}
+
+// SetEvaluator replays against e instead of the configured engine
+func (s *System) SetEvaluator(e engine.Evaluator) *System {
+	s.Evaluator = e
+	return s
+}
+
+// Timeout is how long a replay has to evaluate its decisions
+func Timeout(cfg *ConfigBuilder.Config) time.Duration {
+	if d, ok := cfg.ProjectProperties["replay_timeout"].(time.Duration); ok && d > 0 {
+		return d
+	}
+	return defaultTimeout
+}
+
+// PolicyReport replays the logged decisions of a policy against one of its drafts or versions
+func (s *System) PolicyReport(basePolicyId string, req structs.ReplayRequest) (structs.ReplayReport, error) {
+	p, err := s.PolicyTarget(basePolicyId, req)
+	if err != nil {
+		return structs.ReplayReport{}, err
+	}
+
+	dd, err := decision.NewSystem(s.Config).SetContext(s.Context).Query(decisionQuery(req, structs.DecisionQuery{PolicyID: basePolicyId}))
+	if err != nil {
+		return structs.ReplayReport{}, err
+	}
+
+	return withWindow(s.AgainstPolicy(p, dd, req.SampleSize), req), nil
+}
+
+// FlowReport replays the logged decisions of a flow against one of its drafts or versions
+func (s *System) FlowReport(baseFlowId string, req structs.ReplayRequest) (structs.ReplayReport, error) {
+	f, err := s.FlowTarget(baseFlowId, req)
+	if err != nil {
+		return structs.ReplayReport{}, err
+	}
+
+	dd, err := decision.NewSystem(s.Config).SetContext(s.Context).Query(decisionQuery(req, structs.DecisionQuery{FlowID: baseFlowId}))
+	if err != nil {
+		return structs.ReplayReport{}, err
+	}
+
+	return withWindow(s.AgainstFlow(f, dd, req.SampleSize), req), nil
+}
+
+// AgainstPolicy evaluates the input of every decision against p, nothing is written to the
+// decision log
+func (s *System) AgainstPolicy(p structs.Policy, dd []structs.Decision, sampleSize int) structs.ReplayReport {
+	pe := engine.NewSystem(s.Config).SetContext(s.Context).SetRecorder(nil)
+	if s.Evaluator != nil {
+		pe.SetEvaluator(s.Evaluator)
+	}
+	version := versionLabel(p.Version, p.IsDraft)
+
+	r := s.replay(dd, sampleSize, func(input interface{}) structs.ReplayOutcome {
+		if err := policy.ValidateData(p, input); err != nil {
+			return errorOutcome(version, errors.WrapPolicyError(err, p.PolicyID))
+		}
+
+		ip := p
+		ip.Data = input
+		pr, err := pe.RunPolicyInternal(ip)
+		if err != nil {
+			return errorOutcome(version, errors.WrapPolicyError(err, p.PolicyID))
+		}
+		return structs.ReplayOutcome{
+			Version: version,
+			Result:  pr.Result,
+			Trace:   pr.Trace,
+		}
+	})
+	r.Kind = decision.KindPolicy
+	r.BaseID = p.BaseID
+	r.TargetID = p.PolicyID
+	r.TargetVersion = version
+
+	return r
+}
+
+// AgainstFlow runs the input of every decision through f, nothing is written to the decision log
+func (s *System) AgainstFlow(f structs.StoredFlow, dd []structs.Decision, sampleSize int) structs.ReplayReport {
+	fl := flow.NewSystem(s.Config).SetContext(s.Context).SetRecorder(nil)
+	if s.Evaluator != nil {
+		fl.SetEvaluator(s.Evaluator)
+	}
+	version := versionLabel(f.Version, f.IsDraft)
+
+	r := s.replay(dd, sampleSize, func(input interface{}) structs.ReplayOutcome {
+		fr, err := fl.RunFlowInternal(f.FlowConfig, input)
+		if err != nil {
+			return errorOutcome(version, errors.WithFlowID(err, f.FlowID))
+		}
+		return structs.ReplayOutcome{
+			Version: version,
+			Result:  fr.Result,
+			Trace:   fr.NodeResponse,
+		}
+	})
+	r.Kind = decision.KindFlow
+	r.BaseID = f.BaseID
+	r.TargetID = f.FlowID
+	r.TargetVersion = version
+
+	return r
+}
+
+// replay runs every decision's input through run and compares the outcome with what was logged
+func (s *System) replay(dd []structs.Decision, sampleSize int, run func(input interface{}) structs.ReplayOutcome) structs.ReplayReport {
+	if sampleSize <= 0 {
+		sampleSize = defaultSampleSize
+	}
+	sampleSize = min(sampleSize, maxSampleSize)
+
+	after := make([]structs.ReplayOutcome, len(dd))
+	sem := make(chan struct{}, max(engine.BatchSettingsFromConfig(s.Config).Concurrency, 1))
+	var wg sync.WaitGroup
+	for i, d := range dd {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, input interface{}) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			after[i] = run(input)
+		}(i, d.Input)
+	}
+	wg.Wait()
+
+	r := structs.ReplayReport{
+		Total:   len(dd),
+		Flips:   make([]structs.ReplayFlip, 0),
+		Samples: make([]structs.ReplaySample, 0),
+	}
+
+	var unchanged []structs.ReplaySample
+	for i, d := range dd {
+		before := structs.ReplayOutcome{
+			Version: decisionVersion(d),
+			Result:  d.Result,
+			Trace:   d.Trace,
+			Error:   d.Error,
+		}
+		if after[i].Error != nil {
+			r.Errors++
+		}
+
+		sample := structs.ReplaySample{
+			DecisionID: d.ID,
+			Changed:    changed(before, after[i]),
+			Input:      d.Input,
+			Before:     before,
+			After:      after[i],
+		}
+		if !sample.Changed {
+			r.Unchanged++
+			unchanged = append(unchanged, sample)
+			continue
+		}
+
+		r.Changed++
+		r.Flips = append(r.Flips, structs.ReplayFlip{
+			DecisionID: d.ID,
+			RequestID:  d.RequestID,
+			DecidedAt:  d.DecidedAt,
+			Input:      d.Input,
+			Before:     before.Result,
+			After:      after[i].Result,
+			Error:      after[i].Error,
+		})
+		if len(r.Samples) < sampleSize {
+			r.Samples = append(r.Samples, sample)
+		}
+	}
+
+	// changed decisions are the interesting ones, unchanged ones fill whatever room is left
+	for _, sample := range unchanged {
+		if len(r.Samples) >= sampleSize {
+			break
+		}
+		r.Samples = append(r.Samples, sample)
+	}
+
+	return r
+}
+
+// changed reports whether the outcome differs, a result that now fails or a failure that now
+// has a result both count
+func changed(before, after structs.ReplayOutcome) bool {
+	if (before.Error != nil) != (after.Error != nil) {
+		return true
+	}
+	return !reflect.DeepEqual(normalize(before.Result), normalize(after.Result))
+}
+
+// normalize gives values the shape they have once read back from the decision log
+func normalize(v interface{}) interface{} {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var n interface{}
+	if err := json.Unmarshal(b, &n); err != nil {
+		return v
+	}
+	return n
+}
+
+func errorOutcome(version string, err error) structs.ReplayOutcome {
+	_, httpErr := errors.ToHTTPError(err)
+	return structs.ReplayOutcome{
+		Version: version,
+		Error:   httpErr,
+	}
+}
+
+func decisionVersion(d structs.Decision) string {
+	if d.Kind == decision.KindFlow {
+		return versionLabel(d.FlowVersion, false)
+	}
+	return versionLabel(d.PolicyVersion, false)
+}
+
+func versionLabel(version string, draft bool) string {
+	if version == "" || draft {
+		return "draft"
+	}
+	return version
+}
+
+func decisionQuery(req structs.ReplayRequest, q structs.DecisionQuery) structs.DecisionQuery {
+	q.From = req.From
+	q.To = req.To
+	q.Limit = req.Limit
+	if q.Limit <= 0 {
+		q.Limit = defaultLimit
+	}
+	q.Limit = min(q.Limit, maxLimit)
+	return q
+}
+
+func withWindow(r structs.ReplayReport, req structs.ReplayRequest) structs.ReplayReport {
+	if !req.From.IsZero() {
+		r.From = &req.From
+	}
+	if !req.To.IsZero() {
+		r.To = &req.To
+	}
+	return r
+}
+
+// PolicyTarget loads the draft or version of the policy the decisions are replayed against
+func (s *System) PolicyTarget(basePolicyId string, req structs.ReplayRequest) (structs.Policy, error) {
+	ps := policy.NewSystem(s.Config).SetContext(s.Context)
+
+	targetId := req.TargetID
+	if targetId == "" {
+		pp, err := ps.GetPolicyVersions(basePolicyId)
+		if err != nil {
+			return structs.Policy{}, err
+		}
+		for _, p := range pp {
+			if matchesVersion(req.Version, p.Version, p.IsDraft) {
+				targetId = p.PolicyID
+				break
+			}
+		}
+		if targetId == "" {
+			return structs.Policy{}, errors.WrapPolicyError(errors.ErrPolicyNotFound, basePolicyId)
+		}
+	}
+
+	p, err := ps.LoadPolicy(targetId)
+	if err != nil {
+		return structs.Policy{}, errors.WrapPolicyError(errors.ErrPolicyNotFound, targetId)
+	}
+	if p.BaseID != basePolicyId {
+		return structs.Policy{}, errors.NewValidationError("targetId", "target is not a draft or version of this policy")
+	}
+
+	return p, nil
+}
+
+// FlowTarget loads the draft or version of the flow the decisions are replayed against
+func (s *System) FlowTarget(baseFlowId string, req structs.ReplayRequest) (structs.StoredFlow, error) {
+	fs := flow.NewSystem(s.Config).SetContext(s.Context)
+
+	targetId := req.TargetID
+	if targetId == "" {
+		ff, err := fs.GetFlowVersions(baseFlowId)
+		if err != nil {
+			return structs.StoredFlow{}, err
+		}
+		for _, f := range ff {
+			if matchesVersion(req.Version, f.Version, f.IsDraft) {
+				targetId = f.FlowID
+				break
+			}
+		}
+		if targetId == "" {
+			return structs.StoredFlow{}, errors.WrapFlowError(errors.ErrFlowNotFound, baseFlowId, "")
+		}
+	}
+
+	f, err := fs.GetFullFlow(targetId)
+	if err != nil {
+		return structs.StoredFlow{}, errors.WrapFlowError(errors.ErrFlowNotFound, targetId, "")
+	}
+	if f.BaseID != baseFlowId {
+		return structs.StoredFlow{}, errors.NewValidationError("targetId", "target is not a draft or version of this flow")
+	}
+	if err := yaml.Unmarshal([]byte(f.FlatYAML), &f.FlowConfig); err != nil {
+		return structs.StoredFlow{}, errors.WrapFlowError(errors.ErrInvalidFlow, targetId, "")
+	}
+
+	return *f, nil
+}
+
+// matchesVersion compares the requested version with a stored one, "draft" or nothing asks for
+// the draft and the leading v of a version label is optional
+func matchesVersion(want, version string, draft bool) bool {
+	if want == "" || want == "draft" {
+		return draft
+	}
+	if draft {
+		return false
+	}
+	if w, err := semver.Parse(want); err == nil {
+		if v, err := semver.Parse(version); err == nil {
+			return w.Compare(v) == 0
+		}
+	}
+	return strings.TrimPrefix(want, "v") == strings.TrimPrefix(version, "v")
+}
@@ -0,0 +1,102 @@
+package replay
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/engine"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	ConfigBuilder "github.com/keloran/go-config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSystem_AgainstPolicy(t *testing.T) {
+	// the new draft turns away everyone under 21 and no longer has the v1.0 credit check
+	fe := engine.NewFakeEvaluator().
+		Default(structs.EngineResponse{Result: true, Trace: "over 21"}).
+		OnInput(map[string]interface{}{"age": float64(16)}, structs.EngineResponse{Result: false, Trace: "under 21"}).
+		OnInput(map[string]interface{}{"age": float64(18)}, structs.EngineResponse{Result: false, Trace: "under 21"}).
+		OnInput(map[string]interface{}{"age": float64(19)}, structs.EngineResponse{Result: false, Trace: "under 21"})
+
+	s := NewSystem(ConfigBuilder.NewConfigNoVault()).SetContext(context.Background()).SetEvaluator(fe)
+
+	logged := func(id string, age interface{}, result interface{}) structs.Decision {
+		return structs.Decision{
+			ID:            id,
+			Kind:          decision.KindPolicy,
+			PolicyID:      "policy-v1",
+			BasePolicyID:  "base-1",
+			PolicyVersion: "v1.0",
+			Input:         map[string]interface{}{"age": age},
+			Result:        result,
+			Trace:         "over 18",
+		}
+	}
+	dd := []structs.Decision{
+		logged("d-1", float64(18), true),
+		logged("d-2", float64(19), true),
+		logged("d-3", float64(25), false),
+		logged("d-4", float64(16), false),
+		logged("d-5", "x", nil),
+	}
+	dd[4].Error = map[string]interface{}{"code": "ENGINE_UNAVAILABLE"}
+
+	p := structs.Policy{
+		PolicyID:  "policy-draft",
+		BaseID:    "base-1",
+		IsDraft:   true,
+		DataModel: `{"type": "object", "properties": {"age": {"type": "number"}}}`,
+	}
+	r := s.AgainstPolicy(p, dd, 3)
+
+	assert.Equal(t, decision.KindPolicy, r.Kind)
+	assert.Equal(t, "base-1", r.BaseID)
+	assert.Equal(t, "policy-draft", r.TargetID)
+	assert.Equal(t, "draft", r.TargetVersion)
+	assert.Equal(t, 5, r.Total)
+	assert.Equal(t, 3, r.Changed, "d-1 and d-2 are now turned away, d-3 is now approved")
+	assert.Equal(t, 2, r.Unchanged)
+	assert.Equal(t, 1, r.Errors, "d-5 fails validation")
+
+	require.Len(t, r.Flips, 3)
+	assert.Equal(t, "d-1", r.Flips[0].DecisionID)
+	assert.Equal(t, true, r.Flips[0].Before)
+	assert.Equal(t, false, r.Flips[0].After)
+	assert.Equal(t, "d-3", r.Flips[2].DecisionID)
+
+	require.Len(t, r.Samples, 3)
+	assert.True(t, r.Samples[0].Changed)
+	assert.Equal(t, "v1.0", r.Samples[0].Before.Version)
+	assert.Equal(t, "over 18", r.Samples[0].Before.Trace)
+	assert.Equal(t, "draft", r.Samples[0].After.Version)
+	assert.Equal(t, "under 21", r.Samples[0].After.Trace)
+
+	assert.Len(t, fe.Calls(), 4, "invalid inputs never reach the engine")
+
+	r = s.AgainstPolicy(p, dd[4:], 0)
+	require.Len(t, r.Samples, 1)
+	assert.False(t, r.Samples[0].Changed, "an error before and after is no change")
+	assert.Equal(t, "VALIDATION_ERROR", r.Samples[0].After.Error.(errors.HTTPError).Code)
+}
+
+func TestMatchesVersion(t *testing.T) {
+	assert.True(t, matchesVersion("", "", true))
+	assert.True(t, matchesVersion("draft", "", true))
+	assert.False(t, matchesVersion("draft", "v1.0", false))
+	assert.True(t, matchesVersion("1.1", "v1.1", false))
+	assert.True(t, matchesVersion("v1.1", "v1.1", false))
+	assert.False(t, matchesVersion("v1.1", "v1.10", false))
+	assert.True(t, matchesVersion("1.1", "v1.1.0", false))
+}
+
+func TestTimeout(t *testing.T) {
+	cfg := ConfigBuilder.NewConfigNoVault()
+	assert.Equal(t, defaultTimeout, Timeout(cfg))
+
+	cfg.ProjectProperties = map[string]interface{}{"replay_timeout": time.Minute}
+	assert.Equal(t, time.Minute, Timeout(cfg))
+}
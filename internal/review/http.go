@@ -0,0 +1,176 @@
+package review
+
+import (
+	"encoding/json"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"io"
+	"net/http"
+	"strings"
+)
+
+func (s *System) GetPolicyReview(w http.ResponseWriter, r *http.Request) {
+	s.getReview(w, r, decision.KindPolicy, r.PathValue("policyId"))
+}
+
+func (s *System) SubmitPolicy(w http.ResponseWriter, r *http.Request) {
+	s.act(w, r, decision.KindPolicy, r.PathValue("policyId"), s.Submit)
+}
+
+func (s *System) ApprovePolicy(w http.ResponseWriter, r *http.Request) {
+	s.act(w, r, decision.KindPolicy, r.PathValue("policyId"), s.Approve)
+}
+
+func (s *System) RejectPolicy(w http.ResponseWriter, r *http.Request) {
+	s.act(w, r, decision.KindPolicy, r.PathValue("policyId"), s.Reject)
+}
+
+func (s *System) CommentPolicy(w http.ResponseWriter, r *http.Request) {
+	s.act(w, r, decision.KindPolicy, r.PathValue("policyId"), s.Comment)
+}
+
+func (s *System) GetPolicyApprovers(w http.ResponseWriter, r *http.Request) {
+	s.getRule(w, r, decision.KindPolicy, r.PathValue("policyId"))
+}
+
+func (s *System) UpdatePolicyApprovers(w http.ResponseWriter, r *http.Request) {
+	s.updateRule(w, r, decision.KindPolicy, r.PathValue("policyId"))
+}
+
+func (s *System) GetFlowReview(w http.ResponseWriter, r *http.Request) {
+	s.getReview(w, r, decision.KindFlow, r.PathValue("flowId"))
+}
+
+func (s *System) SubmitFlow(w http.ResponseWriter, r *http.Request) {
+	s.act(w, r, decision.KindFlow, r.PathValue("flowId"), s.Submit)
+}
+
+func (s *System) ApproveFlow(w http.ResponseWriter, r *http.Request) {
+	s.act(w, r, decision.KindFlow, r.PathValue("flowId"), s.Approve)
+}
+
+func (s *System) RejectFlow(w http.ResponseWriter, r *http.Request) {
+	s.act(w, r, decision.KindFlow, r.PathValue("flowId"), s.Reject)
+}
+
+func (s *System) CommentFlow(w http.ResponseWriter, r *http.Request) {
+	s.act(w, r, decision.KindFlow, r.PathValue("flowId"), s.Comment)
+}
+
+func (s *System) GetFlowApprovers(w http.ResponseWriter, r *http.Request) {
+	s.getRule(w, r, decision.KindFlow, r.PathValue("flowId"))
+}
+
+func (s *System) UpdateFlowApprovers(w http.ResponseWriter, r *http.Request) {
+	s.updateRule(w, r, decision.KindFlow, r.PathValue("flowId"))
+}
+
+func (s *System) GetFolderApprovers(w http.ResponseWriter, r *http.Request) {
+	s.getRule(w, r, ScopeFolder, r.PathValue("folder"))
+}
+
+func (s *System) UpdateFolderApprovers(w http.ResponseWriter, r *http.Request) {
+	s.updateRule(w, r, ScopeFolder, r.PathValue("folder"))
+}
+
+func (s *System) getReview(w http.ResponseWriter, r *http.Request, kind, baseId string) {
+	s.SetContext(r.Context())
+
+	rv, err := s.Load(kind, baseId)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	writeJSON(w, rv)
+}
+
+// act submits, approves, rejects or comments on the draft as the reviewer of the request, the
+// body with the comment can be left out
+func (s *System) act(w http.ResponseWriter, r *http.Request, kind, baseId string, action func(kind, baseId string, who structs.Reviewer, comment string) (structs.Review, error)) {
+	s.SetContext(r.Context())
+
+	who, err := Reviewer(r)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	var a structs.ReviewAction
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil && err != io.EOF {
+		errors.WriteHTTPError(w, errors.NewValidationError("body", "invalid JSON format"))
+		return
+	}
+
+	rv, err := action(kind, baseId, who, a.Comment)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	writeJSON(w, rv)
+}
+
+func (s *System) getRule(w http.ResponseWriter, r *http.Request, scope, target string) {
+	s.SetContext(r.Context())
+
+	rule, err := s.Rule(scope, target)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	writeJSON(w, rule)
+}
+
+func (s *System) updateRule(w http.ResponseWriter, r *http.Request, scope, target string) {
+	s.SetContext(r.Context())
+
+	who, err := Reviewer(r)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	var rule structs.ApprovalRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		errors.WriteHTTPError(w, errors.NewValidationError("body", "invalid JSON format"))
+		return
+	}
+
+	updated, err := s.SetRule(scope, target, who, rule.Roles)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	writeJSON(w, updated)
+}
+
+// Reviewer is who a request says it is from, its X-User and comma separated X-User-Roles.
+// Nothing authenticates either header, so like the actors of the audit log they are only
+// claimed and keep apart reviewers who don't claim to be someone else
+func Reviewer(r *http.Request) (structs.Reviewer, error) {
+	who := structs.Reviewer{
+		User:  strings.TrimSpace(r.Header.Get("X-User")),
+		Roles: []string{},
+	}
+	if err := validReviewer(who); err != nil {
+		return who, err
+	}
+
+	for _, role := range strings.Split(r.Header.Get("X-User-Roles"), ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			who.Roles = append(who.Roles, role)
+		}
+	}
+	return who, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
+	}
+}
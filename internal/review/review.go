@@ -0,0 +1,738 @@
+package review
+
+import (
+	"context"
+	"database/sql"
+	stderrors "errors"
+	"fmt"
+	"github.com/1rp-pw/orchestrator/internal/audit"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/listing"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	ConfigBuilder "github.com/keloran/go-config"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	StateDraft      = "draft"
+	StateSubmitted  = "submitted"
+	StateApproved   = "approved"
+	StateRejected   = "rejected"
+	StatePublished  = "published"
+	StateSuperseded = "superseded"
+
+	// ScopeFolder is the scope of the approval rules of folders, the others are the kinds
+	ScopeFolder = "folder"
+
+	maxRoleLength = 100
+)
+
+type System struct {
+	Config  *ConfigBuilder.Config
+	Context context.Context
+	Audit   audit.Recorder
+}
+
+func NewSystem(cfg *ConfigBuilder.Config) *System {
+	return &System{
+		Config:  cfg,
+		Context: context.Background(),
+		Audit:   audit.NewSystem(cfg),
+	}
+}
+
+func (s *System) SetContext(ctx context.Context) *System {
+	s.Context = ctx
+	return s
+}
+
+// SetAudit records every submission, decision and approval rule change with a, nil records
+// nothing
+func (s *System) SetAudit(a audit.Recorder) *System {
+	s.Audit = a
+	return s
+}
+
+// drafts are the table, id column and base id column of the drafts of each kind and the
+// condition for the rows of t that haven't been deleted
+var drafts = map[string][4]string{
+	decision.KindPolicy: {"policies", "policy_id", "base_policy_id", "t.archived_at IS NULL"},
+	decision.KindFlow:   {"flows", "flow_id", "base_flow_id", "TRUE"},
+}
+
+// DB is the part of a pool or transaction the review queries need
+type DB interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+type draft struct {
+	ID       string
+	Revision int64
+	Folder   string
+}
+
+// open is the review of a base that is submitted or approved
+type open struct {
+	ID            int64
+	DraftID       string
+	State         string
+	Author        string
+	Roles         []string
+	DraftRevision int64
+}
+
+// stale is whether the draft was published, replaced or edited after it was submitted
+func (o open) stale(d draft) bool {
+	return o.DraftID != d.ID || o.DraftRevision != d.Revision
+}
+
+// Submit puts the draft of a base policy or flow up for review by who. The roles that must
+// approve are those of its approval rule now, an earlier open review is superseded along with
+// its approvals
+func (s *System) Submit(kind, baseId string, who structs.Reviewer, comment string) (structs.Review, error) {
+	if err := validReviewer(who); err != nil {
+		return structs.Review{}, err
+	}
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return structs.Review{}, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	if _, ok := drafts[kind]; !ok {
+		return structs.Review{}, notFound(kind, baseId)
+	}
+	change, err := audit.Begin(s.Context, s.Audit, client, kind, audit.ActionSubmit, baseId)
+	if err != nil {
+		return structs.Review{}, err
+	}
+	defer change.Close()
+
+	d, err := s.loadDraft(change, kind, baseId)
+	if err != nil {
+		return structs.Review{}, err
+	}
+	rule, err := s.rule(change, kind, baseId, d.Folder)
+	if err != nil {
+		return structs.Review{}, err
+	}
+
+	if _, err := change.Exec(s.Context, `
+		UPDATE reviews
+		SET state = 'superseded'
+		WHERE kind = $1 AND base_id = $2 AND state IN ('submitted', 'approved')`, kind, baseId); err != nil {
+		return structs.Review{}, logs.Errorf("failed to supersede review: %v", err)
+	}
+
+	var id int64
+	if err := change.QueryRow(s.Context, `
+		INSERT INTO reviews (kind, base_id, draft_id, state, author, roles, draft_revision)
+		VALUES ($1, $2, $3, 'submitted', $4, $5, $6)
+		RETURNING id`, kind, baseId, d.ID, who.User, rule.Roles, d.Revision).Scan(&id); err != nil {
+		return structs.Review{}, logs.Errorf("failed to submit review: %v", err)
+	}
+
+	if comment != "" {
+		if err := s.comment(change, kind, baseId, d.ID, id, who, "", comment); err != nil {
+			return structs.Review{}, err
+		}
+	}
+
+	if err := change.Done(d.ID, ""); err != nil {
+		return structs.Review{}, err
+	}
+
+	return s.Load(kind, baseId)
+}
+
+// Approve approves the submitted draft, once every role of the review has approved, or anyone
+// when it has none, the draft is approved. The author can't approve their own draft, nor can
+// anyone who edited it since its last published version
+func (s *System) Approve(kind, baseId string, who structs.Reviewer, comment string) (structs.Review, error) {
+	return s.decide(kind, baseId, who, StateApproved, comment)
+}
+
+// Reject rejects the submitted or approved draft, saying why in the comment. It has to be
+// submitted again before it can be approved
+func (s *System) Reject(kind, baseId string, who structs.Reviewer, comment string) (structs.Review, error) {
+	if strings.TrimSpace(comment) == "" {
+		return structs.Review{}, errors.NewValidationError("comment", "say why the draft is rejected")
+	}
+	return s.decide(kind, baseId, who, StateRejected, comment)
+}
+
+func (s *System) decide(kind, baseId string, who structs.Reviewer, state, comment string) (structs.Review, error) {
+	if err := validReviewer(who); err != nil {
+		return structs.Review{}, err
+	}
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return structs.Review{}, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	action := audit.ActionReject
+	if state == StateApproved {
+		action = audit.ActionApprove
+	}
+	if _, ok := drafts[kind]; !ok {
+		return structs.Review{}, notFound(kind, baseId)
+	}
+	change, err := audit.Begin(s.Context, s.Audit, client, kind, action, baseId)
+	if err != nil {
+		return structs.Review{}, err
+	}
+	defer change.Close()
+
+	d, err := s.loadDraft(change, kind, baseId)
+	if err != nil {
+		return structs.Review{}, err
+	}
+	o, err := s.loadOpen(change, kind, baseId)
+	if err != nil {
+		return structs.Review{}, err
+	}
+	if o.ID == 0 {
+		return structs.Review{}, fmt.Errorf("%w: the draft hasn't been submitted for review", errors.ErrReviewState)
+	}
+	if o.Author == who.User {
+		return structs.Review{}, fmt.Errorf("%w: %s submitted the draft so can't review it", errors.ErrReviewForbidden, who.User)
+	}
+	if state == StateApproved && s.Audit != nil {
+		editors, err := audit.Editors(s.Context, change, kind, baseId)
+		if err != nil {
+			return structs.Review{}, err
+		}
+		if slices.Contains(editors, who.User) {
+			return structs.Review{}, fmt.Errorf("%w: %s edited the draft so can't approve it", errors.ErrReviewForbidden, who.User)
+		}
+	}
+	if o.stale(d) {
+		return structs.Review{}, fmt.Errorf("%w: the draft changed after it was submitted, submit it again", errors.ErrReviewState)
+	}
+	if state == StateApproved && len(o.Roles) > 0 && len(intersect(who.Roles, o.Roles)) == 0 {
+		return structs.Review{}, fmt.Errorf("%w: approving needs one of the roles %s", errors.ErrReviewForbidden, strings.Join(o.Roles, ", "))
+	}
+
+	if err := s.comment(change, kind, baseId, d.ID, o.ID, who, state, comment); err != nil {
+		return structs.Review{}, err
+	}
+
+	next := StateRejected
+	if state == StateApproved {
+		approvals, err := s.approvals(change, o.ID)
+		if err != nil {
+			return structs.Review{}, err
+		}
+		next = StateSubmitted
+		if _, ok := approved(o.Roles, approvals); ok {
+			next = StateApproved
+		}
+	}
+	if _, err := change.Exec(s.Context, `UPDATE reviews SET state = $2 WHERE id = $1`, o.ID, next); err != nil {
+		return structs.Review{}, logs.Errorf("failed to update review: %v", err)
+	}
+
+	if err := change.Done(d.ID, ""); err != nil {
+		return structs.Review{}, err
+	}
+
+	return s.Load(kind, baseId)
+}
+
+// Comment adds a comment to the draft of a base policy or flow, anyone can comment
+func (s *System) Comment(kind, baseId string, who structs.Reviewer, comment string) (structs.Review, error) {
+	if err := validReviewer(who); err != nil {
+		return structs.Review{}, err
+	}
+	if strings.TrimSpace(comment) == "" {
+		return structs.Review{}, errors.NewValidationError("comment", "comment is required")
+	}
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return structs.Review{}, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	d, err := s.loadDraft(client, kind, baseId)
+	if err != nil {
+		return structs.Review{}, err
+	}
+	o, err := s.loadOpen(client, kind, baseId)
+	if err != nil {
+		return structs.Review{}, err
+	}
+	if o.DraftID != d.ID {
+		o.ID = 0
+	}
+
+	if err := s.comment(client, kind, baseId, d.ID, o.ID, who, "", comment); err != nil {
+		return structs.Review{}, err
+	}
+
+	return s.Load(kind, baseId)
+}
+
+func (s *System) comment(db DB, kind, baseId, draftId string, reviewId int64, who structs.Reviewer, decision, comment string) error {
+	var review, dec interface{}
+	if reviewId != 0 {
+		review = reviewId
+	}
+	if decision != "" {
+		dec = decision
+	}
+	if _, err := db.Exec(s.Context, `
+		INSERT INTO review_comments (kind, base_id, draft_id, review_id, author, roles, decision, body)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		kind, baseId, draftId, review, who.User, nonNil(who.Roles), dec, strings.TrimSpace(comment)); err != nil {
+		return logs.Errorf("failed to store comment: %v", err)
+	}
+	return nil
+}
+
+// Load is the review of the draft of a base policy or flow with its comments, or the last
+// review when there is no draft such as after it was published
+func (s *System) Load(kind, baseId string) (structs.Review, error) {
+	r := structs.Review{
+		Kind:     kind,
+		BaseID:   baseId,
+		State:    StateDraft,
+		Roles:    []string{},
+		Missing:  []string{},
+		Comments: []structs.ReviewComment{},
+	}
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return r, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	d, err := s.loadDraft(client, kind, baseId)
+	if err != nil && !stderrors.Is(err, errors.ErrPolicyNotFound) && !stderrors.Is(err, errors.ErrFlowNotFound) {
+		return r, err
+	}
+	r.DraftID = d.ID
+
+	var version sql.NullString
+	var submittedAt time.Time
+	var draftRevision sql.NullInt64
+	err = client.QueryRow(s.Context, `
+		SELECT
+		    id,
+		    draft_id,
+		    state,
+		    author,
+		    roles,
+		    version,
+		    submitted_at,
+		    draft_revision
+		FROM reviews
+		WHERE kind = $1 AND base_id = $2 AND ($3 = '' OR draft_id = $3)
+		ORDER BY id DESC
+		LIMIT 1`, kind, baseId, d.ID).Scan(&r.ID, &r.DraftID, &r.State, &r.Author, &r.Roles, &version, &submittedAt, &draftRevision)
+	switch {
+	case stderrors.Is(err, pgx.ErrNoRows):
+		if d.ID == "" {
+			return r, notFound(kind, baseId)
+		}
+	case err != nil:
+		return r, logs.Errorf("failed to load review: %v", err)
+	default:
+		r.Version = version.String
+		r.SubmittedAt = &submittedAt
+		r.Roles = nonNil(r.Roles)
+	}
+
+	if r.State == StateSubmitted || r.State == StateApproved {
+		o := open{ID: r.ID, DraftID: r.DraftID, DraftRevision: draftRevision.Int64}
+		r.Stale = o.stale(d)
+
+		approvals, err := s.approvals(client, r.ID)
+		if err != nil {
+			return r, err
+		}
+		r.Missing, _ = approved(r.Roles, approvals)
+	}
+
+	rows, err := client.Query(s.Context, `
+		SELECT
+		    id,
+		    review_id,
+		    author,
+		    roles,
+		    decision,
+		    body,
+		    created_at
+		FROM review_comments
+		WHERE kind = $1 AND draft_id = $2
+		ORDER BY id`, kind, r.DraftID)
+	if err != nil {
+		return r, logs.Errorf("failed to load comments: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		c := structs.ReviewComment{}
+		var reviewId sql.NullInt64
+		var dec sql.NullString
+		if err := rows.Scan(&c.ID, &reviewId, &c.Author, &c.Roles, &dec, &c.Comment, &c.CreatedAt); err != nil {
+			return r, logs.Errorf("failed to load comments: %v", err)
+		}
+		c.ReviewID = reviewId.Int64
+		c.Decision = dec.String
+		r.Comments = append(r.Comments, c)
+	}
+
+	return r, nil
+}
+
+// Approved is the id of the approved review of the draft of a base policy or flow, checked on
+// the change that publishes the draft with the review locked until it commits. The publishing
+// of a draft without one fails with ErrNotApproved, no draft is left for publishing to report
+func (s *System) Approved(ctx context.Context, change *audit.Change, kind, baseId string) (int64, error) {
+	rs := &System{Config: s.Config, Context: ctx}
+
+	d, err := rs.loadDraft(change, kind, baseId)
+	if err != nil {
+		if stderrors.Is(err, errors.ErrPolicyNotFound) || stderrors.Is(err, errors.ErrFlowNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	o, err := rs.loadOpen(change, kind, baseId)
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case o.ID == 0 || o.DraftID != d.ID:
+		return 0, fmt.Errorf("%w: submit it for review first", errors.ErrNotApproved)
+	case o.stale(d):
+		return 0, fmt.Errorf("%w: it changed after it was submitted, submit it again", errors.ErrNotApproved)
+	case o.State != StateApproved:
+		return 0, fmt.Errorf("%w: it is waiting for a review", errors.ErrNotApproved)
+	}
+	return o.ID, nil
+}
+
+// Published marks an approved review as published as version on the change that published it
+func (s *System) Published(ctx context.Context, change *audit.Change, reviewId int64, version string) error {
+	if _, err := change.Exec(ctx, `UPDATE reviews SET state = 'published', version = $2 WHERE id = $1`, reviewId, version); err != nil {
+		return logs.Errorf("failed to publish review: %v", err)
+	}
+	return nil
+}
+
+func (s *System) loadDraft(db DB, kind, baseId string) (draft, error) {
+	v, ok := drafts[kind]
+	if !ok {
+		return draft{}, notFound(kind, baseId)
+	}
+
+	d := draft{}
+	var folder sql.NullString
+	err := db.QueryRow(s.Context, fmt.Sprintf(`
+		SELECT
+		    t.%s::text,
+		    t.revision,
+		    m.folder
+		FROM %s t
+		LEFT JOIN metadata m ON m.kind = $1 AND m.base_id = t.%s::text
+		WHERE t.%s::text = $2 AND t.status = 'draft' AND %s`, v[1], v[0], v[2], v[2], v[3]),
+		kind, baseId).Scan(&d.ID, &d.Revision, &folder)
+	if stderrors.Is(err, pgx.ErrNoRows) {
+		return d, notFound(kind, baseId)
+	}
+	if err != nil {
+		return d, logs.Errorf("failed to load draft: %v", err)
+	}
+	d.Folder = folder.String
+
+	return d, nil
+}
+
+// loadOpen is the open review of a base, the zero open when there is none
+func (s *System) loadOpen(db DB, kind, baseId string) (open, error) {
+	o := open{}
+	var draftRevision sql.NullInt64
+	err := db.QueryRow(s.Context, `
+		SELECT
+		    id,
+		    draft_id,
+		    state,
+		    author,
+		    roles,
+		    draft_revision
+		FROM reviews
+		WHERE kind = $1 AND base_id = $2 AND state IN ('submitted', 'approved')
+		FOR UPDATE`, kind, baseId).Scan(&o.ID, &o.DraftID, &o.State, &o.Author, &o.Roles, &draftRevision)
+	if stderrors.Is(err, pgx.ErrNoRows) {
+		return open{}, nil
+	}
+	if err != nil {
+		return o, logs.Errorf("failed to load review: %v", err)
+	}
+	o.DraftRevision = draftRevision.Int64
+
+	return o, nil
+}
+
+// approvals are the roles each approval of a review was given with
+func (s *System) approvals(db DB, reviewId int64) ([][]string, error) {
+	rows, err := db.Query(s.Context, `
+		SELECT roles
+		FROM review_comments
+		WHERE review_id = $1 AND decision = 'approved'
+		ORDER BY id`, reviewId)
+	if err != nil {
+		return nil, logs.Errorf("failed to load approvals: %v", err)
+	}
+	defer rows.Close()
+
+	var approvals [][]string
+	for rows.Next() {
+		var roles []string
+		if err := rows.Scan(&roles); err != nil {
+			return nil, logs.Errorf("failed to load approvals: %v", err)
+		}
+		approvals = append(approvals, roles)
+	}
+	return approvals, nil
+}
+
+// approved lists the roles no approval was given with and whether there are enough approvals,
+// with no roles one approval is enough
+func approved(roles []string, approvals [][]string) ([]string, bool) {
+	missing := make([]string, 0, len(roles))
+	for _, role := range roles {
+		found := false
+		for _, a := range approvals {
+			if len(intersect(a, []string{role})) > 0 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, role)
+		}
+	}
+	return missing, len(approvals) > 0 && len(missing) == 0
+}
+
+func intersect(a, b []string) []string {
+	var both []string
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				both = append(both, x)
+				break
+			}
+		}
+	}
+	return both
+}
+
+// Rule is the approval rule of a base policy or flow or of a folder, that of the deepest folder
+// above it when it has none of its own
+func (s *System) Rule(scope, target string) (structs.ApprovalRule, error) {
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return structs.ApprovalRule{}, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	if scope == ScopeFolder {
+		path, err := listing.CleanFolder(target)
+		if err != nil {
+			return structs.ApprovalRule{}, err
+		}
+		return s.rule(client, scope, path, path)
+	}
+
+	folder, err := s.folder(client, scope, target)
+	if err != nil {
+		return structs.ApprovalRule{}, err
+	}
+	return s.rule(client, scope, target, folder)
+}
+
+// SetRule sets the roles that must approve, no roles lets any reviewer but the author approve.
+// Changing them needs one of the roles of the rule in force, and the author or an editor of the
+// draft of a base policy or flow can't change who approves it
+func (s *System) SetRule(scope, target string, who structs.Reviewer, roles []string) (structs.ApprovalRule, error) {
+	if err := validReviewer(who); err != nil {
+		return structs.ApprovalRule{}, err
+	}
+	roles, err := cleanRoles(roles)
+	if err != nil {
+		return structs.ApprovalRule{}, err
+	}
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return structs.ApprovalRule{}, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	folder := ""
+	if scope == ScopeFolder {
+		if target, err = listing.CleanFolder(target); err != nil {
+			return structs.ApprovalRule{}, err
+		}
+		folder = target
+	} else if folder, err = s.folder(client, scope, target); err != nil {
+		return structs.ApprovalRule{}, err
+	}
+
+	change, err := audit.Begin(s.Context, s.Audit, client, scope, audit.ActionRule, target)
+	if err != nil {
+		return structs.ApprovalRule{}, err
+	}
+	defer change.Close()
+	if err := s.canSetRule(change, scope, target, folder, who); err != nil {
+		return structs.ApprovalRule{}, err
+	}
+	if _, err := change.Exec(s.Context, `
+		INSERT INTO approval_rules (scope, target, roles)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (scope, target) DO UPDATE
+		SET roles = EXCLUDED.roles, updated_at = CURRENT_TIMESTAMP`, scope, target, roles); err != nil {
+		return structs.ApprovalRule{}, logs.Errorf("failed to store approval rule: %v", err)
+	}
+	if err := change.Done("", ""); err != nil {
+		return structs.ApprovalRule{}, err
+	}
+
+	return s.Rule(scope, target)
+}
+
+// canSetRule refuses who changing the approval rule of scope and target without a role of the
+// rule in force, or when who submitted or edited the draft it would approve
+func (s *System) canSetRule(change *audit.Change, scope, target, folder string, who structs.Reviewer) error {
+	current, err := s.rule(change, scope, target, folder)
+	if err != nil {
+		return err
+	}
+	if len(current.Roles) > 0 && len(intersect(who.Roles, current.Roles)) == 0 {
+		return fmt.Errorf("%w: changing the approvers needs one of the roles %s", errors.ErrReviewForbidden, strings.Join(current.Roles, ", "))
+	}
+	if scope == ScopeFolder {
+		return nil
+	}
+
+	o, err := s.loadOpen(change, scope, target)
+	if err != nil {
+		return err
+	}
+	if o.ID != 0 && o.Author == who.User {
+		return fmt.Errorf("%w: %s submitted the draft so can't change who approves it", errors.ErrReviewForbidden, who.User)
+	}
+	if s.Audit != nil {
+		editors, err := audit.Editors(s.Context, change, scope, target)
+		if err != nil {
+			return err
+		}
+		if slices.Contains(editors, who.User) {
+			return fmt.Errorf("%w: %s edited the draft so can't change who approves it", errors.ErrReviewForbidden, who.User)
+		}
+	}
+	return nil
+}
+
+// folder is the folder of a base policy or flow, failing when there is no such base
+func (s *System) folder(db DB, kind, baseId string) (string, error) {
+	v, ok := drafts[kind]
+	if !ok {
+		return "", errors.NewValidationError("scope", "scope must be policy, flow or folder")
+	}
+
+	var folder sql.NullString
+	err := db.QueryRow(s.Context, fmt.Sprintf(`
+		SELECT m.folder
+		FROM %s t
+		LEFT JOIN metadata m ON m.kind = $1 AND m.base_id = t.%s::text
+		WHERE t.%s::text = $2 AND %s
+		LIMIT 1`, v[0], v[2], v[2], v[3]), kind, baseId).Scan(&folder)
+	if stderrors.Is(err, pgx.ErrNoRows) {
+		return "", notFound(kind, baseId)
+	}
+	if err != nil {
+		return "", logs.Errorf("failed to load folder: %v", err)
+	}
+	return folder.String, nil
+}
+
+// rule is the approval rule of scope and target, or of the deepest folder holding folder
+func (s *System) rule(db DB, scope, target, folder string) (structs.ApprovalRule, error) {
+	r := structs.ApprovalRule{Roles: []string{}}
+	err := db.QueryRow(s.Context, `
+		SELECT scope, target, roles, updated_at
+		FROM approval_rules
+		WHERE (scope = $1 AND target = $2)
+		   OR (scope = 'folder' AND (target = $3 OR LEFT($3, LENGTH(target) + 1) = target || '/'))
+		ORDER BY scope = 'folder', LENGTH(target) DESC
+		LIMIT 1`, scope, target, folder).Scan(&r.Scope, &r.Target, &r.Roles, &r.UpdatedAt)
+	if stderrors.Is(err, pgx.ErrNoRows) {
+		return r, nil
+	}
+	if err != nil {
+		return r, logs.Errorf("failed to load approval rule: %v", err)
+	}
+	r.Roles = nonNil(r.Roles)
+	r.Inherited = r.Scope != scope || r.Target != target
+
+	return r, nil
+}
+
+// cleanRoles trims, sorts and dedupes roles, which can't be empty or hold the comma that
+// separates them in X-User-Roles
+func cleanRoles(roles []string) ([]string, error) {
+	seen := make(map[string]bool, len(roles))
+	clean := make([]string, 0, len(roles))
+	for _, role := range roles {
+		role = strings.TrimSpace(role)
+		if role == "" || len(role) > maxRoleLength || strings.Contains(role, ",") {
+			return nil, errors.NewValidationError("roles", fmt.Sprintf("roles must be 1 to %d characters without commas", maxRoleLength))
+		}
+		if !seen[role] {
+			seen[role] = true
+			clean = append(clean, role)
+		}
+	}
+	sort.Strings(clean)
+	return clean, nil
+}
+
+func validReviewer(who structs.Reviewer) error {
+	if strings.TrimSpace(who.User) == "" {
+		return errors.NewValidationError("X-User", "X-User must say who is reviewing")
+	}
+	return nil
+}
+
+func nonNil(ss []string) []string {
+	if ss == nil {
+		return []string{}
+	}
+	return ss
+}
+
+func notFound(kind, id string) error {
+	if kind == decision.KindFlow {
+		return errors.WrapFlowError(errors.ErrFlowNotFound, id, "")
+	}
+	return errors.WrapPolicyError(errors.ErrPolicyNotFound, id)
+}
@@ -0,0 +1,262 @@
+package review
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/1rp-pw/orchestrator/internal/audit"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/policy"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/1rp-pw/orchestrator/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSystem_Review(t *testing.T) {
+	cfg := testutil.Postgres(t, "policy.sql", "flow.sql", "metadata.sql", "review.sql", "audit.sql")
+
+	ctx := context.Background()
+	client, err := cfg.Database.GetPGXPoolClient(ctx)
+	require.NoError(t, err)
+	defer client.Close()
+
+	var baseId string
+	require.NoError(t, client.QueryRow(ctx, `SELECT create_policy('Licence', '{}', '[]', 'rule one', FALSE)`).Scan(&baseId))
+	_, err = client.Exec(ctx, `SELECT update_metadata('policy', $1, p_folder => 'credit/retail')`, baseId)
+	require.NoError(t, err)
+
+	s := NewSystem(cfg)
+	ps := policy.NewSystem(cfg).SetReviews(s)
+	alice := structs.Reviewer{User: "alice"}
+	bob := structs.Reviewer{User: "bob"}
+	riskBob := structs.Reviewer{User: "bob", Roles: []string{"risk"}}
+	carol := structs.Reviewer{User: "carol"}
+	publish := structs.Policy{BaseID: baseId, Version: "1.0.0", Description: "first"}
+
+	_, err = s.SetRule(ScopeFolder, "/credit/", carol, []string{"risk", " risk"})
+	require.NoError(t, err)
+	rule, err := s.Rule(decision.KindPolicy, baseId)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"risk"}, rule.Roles)
+	assert.True(t, rule.Inherited)
+	assert.Equal(t, "credit", rule.Target)
+
+	rv, err := s.Load(decision.KindPolicy, baseId)
+	require.NoError(t, err)
+	assert.Equal(t, StateDraft, rv.State)
+	assert.ErrorIs(t, ps.CreateVersion(publish), errors.ErrNotApproved)
+
+	_, err = s.Approve(decision.KindPolicy, baseId, riskBob, "")
+	assert.ErrorIs(t, err, errors.ErrReviewState, "not submitted yet")
+
+	rv, err = s.Submit(decision.KindPolicy, baseId, alice, "ready")
+	require.NoError(t, err)
+	assert.Equal(t, StateSubmitted, rv.State)
+	assert.Equal(t, []string{"risk"}, rv.Missing)
+
+	_, err = s.Approve(decision.KindPolicy, baseId, structs.Reviewer{User: "alice", Roles: []string{"risk"}}, "")
+	assert.ErrorIs(t, err, errors.ErrReviewForbidden, "authors can't approve their own drafts")
+	_, err = s.Approve(decision.KindPolicy, baseId, bob, "")
+	assert.ErrorIs(t, err, errors.ErrReviewForbidden, "bob doesn't hold the risk role")
+	assert.ErrorIs(t, ps.CreateVersion(publish), errors.ErrNotApproved)
+
+	rv, err = s.Approve(decision.KindPolicy, baseId, riskBob, "looks good")
+	require.NoError(t, err)
+	assert.Equal(t, StateApproved, rv.State)
+	assert.Empty(t, rv.Missing)
+
+	// renaming isn't an edit of the draft
+	_, err = client.Exec(ctx, `SELECT update_metadata('policy', $1, p_name => 'Driving licence')`, baseId)
+	require.NoError(t, err)
+	rv, err = s.Load(decision.KindPolicy, baseId)
+	require.NoError(t, err)
+	assert.False(t, rv.Stale)
+
+	// editing the approved draft needs another review
+	require.NoError(t, ps.UpdateDraft(structs.Policy{BaseID: baseId, Rule: "rule two", DataModel: map[string]interface{}{}, Tests: []interface{}{}}))
+	rv, err = s.Load(decision.KindPolicy, baseId)
+	require.NoError(t, err)
+	assert.True(t, rv.Stale)
+	assert.ErrorIs(t, ps.CreateVersion(publish), errors.ErrNotApproved)
+
+	_, err = s.Submit(decision.KindPolicy, baseId, alice, "")
+	require.NoError(t, err)
+	_, err = s.Reject(decision.KindPolicy, baseId, riskBob, "")
+	assert.Error(t, err, "rejecting needs a reason")
+	rv, err = s.Reject(decision.KindPolicy, baseId, riskBob, "rule two is wrong")
+	require.NoError(t, err)
+	assert.Equal(t, StateRejected, rv.State)
+	_, err = s.Approve(decision.KindPolicy, baseId, riskBob, "")
+	assert.ErrorIs(t, err, errors.ErrReviewState)
+
+	_, err = s.Submit(decision.KindPolicy, baseId, alice, "fixed")
+	require.NoError(t, err)
+	_, err = s.Comment(decision.KindPolicy, baseId, alice, "please look again")
+	require.NoError(t, err)
+	_, err = s.Approve(decision.KindPolicy, baseId, riskBob, "")
+	require.NoError(t, err)
+	require.NoError(t, ps.CreateVersion(publish))
+
+	rv, err = s.Load(decision.KindPolicy, baseId)
+	require.NoError(t, err)
+	assert.Equal(t, StatePublished, rv.State)
+	assert.Equal(t, "v1.0.0", rv.Version)
+	require.Len(t, rv.Comments, 6)
+	assert.Equal(t, "ready", rv.Comments[0].Comment)
+	assert.Equal(t, StateApproved, rv.Comments[5].Decision)
+
+	// a rule of its own wins over the folder's, changing it needs a role of the rule in force
+	_, err = s.SetRule(decision.KindPolicy, baseId, bob, nil)
+	assert.ErrorIs(t, err, errors.ErrReviewForbidden)
+	rule, err = s.SetRule(decision.KindPolicy, baseId, riskBob, nil)
+	require.NoError(t, err)
+	assert.False(t, rule.Inherited)
+	assert.Empty(t, rule.Roles)
+	_, err = s.SetRule(decision.KindPolicy, "00000000-0000-0000-0000-000000000000", riskBob, []string{"risk"})
+	assert.ErrorIs(t, err, errors.ErrPolicyNotFound)
+}
+
+func TestSystem_Approve_Editor(t *testing.T) {
+	cfg := testutil.Postgres(t, "policy.sql", "flow.sql", "metadata.sql", "review.sql", "audit.sql")
+
+	ctx := context.Background()
+	client, err := cfg.Database.GetPGXPoolClient(ctx)
+	require.NoError(t, err)
+	defer client.Close()
+
+	var baseId string
+	require.NoError(t, client.QueryRow(ctx, `SELECT create_policy('Licence', '{}', '[]', 'rule one', FALSE)`).Scan(&baseId))
+
+	// alice edits the draft and bob submits it, alice still can't approve her own work
+	ps := policy.NewSystem(cfg).SetContext(audit.WithActor(ctx, "alice"))
+	require.NoError(t, ps.UpdateDraft(structs.Policy{BaseID: baseId, Rule: "rule two", DataModel: map[string]interface{}{}, Tests: []interface{}{}}))
+
+	s := NewSystem(cfg)
+	_, err = s.SetContext(audit.WithActor(ctx, "bob")).Submit(decision.KindPolicy, baseId, structs.Reviewer{User: "bob"}, "")
+	require.NoError(t, err)
+
+	_, err = s.SetContext(audit.WithActor(ctx, "alice")).Approve(decision.KindPolicy, baseId, structs.Reviewer{User: "alice"}, "")
+	assert.ErrorIs(t, err, errors.ErrReviewForbidden)
+
+	// nor can either of them change who approves it
+	_, err = s.SetContext(audit.WithActor(ctx, "alice")).SetRule(decision.KindPolicy, baseId, structs.Reviewer{User: "alice"}, []string{"risk"})
+	assert.ErrorIs(t, err, errors.ErrReviewForbidden)
+	_, err = s.SetContext(audit.WithActor(ctx, "bob")).SetRule(decision.KindPolicy, baseId, structs.Reviewer{User: "bob"}, []string{"risk"})
+	assert.ErrorIs(t, err, errors.ErrReviewForbidden)
+
+	rv, err := s.SetContext(audit.WithActor(ctx, "carol")).Approve(decision.KindPolicy, baseId, structs.Reviewer{User: "carol"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, StateApproved, rv.State)
+}
+
+func TestSystem_Review_Audited(t *testing.T) {
+	cfg := testutil.Postgres(t, "policy.sql", "flow.sql", "metadata.sql", "review.sql", "audit.sql")
+
+	ctx := context.Background()
+	client, err := cfg.Database.GetPGXPoolClient(ctx)
+	require.NoError(t, err)
+	defer client.Close()
+
+	var baseId string
+	require.NoError(t, client.QueryRow(ctx, `SELECT create_policy('Licence', '{}', '[]', 'rule one', FALSE)`).Scan(&baseId))
+
+	s := NewSystem(cfg)
+	as := func(user string) *System {
+		return s.SetContext(audit.WithActor(ctx, user))
+	}
+	alice := structs.Reviewer{User: "alice"}
+	bob := structs.Reviewer{User: "bob", Roles: []string{"risk"}}
+
+	audited := func(t *testing.T, kind, action, entityId, actor string) {
+		t.Helper()
+		entries, err := audit.NewSystem(cfg).Query(structs.AuditQuery{Kind: kind, Action: action, EntityID: entityId})
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, actor, entries[0].Actor)
+		assert.NotEqual(t, entries[0].BeforeHash, entries[0].AfterHash)
+	}
+
+	t.Run("submit", func(t *testing.T) {
+		_, err := as("alice").Submit(decision.KindPolicy, baseId, alice, "")
+		require.NoError(t, err)
+		audited(t, decision.KindPolicy, audit.ActionSubmit, baseId, "alice")
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		_, err := as("bob").Reject(decision.KindPolicy, baseId, bob, "not yet")
+		require.NoError(t, err)
+		audited(t, decision.KindPolicy, audit.ActionReject, baseId, "bob")
+	})
+
+	t.Run("approve", func(t *testing.T) {
+		_, err := as("alice").Submit(decision.KindPolicy, baseId, alice, "")
+		require.NoError(t, err)
+		_, err = as("bob").Approve(decision.KindPolicy, baseId, bob, "")
+		require.NoError(t, err)
+		audited(t, decision.KindPolicy, audit.ActionApprove, baseId, "bob")
+	})
+
+	t.Run("rule", func(t *testing.T) {
+		_, err := as("carol").SetRule(decision.KindPolicy, baseId, structs.Reviewer{User: "carol"}, []string{"risk"})
+		require.NoError(t, err)
+		audited(t, decision.KindPolicy, audit.ActionRule, baseId, "carol")
+
+		_, err = as("carol").SetRule(ScopeFolder, "credit", structs.Reviewer{User: "carol"}, []string{"risk"})
+		require.NoError(t, err)
+		audited(t, audit.KindFolder, audit.ActionRule, "credit", "carol")
+	})
+}
+
+func TestApproved(t *testing.T) {
+	tests := []struct {
+		name      string
+		roles     []string
+		approvals [][]string
+		missing   []string
+		ok        bool
+	}{
+		{"no roles or approvals", nil, nil, []string{}, false},
+		{"no roles, anyone approves", nil, [][]string{{}}, []string{}, true},
+		{"role missing", []string{"compliance", "risk"}, [][]string{{"risk"}}, []string{"compliance"}, false},
+		{"every role", []string{"compliance", "risk"}, [][]string{{"risk"}, {"compliance", "admin"}}, []string{}, true},
+		{"one reviewer with both", []string{"compliance", "risk"}, [][]string{{"compliance", "risk"}}, []string{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			missing, ok := approved(tt.roles, tt.approvals)
+			assert.Equal(t, tt.missing, missing)
+			assert.Equal(t, tt.ok, ok)
+		})
+	}
+}
+
+func TestCleanRoles(t *testing.T) {
+	roles, err := cleanRoles([]string{" risk", "compliance", "risk"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"compliance", "risk"}, roles)
+
+	roles, err = cleanRoles(nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{}, roles)
+
+	for _, bad := range []string{"", " ", "risk,compliance"} {
+		_, err := cleanRoles([]string{bad})
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestReviewer(t *testing.T) {
+	r := httptest.NewRequest("POST", "/policy/abc/review/approve", nil)
+	_, err := Reviewer(r)
+	assert.Error(t, err)
+
+	r.Header.Set("X-User", " bob ")
+	r.Header.Set("X-User-Roles", "risk, compliance,,")
+	who, err := Reviewer(r)
+	require.NoError(t, err)
+	assert.Equal(t, "bob", who.User)
+	assert.Equal(t, []string{"risk", "compliance"}, who.Roles)
+}
@@ -0,0 +1,148 @@
+package semver
+
+import (
+	"fmt"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	Major = "major"
+	Minor = "minor"
+	Patch = "patch"
+)
+
+// Version is a major.minor.patch version, labels are stored with a leading v
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+// Parse reads a version label such as v1.2.3, 1.2 or v2, missing parts are 0
+func Parse(label string) (Version, error) {
+	s := strings.TrimPrefix(strings.TrimSpace(label), "v")
+	parts := strings.Split(s, ".")
+	if s == "" || len(parts) > 3 {
+		return Version{}, fmt.Errorf("%q is not a major.minor.patch version", label)
+	}
+
+	var nums [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || part != strconv.Itoa(n) {
+			return Version{}, fmt.Errorf("%q is not a major.minor.patch version", label)
+		}
+		nums[i] = n
+	}
+
+	return Version{Major: nums[0], Minor: nums[1], Patch: nums[2]}, nil
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("v%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// Compare returns -1, 0 or 1 as v is lower than, equal to or higher than o
+func (v Version) Compare(o Version) int {
+	for _, d := range []int{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+	return 0
+}
+
+// Bump is the next version after v for a major, minor or patch release
+func (v Version) Bump(part string) (Version, error) {
+	switch part {
+	case Major:
+		return Version{Major: v.Major + 1}, nil
+	case Minor:
+		return Version{Major: v.Major, Minor: v.Minor + 1}, nil
+	case Patch:
+		return Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1}, nil
+	}
+	return v, fmt.Errorf("bump must be major, minor or patch, not %q", part)
+}
+
+// Labels are the ways the version may have been stored, v1.2 and v1.2.0 are the same version
+func (v Version) Labels() []string {
+	labels := []string{v.String()}
+	if v.Patch == 0 {
+		labels = append(labels, fmt.Sprintf("v%d.%d", v.Major, v.Minor))
+		if v.Minor == 0 {
+			labels = append(labels, fmt.Sprintf("v%d", v.Major))
+		}
+	}
+	return labels
+}
+
+// StoredLabels are the labels a requested version may have been stored under, a label that
+// isn't a version is only looked up with a leading v
+func StoredLabels(label string) []string {
+	if v, err := Parse(label); err == nil {
+		return v.Labels()
+	}
+	if label == "" || strings.HasPrefix(label, "v") {
+		return []string{label}
+	}
+	return []string{"v" + label}
+}
+
+// CompareLabels orders version labels semantically, labels that aren't versions sort before
+// those that are and by text among themselves
+func CompareLabels(a, b string) int {
+	va, errA := Parse(a)
+	vb, errB := Parse(b)
+	switch {
+	case errA == nil && errB == nil:
+		if c := va.Compare(vb); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	case errA != nil && errB != nil:
+		return strings.Compare(a, b)
+	case errA != nil:
+		return -1
+	}
+	return 1
+}
+
+// Next works out the label to publish, either the requested version, which has to be higher
+// than every existing one, or the latest existing version bumped. Existing labels that aren't
+// versions are ignored
+func Next(existing []string, version, bump string) (string, error) {
+	var latest Version
+	var latestLabel string
+	for _, label := range existing {
+		if v, err := Parse(label); err == nil && (latestLabel == "" || v.Compare(latest) > 0) {
+			latest, latestLabel = v, label
+		}
+	}
+
+	if bump != "" {
+		if version != "" {
+			return "", errors.NewValidationError("version", "set either version or bump, not both")
+		}
+		next, err := latest.Bump(bump)
+		if err != nil {
+			return "", errors.NewValidationError("bump", err.Error())
+		}
+		return next.String(), nil
+	}
+
+	v, err := Parse(version)
+	if err != nil {
+		return "", errors.NewValidationError("version", err.Error())
+	}
+	if latestLabel != "" && v.Compare(latest) <= 0 {
+		return "", errors.NewValidationError("version", fmt.Sprintf("version %s has to be higher than the latest version %s", version, latestLabel))
+	}
+
+	return "v" + strings.TrimPrefix(strings.TrimSpace(version), "v"), nil
+}
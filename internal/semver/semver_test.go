@@ -0,0 +1,104 @@
+package semver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		label   string
+		want    Version
+		wantErr bool
+	}{
+		{"v1.2.3", Version{1, 2, 3}, false},
+		{"1.2", Version{1, 2, 0}, false},
+		{"v2", Version{2, 0, 0}, false},
+		{"v1.02", Version{}, true},
+		{"v1.2.3.4", Version{}, true},
+		{"draft", Version{}, true},
+		{"", Version{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.label, func(t *testing.T) {
+			v, err := Parse(tt.label)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, v)
+		})
+	}
+}
+
+func TestVersion_Bump(t *testing.T) {
+	v := Version{1, 2, 3}
+
+	for part, want := range map[string]string{Major: "v2.0.0", Minor: "v1.3.0", Patch: "v1.2.4"} {
+		next, err := v.Bump(part)
+		require.NoError(t, err)
+		assert.Equal(t, want, next.String())
+	}
+
+	_, err := v.Bump("huge")
+	assert.Error(t, err)
+}
+
+func TestVersion_Labels(t *testing.T) {
+	assert.Equal(t, []string{"v1.0.0", "v1.0", "v1"}, Version{1, 0, 0}.Labels())
+	assert.Equal(t, []string{"v1.2.0", "v1.2"}, Version{1, 2, 0}.Labels())
+	assert.Equal(t, []string{"v1.2.3"}, Version{1, 2, 3}.Labels())
+}
+
+func TestCompareLabels(t *testing.T) {
+	assert.Equal(t, -1, CompareLabels("v2", "v10"))
+	assert.Equal(t, 1, CompareLabels("v1.10.0", "v1.9.9"))
+	assert.Equal(t, -1, CompareLabels("v1.0", "v1.0.0"))
+	assert.Equal(t, -1, CompareLabels("draft", "v0.0.1"))
+	assert.Equal(t, 1, CompareLabels("v0.0.1", "draft"))
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []string
+		version  string
+		bump     string
+		want     string
+		wantErr  bool
+	}{
+		{"first bump", nil, "", Minor, "v0.1.0", false},
+		{"bump latest", []string{"v1.9.0", "v1.10.0", "v1.2.0"}, "", Patch, "v1.10.1", false},
+		{"explicit version", []string{"v1.0"}, "1.1", "", "v1.1", false},
+		{"first explicit version", nil, "v1.0.0", "", "v1.0.0", false},
+		{"not higher", []string{"v1.2.0"}, "v1.2", "", "", true},
+		{"lower", []string{"v2.0.0"}, "v1.9.9", "", "", true},
+		{"invalid version", nil, "first", "", "", true},
+		{"invalid bump", nil, "", "huge", "", true},
+		{"both set", nil, "v1.0.0", Major, "", true},
+		{"neither set", nil, "", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Next(tt.existing, tt.version, tt.bump)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestStoredLabels(t *testing.T) {
+	assert.Equal(t, []string{"v1.0.0", "v1.0", "v1"}, StoredLabels("1"))
+	assert.Equal(t, []string{"v1.2.3"}, StoredLabels("v1.2.3"))
+	assert.Equal(t, []string{"vnext"}, StoredLabels("next"))
+	assert.Equal(t, []string{"vnext"}, StoredLabels("vnext"))
+}
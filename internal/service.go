@@ -3,9 +3,18 @@ package internal
 import (
 	"context"
 	"crypto/tls"
+	"github.com/1rp-pw/orchestrator/internal/audit"
+	"github.com/1rp-pw/orchestrator/internal/bundle"
+	"github.com/1rp-pw/orchestrator/internal/channel"
+	"github.com/1rp-pw/orchestrator/internal/decision"
 	"github.com/1rp-pw/orchestrator/internal/engine"
 	"github.com/1rp-pw/orchestrator/internal/flow"
+	"github.com/1rp-pw/orchestrator/internal/folder"
+	"github.com/1rp-pw/orchestrator/internal/metadata"
 	"github.com/1rp-pw/orchestrator/internal/policy"
+	"github.com/1rp-pw/orchestrator/internal/replay"
+	"github.com/1rp-pw/orchestrator/internal/review"
+	"github.com/1rp-pw/orchestrator/internal/shadow"
 	"github.com/bugfixes/go-bugfixes/logs"
 	"github.com/bugfixes/go-bugfixes/middleware"
 	ConfigBuilder "github.com/keloran/go-config"
@@ -26,45 +35,128 @@ func New(cfg *ConfigBuilder.Config) *Service {
 
 func (s *Service) Start() error {
 	errChan := make(chan error)
+	engine.NewSystem(s.Config).StartHealthChecks()
+	policy.NewSystem(s.Config).StartPurge()
 	go s.startHTTP(errChan)
 
 	return <-errChan
 }
 
+// reviews is the review drafts pass before they are published, none when require_reviews is off
+func (s *Service) reviews() policy.Reviews {
+	if required, _ := s.Config.ProjectProperties["require_reviews"].(bool); !required {
+		return nil
+	}
+	return review.NewSystem(s.Config)
+}
+
 func (s *Service) startHTTP(errChan chan error) {
 	mux := http.NewServeMux()
 
+	// live decisions are shadowed against drafts, one recorder so they share the concurrency limit
+	recorder := shadow.NewRecorderFromConfig(s.Config)
+
 	// run the structs on the engine
-	mux.HandleFunc("POST /run", engine.NewSystem(s.Config).Run)
-	mux.HandleFunc("POST /run/{policyId}", engine.NewSystem(s.Config).RunPolicy)
+	mux.HandleFunc("POST /run", engine.NewSystem(s.Config).SetRecorder(recorder).Run)
+	mux.HandleFunc("POST /run/{policyId}", engine.NewSystem(s.Config).SetRecorder(recorder).RunPolicy)
+	mux.HandleFunc("POST /run/{policyId}/batch", engine.NewSystem(s.Config).SetRecorder(recorder).RunPolicyBatch)
+	mux.HandleFunc("POST /run/{policyId}/explain", engine.NewSystem(s.Config).SetRecorder(recorder).ExplainPolicy)
+	mux.HandleFunc("GET /engine/status", engine.NewSystem(s.Config).Status)
 
 	// structs storage
 	mux.HandleFunc("POST /policy", policy.NewSystem(s.Config).CreatePolicy)
 	mux.HandleFunc("GET /policy/{policyId}/draft", policy.NewSystem(s.Config).CreateDraftFromVersion)
-	mux.HandleFunc("PUT /policy/{policyId}", policy.NewSystem(s.Config).UpdatePolicy)
+	mux.HandleFunc("GET /policy/{policyId}/draft/changes", policy.NewSystem(s.Config).GetPolicyDraftChanges)
+	mux.HandleFunc("PUT /policy/{policyId}", policy.NewSystem(s.Config).SetTestRunner(engine.NewSystem(s.Config)).SetReviews(s.reviews()).UpdatePolicy)
 	mux.HandleFunc("DELETE /policy/{policyId}", policy.NewSystem(s.Config).DeletePolicy)
+	mux.HandleFunc("POST /policy/{policyId}/restore", policy.NewSystem(s.Config).RestorePolicy)
+	mux.HandleFunc("POST /policy/{policyId}/rollback", policy.NewSystem(s.Config).RollbackPolicy)
+	mux.HandleFunc("POST /policy/{policyId}/tests/run", engine.NewSystem(s.Config).RunPolicyTests)
 	mux.HandleFunc("GET /policy/{policyId}", policy.NewSystem(s.Config).GetPolicy)
 	mux.HandleFunc("GET /policy/{policyId}/versions", policy.NewSystem(s.Config).ListPolicyVersions)
+	mux.HandleFunc("GET /policy/{policyId}/diff", policy.NewSystem(s.Config).DiffPolicy)
+	mux.HandleFunc("GET /policy/{policyId}/metadata", metadata.NewSystem(s.Config).GetPolicyMetadata)
+	mux.HandleFunc("PATCH /policy/{policyId}/metadata", metadata.NewSystem(s.Config).UpdatePolicyMetadata)
+	mux.HandleFunc("GET /policy/{policyId}/metadata/history", metadata.NewSystem(s.Config).ListPolicyMetadataHistory)
+	mux.HandleFunc("POST /policy/{policyId}/promote", channel.NewSystem(s.Config).PromotePolicy)
+	mux.HandleFunc("GET /policy/{policyId}/channels", channel.NewSystem(s.Config).ListPolicyChannels)
+	mux.HandleFunc("GET /policy/{policyId}/channels/history", channel.NewSystem(s.Config).ListPolicyChannelHistory)
+	mux.HandleFunc("GET /policy/{policyId}/review", review.NewSystem(s.Config).GetPolicyReview)
+	mux.HandleFunc("POST /policy/{policyId}/review/submit", review.NewSystem(s.Config).SubmitPolicy)
+	mux.HandleFunc("POST /policy/{policyId}/review/approve", review.NewSystem(s.Config).ApprovePolicy)
+	mux.HandleFunc("POST /policy/{policyId}/review/reject", review.NewSystem(s.Config).RejectPolicy)
+	mux.HandleFunc("POST /policy/{policyId}/review/comments", review.NewSystem(s.Config).CommentPolicy)
+	mux.HandleFunc("GET /policy/{policyId}/approvers", review.NewSystem(s.Config).GetPolicyApprovers)
+	mux.HandleFunc("PUT /policy/{policyId}/approvers", review.NewSystem(s.Config).UpdatePolicyApprovers)
 	mux.HandleFunc("GET /policy/{policyId}/{versionId}", policy.NewSystem(s.Config).GetPolicyVersion)
 	mux.HandleFunc("GET /policies", policy.NewSystem(s.Config).GetAllPolicies)
+	mux.HandleFunc("POST /policy/{policyId}/replay", replay.NewSystem(s.Config).ReplayPolicy)
+	mux.HandleFunc("GET /policy/{policyId}/shadow", shadow.NewSystem(s.Config).GetPolicyShadow)
+	mux.HandleFunc("PUT /policy/{policyId}/shadow", shadow.NewSystem(s.Config).UpdatePolicyShadow)
+	mux.HandleFunc("GET /policy/{policyId}/shadow/disagreements", shadow.NewSystem(s.Config).ListPolicyDisagreements)
 
 	// flow system
 	mux.HandleFunc("GET /flows", flow.NewSystem(s.Config).GetAllFlows)
 	mux.HandleFunc("POST /flow", flow.NewSystem(s.Config).CreateFlow)
 	mux.HandleFunc("GET /flow/{flowId}/versions", flow.NewSystem(s.Config).ListFlowVersions)
 	mux.HandleFunc("GET /flow/{flowId}", flow.NewSystem(s.Config).GetFlow)
-	mux.HandleFunc("PUT /flow/{flowId}", flow.NewSystem(s.Config).UpdateFlow)
+	mux.HandleFunc("PUT /flow/{flowId}", flow.NewSystem(s.Config).SetReviews(s.reviews()).UpdateFlow)
 	mux.HandleFunc("POST /flow/test", flow.NewSystem(s.Config).TestFlow)
-	mux.HandleFunc("POST /flow/{flowId}", flow.NewSystem(s.Config).RunFlow)
+	mux.HandleFunc("POST /flow/{flowId}", flow.NewSystem(s.Config).SetRecorder(recorder).RunFlow)
+	mux.HandleFunc("POST /flow/{flowId}/explain", flow.NewSystem(s.Config).SetRecorder(recorder).ExplainFlow)
 	mux.HandleFunc("GET /flow/{flowId}/draft", flow.NewSystem(s.Config).CreateDraftFromVersion)
+	mux.HandleFunc("POST /flow/{flowId}/rollback", flow.NewSystem(s.Config).RollbackFlow)
+	mux.HandleFunc("GET /flow/{flowId}/draft/changes", flow.NewSystem(s.Config).GetFlowDraftChanges)
+	mux.HandleFunc("POST /flow/{flowId}/replay", replay.NewSystem(s.Config).ReplayFlow)
+	mux.HandleFunc("GET /flow/{flowId}/shadow", shadow.NewSystem(s.Config).GetFlowShadow)
+	mux.HandleFunc("PUT /flow/{flowId}/shadow", shadow.NewSystem(s.Config).UpdateFlowShadow)
+	mux.HandleFunc("GET /flow/{flowId}/shadow/disagreements", shadow.NewSystem(s.Config).ListFlowDisagreements)
+	mux.HandleFunc("GET /flow/{flowId}/metadata", metadata.NewSystem(s.Config).GetFlowMetadata)
+	mux.HandleFunc("PATCH /flow/{flowId}/metadata", metadata.NewSystem(s.Config).UpdateFlowMetadata)
+	mux.HandleFunc("GET /flow/{flowId}/metadata/history", metadata.NewSystem(s.Config).ListFlowMetadataHistory)
+	mux.HandleFunc("POST /flow/{flowId}/promote", channel.NewSystem(s.Config).PromoteFlow)
+	mux.HandleFunc("GET /flow/{flowId}/channels", channel.NewSystem(s.Config).ListFlowChannels)
+	mux.HandleFunc("GET /flow/{flowId}/channels/history", channel.NewSystem(s.Config).ListFlowChannelHistory)
+	mux.HandleFunc("GET /flow/{flowId}/review", review.NewSystem(s.Config).GetFlowReview)
+	mux.HandleFunc("POST /flow/{flowId}/review/submit", review.NewSystem(s.Config).SubmitFlow)
+	mux.HandleFunc("POST /flow/{flowId}/review/approve", review.NewSystem(s.Config).ApproveFlow)
+	mux.HandleFunc("POST /flow/{flowId}/review/reject", review.NewSystem(s.Config).RejectFlow)
+	mux.HandleFunc("POST /flow/{flowId}/review/comments", review.NewSystem(s.Config).CommentFlow)
+	mux.HandleFunc("GET /flow/{flowId}/approvers", review.NewSystem(s.Config).GetFlowApprovers)
+	mux.HandleFunc("PUT /flow/{flowId}/approvers", review.NewSystem(s.Config).UpdateFlowApprovers)
+
+	// folders of policies and flows
+	mux.HandleFunc("GET /folders", folder.NewSystem(s.Config).ListFolders)
+	mux.HandleFunc("GET /folders/{folder...}", folder.NewSystem(s.Config).GetFolder)
+	mux.HandleFunc("POST /folders/move", folder.NewSystem(s.Config).MoveFolder)
+	mux.HandleFunc("GET /approvers/folders/{folder...}", review.NewSystem(s.Config).GetFolderApprovers)
+	mux.HandleFunc("PUT /approvers/folders/{folder...}", review.NewSystem(s.Config).UpdateFolderApprovers)
+
+	// bundles of policies and flows to move between environments
+	mux.HandleFunc("GET /export", bundle.NewSystem(s.Config).ExportBundle)
+	mux.HandleFunc("POST /import", bundle.NewSystem(s.Config).SetReviews(s.reviews()).ImportBundle)
+
+	// decision log
+	mux.HandleFunc("GET /decisions", decision.NewSystem(s.Config).ListDecisions)
+	mux.HandleFunc("GET /decisions/{decisionId}", decision.NewSystem(s.Config).GetDecision)
+
+	// audit log of every change to policies and flows
+	mux.HandleFunc("GET /audit", audit.NewSystem(s.Config).ListAudit)
+	mux.HandleFunc("GET /audit/export", audit.NewSystem(s.Config).ExportAudit)
+	mux.HandleFunc("GET /audit/verify", audit.NewSystem(s.Config).VerifyAudit)
 
 	mw := middleware.NewMiddleware(context.Background())
+	mw.AddMiddleware(audit.Actors)
 	mw.AddMiddleware(middleware.SetupLogger(middleware.Error).Logger)
 	mw.AddMiddleware(middleware.RequestID)
 	mw.AddMiddleware(middleware.Recoverer)
 	mw.AddMiddleware(mw.CORS)
 	mw.AddMiddleware(middleware.LowerCaseHeaders)
-	mw.AddAllowedMethods(http.MethodGet, http.MethodPost, http.MethodOptions, http.MethodDelete, http.MethodPut)
+	mw.AddAllowedMethods(http.MethodGet, http.MethodPost, http.MethodOptions, http.MethodDelete, http.MethodPut, http.MethodPatch)
+	mw.AddAllowedHeaders("If-Match", "X-User", "X-User-Roles", middleware.RequestIDHeader)
+	if origins, ok := s.Config.ProjectProperties["cors_allowed_origins"].([]string); ok {
+		mw.AddAllowedOrigins(origins...)
+	}
 
 	port := s.Config.Local.HTTPPort
 	if s.Config.ProjectProperties["railway_port"].(string) != "" && s.Config.ProjectProperties["on_railway"].(bool) {
@@ -78,7 +170,7 @@ func (s *Service) startHTTP(errChan chan error) {
 	logs.Logf("Starting server on port %d", port)
 	server := &http.Server{
 		Addr:              ":" + strconv.Itoa(port),
-		Handler:           mux,
+		Handler:           mw.Handler(mux),
 		ReadTimeout:       5 * time.Second,
 		WriteTimeout:      10 * time.Second,
 		IdleTimeout:       120 * time.Second,
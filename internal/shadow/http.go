@@ -0,0 +1,97 @@
+package shadow
+
+import (
+	"encoding/json"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"net/http"
+	"strconv"
+)
+
+const maxDisagreements = 1000
+
+func (s *System) GetPolicyShadow(w http.ResponseWriter, r *http.Request) {
+	s.getShadow(w, r, decision.KindPolicy, r.PathValue("policyId"))
+}
+
+func (s *System) UpdatePolicyShadow(w http.ResponseWriter, r *http.Request) {
+	s.updateShadow(w, r, decision.KindPolicy, r.PathValue("policyId"))
+}
+
+func (s *System) ListPolicyDisagreements(w http.ResponseWriter, r *http.Request) {
+	s.listDisagreements(w, r, decision.KindPolicy, r.PathValue("policyId"))
+}
+
+func (s *System) GetFlowShadow(w http.ResponseWriter, r *http.Request) {
+	s.getShadow(w, r, decision.KindFlow, r.PathValue("flowId"))
+}
+
+func (s *System) UpdateFlowShadow(w http.ResponseWriter, r *http.Request) {
+	s.updateShadow(w, r, decision.KindFlow, r.PathValue("flowId"))
+}
+
+func (s *System) ListFlowDisagreements(w http.ResponseWriter, r *http.Request) {
+	s.listDisagreements(w, r, decision.KindFlow, r.PathValue("flowId"))
+}
+
+func (s *System) getShadow(w http.ResponseWriter, r *http.Request, kind, baseId string) {
+	s.SetContext(r.Context())
+
+	sum, err := s.Summary(kind, baseId)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	writeJSON(w, sum)
+}
+
+func (s *System) updateShadow(w http.ResponseWriter, r *http.Request, kind, baseId string) {
+	s.SetContext(r.Context())
+
+	st := structs.ShadowSettings{SampleRate: 1}
+	if err := json.NewDecoder(r.Body).Decode(&st); err != nil {
+		errors.WriteHTTPError(w, errors.NewValidationError("body", "invalid JSON format"))
+		return
+	}
+	st.Kind = kind
+	st.BaseID = baseId
+
+	st, err := s.SaveSettings(st)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	writeJSON(w, st)
+}
+
+func (s *System) listDisagreements(w http.ResponseWriter, r *http.Request, kind, baseId string) {
+	s.SetContext(r.Context())
+
+	limit := recentDisagreements
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+			errors.WriteHTTPError(w, errors.NewValidationError("limit", "limit must be a positive number"))
+			return
+		}
+		limit = min(limit, maxDisagreements)
+	}
+
+	dd, err := s.Disagreements(kind, baseId, r.URL.Query().Get("draftId"), limit)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	writeJSON(w, dd)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		errors.WriteHTTPError(w, errors.NewInternalError("failed to encode response"))
+	}
+}
@@ -0,0 +1,178 @@
+package shadow
+
+import (
+	"context"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/bugfixes/go-bugfixes/logs"
+	ConfigBuilder "github.com/keloran/go-config"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Shadower is what the recorder needs to shadow a decision, System keeps it all in the database
+type Shadower interface {
+	Settings(ctx context.Context, kind, baseId string) (structs.ShadowSettings, error)
+	Compare(ctx context.Context, d structs.Decision) (structs.ShadowComparison, bool, error)
+	StoreComparison(ctx context.Context, c structs.ShadowComparison) error
+}
+
+// Recorder passes decisions on to Next and, for policies and flows in shadow mode, evaluates
+// the live ones against the draft in the background. Shadow evaluations never hold up or change
+// the live response, when Concurrency evaluations are already running the decision isn't
+// shadowed
+type Recorder struct {
+	Next        decision.Recorder
+	Shadower    Shadower
+	Timeout     time.Duration
+	SettingsTTL time.Duration
+
+	sem      chan struct{}
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	settings map[string]cachedSettings
+	now      func() time.Time
+	sample   func() float64
+}
+
+type cachedSettings struct {
+	settings structs.ShadowSettings
+	expires  time.Time
+}
+
+func NewRecorder(next decision.Recorder, shadower Shadower, concurrency int) *Recorder {
+	return &Recorder{
+		Next:        next,
+		Shadower:    shadower,
+		Timeout:     10 * time.Second,
+		SettingsTTL: 30 * time.Second,
+		sem:         make(chan struct{}, max(concurrency, 1)),
+		settings:    make(map[string]cachedSettings),
+		now:         time.Now,
+		sample:      rand.Float64,
+	}
+}
+
+// NewRecorderFromConfig shadows into the database on top of the configured decision recorder
+func NewRecorderFromConfig(cfg *ConfigBuilder.Config) *Recorder {
+	r := NewRecorder(decision.NewRecorder(cfg), NewSystem(cfg), intProperty(cfg, "shadow_concurrency", 4))
+	r.Timeout = durationProperty(cfg, "shadow_timeout", r.Timeout)
+	r.SettingsTTL = durationProperty(cfg, "shadow_settings_ttl", r.SettingsTTL)
+	return r
+}
+
+func (r *Recorder) Record(ctx context.Context, dd ...structs.Decision) error {
+	var err error
+	if r.Next != nil {
+		err = r.Next.Record(ctx, dd...)
+	}
+	for _, d := range dd {
+		r.shadow(ctx, d)
+	}
+	return err
+}
+
+// Wait blocks until every shadow evaluation that has started is done
+func (r *Recorder) Wait() {
+	r.wg.Wait()
+}
+
+func (r *Recorder) shadow(ctx context.Context, d structs.Decision) {
+	if !shadowable(d) {
+		return
+	}
+
+	st, err := r.settingsFor(ctx, d.Kind, baseID(d))
+	if err != nil {
+		_ = logs.Errorf("failed to load shadow settings: %v", err)
+		return
+	}
+	if !st.Enabled || r.sample() >= st.SampleRate {
+		return
+	}
+
+	select {
+	case r.sem <- struct{}{}:
+	default:
+		return
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer func() {
+			<-r.sem
+			r.wg.Done()
+		}()
+
+		sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), r.Timeout)
+		defer cancel()
+
+		c, ok, err := r.Shadower.Compare(sctx, d)
+		if err != nil {
+			_ = logs.Errorf("failed to shadow decision: %v", err)
+			return
+		}
+		if !ok {
+			return
+		}
+		if err := r.Shadower.StoreComparison(sctx, c); err != nil {
+			_ = logs.Errorf("failed to store shadow comparison: %v", err)
+		}
+	}()
+}
+
+func (r *Recorder) settingsFor(ctx context.Context, kind, baseId string) (structs.ShadowSettings, error) {
+	key := kind + "/" + baseId
+
+	r.mu.Lock()
+	c, ok := r.settings[key]
+	r.mu.Unlock()
+	if ok && r.now().Before(c.expires) {
+		return c.settings, nil
+	}
+
+	st, err := r.Shadower.Settings(ctx, kind, baseId)
+	if err != nil {
+		return st, err
+	}
+
+	r.mu.Lock()
+	r.settings[key] = cachedSettings{settings: st, expires: r.now().Add(r.SettingsTTL)}
+	r.mu.Unlock()
+
+	return st, nil
+}
+
+// shadowable reports whether a decision was made by a published version, decisions made by a
+// draft or that failed have nothing to compare the draft with
+func shadowable(d structs.Decision) bool {
+	if d.Error != nil || baseID(d) == "" {
+		return false
+	}
+	if d.Kind == decision.KindFlow {
+		return d.FlowVersion != ""
+	}
+	return d.PolicyVersion != ""
+}
+
+func baseID(d structs.Decision) string {
+	if d.Kind == decision.KindFlow {
+		return d.BaseFlowID
+	}
+	return d.BasePolicyID
+}
+
+func durationProperty(cfg *ConfigBuilder.Config, key string, fallback time.Duration) time.Duration {
+	if d, ok := cfg.ProjectProperties[key].(time.Duration); ok && d > 0 {
+		return d
+	}
+	return fallback
+}
+
+func intProperty(cfg *ConfigBuilder.Config, key string, fallback int) int {
+	if i, ok := cfg.ProjectProperties[key].(int); ok && i > 0 {
+		return i
+	}
+	return fallback
+}
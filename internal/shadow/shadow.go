@@ -0,0 +1,375 @@
+package shadow
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	stderrors "errors"
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/errors"
+	"github.com/1rp-pw/orchestrator/internal/replay"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/jackc/pgx/v5"
+	ConfigBuilder "github.com/keloran/go-config"
+)
+
+const recentDisagreements = 20
+
+type System struct {
+	Config  *ConfigBuilder.Config
+	Context context.Context
+}
+
+func NewSystem(cfg *ConfigBuilder.Config) *System {
+	return &System{
+		Config:  cfg,
+		Context: context.Background(),
+	}
+}
+
+func (s *System) SetContext(ctx context.Context) *System {
+	s.Context = ctx
+	return s
+}
+
+// Settings loads whether shadow mode is on, a policy or flow that was never configured is off
+func (s *System) Settings(ctx context.Context, kind, baseId string) (structs.ShadowSettings, error) {
+	st := structs.ShadowSettings{
+		Kind:       kind,
+		BaseID:     baseId,
+		SampleRate: 1,
+	}
+
+	client, err := s.Config.Database.GetPGXPoolClient(ctx)
+	if err != nil {
+		return st, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	var updatedAt sql.NullTime
+	err = client.QueryRow(ctx, `
+		SELECT
+		    enabled,
+		    sample_rate,
+		    updated_at
+		FROM shadow_settings
+		WHERE kind = $1 AND base_id = $2`, kind, baseId).Scan(&st.Enabled, &st.SampleRate, &updatedAt)
+	if stderrors.Is(err, pgx.ErrNoRows) {
+		return st, nil
+	}
+	if err != nil {
+		return st, logs.Errorf("failed to load shadow settings: %v", err)
+	}
+	st.UpdatedAt = updatedAt.Time
+
+	return st, nil
+}
+
+// SaveSettings turns shadow mode on or off
+func (s *System) SaveSettings(st structs.ShadowSettings) (structs.ShadowSettings, error) {
+	if st.SampleRate <= 0 || st.SampleRate > 1 {
+		return st, errors.NewValidationError("sampleRate", "sampleRate must be greater than 0 and at most 1")
+	}
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return st, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.QueryRow(s.Context, `
+		INSERT INTO shadow_settings (kind, base_id, enabled, sample_rate)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (kind, base_id) DO UPDATE
+		SET
+		    enabled = EXCLUDED.enabled,
+		    sample_rate = EXCLUDED.sample_rate
+		RETURNING updated_at`, st.Kind, st.BaseID, st.Enabled, st.SampleRate).Scan(&st.UpdatedAt); err != nil {
+		return st, logs.Errorf("failed to save shadow settings: %v", err)
+	}
+
+	return st, nil
+}
+
+// Compare evaluates the input of a live decision against the current draft, false when there
+// is no draft to compare with
+func (s *System) Compare(ctx context.Context, d structs.Decision) (structs.ShadowComparison, bool, error) {
+	rs := replay.NewSystem(s.Config).SetContext(ctx)
+	draft := structs.ReplayRequest{Version: "draft"}
+
+	var report structs.ReplayReport
+	switch d.Kind {
+	case decision.KindPolicy:
+		p, err := rs.PolicyTarget(d.BasePolicyID, draft)
+		if stderrors.Is(err, errors.ErrPolicyNotFound) {
+			return structs.ShadowComparison{}, false, nil
+		}
+		if err != nil {
+			return structs.ShadowComparison{}, false, err
+		}
+		report = rs.AgainstPolicy(p, []structs.Decision{d}, 1)
+	case decision.KindFlow:
+		f, err := rs.FlowTarget(d.BaseFlowID, draft)
+		if stderrors.Is(err, errors.ErrFlowNotFound) {
+			return structs.ShadowComparison{}, false, nil
+		}
+		if err != nil {
+			return structs.ShadowComparison{}, false, err
+		}
+		report = rs.AgainstFlow(f, []structs.Decision{d}, 1)
+	default:
+		return structs.ShadowComparison{}, false, nil
+	}
+
+	return comparison(d, report), true, nil
+}
+
+func comparison(d structs.Decision, report structs.ReplayReport) structs.ShadowComparison {
+	c := structs.ShadowComparison{
+		Kind:      d.Kind,
+		BaseID:    report.BaseID,
+		DraftID:   report.TargetID,
+		RequestID: d.RequestID,
+		Input:     d.Input,
+	}
+	if d.Kind == decision.KindFlow {
+		c.LiveID, c.LiveVersion = d.FlowID, d.FlowVersion
+	} else {
+		c.LiveID, c.LiveVersion = d.PolicyID, d.PolicyVersion
+	}
+	if len(report.Samples) > 0 {
+		c.Live = report.Samples[0].Before
+		c.Shadow = report.Samples[0].After
+		c.Disagreed = report.Samples[0].Changed
+	}
+
+	return c
+}
+
+// StoreComparison adds the comparison to its draft's totals and keeps it when the draft disagreed
+func (s *System) StoreComparison(ctx context.Context, c structs.ShadowComparison) error {
+	client, err := s.Config.Database.GetPGXPoolClient(ctx)
+	if err != nil {
+		return logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Exec(ctx, `SELECT record_shadow_evaluation($1, $2, $3, $4, $5)`, c.Kind, c.BaseID, c.DraftID, c.Disagreed, c.Shadow.Error != nil); err != nil {
+		return logs.Errorf("failed to record shadow evaluation: %v", err)
+	}
+	if !c.Disagreed {
+		return nil
+	}
+
+	var args []interface{}
+	for _, v := range []interface{}{c.Input, c.Live.Result, c.Live.Trace, c.Shadow.Result, c.Shadow.Trace, c.Shadow.Error} {
+		b, err := jsonb(v)
+		if err != nil {
+			return logs.Errorf("failed to encode shadow disagreement: %v", err)
+		}
+		args = append(args, b)
+	}
+	if _, err := client.Exec(ctx, `
+		INSERT INTO shadow_disagreements (
+		    kind,
+		    base_id,
+		    draft_id,
+		    live_id,
+		    live_version,
+		    request_id,
+		    input,
+		    live_result,
+		    live_trace,
+		    shadow_result,
+		    shadow_trace,
+		    shadow_error
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		append([]interface{}{c.Kind, c.BaseID, c.DraftID, c.LiveID, nullString(c.LiveVersion), nullString(c.RequestID)}, args...)...); err != nil {
+		return logs.Errorf("failed to store shadow disagreement: %v", err)
+	}
+
+	return nil
+}
+
+// Summary shows the settings, the totals of every draft that has been shadowed and the most
+// recent disagreements of the current draft
+func (s *System) Summary(kind, baseId string) (structs.ShadowSummary, error) {
+	sum := structs.ShadowSummary{
+		Drafts: make([]structs.ShadowStats, 0),
+		Recent: make([]structs.ShadowDisagreement, 0),
+	}
+
+	st, err := s.Settings(s.Context, kind, baseId)
+	if err != nil {
+		return sum, err
+	}
+	sum.Settings = st
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return sum, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	summaryView := "policy_summary"
+	baseColumn := "base_policy_id"
+	if kind == decision.KindFlow {
+		summaryView = "flow_summary"
+		baseColumn = "base_flow_id"
+	}
+	var draftId sql.NullString
+	err = client.QueryRow(s.Context, `SELECT draft_id::text FROM `+summaryView+` WHERE `+baseColumn+`::text = $1`, baseId).Scan(&draftId)
+	if err != nil && !stderrors.Is(err, pgx.ErrNoRows) {
+		return sum, logs.Errorf("failed to load draft: %v", err)
+	}
+	sum.CurrentDraftID = draftId.String
+
+	rows, err := client.Query(s.Context, `
+		SELECT
+		    draft_id,
+		    evaluated,
+		    disagreed,
+		    errors,
+		    first_at,
+		    last_at
+		FROM shadow_stats
+		WHERE kind = $1 AND base_id = $2
+		ORDER BY last_at DESC`, kind, baseId)
+	if err != nil {
+		return sum, logs.Errorf("failed to load shadow stats: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		ss := structs.ShadowStats{}
+		if err := rows.Scan(&ss.DraftID, &ss.Evaluated, &ss.Disagreed, &ss.Errors, &ss.FirstAt, &ss.LastAt); err != nil {
+			return sum, logs.Errorf("failed to load shadow stats: %v", err)
+		}
+		if ss.Evaluated > 0 {
+			ss.AgreementRate = 1 - float64(ss.Disagreed)/float64(ss.Evaluated)
+		}
+		sum.Drafts = append(sum.Drafts, ss)
+	}
+
+	if sum.CurrentDraftID != "" {
+		if sum.Recent, err = s.Disagreements(kind, baseId, sum.CurrentDraftID, recentDisagreements); err != nil {
+			return sum, err
+		}
+	}
+
+	return sum, nil
+}
+
+// Disagreements lists the newest disagreements of a draft
+func (s *System) Disagreements(kind, baseId, draftId string, limit int) ([]structs.ShadowDisagreement, error) {
+	dd := make([]structs.ShadowDisagreement, 0)
+
+	client, err := s.Config.Database.GetPGXPoolClient(s.Context)
+	if err != nil {
+		return dd, logs.Errorf("failed to connect to database: %v", err)
+	}
+	defer client.Close()
+
+	rows, err := client.Query(s.Context, `
+		SELECT
+		    disagreement_id,
+		    draft_id,
+		    live_id,
+		    live_version,
+		    request_id,
+		    input,
+		    live_result,
+		    live_trace,
+		    shadow_result,
+		    shadow_trace,
+		    shadow_error,
+		    recorded_at
+		FROM shadow_disagreements
+		WHERE kind = $1 AND base_id = $2 AND ($3 = '' OR draft_id = $3)
+		ORDER BY recorded_at DESC
+		LIMIT $4`, kind, baseId, draftId, limit)
+	if err != nil {
+		return dd, logs.Errorf("failed to load shadow disagreements: %v", err)
+	}
+	defer rows.Close()
+
+	type dataStruct struct {
+		ID           sql.NullString
+		DraftID      sql.NullString
+		LiveID       sql.NullString
+		LiveVersion  sql.NullString
+		RequestID    sql.NullString
+		Input        []byte
+		LiveResult   []byte
+		LiveTrace    []byte
+		ShadowResult []byte
+		ShadowTrace  []byte
+		ShadowError  []byte
+		RecordedAt   sql.NullTime
+	}
+
+	for rows.Next() {
+		d := dataStruct{}
+		if err := rows.Scan(
+			&d.ID,
+			&d.DraftID,
+			&d.LiveID,
+			&d.LiveVersion,
+			&d.RequestID,
+			&d.Input,
+			&d.LiveResult,
+			&d.LiveTrace,
+			&d.ShadowResult,
+			&d.ShadowTrace,
+			&d.ShadowError,
+			&d.RecordedAt,
+		); err != nil {
+			return dd, logs.Errorf("failed to load shadow disagreements: %v", err)
+		}
+
+		sd := structs.ShadowDisagreement{
+			ID:          d.ID.String,
+			DraftID:     d.DraftID.String,
+			LiveID:      d.LiveID.String,
+			LiveVersion: d.LiveVersion.String,
+			RequestID:   d.RequestID.String,
+			RecordedAt:  d.RecordedAt.Time,
+		}
+		sd.Live.Version = sd.LiveVersion
+		sd.Shadow.Version = "draft"
+		for _, f := range []struct {
+			raw []byte
+			v   *interface{}
+		}{
+			{d.Input, &sd.Input},
+			{d.LiveResult, &sd.Live.Result},
+			{d.LiveTrace, &sd.Live.Trace},
+			{d.ShadowResult, &sd.Shadow.Result},
+			{d.ShadowTrace, &sd.Shadow.Trace},
+			{d.ShadowError, &sd.Shadow.Error},
+		} {
+			if len(f.raw) == 0 {
+				continue
+			}
+			if err := json.Unmarshal(f.raw, f.v); err != nil {
+				return dd, logs.Errorf("failed to decode shadow disagreement: %v", err)
+			}
+		}
+		dd = append(dd, sd)
+	}
+
+	return dd, nil
+}
+
+// jsonb encodes v for a JSONB column, nil stays NULL
+func jsonb(v interface{}) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
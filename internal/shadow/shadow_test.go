@@ -0,0 +1,145 @@
+package shadow
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/1rp-pw/orchestrator/internal/decision"
+	"github.com/1rp-pw/orchestrator/internal/structs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeShadower struct {
+	mu           sync.Mutex
+	enabled      map[string]bool
+	settingsHits int
+	compared     []structs.Decision
+	stored       []structs.ShadowComparison
+}
+
+func (f *fakeShadower) Settings(_ context.Context, kind, baseId string) (structs.ShadowSettings, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.settingsHits++
+	return structs.ShadowSettings{Kind: kind, BaseID: baseId, Enabled: f.enabled[baseId], SampleRate: 1}, nil
+}
+
+func (f *fakeShadower) Compare(_ context.Context, d structs.Decision) (structs.ShadowComparison, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.compared = append(f.compared, d)
+	return structs.ShadowComparison{Kind: d.Kind, BaseID: baseID(d), DraftID: "draft-1", LiveID: d.PolicyID, Disagreed: true}, true, nil
+}
+
+func (f *fakeShadower) StoreComparison(_ context.Context, c structs.ShadowComparison) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stored = append(f.stored, c)
+	return nil
+}
+
+func TestRecorder_Record(t *testing.T) {
+	next := decision.NewMemoryRecorder()
+	fs := &fakeShadower{enabled: map[string]bool{"base-on": true}}
+	r := NewRecorder(next, fs, 2)
+
+	live := func(id, base string) structs.Decision {
+		return structs.Decision{
+			ID:            id,
+			Kind:          decision.KindPolicy,
+			PolicyID:      base + "-v1",
+			BasePolicyID:  base,
+			PolicyVersion: "v1.0",
+			Result:        true,
+		}
+	}
+	draft := live("d-draft", "base-on")
+	draft.PolicyVersion = ""
+	failed := live("d-failed", "base-on")
+	failed.Error = map[string]interface{}{"code": "ENGINE_UNAVAILABLE"}
+
+	require.NoError(t, r.Record(context.Background(),
+		live("d-1", "base-on"),
+		live("d-2", "base-off"),
+		draft,
+		failed,
+	))
+	require.NoError(t, r.Record(context.Background(), live("d-3", "base-on")))
+	r.Wait()
+
+	assert.Len(t, next.Decisions(), 5, "every decision still reaches the decision log")
+
+	require.Len(t, fs.compared, 2, "only live decisions of policies in shadow mode are shadowed")
+	ids := []string{fs.compared[0].ID, fs.compared[1].ID}
+	assert.ElementsMatch(t, []string{"d-1", "d-3"}, ids)
+	require.Len(t, fs.stored, 2)
+	assert.Equal(t, "draft-1", fs.stored[0].DraftID)
+
+	assert.Equal(t, 2, fs.settingsHits, "settings are cached per policy")
+}
+
+func TestRecorder_SettingsExpire(t *testing.T) {
+	fs := &fakeShadower{}
+	r := NewRecorder(nil, fs, 1)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	d := structs.Decision{Kind: decision.KindFlow, FlowID: "flow-v1", BaseFlowID: "base-flow", FlowVersion: "v1.0"}
+	require.NoError(t, r.Record(context.Background(), d))
+	require.NoError(t, r.Record(context.Background(), d))
+	assert.Equal(t, 1, fs.settingsHits)
+
+	now = now.Add(r.SettingsTTL)
+	fs.enabled = map[string]bool{"base-flow": true}
+	require.NoError(t, r.Record(context.Background(), d))
+	r.Wait()
+
+	assert.Equal(t, 2, fs.settingsHits)
+	assert.Len(t, fs.compared, 1, "shadowing starts once the cached settings expire")
+}
+
+func TestRecorder_SampleRate(t *testing.T) {
+	fs := &fakeShadower{enabled: map[string]bool{"base-1": true}}
+	r := NewRecorder(nil, fs, 1)
+	r.sample = func() float64 { return 1 }
+
+	d := structs.Decision{Kind: decision.KindPolicy, PolicyID: "p-1", BasePolicyID: "base-1", PolicyVersion: "v1.0"}
+	require.NoError(t, r.Record(context.Background(), d))
+	r.Wait()
+
+	assert.Empty(t, fs.compared, "a decision outside the sample isn't shadowed")
+}
+
+func TestComparison(t *testing.T) {
+	d := structs.Decision{
+		ID:            "d-1",
+		Kind:          decision.KindPolicy,
+		PolicyID:      "policy-v1",
+		BasePolicyID:  "base-1",
+		PolicyVersion: "v1.0",
+		RequestID:     "req-1",
+		Input:         map[string]interface{}{"age": float64(18)},
+	}
+	report := structs.ReplayReport{
+		BaseID:   "base-1",
+		TargetID: "policy-draft",
+		Samples: []structs.ReplaySample{{
+			DecisionID: "d-1",
+			Changed:    true,
+			Before:     structs.ReplayOutcome{Version: "v1.0", Result: true},
+			After:      structs.ReplayOutcome{Version: "draft", Result: false},
+		}},
+	}
+
+	c := comparison(d, report)
+	assert.Equal(t, "policy-draft", c.DraftID)
+	assert.Equal(t, "policy-v1", c.LiveID)
+	assert.Equal(t, "v1.0", c.LiveVersion)
+	assert.Equal(t, "req-1", c.RequestID)
+	assert.True(t, c.Disagreed)
+	assert.Equal(t, true, c.Live.Result)
+	assert.Equal(t, false, c.Shadow.Result)
+}
@@ -0,0 +1,45 @@
+package structs
+
+import "time"
+
+// AuditEntry is the record kept of a single mutation of a policy or flow. BeforeHash and
+// AfterHash are hashes of every row of the policy or flow, Hash chains the entry to the one
+// before it through PrevHash. ActorClaimed is set when the actor only said who it was, through
+// the X-User header, rather than being authenticated
+type AuditEntry struct {
+	ID           int64     `json:"id"`
+	Actor        string    `json:"actor"`
+	ActorClaimed bool      `json:"actorClaimed"`
+	Action       string    `json:"action"`
+	Kind         string    `json:"kind"`
+	EntityID     string    `json:"entityId"`
+	TargetID     string    `json:"targetId,omitempty"`
+	Version      string    `json:"version,omitempty"`
+	BeforeHash   string    `json:"beforeHash,omitempty"`
+	AfterHash    string    `json:"afterHash,omitempty"`
+	RequestID    string    `json:"requestId,omitempty"`
+	PrevHash     string    `json:"prevHash"`
+	Hash         string    `json:"hash"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// AuditQuery filters the audit log, zero values don't filter
+type AuditQuery struct {
+	Actor     string
+	Action    string
+	Kind      string
+	EntityID  string
+	RequestID string
+	From      time.Time
+	To        time.Time
+	Limit     int
+}
+
+// AuditVerification is the outcome of rechecking the hash chain, BrokenAt is the first entry
+// that doesn't chain to the one before it or whose hash doesn't match what it holds
+type AuditVerification struct {
+	Valid    bool   `json:"valid"`
+	Entries  int64  `json:"entries"`
+	BrokenAt int64  `json:"brokenAt,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
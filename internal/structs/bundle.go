@@ -0,0 +1,59 @@
+package structs
+
+import "time"
+
+// BundleEntity is a base policy or flow with all of its drafts and versions, a bundle is one
+// YAML document of these per base
+type BundleEntity struct {
+	Kind        string           `yaml:"kind" json:"kind"`
+	BaseID      string           `yaml:"baseId" json:"baseId"`
+	Name        string           `yaml:"name" json:"name"`
+	Owner       string           `yaml:"owner,omitempty" json:"owner,omitempty"`
+	Description string           `yaml:"description,omitempty" json:"description,omitempty"`
+	Tags        []string         `yaml:"tags,omitempty" json:"tags,omitempty"`
+	Folder      string           `yaml:"folder,omitempty" json:"folder,omitempty"`
+	Team        string           `yaml:"team,omitempty" json:"team,omitempty"`
+	Revisions   []BundleRevision `yaml:"revisions" json:"revisions"`
+}
+
+// BundleRevision is a draft or version, oldest first. Policies have a rule and schema, flows
+// have nodes, edges and flowFlat. EffectiveFrom and EffectiveUntil are when a version is in force
+type BundleRevision struct {
+	ID               string      `yaml:"id" json:"id"`
+	Status           string      `yaml:"status" json:"status"`
+	Version          string      `yaml:"version,omitempty" json:"version,omitempty"`
+	Description      string      `yaml:"description,omitempty" json:"description,omitempty"`
+	CreatedAt        time.Time   `yaml:"createdAt" json:"createdAt"`
+	EffectiveFrom    *time.Time  `yaml:"effectiveFrom,omitempty" json:"effectiveFrom,omitempty"`
+	EffectiveUntil   *time.Time  `yaml:"effectiveUntil,omitempty" json:"effectiveUntil,omitempty"`
+	Rule             string      `yaml:"rule,omitempty" json:"rule,omitempty"`
+	DataModel        interface{} `yaml:"schema,omitempty" json:"schema,omitempty"`
+	StrictValidation bool        `yaml:"strictValidation,omitempty" json:"strictValidation,omitempty"`
+	Nodes            interface{} `yaml:"nodes,omitempty" json:"nodes,omitempty"`
+	Edges            interface{} `yaml:"edges,omitempty" json:"edges,omitempty"`
+	FlowFlat         string      `yaml:"flowFlat,omitempty" json:"flowFlat,omitempty"`
+	Tests            interface{} `yaml:"tests" json:"tests"`
+}
+
+// ImportReport is what an import did, or would have done on a dry run. IDMap has the id each
+// base, draft and version of the bundle was stored under
+type ImportReport struct {
+	DryRun   bool              `json:"dryRun"`
+	Conflict string            `json:"conflict"`
+	Remap    bool              `json:"remap"`
+	Results  []ImportResult    `json:"results"`
+	IDMap    map[string]string `json:"idMap"`
+}
+
+// ImportResult is what happened to one base policy or flow of the bundle. Unresolved lists the
+// policy references of a flow that don't lead to a stored policy after the import
+type ImportResult struct {
+	Kind       string   `json:"kind"`
+	Name       string   `json:"name"`
+	SourceID   string   `json:"sourceId"`
+	BaseID     string   `json:"baseId"`
+	Action     string   `json:"action"`
+	Version    string   `json:"version,omitempty"`
+	Revisions  int      `json:"revisions"`
+	Unresolved []string `json:"unresolved,omitempty"`
+}
@@ -0,0 +1,32 @@
+package structs
+
+import "time"
+
+// Channel is a named pointer, such as prod, at a published version of a base policy or flow.
+// ID is the policy or flow id of that version
+type Channel struct {
+	Kind       string    `json:"kind"`
+	BaseID     string    `json:"baseId"`
+	Channel    string    `json:"channel"`
+	Version    string    `json:"version"`
+	ID         string    `json:"id,omitempty"`
+	PromotedAt time.Time `json:"promotedAt"`
+}
+
+// ChannelPromotion points a channel at a version, or at the version the From channel points at
+type ChannelPromotion struct {
+	Channel string `json:"channel"`
+	Version string `json:"version,omitempty"`
+	From    string `json:"from,omitempty"`
+	Note    string `json:"note,omitempty"`
+}
+
+// ChannelChange is one promotion of a channel
+type ChannelChange struct {
+	ID              int64     `json:"id"`
+	Channel         string    `json:"channel"`
+	Version         string    `json:"version"`
+	PreviousVersion string    `json:"previousVersion,omitempty"`
+	Note            string    `json:"note,omitempty"`
+	PromotedAt      time.Time `json:"promotedAt"`
+}
@@ -0,0 +1,34 @@
+package structs
+
+import "time"
+
+// Decision is the record kept of a single policy or flow evaluation
+type Decision struct {
+	ID            string      `json:"id"`
+	Kind          string      `json:"kind"`
+	PolicyID      string      `json:"policyId,omitempty"`
+	BasePolicyID  string      `json:"basePolicyId,omitempty"`
+	PolicyVersion string      `json:"policyVersion,omitempty"`
+	FlowID        string      `json:"flowId,omitempty"`
+	BaseFlowID    string      `json:"baseFlowId,omitempty"`
+	FlowVersion   string      `json:"flowVersion,omitempty"`
+	RequestID     string      `json:"requestId,omitempty"`
+	Input         interface{} `json:"input"`
+	Result        interface{} `json:"result"`
+	Trace         interface{} `json:"trace,omitempty"`
+	Labels        interface{} `json:"labels,omitempty"`
+	Error         interface{} `json:"error,omitempty"`
+	LatencyMs     float64     `json:"latencyMs"`
+	DecidedAt     time.Time   `json:"decidedAt"`
+}
+
+// DecisionQuery filters the decision log, zero values don't filter
+type DecisionQuery struct {
+	PolicyID  string
+	FlowID    string
+	RequestID string
+	From      time.Time
+	To        time.Time
+	Result    string
+	Limit     int
+}
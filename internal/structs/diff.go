@@ -0,0 +1,84 @@
+package structs
+
+// PolicyDiff is what changed between two versions or drafts of a base policy
+type PolicyDiff struct {
+	BaseID       string        `json:"baseId"`
+	From         string        `json:"from"`
+	To           string        `json:"to"`
+	FromPolicyID string        `json:"fromPolicyId"`
+	ToPolicyID   string        `json:"toPolicyId"`
+	Changed      bool          `json:"changed"`
+	Rule         TextDiff      `json:"rule"`
+	DataModel    DataModelDiff `json:"dataModel"`
+	Tests        TestsDiff     `json:"tests"`
+}
+
+// TextDiff is a line diff, only the changed lines and the context around them are kept
+type TextDiff struct {
+	Hunks []DiffHunk `json:"hunks"`
+}
+
+// DiffHunk is a run of changed lines, starts are 1-based line numbers like a unified diff
+type DiffHunk struct {
+	FromStart int        `json:"fromStart"`
+	FromLines int        `json:"fromLines"`
+	ToStart   int        `json:"toStart"`
+	ToLines   int        `json:"toLines"`
+	Lines     []DiffLine `json:"lines"`
+}
+
+// DiffLine is a line of a hunk, Op is context, added or removed
+type DiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// DataModelDiff is the fields of the data model that were added, removed or retyped, along
+// with a line diff of the data model as indented JSON
+type DataModelDiff struct {
+	Fields []FieldChange `json:"fields"`
+	Hunks  []DiffHunk    `json:"hunks"`
+}
+
+// FieldChange is a field of the data model by its dotted path, array items are path[]
+type FieldChange struct {
+	Path   string `json:"path"`
+	Change string `json:"change"`
+	From   string `json:"fromType,omitempty"`
+	To     string `json:"toType,omitempty"`
+}
+
+// TestsDiff is the test cases that were added, removed or changed, along with a line diff of
+// the tests as indented JSON
+type TestsDiff struct {
+	Cases []TestCaseChange `json:"cases"`
+	Hunks []DiffHunk       `json:"hunks"`
+}
+
+// TestCaseChange is a test case matched by its name, or by its position when it has none
+type TestCaseChange struct {
+	Name   string          `json:"name"`
+	Change string          `json:"change"`
+	From   *PolicyTestCase `json:"from,omitempty"`
+	To     *PolicyTestCase `json:"to,omitempty"`
+}
+
+// FlowDiff is a line diff of the flow YAML and of the nodes, edges and tests as indented JSON
+type FlowDiff struct {
+	Flow  TextDiff `json:"flow"`
+	Nodes TextDiff `json:"nodes"`
+	Edges TextDiff `json:"edges"`
+	Tests TextDiff `json:"tests"`
+}
+
+// DraftChanges is what changed in the draft of a base policy or flow since an earlier revision,
+// such as the one an edit that conflicted was made from
+type DraftChanges struct {
+	BaseID   string      `json:"baseId"`
+	DraftID  string      `json:"draftId"`
+	Since    int64       `json:"since"`
+	Revision int64       `json:"revision"`
+	Changed  bool        `json:"changed"`
+	Policy   *PolicyDiff `json:"policy,omitempty"`
+	Flow     *FlowDiff   `json:"flow,omitempty"`
+}
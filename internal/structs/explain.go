@@ -0,0 +1,31 @@
+package structs
+
+// Explanation is an engine trace written out for people, Steps are in the order they ran
+type Explanation struct {
+	Result   interface{}       `json:"result"`
+	Summary  string            `json:"summary"`
+	Steps    []ExplanationStep `json:"steps"`
+	Markdown string            `json:"markdown"`
+}
+
+// ExplanationStep is one rule the engine evaluated, or one flow node that ran
+type ExplanationStep struct {
+	NodeID     string               `json:"nodeId,omitempty"`
+	NodeType   string               `json:"nodeType,omitempty"`
+	Selector   string               `json:"selector,omitempty"`
+	Outcome    string               `json:"outcome,omitempty"`
+	Passed     bool                 `json:"passed"`
+	Conditions []ExplainedCondition `json:"conditions"`
+	Text       string               `json:"text"`
+}
+
+type ExplainedCondition struct {
+	Passed bool   `json:"passed"`
+	Text   string `json:"text"`
+}
+
+// ExplainResponse is the response of a run along with its explanation
+type ExplainResponse struct {
+	Response    interface{} `json:"response"`
+	Explanation Explanation `json:"explanation"`
+}
@@ -22,7 +22,11 @@ type FlowRequest struct {
 	Description string      `json:"description"`
 	Version     string      `json:"version"`
 	Status      string      `json:"status"`
-	Flow        FlowConfig
+	Bump        string      `json:"bump,omitempty"`
+	// EffectiveFrom and EffectiveUntil are when the version published is in force
+	EffectiveFrom  *time.Time `json:"effectiveFrom,omitempty"`
+	EffectiveUntil *time.Time `json:"effectiveUntil,omitempty"`
+	Flow           FlowConfig
 }
 
 type StoredFlow struct {
@@ -42,8 +46,17 @@ type StoredFlow struct {
 	UpdatedAt       time.Time `yaml:"updatedAt" json:"updatedAt"`
 	LastPublishedAt time.Time `yaml:"lastPublishedAt" json:"lastPublishedAt"`
 	HasDraft        bool      `yaml:"hasDraft" json:"hasDraft"`
+	Revision        int64     `yaml:"revision,omitempty" json:"revision,omitempty"`
+	Owner           string    `yaml:"owner,omitempty" json:"owner,omitempty"`
+	Tags            []string  `yaml:"tags,omitempty" json:"tags,omitempty"`
+	Folder          string    `yaml:"folder,omitempty" json:"folder,omitempty"`
+	Team            string    `yaml:"team,omitempty" json:"team,omitempty"`
 	FlatYAML        string    `yaml:"flowFlat" json:"flowFlat"`
+	Bump            string    `yaml:"-" json:"-"`
 	FlowConfig      FlowConfig
+	// EffectiveFrom and EffectiveUntil are when a version is in force, see Policy
+	EffectiveFrom  *time.Time `yaml:"effectiveFrom,omitempty" json:"effectiveFrom,omitempty"`
+	EffectiveUntil *time.Time `yaml:"effectiveUntil,omitempty" json:"effectiveUntil,omitempty"`
 }
 
 type FlowConfig struct {
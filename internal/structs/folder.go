@@ -0,0 +1,28 @@
+package structs
+
+// Folder is a folder and how many policies and flows are in it, the folders beneath it included
+type Folder struct {
+	Path     string `json:"path"`
+	Name     string `json:"name"`
+	Policies int    `json:"policies"`
+	Flows    int    `json:"flows"`
+}
+
+// FolderContents is a page each of the policies and flows in a folder and the folders in it
+type FolderContents struct {
+	Path             string       `json:"path"`
+	Folders          []Folder     `json:"folders"`
+	Policies         []Policy     `json:"policies"`
+	PolicyTotal      int          `json:"policyTotal"`
+	NextPolicyCursor string       `json:"nextPolicyCursor,omitempty"`
+	Flows            []StoredFlow `json:"flows"`
+	FlowTotal        int          `json:"flowTotal"`
+	NextFlowCursor   string       `json:"nextFlowCursor,omitempty"`
+}
+
+// FolderMove moves a folder and everything in it, an empty To moves it to the top
+type FolderMove struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Moved int    `json:"moved"`
+}
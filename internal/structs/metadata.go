@@ -0,0 +1,39 @@
+package structs
+
+import "time"
+
+// Metadata is what describes a base policy or flow without being part of its versions
+type Metadata struct {
+	Kind        string    `json:"kind"`
+	BaseID      string    `json:"baseId"`
+	Name        string    `json:"name"`
+	Owner       string    `json:"owner"`
+	Description string    `json:"description"`
+	Tags        []string  `json:"tags"`
+	Folder      string    `json:"folder"`
+	Team        string    `json:"team"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// MetadataUpdate holds the fields to change, the ones left out stay as they are. With Version
+// the description is that of the published version instead of the base's. An empty folder
+// moves it to the top and an empty team leaves it without one
+type MetadataUpdate struct {
+	Name        *string   `json:"name"`
+	Owner       *string   `json:"owner"`
+	Description *string   `json:"description"`
+	Tags        *[]string `json:"tags"`
+	Folder      *string   `json:"folder"`
+	Team        *string   `json:"team"`
+	Version     string    `json:"version,omitempty"`
+}
+
+// MetadataChange is one edit of one field
+type MetadataChange struct {
+	ID        int64       `json:"id"`
+	Version   string      `json:"version,omitempty"`
+	Field     string      `json:"field"`
+	OldValue  interface{} `json:"oldValue"`
+	NewValue  interface{} `json:"newValue"`
+	ChangedAt time.Time   `json:"changedAt"`
+}
@@ -19,6 +19,20 @@ type Policy struct {
 	DraftID         string      `json:"draftId"`
 	Status          string      `json:"status"`
 	HasDraft        bool        `json:"hasDraft"`
+	Revision        int64       `json:"revision,omitempty"`
+	Owner           string      `json:"owner,omitempty"`
+	Tags            []string    `json:"tags,omitempty"`
+	Folder          string      `json:"folder,omitempty"`
+	Team            string      `json:"team,omitempty"`
+	// EffectiveFrom and EffectiveUntil are when a version is in force, latest resolves to the
+	// version in force. Unset it is in force from when it is published until it is replaced
+	EffectiveFrom  *time.Time `json:"effectiveFrom,omitempty"`
+	EffectiveUntil *time.Time `json:"effectiveUntil,omitempty"`
+	// StrictValidation rejects data with fields the data model doesn't define, a draft edit that
+	// leaves it out keeps the mode the draft has
+	StrictValidation *bool `json:"strictValidation"`
+	// Bump publishes the next major, minor or patch version instead of Version
+	Bump string `json:"bump,omitempty"`
 }
 
 type EngineResponse struct {
@@ -29,3 +43,63 @@ type EngineResponse struct {
 	Error  interface{} `json:"error"`
 	Labels interface{} `json:"labels"`
 }
+
+type BatchResponse struct {
+	Total     int               `json:"total"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Results   []BatchItemResult `json:"results"`
+}
+
+type BatchItemResult struct {
+	Index  int             `json:"index"`
+	Result *EngineResponse `json:"result,omitempty"`
+	Error  interface{}     `json:"error,omitempty"`
+}
+
+// PolicyDeletion is what an archive, restore or purge did, Affected is the number of drafts
+// and versions
+type PolicyDeletion struct {
+	ID         string     `json:"id"`
+	Action     string     `json:"action"`
+	Affected   int        `json:"affected"`
+	PurgeAfter *time.Time `json:"purgeAfter,omitempty"`
+}
+
+// ArchivedPolicy is a policy with archived drafts or versions, FullyArchived when nothing of it
+// is left in the policy list
+type ArchivedPolicy struct {
+	BaseID        string    `json:"baseId"`
+	Name          string    `json:"name"`
+	ArchivedCount int       `json:"archivedCount"`
+	FullyArchived bool      `json:"fullyArchived"`
+	ArchivedAt    time.Time `json:"archivedAt"`
+	PurgeAfter    time.Time `json:"purgeAfter"`
+}
+
+// PolicyTestCase is one of the stored tests of a policy, the policy is expected to return
+// Expected for Data
+type PolicyTestCase struct {
+	Name     string      `json:"name"`
+	Data     interface{} `json:"data"`
+	Expected *bool       `json:"expected"`
+}
+
+// PolicyTestResult is how a test case came out, Actual is nil when the run failed
+type PolicyTestResult struct {
+	Index    int         `json:"index"`
+	Name     string      `json:"name"`
+	Expected *bool       `json:"expected"`
+	Actual   *bool       `json:"actual,omitempty"`
+	Passed   bool        `json:"passed"`
+	Trace    interface{} `json:"trace,omitempty"`
+	Error    interface{} `json:"error,omitempty"`
+}
+
+type PolicyTestReport struct {
+	PolicyID string             `json:"policyId"`
+	Total    int                `json:"total"`
+	Passed   int                `json:"passed"`
+	Failed   int                `json:"failed"`
+	Results  []PolicyTestResult `json:"results"`
+}
@@ -0,0 +1,58 @@
+package structs
+
+import "time"
+
+// ReplayRequest picks the logged decisions to replay and the draft or version to replay them
+// against. TargetID is the exact policy or flow row, otherwise Version picks it by version
+// label and "draft" (the default) picks the current draft
+type ReplayRequest struct {
+	TargetID   string    `json:"targetId"`
+	Version    string    `json:"version"`
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+	Limit      int       `json:"limit"`
+	SampleSize int       `json:"sampleSize"`
+}
+
+// ReplayReport shows how the logged decisions would have come out against the target
+type ReplayReport struct {
+	Kind          string         `json:"kind"`
+	BaseID        string         `json:"baseId"`
+	TargetID      string         `json:"targetId"`
+	TargetVersion string         `json:"targetVersion"`
+	From          *time.Time     `json:"from,omitempty"`
+	To            *time.Time     `json:"to,omitempty"`
+	Total         int            `json:"total"`
+	Changed       int            `json:"changed"`
+	Unchanged     int            `json:"unchanged"`
+	Errors        int            `json:"errors"`
+	Flips         []ReplayFlip   `json:"flips"`
+	Samples       []ReplaySample `json:"samples"`
+}
+
+// ReplayFlip is a logged decision whose outcome would change
+type ReplayFlip struct {
+	DecisionID string      `json:"decisionId"`
+	RequestID  string      `json:"requestId,omitempty"`
+	DecidedAt  time.Time   `json:"decidedAt"`
+	Input      interface{} `json:"input"`
+	Before     interface{} `json:"before"`
+	After      interface{} `json:"after"`
+	Error      interface{} `json:"error,omitempty"`
+}
+
+// ReplaySample puts the logged and replayed traces of a decision side by side
+type ReplaySample struct {
+	DecisionID string        `json:"decisionId"`
+	Changed    bool          `json:"changed"`
+	Input      interface{}   `json:"input"`
+	Before     ReplayOutcome `json:"before"`
+	After      ReplayOutcome `json:"after"`
+}
+
+type ReplayOutcome struct {
+	Version string      `json:"version,omitempty"`
+	Result  interface{} `json:"result"`
+	Trace   interface{} `json:"trace,omitempty"`
+	Error   interface{} `json:"error,omitempty"`
+}
@@ -0,0 +1,53 @@
+package structs
+
+import "time"
+
+// Review is where the draft of a base policy or flow is in its review. State is draft until
+// it is submitted, Missing lists the roles still to approve and Stale is set when the draft
+// changed after it was submitted
+type Review struct {
+	ID          int64           `json:"id,omitempty"`
+	Kind        string          `json:"kind"`
+	BaseID      string          `json:"baseId"`
+	DraftID     string          `json:"draftId,omitempty"`
+	State       string          `json:"state"`
+	Author      string          `json:"author,omitempty"`
+	Roles       []string        `json:"roles"`
+	Missing     []string        `json:"missingRoles"`
+	Stale       bool            `json:"stale"`
+	Version     string          `json:"version,omitempty"`
+	SubmittedAt *time.Time      `json:"submittedAt,omitempty"`
+	Comments    []ReviewComment `json:"comments"`
+}
+
+// ReviewComment is a comment on a draft, approvals and rejections have a Decision
+type ReviewComment struct {
+	ID        int64     `json:"id"`
+	ReviewID  int64     `json:"reviewId,omitempty"`
+	Author    string    `json:"author"`
+	Roles     []string  `json:"roles,omitempty"`
+	Decision  string    `json:"decision,omitempty"`
+	Comment   string    `json:"comment"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ReviewAction is the body of a submit, approve, reject or comment
+type ReviewAction struct {
+	Comment string `json:"comment"`
+}
+
+// Reviewer is who submits, reviews or comments and the roles they hold
+type Reviewer struct {
+	User  string
+	Roles []string
+}
+
+// ApprovalRule is the roles that must approve the drafts of a base policy or flow, or of
+// everything in a folder. No roles means any reviewer but the author
+type ApprovalRule struct {
+	Scope     string    `json:"scope"`
+	Target    string    `json:"target"`
+	Roles     []string  `json:"roles"`
+	Inherited bool      `json:"inherited,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt,omitempty"`
+}
@@ -0,0 +1,20 @@
+package structs
+
+// RollbackRequest is the body of a rollback, Version is the published version to make the
+// latest again and Reason why
+type RollbackRequest struct {
+	Version string `json:"version"`
+	Reason  string `json:"reason"`
+}
+
+// Rollback is a published version made the latest again by publishing a copy of it as
+// PublishedAs. DraftID is the draft that was left as it was
+type Rollback struct {
+	BaseID          string `json:"baseId"`
+	ID              string `json:"id"`
+	Version         string `json:"version"`
+	PreviousVersion string `json:"previousVersion"`
+	PublishedAs     string `json:"publishedAs"`
+	Reason          string `json:"reason"`
+	DraftID         string `json:"draftId,omitempty"`
+}
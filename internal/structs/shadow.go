@@ -0,0 +1,58 @@
+package structs
+
+import "time"
+
+// ShadowSettings turns shadow evaluation of a policy's or flow's draft on or off
+type ShadowSettings struct {
+	Kind       string    `json:"kind"`
+	BaseID     string    `json:"baseId"`
+	Enabled    bool      `json:"enabled"`
+	SampleRate float64   `json:"sampleRate"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// ShadowComparison is a live decision next to what the draft made of the same input
+type ShadowComparison struct {
+	Kind        string
+	BaseID      string
+	DraftID     string
+	LiveID      string
+	LiveVersion string
+	RequestID   string
+	Input       interface{}
+	Live        ReplayOutcome
+	Shadow      ReplayOutcome
+	Disagreed   bool
+}
+
+// ShadowStats are the running totals of a draft
+type ShadowStats struct {
+	DraftID       string    `json:"draftId"`
+	Evaluated     int64     `json:"evaluated"`
+	Disagreed     int64     `json:"disagreed"`
+	Errors        int64     `json:"errors"`
+	AgreementRate float64   `json:"agreementRate"`
+	FirstAt       time.Time `json:"firstAt"`
+	LastAt        time.Time `json:"lastAt"`
+}
+
+type ShadowDisagreement struct {
+	ID          string        `json:"id"`
+	DraftID     string        `json:"draftId"`
+	LiveID      string        `json:"liveId"`
+	LiveVersion string        `json:"liveVersion,omitempty"`
+	RequestID   string        `json:"requestId,omitempty"`
+	Input       interface{}   `json:"input"`
+	Live        ReplayOutcome `json:"live"`
+	Shadow      ReplayOutcome `json:"shadow"`
+	RecordedAt  time.Time     `json:"recordedAt"`
+}
+
+// ShadowSummary is what shadow mode has found so far for a policy or flow, CurrentDraftID is
+// empty when there is no draft to shadow
+type ShadowSummary struct {
+	Settings       ShadowSettings       `json:"settings"`
+	CurrentDraftID string               `json:"currentDraftId,omitempty"`
+	Drafts         []ShadowStats        `json:"drafts"`
+	Recent         []ShadowDisagreement `json:"recentDisagreements"`
+}
@@ -0,0 +1,56 @@
+package testutil
+
+import (
+	"context"
+	ConfigBuilder "github.com/keloran/go-config"
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
+	"os"
+	"testing"
+	"time"
+)
+
+// Postgres starts a database for the test with each of files from sql/ run in order, the
+// container is removed when the test finishes
+func Postgres(t *testing.T, files ...string) *ConfigBuilder.Config {
+	t.Helper()
+	ctx := context.Background()
+
+	pgContainer, err := postgres.Run(ctx,
+		"postgres:16-alpine",
+		postgres.WithDatabase("testdb"),
+		postgres.WithUsername("testuser"),
+		postgres.WithPassword("testpass"),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if err := pgContainer.Terminate(context.Background()); err != nil {
+			t.Logf("failed to terminate container: %v", err)
+		}
+	})
+
+	connStr, err := pgContainer.ConnectionString(ctx, "sslmode=disable")
+	require.NoError(t, err)
+
+	cfg := ConfigBuilder.NewConfigNoVault()
+	require.NoError(t, cfg.Build(ConfigBuilder.Postgres))
+	require.NoError(t, cfg.Database.ParseConnectionString(connStr))
+	cfg.Database.Details.ConnectionTimeout = 30 * time.Second
+
+	// the container reports ready before it accepts connections
+	time.Sleep(2 * time.Second)
+
+	client, err := cfg.Database.GetPGXPoolClient(ctx)
+	require.NoError(t, err)
+	defer client.Close()
+
+	for _, file := range files {
+		schemaSQL, err := os.ReadFile("../../sql/" + file)
+		require.NoError(t, err)
+		if _, err := client.Exec(ctx, string(schemaSQL)); err != nil {
+			t.Fatalf("Failed to execute %s: %v", file, err)
+		}
+	}
+
+	return cfg
+}
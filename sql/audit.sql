@@ -0,0 +1,55 @@
+-- Audit Log
+-- One row per mutation of a policy, flow or folder: who did it, what it was, the request it came
+-- from and hashes of it, with its metadata, channels, reviews and approval rule, before and after. Rows can only be added, and each row
+-- carries the hash of the row before it so an edited, removed or reordered row breaks the chain
+
+CREATE TABLE audit_log (
+                           id BIGSERIAL PRIMARY KEY,
+                           actor TEXT NOT NULL, -- From the X-User header, anonymous without one, system for background jobs
+                           actor_claimed BOOLEAN NOT NULL DEFAULT FALSE, -- TRUE when the actor came from the X-User header, which isn't authenticated
+                           action VARCHAR(20) NOT NULL CHECK (action IN ('create', 'update', 'publish', 'draft', 'archive', 'restore', 'purge', 'rollback',
+                                                                 'metadata', 'promote', 'move', 'import', 'submit', 'approve', 'reject', 'rule')),
+                           kind VARCHAR(20) NOT NULL CHECK (kind IN ('policy', 'flow', 'folder')),
+                           entity_id TEXT NOT NULL, -- base_policy_id, base_flow_id or folder path
+                           target_id TEXT, -- the policy_id or flow_id the call named or made, or the path a folder moved to, when it differs
+                           version VARCHAR(50), -- the version published, promoted, imported or edited
+                           before_hash TEXT, -- NULL when the entity didn't exist
+                           after_hash TEXT, -- NULL when the entity no longer exists
+                           request_id TEXT,
+                           prev_hash TEXT NOT NULL, -- hash of the previous row, empty for the first
+                           hash TEXT NOT NULL UNIQUE,
+                           created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_audit_log_created_at ON audit_log(created_at);
+CREATE INDEX idx_audit_log_entity_id ON audit_log(kind, entity_id, id);
+CREATE INDEX idx_audit_log_actor ON audit_log(actor, id);
+CREATE INDEX idx_audit_log_request_id ON audit_log(request_id) WHERE request_id IS NOT NULL;
+
+-- Rows are never changed or removed
+CREATE OR REPLACE FUNCTION audit_log_append_only()
+RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_no_update
+    BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW
+EXECUTE FUNCTION audit_log_append_only();
+
+CREATE TRIGGER audit_log_no_truncate
+    BEFORE TRUNCATE ON audit_log
+    FOR EACH STATEMENT
+EXECUTE FUNCTION audit_log_append_only();
+
+-- Sample queries and usage examples:
+
+-- 1. Everything done to a policy, oldest first
+-- SELECT actor, action, version, created_at FROM audit_log
+-- WHERE kind = 'policy' AND entity_id = 'your-base-policy-id' ORDER BY id;
+
+-- 2. Rows whose prev_hash doesn't match the row before, GET /audit/verify also rechecks each hash
+-- SELECT id FROM (SELECT id, prev_hash, LAG(hash, 1, '') OVER (ORDER BY id) AS expected FROM audit_log) c
+-- WHERE prev_hash <> expected;
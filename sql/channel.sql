@@ -0,0 +1,68 @@
+-- Promotion Channels
+-- Named channels such as dev, staging and prod point a base policy or flow at one of its
+-- published versions, {baseId}@prod runs whatever prod points at. Every promotion is kept so
+-- what a channel pointed at can be found for any time
+
+-- The version each channel of a base policy or flow points at
+CREATE TABLE channels (
+                          kind VARCHAR(20) NOT NULL CHECK (kind IN ('policy', 'flow')),
+                          base_id TEXT NOT NULL, -- base_policy_id or base_flow_id
+                          channel VARCHAR(50) NOT NULL,
+                          version VARCHAR(50) NOT NULL,
+                          promoted_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+                          PRIMARY KEY (kind, base_id, channel)
+);
+
+-- Every promotion, oldest first
+CREATE TABLE channel_history (
+                                 id BIGSERIAL PRIMARY KEY,
+                                 kind VARCHAR(20) NOT NULL CHECK (kind IN ('policy', 'flow')),
+                                 base_id TEXT NOT NULL,
+                                 channel VARCHAR(50) NOT NULL,
+                                 version VARCHAR(50) NOT NULL,
+                                 previous_version VARCHAR(50), -- NULL the first time the channel is promoted
+                                 note TEXT,
+                                 promoted_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_channel_history_channel ON channel_history(kind, base_id, channel, promoted_at);
+
+-- Function to point a channel at a version and keep the promotion, returns the version the
+-- channel pointed at before
+CREATE OR REPLACE FUNCTION promote_channel(
+    p_kind VARCHAR(20),
+    p_base_id TEXT,
+    p_channel VARCHAR(50),
+    p_version VARCHAR(50),
+    p_note TEXT DEFAULT NULL
+) RETURNS VARCHAR(50) AS $$
+DECLARE
+    previous VARCHAR(50);
+BEGIN
+    SELECT version INTO previous
+    FROM channels
+    WHERE kind = p_kind AND base_id = p_base_id AND channel = p_channel
+    FOR UPDATE;
+
+    INSERT INTO channels (kind, base_id, channel, version)
+    VALUES (p_kind, p_base_id, p_channel, p_version)
+    ON CONFLICT (kind, base_id, channel) DO UPDATE
+    SET version = EXCLUDED.version, promoted_at = CURRENT_TIMESTAMP;
+
+    INSERT INTO channel_history (kind, base_id, channel, version, previous_version, note)
+    VALUES (p_kind, p_base_id, p_channel, p_version, previous, p_note);
+
+    RETURN previous;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Sample queries and usage examples:
+
+-- 1. Promote v1.2.0 of a policy to prod
+-- SELECT promote_channel('policy', 'your-base-policy-id', 'prod', 'v1.2.0', 'passed staging');
+
+-- 2. What prod pointed at on the first of June
+-- SELECT version FROM channel_history
+-- WHERE kind = 'policy' AND base_id = 'your-base-policy-id' AND channel = 'prod' AND promoted_at <= '2025-06-01'
+-- ORDER BY promoted_at DESC, id DESC LIMIT 1;
@@ -0,0 +1,45 @@
+-- Decision Log
+-- One row per policy or flow evaluation, written by /run, /run/{policyId} and flow runs
+
+-- Create extension for UUID generation
+CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+
+CREATE TABLE decisions (
+                           decision_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+                           kind VARCHAR(20) NOT NULL CHECK (kind IN ('policy', 'flow')),
+                           policy_id TEXT, -- The exact policy row evaluated, NULL for flows
+                           base_policy_id TEXT,
+                           policy_version VARCHAR(50), -- NULL when a draft or an unsaved policy was evaluated
+                           flow_id TEXT, -- The exact flow row evaluated, NULL for policies
+                           base_flow_id TEXT,
+                           flow_version VARCHAR(50),
+                           request_id TEXT, -- From the X-Request-Id header or generated by the request id middleware
+                           input JSONB,
+                           result JSONB, -- NULL when the evaluation failed
+                           trace JSONB,
+                           labels JSONB,
+                           error JSONB, -- The error returned to the caller when the evaluation failed
+                           latency_ms DOUBLE PRECISION NOT NULL DEFAULT 0,
+                           decided_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Indexes for the auditor queries
+CREATE INDEX idx_decisions_decided_at ON decisions(decided_at);
+CREATE INDEX idx_decisions_policy_id ON decisions(policy_id, decided_at) WHERE policy_id IS NOT NULL;
+CREATE INDEX idx_decisions_base_policy_id ON decisions(base_policy_id, decided_at) WHERE base_policy_id IS NOT NULL;
+CREATE INDEX idx_decisions_flow_id ON decisions(flow_id, decided_at) WHERE flow_id IS NOT NULL;
+CREATE INDEX idx_decisions_base_flow_id ON decisions(base_flow_id, decided_at) WHERE base_flow_id IS NOT NULL;
+CREATE INDEX idx_decisions_request_id ON decisions(request_id) WHERE request_id IS NOT NULL;
+
+-- Sample queries and usage examples:
+
+-- 1. Every rejection by a policy on a given day
+-- SELECT decision_id, request_id, input, trace
+-- FROM decisions
+-- WHERE base_policy_id = 'your-base-policy-id'
+--   AND result = 'false'::jsonb
+--   AND decided_at >= '2025-01-07' AND decided_at < '2025-01-08'
+-- ORDER BY decided_at DESC;
+
+-- 2. Everything decided for a single request
+-- SELECT * FROM decisions WHERE request_id = 'host/abc123-000042';
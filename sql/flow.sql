@@ -4,6 +4,9 @@
 -- Create extension for UUID generation
 CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
 
+-- Revisions of drafts, every edit takes the next one
+CREATE SEQUENCE flow_revisions;
+
 -- Main policies table
 CREATE TABLE flows (
                        flow_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
@@ -16,6 +19,9 @@ CREATE TABLE flows (
                        version VARCHAR(50), -- NULL for drafts, 'v1.0', 'v1.1', etc. for versions
                        description TEXT, -- Required for versions, optional for drafts
                        status VARCHAR(20) NOT NULL CHECK (status IN ('draft', 'version')),
+                       effective_from TIMESTAMPTZ, -- versions only, NULL for in force once published
+                       effective_until TIMESTAMPTZ, -- versions only, NULL for in force until replaced
+                       revision BIGINT NOT NULL DEFAULT nextval('flow_revisions'), -- changed by every edit of a draft, unique so an ETag can't match another draft
                        created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
                        updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
 
@@ -34,6 +40,11 @@ CREATE TABLE flows (
                            (status = 'version' AND version IS NOT NULL)
                            ),
 
+    -- Ensure a version stops being in force after it starts
+                       CONSTRAINT effective_rules CHECK (
+                           effective_from IS NULL OR effective_until IS NULL OR effective_until > effective_from
+                           ),
+
     -- Ensure versions have descriptions but drafts don't require them
                        CONSTRAINT version_description_rules CHECK (
                            (status = 'version' AND description IS NOT NULL AND description != '') OR
@@ -46,10 +57,25 @@ CREATE INDEX idx_flows_base_flow_id ON flows(base_flow_id);
 CREATE INDEX idx_flows_status ON flows(status);
 CREATE INDEX idx_flows_version ON flows(version) WHERE version IS NOT NULL;
 
--- Trigger to automatically update updated_at
+-- Earlier revisions of drafts, kept so an editor whose edit was refused can see what changed
+CREATE TABLE flow_draft_revisions (
+                                      flow_id UUID NOT NULL REFERENCES flows(flow_id) ON DELETE CASCADE,
+                                      revision BIGINT NOT NULL,
+                                      nodes JSONB NOT NULL,
+                                      edges JSONB NOT NULL,
+                                      tests JSONB NOT NULL,
+                                      flow TEXT NOT NULL,
+                                      description TEXT,
+                                      created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+
+                                      PRIMARY KEY (flow_id, revision)
+);
+
+-- Trigger to automatically update updated_at, a rename through update_metadata isn't an edit
 CREATE TRIGGER update_flows_updated_at
     BEFORE UPDATE ON flows
     FOR EACH ROW
+    WHEN (OLD.name IS NOT DISTINCT FROM NEW.name)
 EXECUTE FUNCTION update_updated_at_column();
 
 -- Function to create a new policy (creates initial draft)
@@ -74,11 +100,15 @@ BEGIN
 END;
 $$ LANGUAGE plpgsql;
 
--- Function to publish a draft as a version (removes draft after publishing)
+-- Function to publish a draft as a version (removes draft after publishing). With p_revision
+-- the draft is only published when it is still at that revision, otherwise it raises P0409
 CREATE OR REPLACE FUNCTION publish_draft_flow_as_version(
     p_base_flow_id UUID,
     p_version VARCHAR(50),
-    p_description TEXT
+    p_description TEXT,
+    p_effective_from TIMESTAMPTZ DEFAULT NULL,
+    p_effective_until TIMESTAMPTZ DEFAULT NULL,
+    p_revision BIGINT DEFAULT NULL
 ) RETURNS UUID AS $$
 DECLARE
     draft_flow_record RECORD;
@@ -89,22 +119,27 @@ BEGIN
         RAISE EXCEPTION 'Description is required when publishing a version';
     END IF;
 
-    -- Get the current draft
+    -- Get the current draft, locked so it can't be edited while it is published
     SELECT * INTO draft_flow_record
     FROM flows
-    WHERE base_flow_id = p_base_flow_id AND status = 'draft';
+    WHERE base_flow_id = p_base_flow_id AND status = 'draft'
+    FOR UPDATE;
 
     IF NOT FOUND THEN
         RAISE EXCEPTION 'No draft found for base_flow_id: %', p_base_flow_id;
     END IF;
 
+    IF p_revision IS NOT NULL AND p_revision <> draft_flow_record.revision THEN
+        RAISE EXCEPTION 'Draft of % is at revision %, not %', p_base_flow_id, draft_flow_record.revision, p_revision USING ERRCODE = 'P0409';
+    END IF;
+
     -- Check if version already exists
     IF EXISTS (SELECT 1 FROM flows WHERE base_flow_id = p_base_flow_id AND version = p_version) THEN
         RAISE EXCEPTION 'Version % already exists for this flow', p_version;
     END IF;
 
     -- Create new version record
-    INSERT INTO flows (base_flow_id, name, nodes, edges, tests, flow, version, description, status)
+    INSERT INTO flows (base_flow_id, name, nodes, edges, tests, flow, version, description, status, effective_from, effective_until)
     VALUES (
                draft_flow_record.base_flow_id,
                draft_flow_record.name,
@@ -114,7 +149,9 @@ BEGIN
                draft_flow_record.flow,
                p_version,
                p_description,
-               'version'
+               'version',
+               p_effective_from,
+               p_effective_until
            )
     RETURNING flow_id INTO new_flow_id;
 
@@ -177,26 +214,98 @@ BEGIN
 END;
 $$ LANGUAGE plpgsql;
 
--- Function to update a draft (name cannot be changed)
+-- Function to roll back to a version by publishing a copy of it as a new version, the versions
+-- in between and the draft are left as they are
+CREATE OR REPLACE FUNCTION rollback_flow_to_version(
+    p_flow_id UUID, -- the version rolled back to
+    p_version VARCHAR(50),
+    p_description TEXT
+) RETURNS UUID AS $$
+DECLARE
+    source_record RECORD;
+    new_flow_id UUID;
+BEGIN
+    IF p_description IS NULL OR p_description = '' THEN
+        RAISE EXCEPTION 'Description is required when publishing a version';
+    END IF;
+
+    SELECT * INTO source_record
+    FROM flows
+    WHERE flow_id = p_flow_id AND status = 'version';
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Version % not found', p_flow_id;
+    END IF;
+
+    INSERT INTO flows (base_flow_id, name, nodes, edges, tests, flow, version, description, status)
+    VALUES (
+               source_record.base_flow_id,
+               source_record.name,
+               source_record.nodes,
+               source_record.edges,
+               source_record.tests,
+               source_record.flow,
+               p_version,
+               p_description,
+               'version'
+           )
+    RETURNING flow_id INTO new_flow_id;
+
+    RETURN new_flow_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Function to update a draft (name cannot be changed, update_metadata renames). With p_revision
+-- the draft is only updated when it is still at that revision. updated is FALSE when there is
+-- no draft or it is at another revision, current_revision is the revision of the draft after
+-- the call and NULL without a draft
 CREATE OR REPLACE FUNCTION update_draft_flow(
     p_base_flow_id UUID,
     p_nodes JSONB DEFAULT NULL,
     p_edges JSONB DEFAULT NULL,
     p_tests JSONB DEFAULT NULL,
     p_flow TEXT DEFAULT NULL,
-    p_description TEXT DEFAULT NULL
-) RETURNS BOOLEAN AS $$
+    p_description TEXT DEFAULT NULL,
+    p_revision BIGINT DEFAULT NULL,
+    OUT updated BOOLEAN,
+    OUT current_revision BIGINT
+) AS $$
+DECLARE
+    draft_record RECORD;
 BEGIN
+    updated := FALSE;
+
+    SELECT * INTO draft_record
+    FROM flows
+    WHERE base_flow_id = p_base_flow_id AND status = 'draft'
+    FOR UPDATE;
+
+    IF NOT FOUND THEN
+        RETURN;
+    END IF;
+
+    current_revision := draft_record.revision;
+    IF p_revision IS NOT NULL AND p_revision <> draft_record.revision THEN
+        RETURN;
+    END IF;
+
+    INSERT INTO flow_draft_revisions (flow_id, revision, nodes, edges, tests, flow, description)
+    VALUES (draft_record.flow_id, draft_record.revision, draft_record.nodes, draft_record.edges,
+            draft_record.tests, draft_record.flow, draft_record.description)
+    ON CONFLICT (flow_id, revision) DO NOTHING;
+
     UPDATE flows
     SET
         nodes = COALESCE(p_nodes, nodes),
         edges = COALESCE(p_edges, edges),
         tests = COALESCE(p_tests, tests),
         flow = COALESCE(p_flow, flow),
-        description = COALESCE(p_description, description)
-    WHERE base_flow_id = p_base_flow_id AND status = 'draft';
+        description = COALESCE(p_description, description),
+        revision = nextval('flow_revisions')
+    WHERE flow_id = draft_record.flow_id
+    RETURNING revision INTO current_revision;
 
-    RETURN FOUND;
+    updated := TRUE;
 END;
 $$ LANGUAGE plpgsql;
 
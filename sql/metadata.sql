@@ -0,0 +1,215 @@
+-- Policy and Flow Metadata
+-- Names are kept on every draft and version so a rename updates all of them, the owner,
+-- description, tags, folder and team of a base policy or flow are kept here. Every edit goes
+-- into the history
+
+-- Owner, description, tags, folder and team of a base policy or flow
+CREATE TABLE metadata (
+                          kind VARCHAR(20) NOT NULL CHECK (kind IN ('policy', 'flow')),
+                          base_id TEXT NOT NULL, -- base_policy_id or base_flow_id
+                          owner TEXT,
+                          description TEXT,
+                          tags TEXT[] NOT NULL DEFAULT '{}',
+                          folder TEXT, -- slash separated path such as credit/retail, NULL at the top
+                          team TEXT, -- the team that owns it
+                          created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+                          updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+
+                          PRIMARY KEY (kind, base_id)
+);
+
+CREATE INDEX idx_metadata_folder ON metadata(folder text_pattern_ops) WHERE folder IS NOT NULL;
+CREATE INDEX idx_metadata_tags ON metadata USING GIN (tags);
+
+CREATE TRIGGER update_metadata_updated_at
+    BEFORE UPDATE ON metadata
+    FOR EACH ROW
+EXECUTE FUNCTION update_updated_at_column();
+
+-- Every metadata edit, oldest first
+CREATE TABLE metadata_history (
+                                  id BIGSERIAL PRIMARY KEY,
+                                  kind VARCHAR(20) NOT NULL CHECK (kind IN ('policy', 'flow')),
+                                  base_id TEXT NOT NULL,
+                                  version VARCHAR(50), -- set when the description of a published version was edited
+                                  field VARCHAR(20) NOT NULL CHECK (field IN ('name', 'owner', 'description', 'tags', 'folder', 'team')),
+                                  old_value JSONB,
+                                  new_value JSONB,
+                                  changed_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_metadata_history_base_id ON metadata_history(kind, base_id, id);
+
+-- Function to edit the metadata of a base policy or flow, NULL leaves a field as it is and an
+-- empty folder or team clears it. With p_versions the description is that of the published
+-- version stored under one of the labels instead of the base's. Returns FALSE when there is no
+-- such policy or flow
+CREATE OR REPLACE FUNCTION update_metadata(
+    p_kind VARCHAR(20),
+    p_base_id TEXT,
+    p_name VARCHAR(255) DEFAULT NULL,
+    p_owner TEXT DEFAULT NULL,
+    p_description TEXT DEFAULT NULL,
+    p_tags TEXT[] DEFAULT NULL,
+    p_versions TEXT[] DEFAULT NULL,
+    p_folder TEXT DEFAULT NULL,
+    p_team TEXT DEFAULT NULL
+) RETURNS BOOLEAN AS $$
+DECLARE
+    old_name VARCHAR(255);
+    old_description TEXT;
+    matched_version VARCHAR(50);
+    meta RECORD;
+BEGIN
+    IF p_kind = 'policy' THEN
+        SELECT name INTO old_name
+        FROM policies
+        WHERE base_policy_id::text = p_base_id AND archived_at IS NULL
+        ORDER BY CASE WHEN status = 'draft' THEN 1 ELSE 2 END, created_at DESC
+        LIMIT 1;
+    ELSE
+        SELECT name INTO old_name
+        FROM flows
+        WHERE base_flow_id::text = p_base_id
+        ORDER BY CASE WHEN status = 'draft' THEN 1 ELSE 2 END, created_at DESC
+        LIMIT 1;
+    END IF;
+
+    IF NOT FOUND THEN
+        RETURN FALSE;
+    END IF;
+
+    INSERT INTO metadata (kind, base_id)
+    VALUES (p_kind, p_base_id)
+    ON CONFLICT (kind, base_id) DO NOTHING;
+
+    SELECT * INTO meta
+    FROM metadata
+    WHERE kind = p_kind AND base_id = p_base_id
+    FOR UPDATE;
+
+    IF p_name IS NOT NULL AND p_name IS DISTINCT FROM old_name THEN
+        IF p_kind = 'policy' THEN
+            UPDATE policies SET name = p_name WHERE base_policy_id::text = p_base_id AND archived_at IS NULL;
+        ELSE
+            UPDATE flows SET name = p_name WHERE base_flow_id::text = p_base_id;
+        END IF;
+
+        INSERT INTO metadata_history (kind, base_id, field, old_value, new_value)
+        VALUES (p_kind, p_base_id, 'name', to_jsonb(old_name), to_jsonb(p_name));
+    END IF;
+
+    IF p_owner IS NOT NULL AND p_owner IS DISTINCT FROM meta.owner THEN
+        UPDATE metadata SET owner = p_owner WHERE kind = p_kind AND base_id = p_base_id;
+
+        INSERT INTO metadata_history (kind, base_id, field, old_value, new_value)
+        VALUES (p_kind, p_base_id, 'owner', to_jsonb(meta.owner), to_jsonb(p_owner));
+    END IF;
+
+    IF p_tags IS NOT NULL AND p_tags IS DISTINCT FROM meta.tags THEN
+        UPDATE metadata SET tags = p_tags WHERE kind = p_kind AND base_id = p_base_id;
+
+        INSERT INTO metadata_history (kind, base_id, field, old_value, new_value)
+        VALUES (p_kind, p_base_id, 'tags', to_jsonb(meta.tags), to_jsonb(p_tags));
+    END IF;
+
+    IF p_folder IS NOT NULL AND NULLIF(p_folder, '') IS DISTINCT FROM meta.folder THEN
+        UPDATE metadata SET folder = NULLIF(p_folder, '') WHERE kind = p_kind AND base_id = p_base_id;
+
+        INSERT INTO metadata_history (kind, base_id, field, old_value, new_value)
+        VALUES (p_kind, p_base_id, 'folder', to_jsonb(meta.folder), to_jsonb(NULLIF(p_folder, '')));
+    END IF;
+
+    IF p_team IS NOT NULL AND NULLIF(p_team, '') IS DISTINCT FROM meta.team THEN
+        UPDATE metadata SET team = NULLIF(p_team, '') WHERE kind = p_kind AND base_id = p_base_id;
+
+        INSERT INTO metadata_history (kind, base_id, field, old_value, new_value)
+        VALUES (p_kind, p_base_id, 'team', to_jsonb(meta.team), to_jsonb(NULLIF(p_team, '')));
+    END IF;
+
+    IF p_description IS NOT NULL AND p_versions IS NULL THEN
+        IF p_description IS DISTINCT FROM meta.description THEN
+            UPDATE metadata SET description = p_description WHERE kind = p_kind AND base_id = p_base_id;
+
+            INSERT INTO metadata_history (kind, base_id, field, old_value, new_value)
+            VALUES (p_kind, p_base_id, 'description', to_jsonb(meta.description), to_jsonb(p_description));
+        END IF;
+    ELSIF p_description IS NOT NULL THEN
+        IF p_kind = 'policy' THEN
+            SELECT version, description INTO matched_version, old_description
+            FROM policies
+            WHERE base_policy_id::text = p_base_id AND status = 'version' AND version = ANY(p_versions) AND archived_at IS NULL;
+        ELSE
+            SELECT version, description INTO matched_version, old_description
+            FROM flows
+            WHERE base_flow_id::text = p_base_id AND status = 'version' AND version = ANY(p_versions);
+        END IF;
+
+        IF NOT FOUND THEN
+            RAISE EXCEPTION 'Version % not found for %', p_versions[1], p_base_id USING ERRCODE = 'no_data_found';
+        END IF;
+
+        IF p_description IS DISTINCT FROM old_description THEN
+            IF p_kind = 'policy' THEN
+                UPDATE policies SET description = p_description
+                WHERE base_policy_id::text = p_base_id AND version = matched_version;
+            ELSE
+                UPDATE flows SET description = p_description
+                WHERE base_flow_id::text = p_base_id AND version = matched_version;
+            END IF;
+
+            INSERT INTO metadata_history (kind, base_id, version, field, old_value, new_value)
+            VALUES (p_kind, p_base_id, matched_version, 'description', to_jsonb(old_description), to_jsonb(p_description));
+        END IF;
+    END IF;
+
+    RETURN TRUE;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Function to move a folder, and every folder beneath it, under a new path, an empty path moves
+-- it to the top. Returns how many policies and flows moved
+CREATE OR REPLACE FUNCTION move_folder(
+    p_from TEXT,
+    p_to TEXT
+) RETURNS INTEGER AS $$
+DECLARE
+    moved INTEGER;
+BEGIN
+    WITH changed AS (
+        UPDATE metadata m
+        SET folder = NULLIF(LTRIM(p_to || SUBSTRING(m.folder FROM LENGTH(p_from) + 1), '/'), '')
+        FROM (
+            SELECT kind, base_id, folder AS old_folder
+            FROM metadata
+            WHERE folder = p_from OR LEFT(folder, LENGTH(p_from) + 1) = p_from || '/'
+            FOR UPDATE
+        ) old
+        WHERE m.kind = old.kind AND m.base_id = old.base_id
+        RETURNING m.kind, m.base_id, old.old_folder, m.folder
+    )
+    INSERT INTO metadata_history (kind, base_id, field, old_value, new_value)
+    SELECT kind, base_id, 'folder', to_jsonb(old_folder), to_jsonb(folder)
+    FROM changed;
+
+    GET DIAGNOSTICS moved = ROW_COUNT;
+    RETURN moved;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Sample queries and usage examples:
+
+-- 1. Rename a policy and give it an owner and tags
+-- SELECT update_metadata('policy', 'your-base-policy-id', 'Driving Licence Policy', 'licensing-team', NULL, ARRAY['dvla', 'licence']);
+
+-- 2. Edit the description of a published version
+-- SELECT update_metadata('policy', 'your-base-policy-id', NULL, NULL, 'Lowered the minimum age', NULL, ARRAY['v1.1.0', 'v1.1']);
+
+-- 3. File a flow in a folder and give it to a team
+-- SELECT update_metadata('flow', 'your-base-flow-id', NULL, NULL, NULL, NULL, NULL, 'credit/retail', 'credit-risk');
+
+-- 4. Move everything in credit/retail to lending/retail
+-- SELECT move_folder('credit/retail', 'lending/retail');
+
+-- 5. Show what was edited
+-- SELECT * FROM metadata_history WHERE kind = 'policy' AND base_id = 'your-base-policy-id' ORDER BY id;
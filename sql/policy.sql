@@ -4,6 +4,9 @@
 -- Create extension for UUID generation
 CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
 
+-- Revisions of drafts, every edit takes the next one
+CREATE SEQUENCE policy_revisions;
+
 -- Main policies table
 CREATE TABLE policies (
                           policy_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
@@ -15,13 +18,18 @@ CREATE TABLE policies (
                           version VARCHAR(50), -- NULL for drafts, 'v1.0', 'v1.1', etc. for versions
                           description TEXT, -- Required for versions, optional for drafts
                           status VARCHAR(20) NOT NULL CHECK (status IN ('draft', 'version')),
+                          strict_validation BOOLEAN NOT NULL DEFAULT FALSE, -- Reject data with fields the data model doesn't define
+                          archived_at TIMESTAMPTZ, -- NULL unless archived, archived rows are purged after the retention period
+                          effective_from TIMESTAMPTZ, -- versions only, NULL for in force once published
+                          effective_until TIMESTAMPTZ, -- versions only, NULL for in force until replaced
+                          revision BIGINT NOT NULL DEFAULT nextval('policy_revisions'), -- changed by every edit of a draft, unique so an ETag can't match another draft
                           created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
                           updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
 
-    -- Ensure only one draft per base_policy_id
+    -- Ensure only one draft per base_policy_id, archived drafts don't count
                           CONSTRAINT unique_draft_per_policy
                               EXCLUDE (base_policy_id WITH =)
-                              WHERE (status = 'draft'),
+                              WHERE (status = 'draft' AND archived_at IS NULL),
 
     -- Ensure version is unique per base_policy_id for versions
                           CONSTRAINT unique_version_per_policy
@@ -33,6 +41,11 @@ CREATE TABLE policies (
                               (status = 'version' AND version IS NOT NULL)
                               ),
 
+    -- Ensure a version stops being in force after it starts
+                          CONSTRAINT effective_rules CHECK (
+                              effective_from IS NULL OR effective_until IS NULL OR effective_until > effective_from
+                              ),
+
     -- Ensure versions have descriptions but drafts don't require them
                           CONSTRAINT version_description_rules CHECK (
                               (status = 'version' AND description IS NOT NULL AND description != '') OR
@@ -44,6 +57,21 @@ CREATE TABLE policies (
 CREATE INDEX idx_policies_base_policy_id ON policies(base_policy_id);
 CREATE INDEX idx_policies_status ON policies(status);
 CREATE INDEX idx_policies_version ON policies(version) WHERE version IS NOT NULL;
+CREATE INDEX idx_policies_archived_at ON policies(archived_at) WHERE archived_at IS NOT NULL;
+
+-- Earlier revisions of drafts, kept so an editor whose edit was refused can see what changed
+CREATE TABLE policy_draft_revisions (
+                                        policy_id UUID NOT NULL REFERENCES policies(policy_id) ON DELETE CASCADE,
+                                        revision BIGINT NOT NULL,
+                                        data_model JSONB NOT NULL,
+                                        tests JSONB NOT NULL,
+                                        rule TEXT NOT NULL,
+                                        description TEXT,
+                                        strict_validation BOOLEAN NOT NULL,
+                                        created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+
+                                        PRIMARY KEY (policy_id, revision)
+);
 
 -- Function to update the updated_at timestamp
 CREATE OR REPLACE FUNCTION update_updated_at_column()
@@ -54,10 +82,11 @@ BEGIN
 END;
 $$ LANGUAGE plpgsql;
 
--- Trigger to automatically update updated_at
+-- Trigger to automatically update updated_at, a rename through update_metadata isn't an edit
 CREATE TRIGGER update_policies_updated_at
     BEFORE UPDATE ON policies
     FOR EACH ROW
+    WHEN (OLD.name IS NOT DISTINCT FROM NEW.name)
 EXECUTE FUNCTION update_updated_at_column();
 
 -- Function to create a new policy (creates initial draft)
@@ -65,7 +94,8 @@ CREATE OR REPLACE FUNCTION create_policy(
     p_name VARCHAR(255),
     p_data_model JSONB,
     p_tests JSONB,
-    p_rule TEXT
+    p_rule TEXT,
+    p_strict_validation BOOLEAN DEFAULT FALSE
 ) RETURNS UUID AS $$
 DECLARE
     new_base_policy_id UUID;
@@ -73,19 +103,23 @@ DECLARE
 BEGIN
     new_base_policy_id := uuid_generate_v4();
 
-    INSERT INTO policies (base_policy_id, name, data_model, tests, rule, status)
-    VALUES (new_base_policy_id, p_name, p_data_model, p_tests, p_rule, 'draft')
+    INSERT INTO policies (base_policy_id, name, data_model, tests, rule, strict_validation, status)
+    VALUES (new_base_policy_id, p_name, p_data_model, p_tests, p_rule, COALESCE(p_strict_validation, FALSE), 'draft')
     RETURNING policy_id INTO new_policy_id;
 
     RETURN new_base_policy_id;
 END;
 $$ LANGUAGE plpgsql;
 
--- Function to publish a draft as a version (removes draft after publishing)
+-- Function to publish a draft as a version (removes draft after publishing). With p_revision
+-- the draft is only published when it is still at that revision, otherwise it raises P0409
 CREATE OR REPLACE FUNCTION publish_draft_as_version(
     p_base_policy_id UUID,
     p_version VARCHAR(50),
-    p_description TEXT
+    p_description TEXT,
+    p_effective_from TIMESTAMPTZ DEFAULT NULL,
+    p_effective_until TIMESTAMPTZ DEFAULT NULL,
+    p_revision BIGINT DEFAULT NULL
 ) RETURNS UUID AS $$
 DECLARE
     draft_record RECORD;
@@ -96,37 +130,45 @@ BEGIN
         RAISE EXCEPTION 'Description is required when publishing a version';
     END IF;
 
-    -- Get the current draft
+    -- Get the current draft, locked so it can't be edited while it is published
     SELECT * INTO draft_record
     FROM policies
-    WHERE base_policy_id = p_base_policy_id AND status = 'draft';
+    WHERE base_policy_id = p_base_policy_id AND status = 'draft' AND archived_at IS NULL
+    FOR UPDATE;
 
     IF NOT FOUND THEN
         RAISE EXCEPTION 'No draft found for base_policy_id: %', p_base_policy_id;
     END IF;
 
+    IF p_revision IS NOT NULL AND p_revision <> draft_record.revision THEN
+        RAISE EXCEPTION 'Draft of % is at revision %, not %', p_base_policy_id, draft_record.revision, p_revision USING ERRCODE = 'P0409';
+    END IF;
+
     -- Check if version already exists
     IF EXISTS (SELECT 1 FROM policies WHERE base_policy_id = p_base_policy_id AND version = p_version) THEN
         RAISE EXCEPTION 'Version % already exists for this policy', p_version;
     END IF;
 
     -- Create new version record
-    INSERT INTO policies (base_policy_id, name, data_model, tests, rule, version, description, status)
+    INSERT INTO policies (base_policy_id, name, data_model, tests, rule, strict_validation, version, description, status, effective_from, effective_until)
     VALUES (
                draft_record.base_policy_id,
                draft_record.name,
                draft_record.data_model,
                draft_record.tests,
                draft_record.rule,
+               draft_record.strict_validation,
                p_version,
                p_description,
-               'version'
+               'version',
+               p_effective_from,
+               p_effective_until
            )
     RETURNING policy_id INTO new_policy_id;
 
     -- Remove the draft after successful version creation
     DELETE FROM policies
-    WHERE base_policy_id = p_base_policy_id AND status = 'draft';
+    WHERE base_policy_id = p_base_policy_id AND status = 'draft' AND archived_at IS NULL;
 
     RETURN new_policy_id;
 END;
@@ -143,19 +185,19 @@ DECLARE
 BEGIN
     -- Delete existing draft if it exists
     DELETE FROM policies
-    WHERE base_policy_id = p_base_policy_id AND status = 'draft';
+    WHERE base_policy_id = p_base_policy_id AND status = 'draft' AND archived_at IS NULL;
 
     -- Get source version (latest if not specified)
     IF p_version IS NULL THEN
         SELECT * INTO source_record
         FROM policies
-        WHERE base_policy_id = p_base_policy_id AND status = 'version'
+        WHERE base_policy_id = p_base_policy_id AND status = 'version' AND archived_at IS NULL
         ORDER BY created_at DESC
         LIMIT 1;
     ELSE
         SELECT * INTO source_record
         FROM policies
-        WHERE base_policy_id = p_base_policy_id AND version = p_version AND status = 'version';
+        WHERE base_policy_id = p_base_policy_id AND version = p_version AND status = 'version' AND archived_at IS NULL;
     END IF;
 
     IF NOT FOUND THEN
@@ -167,13 +209,14 @@ BEGIN
     END IF;
 
     -- Create new draft
-    INSERT INTO policies (base_policy_id, name, data_model, tests, rule, status)
+    INSERT INTO policies (base_policy_id, name, data_model, tests, rule, strict_validation, status)
     VALUES (
                source_record.base_policy_id,
                source_record.name,
                source_record.data_model,
                source_record.tests,
                source_record.rule,
+               source_record.strict_validation,
                'draft'
            )
     RETURNING policy_id INTO new_policy_id;
@@ -182,24 +225,98 @@ BEGIN
 END;
 $$ LANGUAGE plpgsql;
 
--- Function to update a draft (name cannot be changed)
+-- Function to roll back to a version by publishing a copy of it as a new version, the versions
+-- in between and the draft are left as they are
+CREATE OR REPLACE FUNCTION rollback_to_version(
+    p_policy_id UUID, -- the version rolled back to
+    p_version VARCHAR(50),
+    p_description TEXT
+) RETURNS UUID AS $$
+DECLARE
+    source_record RECORD;
+    new_policy_id UUID;
+BEGIN
+    IF p_description IS NULL OR p_description = '' THEN
+        RAISE EXCEPTION 'Description is required when publishing a version';
+    END IF;
+
+    SELECT * INTO source_record
+    FROM policies
+    WHERE policy_id = p_policy_id AND status = 'version' AND archived_at IS NULL;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Version % not found', p_policy_id;
+    END IF;
+
+    INSERT INTO policies (base_policy_id, name, data_model, tests, rule, strict_validation, version, description, status)
+    VALUES (
+               source_record.base_policy_id,
+               source_record.name,
+               source_record.data_model,
+               source_record.tests,
+               source_record.rule,
+               source_record.strict_validation,
+               p_version,
+               p_description,
+               'version'
+           )
+    RETURNING policy_id INTO new_policy_id;
+
+    RETURN new_policy_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Function to update a draft (name cannot be changed, update_metadata renames). With p_revision
+-- the draft is only updated when it is still at that revision. updated is FALSE when there is
+-- no draft or it is at another revision, current_revision is the revision of the draft after
+-- the call and NULL without a draft
 CREATE OR REPLACE FUNCTION update_draft(
     p_base_policy_id UUID,
     p_data_model JSONB DEFAULT NULL,
     p_tests JSONB DEFAULT NULL,
     p_rule TEXT DEFAULT NULL,
-    p_description TEXT DEFAULT NULL
-) RETURNS BOOLEAN AS $$
+    p_description TEXT DEFAULT NULL,
+    p_strict_validation BOOLEAN DEFAULT NULL,
+    p_revision BIGINT DEFAULT NULL,
+    OUT updated BOOLEAN,
+    OUT current_revision BIGINT
+) AS $$
+DECLARE
+    draft_record RECORD;
 BEGIN
+    updated := FALSE;
+
+    SELECT * INTO draft_record
+    FROM policies
+    WHERE base_policy_id = p_base_policy_id AND status = 'draft' AND archived_at IS NULL
+    FOR UPDATE;
+
+    IF NOT FOUND THEN
+        RETURN;
+    END IF;
+
+    current_revision := draft_record.revision;
+    IF p_revision IS NOT NULL AND p_revision <> draft_record.revision THEN
+        RETURN;
+    END IF;
+
+    INSERT INTO policy_draft_revisions (policy_id, revision, data_model, tests, rule, description, strict_validation)
+    VALUES (draft_record.policy_id, draft_record.revision, draft_record.data_model, draft_record.tests,
+            draft_record.rule, draft_record.description, draft_record.strict_validation)
+    ON CONFLICT (policy_id, revision) DO NOTHING;
+
     UPDATE policies
     SET
         data_model = COALESCE(p_data_model, data_model),
         tests = COALESCE(p_tests, tests),
         rule = COALESCE(p_rule, rule),
-        description = COALESCE(p_description, description)
-    WHERE base_policy_id = p_base_policy_id AND status = 'draft';
+        description = COALESCE(p_description, description),
+        strict_validation = COALESCE(p_strict_validation, strict_validation),
+        revision = nextval('policy_revisions')
+    WHERE policy_id = draft_record.policy_id
+    RETURNING revision INTO current_revision;
 
-    RETURN FOUND;
+    updated := TRUE;
 END;
 $$ LANGUAGE plpgsql;
 
@@ -218,7 +335,72 @@ SELECT DISTINCT
     MAX(created_at) FILTER (WHERE status = 'version') OVER (PARTITION BY base_policy_id) as latest_version_date,
     MAX(updated_at) OVER (PARTITION BY base_policy_id) as latest_activity_date,
     BOOL_OR(status = 'draft') OVER (PARTITION BY base_policy_id) as has_draft
-FROM policies;
+FROM policies
+WHERE archived_at IS NULL;
+
+-- View to list the policies that have archived drafts or versions
+CREATE VIEW archived_policy_summary AS
+SELECT
+    base_policy_id,
+    (ARRAY_AGG(name ORDER BY created_at DESC))[1] as current_name,
+    COUNT(*) as archived_count,
+    BOOL_AND(archived_at IS NOT NULL) as fully_archived,
+    MAX(archived_at) as latest_archived_date
+FROM policies
+GROUP BY base_policy_id
+HAVING BOOL_OR(archived_at IS NOT NULL);
+
+-- Function to archive a whole policy (by base_policy_id) or a single draft or version (by policy_id)
+CREATE OR REPLACE FUNCTION archive_policy(
+    p_id TEXT
+) RETURNS INTEGER AS $$
+DECLARE
+    archived INTEGER;
+BEGIN
+    UPDATE policies
+    SET archived_at = CURRENT_TIMESTAMP
+    WHERE (base_policy_id::text = p_id OR policy_id::text = p_id) AND archived_at IS NULL;
+
+    GET DIAGNOSTICS archived = ROW_COUNT;
+    RETURN archived;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Function to restore what archive_policy archived, restoring a draft while another draft
+-- exists violates unique_draft_per_policy
+CREATE OR REPLACE FUNCTION restore_policy(
+    p_id TEXT
+) RETURNS INTEGER AS $$
+DECLARE
+    restored INTEGER;
+BEGIN
+    UPDATE policies
+    SET archived_at = NULL
+    WHERE (base_policy_id::text = p_id OR policy_id::text = p_id) AND archived_at IS NOT NULL;
+
+    GET DIAGNOSTICS restored = ROW_COUNT;
+    RETURN restored;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Function to delete archived rows for good once they were archived before p_archived_before,
+-- a NULL p_id purges every policy
+CREATE OR REPLACE FUNCTION purge_archived_policies(
+    p_id TEXT,
+    p_archived_before TIMESTAMPTZ
+) RETURNS INTEGER AS $$
+DECLARE
+    purged INTEGER;
+BEGIN
+    DELETE FROM policies
+    WHERE archived_at IS NOT NULL
+      AND archived_at <= p_archived_before
+      AND (p_id IS NULL OR base_policy_id::text = p_id OR policy_id::text = p_id);
+
+    GET DIAGNOSTICS purged = ROW_COUNT;
+    RETURN purged;
+END;
+$$ LANGUAGE plpgsql;
 
 -- Example usage and sample data
 INSERT INTO policies (base_policy_id, name, data_model, tests, rule, status) VALUES
@@ -249,7 +431,19 @@ INSERT INTO policies (base_policy_id, name, data_model, tests, rule, status) VAL
 -- 6. Update a draft (no name changes allowed)
 -- SELECT update_draft('your-base-policy-id', '{"new": "data"}', '{"new": "tests"}', 'Updated rule text', 'Work in progress description');
 
--- 7. Example workflow:
+-- 7. Archive a whole policy or a single version, restore it, and purge what was archived over 30 days ago
+-- SELECT archive_policy('your-base-policy-id');
+-- SELECT restore_policy('your-base-policy-id');
+-- SELECT purge_archived_policies(NULL, CURRENT_TIMESTAMP - INTERVAL '30 days');
+
+-- 8. Publish a version that comes into force on 1 January, latest keeps resolving to the
+-- version in force before then
+-- SELECT publish_draft_as_version('your-base-policy-id', 'v2.0', 'New thresholds', '2026-01-01T00:00:00Z');
+
+-- 9. Roll back to v1.0 by publishing it again as the next version, the draft is kept
+-- SELECT rollback_to_version('v1.0-policy-id', 'v1.2.1', 'Rollback to v1.0: v1.2 rejects valid applications');
+
+-- 10. Example workflow:
 -- Step 1: Create policy (creates draft)
 -- SELECT create_policy('Example Policy', '{"setting": "value"}', '{"test": "case"}', 'Example rule text');
 
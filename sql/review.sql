@@ -0,0 +1,63 @@
+-- Draft Reviews
+-- A draft is submitted for review, approved or rejected by reviewers other than its author and
+-- only published once approved: draft -> submitted -> approved/rejected -> published. The roles
+-- that must approve are set per policy or flow, or per folder for everything under it
+
+-- The reviews of the drafts of a base policy or flow, a base has at most one open review
+CREATE TABLE reviews (
+                         id BIGSERIAL PRIMARY KEY,
+                         kind VARCHAR(20) NOT NULL CHECK (kind IN ('policy', 'flow')),
+                         base_id TEXT NOT NULL, -- base_policy_id or base_flow_id
+                         draft_id TEXT NOT NULL, -- policy_id or flow_id of the draft under review
+                         state VARCHAR(20) NOT NULL CHECK (state IN ('submitted', 'approved', 'rejected', 'published', 'superseded')),
+                         author TEXT NOT NULL,
+                         roles TEXT[] NOT NULL DEFAULT '{}', -- roles that must approve, empty for any reviewer
+                         draft_revision BIGINT, -- revision of the draft when it was submitted, an edit since makes the review stale
+                         version VARCHAR(50), -- the version the draft was published as
+                         submitted_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+                         updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_reviews_base_id ON reviews(kind, base_id, id);
+CREATE UNIQUE INDEX idx_reviews_open ON reviews(kind, base_id) WHERE state IN ('submitted', 'approved');
+
+CREATE TRIGGER update_reviews_updated_at
+    BEFORE UPDATE ON reviews
+    FOR EACH ROW
+EXECUTE FUNCTION update_updated_at_column();
+
+-- Comments on a draft, approvals and rejections are comments with a decision
+CREATE TABLE review_comments (
+                                 id BIGSERIAL PRIMARY KEY,
+                                 kind VARCHAR(20) NOT NULL CHECK (kind IN ('policy', 'flow')),
+                                 base_id TEXT NOT NULL,
+                                 draft_id TEXT NOT NULL,
+                                 review_id BIGINT REFERENCES reviews(id) ON DELETE CASCADE, -- NULL when no review was open
+                                 author TEXT NOT NULL,
+                                 roles TEXT[] NOT NULL DEFAULT '{}', -- roles of the author when they decided
+                                 decision VARCHAR(20) CHECK (decision IN ('approved', 'rejected')),
+                                 body TEXT NOT NULL DEFAULT '',
+                                 created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_review_comments_draft_id ON review_comments(kind, draft_id, id);
+
+-- Roles that must approve the drafts of a base policy or flow, or of everything in a folder.
+-- The rule of the base wins over those of its folders and a deeper folder over its parents
+CREATE TABLE approval_rules (
+                                scope VARCHAR(20) NOT NULL CHECK (scope IN ('policy', 'flow', 'folder')),
+                                target TEXT NOT NULL, -- base id or folder path
+                                roles TEXT[] NOT NULL DEFAULT '{}',
+                                updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+                                PRIMARY KEY (scope, target)
+);
+
+-- Sample queries and usage examples:
+
+-- 1. Require a risk and a compliance approval for everything in the credit folder
+-- INSERT INTO approval_rules (scope, target, roles) VALUES ('folder', 'credit', '{risk,compliance}')
+-- ON CONFLICT (scope, target) DO UPDATE SET roles = EXCLUDED.roles, updated_at = CURRENT_TIMESTAMP;
+
+-- 2. Drafts waiting for a review
+-- SELECT kind, base_id, author, roles, submitted_at FROM reviews WHERE state = 'submitted' ORDER BY submitted_at;
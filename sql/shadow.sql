@@ -0,0 +1,88 @@
+-- Shadow Evaluation
+-- Live traffic to a published policy or flow is also evaluated against its draft, the outcomes
+-- are compared and the disagreements kept until the draft is published
+
+-- Create extension for UUID generation
+CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+
+-- Which policies and flows have shadow mode turned on
+CREATE TABLE shadow_settings (
+                                 kind VARCHAR(20) NOT NULL CHECK (kind IN ('policy', 'flow')),
+                                 base_id TEXT NOT NULL, -- base_policy_id or base_flow_id
+                                 enabled BOOLEAN NOT NULL DEFAULT FALSE,
+                                 sample_rate DOUBLE PRECISION NOT NULL DEFAULT 1 CHECK (sample_rate > 0 AND sample_rate <= 1),
+                                 created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+                                 updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+
+                                 PRIMARY KEY (kind, base_id)
+);
+
+CREATE TRIGGER update_shadow_settings_updated_at
+    BEFORE UPDATE ON shadow_settings
+    FOR EACH ROW
+EXECUTE FUNCTION update_updated_at_column();
+
+-- Running totals per draft, a new draft starts its own totals
+CREATE TABLE shadow_stats (
+                              kind VARCHAR(20) NOT NULL CHECK (kind IN ('policy', 'flow')),
+                              base_id TEXT NOT NULL,
+                              draft_id TEXT NOT NULL, -- policy_id or flow_id of the draft
+                              evaluated BIGINT NOT NULL DEFAULT 0,
+                              disagreed BIGINT NOT NULL DEFAULT 0,
+                              errors BIGINT NOT NULL DEFAULT 0, -- Shadow evaluations that failed
+                              first_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+                              last_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+                              PRIMARY KEY (kind, base_id, draft_id)
+);
+
+-- Every live decision the draft would have made differently
+CREATE TABLE shadow_disagreements (
+                                      disagreement_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+                                      kind VARCHAR(20) NOT NULL CHECK (kind IN ('policy', 'flow')),
+                                      base_id TEXT NOT NULL,
+                                      draft_id TEXT NOT NULL,
+                                      live_id TEXT NOT NULL, -- policy_id or flow_id of the published version
+                                      live_version VARCHAR(50),
+                                      request_id TEXT,
+                                      input JSONB,
+                                      live_result JSONB,
+                                      live_trace JSONB,
+                                      shadow_result JSONB,
+                                      shadow_trace JSONB,
+                                      shadow_error JSONB,
+                                      recorded_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_shadow_disagreements_draft ON shadow_disagreements(kind, base_id, draft_id, recorded_at);
+
+-- Function to add a shadow evaluation to the totals of its draft
+CREATE OR REPLACE FUNCTION record_shadow_evaluation(
+    p_kind VARCHAR(20),
+    p_base_id TEXT,
+    p_draft_id TEXT,
+    p_disagreed BOOLEAN,
+    p_errored BOOLEAN
+) RETURNS VOID AS $$
+BEGIN
+    INSERT INTO shadow_stats (kind, base_id, draft_id, evaluated, disagreed, errors)
+    VALUES (p_kind, p_base_id, p_draft_id, 1, p_disagreed::int, p_errored::int)
+    ON CONFLICT (kind, base_id, draft_id) DO UPDATE
+    SET
+        evaluated = shadow_stats.evaluated + 1,
+        disagreed = shadow_stats.disagreed + EXCLUDED.disagreed,
+        errors = shadow_stats.errors + EXCLUDED.errors,
+        last_at = CURRENT_TIMESTAMP;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Sample queries and usage examples:
+
+-- 1. Turn shadow mode on for half of the traffic to a policy
+-- INSERT INTO shadow_settings (kind, base_id, enabled, sample_rate) VALUES ('policy', 'your-base-policy-id', TRUE, 0.5)
+-- ON CONFLICT (kind, base_id) DO UPDATE SET enabled = EXCLUDED.enabled, sample_rate = EXCLUDED.sample_rate;
+
+-- 2. How often does the draft agree with the published version
+-- SELECT draft_id, evaluated, disagreed, 1 - disagreed::float / NULLIF(evaluated, 0) AS agreement_rate
+-- FROM shadow_stats
+-- WHERE kind = 'policy' AND base_id = 'your-base-policy-id';